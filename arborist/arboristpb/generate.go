@@ -0,0 +1,7 @@
+// Package arboristpb has the Go code generated from `arborist.proto`, the
+// gRPC interface to arborist. After changing the proto, regenerate it with
+// `go generate`, which needs `protoc`, `protoc-gen-go` and
+// `protoc-gen-go-grpc` installed.
+package arboristpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative arborist.proto
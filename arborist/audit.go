@@ -0,0 +1,73 @@
+package arborist
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditRecord is one line of the audit log: a single authorization decision
+// from `/auth/proxy` or `/auth/request`, written as JSON.
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Endpoint  string    `json:"endpoint"`
+	Username  string    `json:"username"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Resource  string    `json:"resource"`
+	Service   string    `json:"service"`
+	Method    string    `json:"method"`
+	Decision  string    `json:"decision"`
+	// PolicyID and RoleID are the policy and role which allowed the request,
+	// when a user's policy did.
+	PolicyID string `json:"policy_id,omitempty"`
+	RoleID   string `json:"role_id,omitempty"`
+}
+
+// auditLog writes audit records as JSON lines. Writes are serialized so that
+// records from concurrent requests don't interleave.
+type auditLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (audit *auditLog) write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	_, err = audit.out.Write(line)
+	return err
+}
+
+// auditDecision records the decision for one authorization check in the
+// audit log, if the server has one (see `WithAuditLog`). A username is empty
+// for anonymous requests.
+func (server *Server) auditDecision(endpoint string, request *AuthRequest, decision *AuthDecision) {
+	if server.audit == nil {
+		return
+	}
+	outcome := "deny"
+	if decision.Auth {
+		outcome = "allow"
+	}
+	record := AuditRecord{
+		Timestamp: server.clock().UTC(),
+		Endpoint:  endpoint,
+		Username:  request.Username,
+		ClientID:  request.ClientID,
+		Resource:  request.Resource,
+		Service:   request.Service,
+		Method:    request.Method,
+		Decision:  outcome,
+		PolicyID:  decision.PolicyID,
+		RoleID:    decision.RoleID,
+	}
+	err := server.audit.write(record)
+	if err != nil {
+		server.logger.Error("couldn't write audit log: %s", err.Error())
+	}
+}
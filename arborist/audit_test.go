@@ -0,0 +1,58 @@
+package arborist
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditDecision(t *testing.T) {
+	out := &bytes.Buffer{}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	server := NewServer().
+		WithLogger(log.New(&bytes.Buffer{}, "", 0)).
+		WithClock(func() time.Time { return now }).
+		WithAuditLog(out)
+
+	request := &AuthRequest{
+		Username: "test-user",
+		Resource: "/programs/a",
+		Service:  "peregrine",
+		Method:   "read",
+	}
+	allowed := &AuthDecision{Auth: true, PolicyID: "programs.a-reader", RoleID: "reader"}
+	server.auditDecision("/auth/request", request, allowed)
+	server.auditDecision("/auth/proxy", &AuthRequest{Resource: "/programs/b", ClientID: "client"}, &AuthDecision{DeniedBy: AuthCheckClient})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if !assert.Len(t, lines, 2, out.String()) {
+		return
+	}
+	assert.JSONEq(t, `{
+		"timestamp": "2020-01-01T12:00:00Z",
+		"endpoint": "/auth/request",
+		"username": "test-user",
+		"resource": "/programs/a",
+		"service": "peregrine",
+		"method": "read",
+		"decision": "allow",
+		"policy_id": "programs.a-reader",
+		"role_id": "reader"
+	}`, lines[0])
+	denied := AuditRecord{}
+	err := json.Unmarshal([]byte(lines[1]), &denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "deny", denied.Decision)
+	assert.Equal(t, "client", denied.ClientID)
+	assert.Equal(t, "", denied.PolicyID)
+
+	// without an audit log, nothing is written (and nothing breaks)
+	NewServer().auditDecision("/auth/request", request, allowed)
+}
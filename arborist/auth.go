@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -65,10 +67,34 @@ func (requestJSON *AuthRequestJSON_User) UnmarshalJSON(data []byte) error {
 
 type Constraints = map[string]string
 
+// AuthContext holds the attributes of an auth request which permission
+// constraints are matched against (see `attributesJSON`). Each attribute can
+// have several values.
+type AuthContext map[string]AuthContextValues
+
+// AuthContextValues are the values of one attribute in an `AuthContext`. In
+// JSON they are either a string, for a single value, or a list of strings.
+type AuthContextValues []string
+
+func (values *AuthContextValues) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*values = AuthContextValues{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("input auth request context values must be a string or an array of strings, not %s", string(data))
+	}
+	*values = list
+	return nil
+}
+
 type AuthRequestJSON_Request struct {
 	Resource    string      `json:"resource"`
 	Action      Action      `json:"action"`
 	Constraints Constraints `json:"constraints,omitempty"`
+	Context     AuthContext `json:"context,omitempty"`
 }
 
 // UnmarshalJSON defines the deserialization from JSON into an AuthRequestJSON
@@ -83,6 +109,7 @@ func (requestJSON *AuthRequestJSON_Request) UnmarshalJSON(data []byte) error {
 
 	optionalFieldsPath := map[string]struct{}{
 		"constraints": {},
+		"context":     {},
 	}
 	err = validateJSON("auth request", requestJSON, fields, optionalFieldsPath)
 	if err != nil {
@@ -101,25 +128,135 @@ func (requestJSON *AuthRequestJSON_Request) UnmarshalJSON(data []byte) error {
 }
 
 type AuthRequest struct {
-	Username string
-	ClientID string
-	Policies []string
-	Resource string
-	Service  string
-	Method   string
-	stmts    *CachedStmts
+	Username    string
+	ClientID    string
+	Policies    []string
+	Resource    string
+	Service     string
+	Method      string
+	Constraints Constraints
+	Context     AuthContext
+	stmts       *CachedStmts
+	// now is the time a grant's `expires_at` is checked against: the
+	// server's clock (see `WithClock`) when the request came in.
+	now time.Time
 }
 
 type AuthResponse struct {
 	Auth bool `json:"auth"`
+	// PolicyID and RoleID are a policy and role of the user which allow the
+	// request, if it is allowed. If several do, the first by name is given.
+	PolicyID string `json:"policy_id,omitempty"`
+	RoleID   string `json:"role_id,omitempty"`
+	// Explain says why the request was denied, with `?explain=true`.
+	Explain *AuthExplanation `json:"explain,omitempty"`
 }
 
+// AuthDecision is the outcome of checking an auth request for a user and/or
+// client, which `/auth/proxy` and `/auth/request` each turn into their own
+// responses.
+type AuthDecision struct {
+	Auth bool
+	// PolicyID and RoleID are the policy and role of the user which allow
+	// the request, if it is allowed and a user was checked.
+	PolicyID string
+	RoleID   string
+	// DeniedBy is which check refused the request, `AuthCheckUser` or
+	// `AuthCheckClient`; empty if it was allowed.
+	DeniedBy string
+}
+
+const (
+	AuthCheckUser   = "user"
+	AuthCheckClient = "client"
+)
+
+// response is the `/auth/request` response for the decision.
+func (decision *AuthDecision) response() *AuthResponse {
+	if !decision.Auth {
+		return &AuthResponse{Auth: false}
+	}
+	return &AuthResponse{
+		Auth:     true,
+		PolicyID: decision.PolicyID,
+		RoleID:   decision.RoleID,
+	}
+}
+
+// authorizeUserRow is the decision from the `authorizeUser` query, and what
+// allowed it.
+type authorizeUserRow struct {
+	Auth     bool   `db:"auth"`
+	PolicyID string `db:"policy_id"`
+	RoleID   string `db:"role_id"`
+}
+
+// attributesJSON encodes the `constraints` and `context` attributes from an
+// auth request, as an object of the values for each attribute, for
+// `constraintsMatch` to compare against permission constraints in the
+// database. A constraint and context attribute with the same name are
+// combined.
+//
+// A permission only grants access if each of its constraints is satisfied by
+// the request. A constraint is satisfied if the request has that attribute
+// with the same value, or, for an attribute with a list of values, if the
+// constraint's value is in the list: a permission constrained to
+// `{"project": "X"}` matches `{"project": "X"}` and `{"project": ["X", "Y"]}`,
+// but not `{"project": "Y"}`. An attribute the request leaves out counts as
+// not satisfied, and attributes in the request which the permission does not
+// mention are ignored; a permission without constraints matches any request.
+func attributesJSON(request *AuthRequest) (string, error) {
+	attributes := map[string][]string{}
+	for name, value := range request.Constraints {
+		attributes[name] = append(attributes[name], value)
+	}
+	for name, values := range request.Context {
+		attributes[name] = append(attributes[name], values...)
+	}
+	encoded, err := json.Marshal(attributes)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// constraintsMatch is a SQL condition that the constraints of `permission`
+// are all satisfied by the request attributes in the parameter `param`, from
+// `attributesJSON`. Constraints which aren't an object count as none.
+func constraintsMatch(param string) string {
+	return `NOT EXISTS (
+		SELECT 1 FROM jsonb_each_text(
+			CASE WHEN jsonb_typeof(permission.constraints) = 'object' THEN permission.constraints ELSE '{}' END
+		) AS required(name, value)
+		WHERE NOT coalesce((CAST(` + param + ` AS jsonb) -> required.name) ? required.value, FALSE)
+	)`
+}
+
+// resourcePathLquery is a SQL expression converting `resource.path` into an
+// lquery which matches that resource and everything below it. A path segment
+// which is exactly `*` (stored underscore-encoded as `__2A`) matches any one
+// segment, so a policy on `/programs/*/projects` covers
+// `/programs/foo/projects/bar` but not `/programs/foo/studies`, and a policy
+// on `/programs/*` covers anything below `/programs` but not `/programs`
+// itself.
+//
+// Among allow policies there is no precedence: a request is authorized if any
+// granted path matches it, exact or wildcard. Deny policies are checked the
+// same way, but any matching deny policy refuses the request regardless of
+// the allow policies which also match.
+const resourcePathLquery = `CAST(regexp_replace(ltree2text(resource.path), '(^|\.)__2A(?=\.|$)', '\1*{1}', 'g') || '.*' AS lquery)`
+
 // Authorize a request where the end user is anonymous, so there is no token
 // involved, and access is granted only through the built-in anonymous group.
 func authorizeAnonymous(request *AuthRequest) (*AuthResponse, error) {
 	var tag string
 	var err error
 
+	constraints, err := attributesJSON(request)
+	if err != nil {
+		return nil, err
+	}
+
 	resource := request.Resource
 	// See if the resource field is a path or a tag.
 	if strings.HasPrefix(resource, "/") {
@@ -135,12 +272,18 @@ func authorizeAnonymous(request *AuthRequest) (*AuthResponse, error) {
 		// run authorization query
 		err = request.stmts.Select(
 			`
-			SELECT coalesce(text2ltree($5) <@ allowed, FALSE) FROM (
-				SELECT array_agg(resource.path) AS allowed FROM (
+			SELECT coalesce(text2ltree($5) ? allowed, FALSE) AND NOT coalesce(text2ltree($5) ? denied, FALSE) FROM (
+				SELECT
+					array_agg(`+resourcePathLquery+`) FILTER (
+						WHERE policy.effect = 'allow' AND ($3 OR policy.name = ANY($4))
+					) AS allowed,
+					array_agg(`+resourcePathLquery+`) FILTER (WHERE policy.effect = 'deny') AS denied
+				FROM (
 					SELECT policy_id FROM grp_policy
 					INNER JOIN grp ON grp_policy.grp_id = grp.id
 					WHERE grp.name = $6
 				) AS policies
+				JOIN policy ON policy.id = policies.policy_id
 				LEFT JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 				LEFT JOIN resource ON resource.id = policy_resource.resource_id
 				WHERE EXISTS (
@@ -149,11 +292,7 @@ func authorizeAnonymous(request *AuthRequest) (*AuthResponse, error) {
 					WHERE policy_role.policy_id = policies.policy_id
 					AND (permission.service = $1 OR permission.service = '*')
 					AND (permission.method = $2 OR permission.method = '*')
-				) AND (
-					$3 OR policies.policy_id IN (
-						SELECT id FROM policy
-						WHERE policy.name = ANY($4)
-					)
+					AND `+constraintsMatch("$7")+`
 				)
 			) _
 			`,
@@ -164,16 +303,23 @@ func authorizeAnonymous(request *AuthRequest) (*AuthResponse, error) {
 			pq.Array(request.Policies), // $4
 			resource,                   // $5
 			AnonymousGroup,             // $6
+			constraints,                // $7
 		)
 	} else if tag != "" {
 		err = request.stmts.Select(
 			`
-			SELECT coalesce((SELECT resource.path AS request FROM resource WHERE resource.tag = $5) <@ allowed, FALSE) FROM (
-				SELECT array_agg(resource.path) AS allowed FROM (
+			SELECT coalesce((SELECT resource.path AS request FROM resource WHERE resource.tag = $5) ? allowed, FALSE) AND NOT coalesce((SELECT resource.path AS request FROM resource WHERE resource.tag = $5) ? denied, FALSE) FROM (
+				SELECT
+					array_agg(`+resourcePathLquery+`) FILTER (
+						WHERE policy.effect = 'allow' AND ($3 OR policy.name = ANY($4))
+					) AS allowed,
+					array_agg(`+resourcePathLquery+`) FILTER (WHERE policy.effect = 'deny') AS denied
+				FROM (
 					SELECT policy_id FROM grp_policy
 					INNER JOIN grp ON grp_policy.grp_id = grp.id
 					WHERE grp.name = $6
 				) AS policies
+				JOIN policy ON policy.id = policies.policy_id
 				JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 				JOIN resource ON resource.id = policy_resource.resource_id
 				WHERE EXISTS (
@@ -182,11 +328,7 @@ func authorizeAnonymous(request *AuthRequest) (*AuthResponse, error) {
 					WHERE policy_role.policy_id = policies.policy_id
 					AND (permission.service = $1 OR permission.service = '*')
 					AND (permission.method = $2 OR permission.method = '*')
-				) AND (
-					$3 OR policies.policy_id IN (
-						SELECT id FROM policy
-						WHERE policy.name = ANY($4)
-					)
+					AND `+constraintsMatch("$7")+`
 				)
 			)
 			`,
@@ -197,6 +339,7 @@ func authorizeAnonymous(request *AuthRequest) (*AuthResponse, error) {
 			pq.Array(request.Policies), // $4
 			resource,                   // $5
 			AnonymousGroup,             // $6
+			constraints,                // $7
 		)
 	} else {
 		err = errors.New("missing resource in auth request")
@@ -205,15 +348,20 @@ func authorizeAnonymous(request *AuthRequest) (*AuthResponse, error) {
 		return nil, err
 	}
 	result := len(authorized) > 0 && authorized[0]
-	return &AuthResponse{result}, nil
+	return &AuthResponse{Auth: result}, nil
 }
 
 // Authorize the given token to access resources by service and method.
 func authorizeUser(request *AuthRequest) (*AuthResponse, error) {
-	var authorized []bool
+	var authorized []authorizeUserRow
 	var tag string
 	var err error
 
+	constraints, err := attributesJSON(request)
+	if err != nil {
+		return nil, err
+	}
+
 	resource := request.Resource
 	// See if the resource field is a path or a tag.
 	if strings.HasPrefix(resource, "/") {
@@ -226,35 +374,52 @@ func authorizeUser(request *AuthRequest) (*AuthResponse, error) {
 	if resource != "" {
 		err = request.stmts.Select(
 			`
-			SELECT coalesce(text2ltree($6) <@ allowed, FALSE) FROM (
-				SELECT array_agg(resource.path) AS allowed FROM (
+			SELECT
+				coalesce(text2ltree($6) ? allowed, FALSE) AND NOT coalesce(text2ltree($6) ? denied, FALSE) AS auth,
+				coalesce(granting_policies[1], '') AS policy_id,
+				coalesce(granting_roles[1], '') AS role_id
+			FROM (
+				SELECT
+					array_agg(`+resourcePathLquery+`) FILTER (
+						WHERE policy.effect = 'allow' AND ($4 OR policy.name = ANY($5))
+					) AS allowed,
+					array_agg(`+resourcePathLquery+`) FILTER (WHERE policy.effect = 'deny') AS denied,
+					array_agg(policy.name ORDER BY policy.name, granting_role.name) FILTER (
+						WHERE policy.effect = 'allow' AND ($4 OR policy.name = ANY($5))
+						AND text2ltree($6) ~ `+resourcePathLquery+`
+					) AS granting_policies,
+					array_agg(granting_role.name ORDER BY policy.name, granting_role.name) FILTER (
+						WHERE policy.effect = 'allow' AND ($4 OR policy.name = ANY($5))
+						AND text2ltree($6) ~ `+resourcePathLquery+`
+					) AS granting_roles
+				FROM (
 					SELECT usr_policy.policy_id FROM usr
 					INNER JOIN usr_policy ON usr_policy.usr_id = usr.id
-					WHERE usr.name = $1 AND (usr_policy.expires_at IS NULL OR NOW() < usr_policy.expires_at)
+					WHERE usr.name = $1 AND (usr_policy.expires_at IS NULL OR $10 < usr_policy.expires_at)
 					UNION
 					SELECT grp_policy.policy_id FROM usr
 					INNER JOIN usr_grp ON usr_grp.usr_id = usr.id
 					INNER JOIN grp_policy ON grp_policy.grp_id = usr_grp.grp_id
-					WHERE usr.name = $1 AND (usr_grp.expires_at IS NULL OR NOW() < usr_grp.expires_at)
+					WHERE usr.name = $1 AND (usr_grp.expires_at IS NULL OR $10 < usr_grp.expires_at)
 					UNION
 					SELECT grp_policy.policy_id FROM grp
 					INNER JOIN grp_policy ON grp_policy.grp_id = grp.id
 					WHERE grp.name IN ($7, $8)
 				) AS policies
+				JOIN policy ON policy.id = policies.policy_id
 				JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 				JOIN resource ON resource.id = policy_resource.resource_id
-				WHERE EXISTS (
-					SELECT 1 FROM policy_role
+				JOIN LATERAL (
+					SELECT role.name FROM policy_role
+					JOIN role ON role.id = policy_role.role_id
 					JOIN permission ON permission.role_id = policy_role.role_id
 					WHERE policy_role.policy_id = policies.policy_id
 					AND (permission.service = $2 OR permission.service = '*')
 					AND (permission.method = $3 OR permission.method = '*')
-				) AND (
-					$4 OR policies.policy_id IN (
-						SELECT id FROM policy
-						WHERE policy.name = ANY($5)
-					)
-				)
+					AND `+constraintsMatch("$9")+`
+					ORDER BY role.name
+					LIMIT 1
+				) AS granting_role ON TRUE
 			) _
 			`,
 			&authorized,
@@ -266,39 +431,58 @@ func authorizeUser(request *AuthRequest) (*AuthResponse, error) {
 			resource,                   // $6
 			AnonymousGroup,             // $7
 			LoggedInGroup,              // $8
+			constraints,                // $9
+			request.now,                // $10
 		)
 	} else if tag != "" {
 		err = request.stmts.Select(
 			`
-			SELECT coalesce((SELECT resource.path FROM resource WHERE resource.tag = $6) <@ allowed, FALSE) FROM (
-				SELECT array_agg(resource.path) AS allowed FROM (
+			SELECT
+				coalesce((SELECT resource.path FROM resource WHERE resource.tag = $6) ? allowed, FALSE) AND NOT coalesce((SELECT resource.path FROM resource WHERE resource.tag = $6) ? denied, FALSE) AS auth,
+				coalesce(granting_policies[1], '') AS policy_id,
+				coalesce(granting_roles[1], '') AS role_id
+			FROM (
+				SELECT
+					array_agg(`+resourcePathLquery+`) FILTER (
+						WHERE policy.effect = 'allow' AND ($4 OR policy.name = ANY($5))
+					) AS allowed,
+					array_agg(`+resourcePathLquery+`) FILTER (WHERE policy.effect = 'deny') AS denied,
+					array_agg(policy.name ORDER BY policy.name, granting_role.name) FILTER (
+						WHERE policy.effect = 'allow' AND ($4 OR policy.name = ANY($5))
+						AND (SELECT resource.path FROM resource WHERE resource.tag = $6) ~ `+resourcePathLquery+`
+					) AS granting_policies,
+					array_agg(granting_role.name ORDER BY policy.name, granting_role.name) FILTER (
+						WHERE policy.effect = 'allow' AND ($4 OR policy.name = ANY($5))
+						AND (SELECT resource.path FROM resource WHERE resource.tag = $6) ~ `+resourcePathLquery+`
+					) AS granting_roles
+				FROM (
 					SELECT usr_policy.policy_id FROM usr
 					INNER JOIN usr_policy ON usr_policy.usr_id = usr.id
-					WHERE usr.name = $1 AND (usr_policy.expires_at IS NULL OR NOW() < usr_policy.expires_at)
+					WHERE usr.name = $1 AND (usr_policy.expires_at IS NULL OR $10 < usr_policy.expires_at)
 					UNION
 					SELECT grp_policy.policy_id FROM usr
 					INNER JOIN usr_grp ON usr_grp.usr_id = usr.id
 					INNER JOIN grp_policy ON grp_policy.grp_id = usr_grp.grp_id
-					WHERE usr.name = $1 AND (usr_grp.expires_at IS NULL OR NOW() < usr_grp.expires_at)
+					WHERE usr.name = $1 AND (usr_grp.expires_at IS NULL OR $10 < usr_grp.expires_at)
 					UNION
 					SELECT grp_policy.policy_id FROM grp
 					INNER JOIN grp_policy ON grp_policy.grp_id = grp.id
 					WHERE grp.name IN ($7, $8)
 				) AS policies
+				JOIN policy ON policy.id = policies.policy_id
 				JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 				JOIN resource ON resource.id = policy_resource.resource_id
-				WHERE EXISTS (
-					SELECT 1 FROM policy_role
+				JOIN LATERAL (
+					SELECT role.name FROM policy_role
+					JOIN role ON role.id = policy_role.role_id
 					JOIN permission ON permission.role_id = policy_role.role_id
 					WHERE policy_role.policy_id = policies.policy_id
 					AND (permission.service = $2 OR permission.service = '*')
 					AND (permission.method = $3 OR permission.method = '*')
-				) AND (
-					$4 OR policies.policy_id IN (
-						SELECT id FROM policy
-						WHERE policy.name = ANY($5)
-					)
-				)
+					AND `+constraintsMatch("$9")+`
+					ORDER BY role.name
+					LIMIT 1
+				) AS granting_role ON TRUE
 			) _
 			`,
 			&authorized,
@@ -310,6 +494,8 @@ func authorizeUser(request *AuthRequest) (*AuthResponse, error) {
 			tag,                        // $6
 			AnonymousGroup,             // $7
 			LoggedInGroup,              // $8
+			constraints,                // $9
+			request.now,                // $10
 		)
 	} else {
 		err = errors.New("missing resource in auth request")
@@ -317,8 +503,94 @@ func authorizeUser(request *AuthRequest) (*AuthResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	result := len(authorized) > 0 && authorized[0]
-	return &AuthResponse{result}, nil
+	if len(authorized) == 0 || !authorized[0].Auth {
+		return &AuthResponse{Auth: false}, nil
+	}
+	return &AuthResponse{
+		Auth:     true,
+		PolicyID: authorized[0].PolicyID,
+		RoleID:   authorized[0].RoleID,
+	}, nil
+}
+
+// authorizePolicy decides the request using only the policies named in
+// `request.Policies`, whoever they are granted to, the same way as
+// `authorizeUser` would for a user holding just those. This lets a policy be
+// tried out before granting it.
+func authorizePolicy(request *AuthRequest) (*AuthResponse, error) {
+	constraints, err := attributesJSON(request)
+	if err != nil {
+		return nil, err
+	}
+	// the resource is either a path or a tag
+	var path, tag string
+	if strings.HasPrefix(request.Resource, "/") {
+		path = FormatPathForDb(request.Resource)
+	} else if request.Resource != "" {
+		tag = request.Resource
+	} else {
+		return nil, errors.New("missing resource in auth request")
+	}
+
+	var authorized []authorizeUserRow
+	err = request.stmts.Select(
+		`
+		WITH requested AS (
+			SELECT CASE
+				WHEN $4 <> '' THEN text2ltree($4)
+				ELSE (SELECT resource.path FROM resource WHERE resource.tag = $5)
+			END AS path
+		)
+		SELECT
+			coalesce(requested.path ? allowed, FALSE) AND NOT coalesce(requested.path ? denied, FALSE) AS auth,
+			coalesce(granting_policies[1], '') AS policy_id,
+			coalesce(granting_roles[1], '') AS role_id
+		FROM requested, (
+			SELECT
+				array_agg(`+resourcePathLquery+`) FILTER (WHERE policy.effect = 'allow') AS allowed,
+				array_agg(`+resourcePathLquery+`) FILTER (WHERE policy.effect = 'deny') AS denied,
+				array_agg(policy.name ORDER BY policy.name, granting_role.name) FILTER (
+					WHERE policy.effect = 'allow' AND (SELECT path FROM requested) ~ `+resourcePathLquery+`
+				) AS granting_policies,
+				array_agg(granting_role.name ORDER BY policy.name, granting_role.name) FILTER (
+					WHERE policy.effect = 'allow' AND (SELECT path FROM requested) ~ `+resourcePathLquery+`
+				) AS granting_roles
+			FROM policy
+			JOIN policy_resource ON policy_resource.policy_id = policy.id
+			JOIN resource ON resource.id = policy_resource.resource_id
+			JOIN LATERAL (
+				SELECT role.name FROM policy_role
+				JOIN role ON role.id = policy_role.role_id
+				JOIN permission ON permission.role_id = policy_role.role_id
+				WHERE policy_role.policy_id = policy.id
+				AND (permission.service = $1 OR permission.service = '*')
+				AND (permission.method = $2 OR permission.method = '*')
+				AND `+constraintsMatch("$6")+`
+				ORDER BY role.name
+				LIMIT 1
+			) AS granting_role ON TRUE
+			WHERE policy.name = ANY($3)
+		) _
+		`,
+		&authorized,
+		request.Service,            // $1
+		request.Method,             // $2
+		pq.Array(request.Policies), // $3
+		path,                       // $4
+		tag,                        // $5
+		constraints,                // $6
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(authorized) == 0 || !authorized[0].Auth {
+		return &AuthResponse{Auth: false}, nil
+	}
+	return &AuthResponse{
+		Auth:     true,
+		PolicyID: authorized[0].PolicyID,
+		RoleID:   authorized[0].RoleID,
+	}, nil
 }
 
 // This is similar to authorizeUser, only that this method checks for clientID only
@@ -327,6 +599,11 @@ func authorizeClient(request *AuthRequest) (*AuthResponse, error) {
 	var tag string
 	var authorized []bool
 
+	constraints, err := attributesJSON(request)
+	if err != nil {
+		return nil, err
+	}
+
 	resource := request.Resource
 	// See if the resource field is a path or a tag.
 	if strings.HasPrefix(resource, "/") {
@@ -339,9 +616,13 @@ func authorizeClient(request *AuthRequest) (*AuthResponse, error) {
 	if resource != "" {
 		err = request.stmts.Select(
 			`
-			SELECT coalesce(text2ltree($4) <@ allowed, FALSE) FROM (
-				SELECT array_agg(resource.path) AS allowed FROM client
+			SELECT coalesce(text2ltree($4) ? allowed, FALSE) AND NOT coalesce(text2ltree($4) ? denied, FALSE) FROM (
+				SELECT
+					array_agg(`+resourcePathLquery+`) FILTER (WHERE policy.effect = 'allow') AS allowed,
+					array_agg(`+resourcePathLquery+`) FILTER (WHERE policy.effect = 'deny') AS denied
+				FROM client
 				JOIN client_policy ON client_policy.client_id = client.id
+				JOIN policy ON policy.id = client_policy.policy_id
 				JOIN policy_resource ON policy_resource.policy_id = client_policy.policy_id
 				JOIN resource ON resource.id = policy_resource.resource_id
 				WHERE client.external_client_id = $1
@@ -351,6 +632,7 @@ func authorizeClient(request *AuthRequest) (*AuthResponse, error) {
 					WHERE policy_role.policy_id = client_policy.policy_id
 					AND (permission.service = $2 OR permission.service = '*')
 					AND (permission.method = $3 OR permission.method = '*')
+					AND `+constraintsMatch("$5")+`
 				)
 			) _
 			`,
@@ -359,16 +641,23 @@ func authorizeClient(request *AuthRequest) (*AuthResponse, error) {
 			request.Service,  // $2
 			request.Method,   // $3
 			resource,         // $4
+			constraints,      // $5
 		)
 	} else if tag != "" {
 		err = request.stmts.Select(
 			`
-			SELECT coalesce((SELECT resource.path FROM resource WHERE resource.tag = $6) <@ allowed, FALSE) FROM (
-				SELECT array_agg(resource.path) AS allowed FROM (
+			SELECT coalesce((SELECT resource.path FROM resource WHERE resource.tag = $6) ? allowed, FALSE) AND NOT coalesce((SELECT resource.path FROM resource WHERE resource.tag = $6) ? denied, FALSE) FROM (
+				SELECT
+					array_agg(`+resourcePathLquery+`) FILTER (
+						WHERE policy.effect = 'allow' AND ($4 OR policy.name = ANY($5))
+					) AS allowed,
+					array_agg(`+resourcePathLquery+`) FILTER (WHERE policy.effect = 'deny') AS denied
+				FROM (
 					SELECT client_policy.policy_id FROM client
 					INNER JOIN client_policy ON client_policy.client_id = client.id
 					WHERE client.external_client_id = $1
 				) AS policies
+				JOIN policy ON policy.id = policies.policy_id
 				JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 				JOIN resource ON resource.id = policy_resource.resource_id
 				WHERE EXISTS (
@@ -377,11 +666,7 @@ func authorizeClient(request *AuthRequest) (*AuthResponse, error) {
 					WHERE policy_role.policy_id = policies.policy_id
 					AND (permission.service = $2 OR permission.service = '*')
 					AND (permission.method = $3 OR permission.method = '*')
-				) AND (
-					$4 OR policies.policy_id IN (
-						SELECT id FROM policy
-						WHERE policy.name = ANY($5)
-					)
+					AND `+constraintsMatch("$7")+`
 				)
 			) _
 			`,
@@ -392,6 +677,7 @@ func authorizeClient(request *AuthRequest) (*AuthResponse, error) {
 			len(request.Policies) == 0, // $4
 			pq.Array(request.Policies), // $5
 			tag,                        // $6
+			constraints,                // $7
 		)
 	} else {
 		err = errors.New("missing resource in auth request")
@@ -400,51 +686,194 @@ func authorizeClient(request *AuthRequest) (*AuthResponse, error) {
 		return nil, err
 	}
 	result := len(authorized) > 0 && authorized[0]
-	return &AuthResponse{result}, nil
+	return &AuthResponse{Auth: result}, nil
 }
 
-func authRequestFromGET(decode func(string, []string) (*TokenInfo, error), r *http.Request) (*AuthRequest, *ErrorResponse) {
-	resourcePath := ""
-	resourcePathQS, ok := r.URL.Query()["resource"]
-	if ok {
-		resourcePath = resourcePathQS[0]
-	}
-	service := ""
-	serviceQS, ok := r.URL.Query()["service"]
-	if ok {
-		service = serviceQS[0]
-	}
-	method := ""
-	methodQS, ok := r.URL.Query()["method"]
-	if ok {
-		method = methodQS[0]
-	}
-	// get JWT from auth header and decode it
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
+// authRequestFromGET reads an auth request from the query string, and the
+// user from `userJWT`, the token from the auth header, which must have all
+// the `scopes`.
+func authRequestFromGET(decode func(string, []string) (*TokenInfo, error), scopes []string, userJWT string, r *http.Request) (*AuthRequest, *ErrorResponse) {
+	// decode the JWT from the auth header
+	if userJWT == "" {
 		msg := "auth request missing auth header"
-		return nil, newErrorResponse(msg, 401, nil)
+		return nil, newErrorResponse(msg, 401, nil).withCode(ErrorCodeMissingToken)
 	}
-	userJWT := strings.TrimPrefix(authHeader, "Bearer ")
-	userJWT = strings.TrimPrefix(userJWT, "bearer ")
-	scopes := []string{"openid"}
 	info, err := decode(userJWT, scopes)
 	if err != nil {
-		return nil, newErrorResponse(err.Error(), 401, &err)
+		return nil, newErrorResponse(err.Error(), 401, &err).withCode(ErrorCodeInvalidToken)
 	}
+	return authRequestFromQuery(info, r), nil
+}
 
+// authRequestFromQuery is the auth request for the caller `info`, for the
+// resource, service and method in the query string of `r`.
+func authRequestFromQuery(info *TokenInfo, r *http.Request) *AuthRequest {
+	query := r.URL.Query()
 	authRequest := AuthRequest{
 		Username: info.username,
 		ClientID: info.clientID,
 		Policies: info.policies,
-		Resource: resourcePath,
-		Service:  service,
-		Method:   method,
+		Resource: query.Get("resource"),
+		Service:  query.Get("service"),
+		Method:   query.Get("method"),
 	}
+	return &authRequest
+}
+
+// EffectivePolicies describes what a token grants, for `/auth/policies`: the
+// policies its user has, and those of its client.
+type EffectivePolicies struct {
+	Username string `json:"username"`
+	ClientID string `json:"client_id,omitempty"`
+	// TokenPolicies are the policies listed in the token, if any. The user
+	// then only has those of its granted allow policies which are also
+	// listed, while its deny policies all still apply.
+	TokenPolicies []string          `json:"token_policies,omitempty"`
+	Policies      []EffectivePolicy `json:"policies"`
+	// ClientPolicies are the policies granted to the client.
+	ClientPolicies []string `json:"client_policies,omitempty"`
+}
 
-	return &authRequest, nil
+// EffectivePolicy is one of a user's policies, with how it was granted:
+// `user` for a grant to the user, or `group:<name>` for a grant to a group
+// the user is in (including the `anonymous` and `logged-in` groups).
+type EffectivePolicy struct {
+	ID  string         `json:"id" db:"id"`
+	Via pq.StringArray `json:"via" db:"via"`
 }
 
+// effectivePolicies lists the policies which `authorizeUser` and
+// `authorizeClient` would check for `request`, which only needs its
+// username, client ID and policies set.
+func effectivePolicies(db *sqlx.DB, request *AuthRequest) (*EffectivePolicies, error) {
+	result := &EffectivePolicies{
+		Username:       request.Username,
+		ClientID:       request.ClientID,
+		TokenPolicies:  request.Policies,
+		Policies:       []EffectivePolicy{},
+		ClientPolicies: []string{},
+	}
+	if request.Username != "" {
+		stmt := `
+			SELECT policy.name AS id, array_agg(DISTINCT grants.via ORDER BY grants.via) AS via
+			FROM (
+				SELECT usr_policy.policy_id, 'user' AS via FROM usr
+				INNER JOIN usr_policy ON usr_policy.usr_id = usr.id
+				WHERE usr.name = $1 AND (usr_policy.expires_at IS NULL OR $6 < usr_policy.expires_at)
+				UNION
+				SELECT grp_policy.policy_id, 'group:' || grp.name AS via FROM usr
+				INNER JOIN usr_grp ON usr_grp.usr_id = usr.id
+				INNER JOIN grp ON grp.id = usr_grp.grp_id
+				INNER JOIN grp_policy ON grp_policy.grp_id = usr_grp.grp_id
+				WHERE usr.name = $1 AND (usr_grp.expires_at IS NULL OR $6 < usr_grp.expires_at)
+				UNION
+				SELECT grp_policy.policy_id, 'group:' || grp.name AS via FROM grp
+				INNER JOIN grp_policy ON grp_policy.grp_id = grp.id
+				WHERE grp.name IN ($2, $3)
+			) AS grants
+			JOIN policy ON policy.id = grants.policy_id
+			WHERE $4 OR policy.name = ANY($5) OR policy.effect = 'deny'
+			GROUP BY policy.name
+			ORDER BY policy.name
+		`
+		err := db.Select(
+			&result.Policies,
+			stmt,
+			request.Username,           // $1
+			AnonymousGroup,             // $2
+			LoggedInGroup,              // $3
+			len(request.Policies) == 0, // $4
+			pq.Array(request.Policies), // $5
+			request.now,                // $6
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if request.ClientID != "" {
+		stmt := `
+			SELECT policy.name FROM client
+			JOIN client_policy ON client_policy.client_id = client.id
+			JOIN policy ON policy.id = client_policy.policy_id
+			WHERE client.external_client_id = $1
+			ORDER BY policy.name
+		`
+		err := db.Select(&result.ClientPolicies, stmt, request.ClientID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// constraintQueryPrefix marks the query parameters of an `/auth/proxy` request
+// which are constraints: `constraint.project=X` is the constraint
+// `{"project": "X"}`.
+const constraintQueryPrefix = "constraint."
+
+// constraintsFromQuery collects the `constraint.<name>=<value>` parameters in
+// `query`. Each name can only be given once.
+func constraintsFromQuery(query url.Values) (Constraints, *ErrorResponse) {
+	constraints := Constraints{}
+	for key, values := range query {
+		if !strings.HasPrefix(key, constraintQueryPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, constraintQueryPrefix)
+		if name == "" {
+			msg := fmt.Sprintf("constraint parameter `%s` missing a name", key)
+			return nil, newErrorResponse(msg, 400, nil)
+		}
+		if len(values) > 1 {
+			msg := fmt.Sprintf("constraint parameter `%s` given more than once", key)
+			return nil, newErrorResponse(msg, 400, nil)
+		}
+		constraints[name] = values[0]
+	}
+	return constraints, nil
+}
+
+// deniedActions is a SQL common table expression `denied_actions` for the
+// queries listing what a user, client or group can access, which come after a
+// `policies` table of the policy IDs granted to them. For each action in the
+// deny policies among those, it has the lqueries (see `resourcePathLquery`)
+// matching the resources those policies deny the action on. There are no
+// request attributes to check constraints against, so as in an auth request
+// without any, a deny permission with constraints doesn't apply.
+var deniedActions = `denied_actions AS (
+	SELECT
+		permission.service,
+		permission.method,
+		array_agg(` + resourcePathLquery + `) AS paths
+	FROM policies
+	JOIN policy ON policy.id = policies.policy_id
+	JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
+	JOIN resource ON resource.id = policy_resource.resource_id
+	JOIN policy_role ON policy_role.policy_id = policies.policy_id
+	JOIN permission ON permission.role_id = policy_role.role_id
+	WHERE policy.effect = 'deny' AND ` + constraintsMatch(`'{}'`) + `
+	GROUP BY permission.service, permission.method
+)`
+
+// actionNotDenied is a SQL condition, for a query with `deniedActions`, that
+// no deny policy covers the action in `permission` on `resource.path`,
+// checked the same way as in the authorize queries.
+const actionNotDenied = `NOT EXISTS (
+	SELECT 1 FROM denied_actions
+	WHERE (denied_actions.service = permission.service OR denied_actions.service = '*')
+	AND (denied_actions.method = permission.method OR denied_actions.method = '*')
+	AND resource.path ? denied_actions.paths
+)`
+
+// resourceNotDenied is a SQL condition, for a query with `deniedActions`,
+// that no deny policy covers `resource.path` for any action. Listing the
+// resources accessible with any action leaves out the ones under a deny
+// policy, even where it only denies some of the actions.
+const resourceNotDenied = `NOT EXISTS (
+	SELECT 1 FROM denied_actions
+	WHERE resource.path ? denied_actions.paths
+)`
+
 // authorizedResources returns the resources that are accessible (with any action)
 // to the username in AuthRequest. This includes the resources accessible to the
 // `anonymous` and `logged-in` groups. If the username in AuthRequest does not exist
@@ -464,11 +893,12 @@ func authorizedResources(db *sqlx.DB, request *AuthRequest) ([]ResourceFromQuery
 		}
 		values = strings.TrimRight(values, ", ")
 		selectPolicyWhereName := fmt.Sprintf(
-			"SELECT id FROM policy INNER JOIN (VALUES %s) values(v) ON name = v",
+			"SELECT id AS policy_id FROM policy INNER JOIN (VALUES %s) values(v) ON name = v",
 			values,
 		)
 		stmt := fmt.Sprintf(
 			`
+			WITH policies AS (%s), %s
 			SELECT
 				resource.id,
 				resource.name,
@@ -484,15 +914,18 @@ func authorizedResources(db *sqlx.DB, request *AuthRequest) ([]ResourceFromQuery
 				) AS subresources
 			FROM resource
 			INNER JOIN policy_resource ON resource.id = policy_resource.resource_id
+			INNER JOIN policy ON policy.id = policy_resource.policy_id
 			INNER JOIN usr_policy ON usr_policy.policy_id = policy_resource.policy_id
-			WHERE (policy_resource.policy_id IN (%s)) AND (
-				usr_policy.expires_at IS NULL OR NOW() < usr_policy.expires_at
-			)
+			WHERE (policy_resource.policy_id IN (SELECT policy_id FROM policies)) AND (
+				usr_policy.expires_at IS NULL OR $1 < usr_policy.expires_at
+			) AND policy.effect = 'allow' AND %s
 			`,
 			selectPolicyWhereName,
+			deniedActions,
+			resourceNotDenied,
 		)
 		resources := []ResourceFromQuery{}
-		err := db.Select(&resources, stmt)
+		err := db.Select(&resources, stmt, request.now)
 		if err != nil {
 			return nil, newErrorResponse("resources query (using policies) failed", 500, &err)
 		}
@@ -505,40 +938,43 @@ func authorizedResources(db *sqlx.DB, request *AuthRequest) ([]ResourceFromQuery
 		}
 		// alternative: SELECT DISTINCT * FROM resource WHERE resource.path <@ ARRAY(SELECT resource.path FROM (SELECT usr_policy.policy_id FROM usr JOIN usr_policy ON usr.id = usr_policy.usr_id WHERE usr.name = $1) policies INNER JOIN policy_resource ON policy_resource.policy_id = policies.policy_id INNER JOIN resource ON resource.id = policy_resource.resource_id);
 		stmt := `
-			SELECT DISTINCT
-				resource.id,
-				resource.name,
-				resource.path,
-				resource.tag,
-				resource.description,
-				array(
-					SELECT child.path
-					FROM resource AS child
-					WHERE child.path ~ (
-						CAST ((ltree2text(resource.path) || '.*{1}') AS lquery)
-					)
-				) AS subresources
-			FROM (
+			WITH policies AS (
 				SELECT usr_policy.policy_id
 				FROM usr
 				JOIN usr_policy ON usr.id = usr_policy.usr_id
-				WHERE usr.name = $1 AND (usr_policy.expires_at IS NULL OR NOW() < usr_policy.expires_at)
+				WHERE usr.name = $1 AND (usr_policy.expires_at IS NULL OR $4 < usr_policy.expires_at)
 				UNION
 				SELECT grp_policy.policy_id
 				FROM grp
 				JOIN grp_policy ON grp_policy.grp_id = grp.id
 				JOIN usr_grp ON usr_grp.grp_id = grp.id
 				JOIN usr ON usr.id = usr_grp.usr_id
-				WHERE usr.name = $1 AND (usr_grp.expires_at IS NULL OR NOW() < usr_grp.expires_at)
+				WHERE usr.name = $1 AND (usr_grp.expires_at IS NULL OR $4 < usr_grp.expires_at)
 				UNION
 				SELECT grp_policy.policy_id
 				FROM grp
 				JOIN grp_policy ON grp_policy.grp_id = grp.id
 				WHERE grp.name IN ($2, $3)
-			) policies
+			), ` + deniedActions + `
+			SELECT DISTINCT
+				resource.id,
+				resource.name,
+				resource.path,
+				resource.tag,
+				resource.description,
+				array(
+					SELECT child.path
+					FROM resource AS child
+					WHERE child.path ~ (
+						CAST ((ltree2text(resource.path) || '.*{1}') AS lquery)
+					)
+				) AS subresources
+			FROM policies
+			INNER JOIN policy ON policy.id = policies.policy_id AND policy.effect = 'allow'
 			INNER JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 			INNER JOIN resource AS roots ON roots.id = policy_resource.resource_id
 			LEFT JOIN resource ON resource.path <@ roots.path
+			WHERE ` + resourceNotDenied + `
 		`
 		err := db.Select(
 			&resources,
@@ -546,6 +982,7 @@ func authorizedResources(db *sqlx.DB, request *AuthRequest) ([]ResourceFromQuery
 			request.Username, // $1
 			AnonymousGroup,   // $2
 			LoggedInGroup,    // $3
+			request.now,      // $4
 		)
 		if err != nil {
 			errResponse := newErrorResponse(
@@ -558,24 +995,11 @@ func authorizedResources(db *sqlx.DB, request *AuthRequest) ([]ResourceFromQuery
 		return resources, nil
 	} else {
 		stmt := `
-			SELECT DISTINCT
-				resource.id,
-				resource.name,
-				resource.path,
-				resource.tag,
-				resource.description,
-				array(
-					SELECT child.path
-					FROM resource AS child
-					WHERE child.path ~ (
-						CAST ((ltree2text(resource.path) || '.*{1}') AS lquery)
-					)
-				) AS subresources
-			FROM (
+			WITH policies AS (
 				SELECT usr_policy.policy_id
 				FROM usr
 				JOIN usr_policy ON usr.id = usr_policy.usr_id
-				WHERE usr.name = $1 AND (usr_policy.expires_at IS NULL OR NOW() < usr_policy.expires_at)
+				WHERE usr.name = $1 AND (usr_policy.expires_at IS NULL OR $3 < usr_policy.expires_at)
 				UNION
 				SELECT client_policy.policy_id
 				FROM client
@@ -587,13 +1011,29 @@ func authorizedResources(db *sqlx.DB, request *AuthRequest) ([]ResourceFromQuery
 				JOIN grp_policy ON grp_policy.grp_id = grp.id
 				JOIN usr_grp ON usr_grp.grp_id = grp.id
 				JOIN usr ON usr.id = usr_grp.usr_id
-				WHERE usr.name = $1 AND (usr_grp.expires_at IS NULL OR NOW() < usr_grp.expires_at)
-			) policies
+				WHERE usr.name = $1 AND (usr_grp.expires_at IS NULL OR $3 < usr_grp.expires_at)
+			), ` + deniedActions + `
+			SELECT DISTINCT
+				resource.id,
+				resource.name,
+				resource.path,
+				resource.tag,
+				resource.description,
+				array(
+					SELECT child.path
+					FROM resource AS child
+					WHERE child.path ~ (
+						CAST ((ltree2text(resource.path) || '.*{1}') AS lquery)
+					)
+				) AS subresources
+			FROM policies
+			INNER JOIN policy ON policy.id = policies.policy_id AND policy.effect = 'allow'
 			LEFT JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 			INNER JOIN resource AS roots ON roots.id = policy_resource.resource_id
 			LEFT JOIN resource ON resource.path <@ roots.path
+			WHERE ` + resourceNotDenied + `
 		`
-		err := db.Select(&resources, stmt, request.Username, request.ClientID)
+		err := db.Select(&resources, stmt, request.Username, request.ClientID, request.now)
 		if err != nil {
 			errResponse := newErrorResponse(
 				"resources query (using username + client) failed",
@@ -611,6 +1051,12 @@ func authorizedResources(db *sqlx.DB, request *AuthRequest) ([]ResourceFromQuery
 func authorizedResourcesForGroups(db *sqlx.DB, groups ...string) ([]ResourceFromQuery, *ErrorResponse) {
 	resources := []ResourceFromQuery{}
 	stmt := `
+		WITH policies AS (
+			SELECT grp_policy.policy_id
+			FROM grp
+			JOIN grp_policy ON grp_policy.grp_id = grp.id
+			WHERE grp.name = ANY($1)
+		), ` + deniedActions + `
 		SELECT DISTINCT
 			resource.id,
 			resource.name,
@@ -624,27 +1070,16 @@ func authorizedResourcesForGroups(db *sqlx.DB, groups ...string) ([]ResourceFrom
 					CAST ((ltree2text(resource.path) || '.*{1}') AS lquery)
 				)
 			) AS subresources
-		FROM (
-			SELECT grp_policy.policy_id
-			FROM grp
-			JOIN grp_policy ON grp_policy.grp_id = grp.id
-			WHERE grp.name IN (?)
-		) policies
+		FROM policies
+		INNER JOIN policy ON policy.id = policies.policy_id AND policy.effect = 'allow'
 		INNER JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 		INNER JOIN resource AS roots ON roots.id = policy_resource.resource_id
 		LEFT JOIN resource ON resource.path <@ roots.path
+		WHERE ` + resourceNotDenied + `
 	`
-	// sqlx.In allows safely binding variable numbers of arguments as bindvars.
-	// See https://jmoiron.github.io/sqlx/#inQueries,
-	query, args, err := sqlx.In(stmt, groups)
-	if err != nil {
-		errResponse := newErrorResponse("mapping query failed", 500, &err)
-		errResponse.log.Error(err.Error())
-		return nil, errResponse
-	}
-	// db.Rebind converts the '?' bindvar syntax required by sqlx.In to postgres $1 bindvar syntax
-	query = db.Rebind(query)
-	err = db.Select(&resources, query, args...)
+	// The ltree `?` operator in the deny check rules out `sqlx.In`, so the
+	// groups are bound as one array instead.
+	err := db.Select(&resources, stmt, pq.Array(groups))
 	if err != nil {
 		errResponse := newErrorResponse(
 			"resources query (using no username) failed",
@@ -687,8 +1122,8 @@ ARRAY[
 // `logged-in` groups.
 // If there is no user with this username in the db, this function will NOT
 // throw an error, but will return only the auth mapping of the `anonymous`
-// and `logged-in` groups.
-func authMappingForUser(db *sqlx.DB, username string) (AuthMapping, *ErrorResponse) {
+// and `logged-in` groups. Grants which have expired by `now` don't count.
+func authMappingForUser(db *sqlx.DB, username string, now time.Time) (AuthMapping, *ErrorResponse) {
 	mappingQuery := []AuthMappingQuery{}
 	stmt := `
 		WITH policies AS (
@@ -696,14 +1131,14 @@ func authMappingForUser(db *sqlx.DB, username string) (AuthMapping, *ErrorRespon
 		    FROM usr
 		    INNER JOIN usr_policy ON usr_policy.usr_id = usr.id
 		    WHERE usr.name = $1
-		        AND (usr_policy.expires_at IS NULL OR NOW() < usr_policy.expires_at)
+		        AND (usr_policy.expires_at IS NULL OR $4 < usr_policy.expires_at)
 		    UNION
 		    SELECT grp_policy.policy_id
 		    FROM usr
 		    INNER JOIN usr_grp ON usr_grp.usr_id = usr.id
 		    INNER JOIN grp_policy ON grp_policy.grp_id = usr_grp.grp_id
 		    WHERE usr.name = $1
-		        AND (usr_grp.expires_at IS NULL OR NOW() < usr_grp.expires_at)
+		        AND (usr_grp.expires_at IS NULL OR $4 < usr_grp.expires_at)
 		    UNION
 		    SELECT grp_policy.policy_id
 		    FROM grp
@@ -713,9 +1148,11 @@ func authMappingForUser(db *sqlx.DB, username string) (AuthMapping, *ErrorRespon
 		policy_resources AS materialized (
 		    SELECT policies.policy_id, policy_resource.resource_id, roots.path
 		    FROM policies
+		    INNER JOIN policy ON policy.id = policies.policy_id AND policy.effect = 'allow'
 		    INNER JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 		    INNER JOIN resource AS roots ON roots.id = policy_resource.resource_id
-		)
+		),
+		` + deniedActions + `
 	    SELECT DISTINCT
 	        resource.path,
 	        permission.service,
@@ -725,7 +1162,8 @@ func authMappingForUser(db *sqlx.DB, username string) (AuthMapping, *ErrorRespon
 	    INNER JOIN policy_role ON policy_role.policy_id = policies.policy_id
 	    INNER JOIN permission ON permission.role_id = policy_role.role_id
 	    INNER JOIN resource ON resource.path <@ policy_resources.path
-	    WHERE ltree2text(resource.path) NOT LIKE ALL (`
+	    WHERE ` + actionNotDenied + `
+	    AND ltree2text(resource.path) NOT LIKE ALL (`
 
    stmt += authMappingProjectExclusion
    stmt += `
@@ -740,6 +1178,7 @@ func authMappingForUser(db *sqlx.DB, username string) (AuthMapping, *ErrorRespon
 		username,       // $1
 		AnonymousGroup, // $2
 		LoggedInGroup,  // $3
+		now,            // $4
 	)
 
 	if err != nil {
@@ -760,36 +1199,30 @@ func authMappingForUser(db *sqlx.DB, username string) (AuthMapping, *ErrorRespon
 func authMappingForGroups(db *sqlx.DB, groups ...string) (AuthMapping, *ErrorResponse) {
 	mappingQuery := []AuthMappingQuery{}
 	stmt := `
-		SELECT DISTINCT resource.path, permission.service, permission.method
-		FROM
-		(
+		WITH policies AS (
 			SELECT grp_policy.policy_id FROM grp
 			INNER JOIN grp_policy ON grp_policy.grp_id = grp.id
-			WHERE grp.name IN (?)
-		) AS policies
+			WHERE grp.name = ANY($1)
+		), ` + deniedActions + `
+		SELECT DISTINCT resource.path, permission.service, permission.method
+		FROM policies
+		INNER JOIN policy ON policy.id = policies.policy_id AND policy.effect = 'allow'
 		INNER JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 		INNER JOIN resource AS roots ON roots.id = policy_resource.resource_id
 		INNER JOIN policy_role ON policy_role.policy_id = policies.policy_id
 		INNER JOIN permission ON permission.role_id = policy_role.role_id
 		INNER JOIN resource ON resource.path <@ roots.path
-		WHERE ltree2text(resource.path) NOT LIKE ALL (`
+		WHERE ` + actionNotDenied + `
+		AND ltree2text(resource.path) NOT LIKE ALL (`
 
    	stmt += authMappingProjectExclusion
    	stmt += `
 	    )
 		
 	`
-	// sqlx.In allows safely binding variable numbers of arguments as bindvars.
-	// See https://jmoiron.github.io/sqlx/#inQueries,
-	query, args, err := sqlx.In(stmt, groups)
-	if err != nil {
-		errResponse := newErrorResponse("mapping query failed", 500, &err)
-		errResponse.log.Error(err.Error())
-		return nil, errResponse
-	}
-	// db.Rebind converts the '?' bindvar syntax required by sqlx.In to postgres $1 bindvar syntax
-	query = db.Rebind(query)
-	err = db.Select(&mappingQuery, query, args...)
+	// The ltree `?` operator in the deny check rules out `sqlx.In`, so the
+	// groups are bound as one array instead.
+	err := db.Select(&mappingQuery, stmt, pq.Array(groups))
 	if err != nil {
 		errResponse := newErrorResponse("mapping query failed", 500, &err)
 		errResponse.log.Error(err.Error())
@@ -812,19 +1245,21 @@ func authMappingForGroups(db *sqlx.DB, groups ...string) (AuthMapping, *ErrorRes
 func authMappingForClient(db *sqlx.DB, clientID string) (AuthMapping, *ErrorResponse) {
 	mappingQuery := []AuthMappingQuery{}
 	stmt := `
-		SELECT DISTINCT resource.path, permission.service, permission.method
-		FROM
-		(
+		WITH policies AS (
 			SELECT client_policy.policy_id FROM client
 			INNER JOIN client_policy ON client_policy.client_id = client.id
 			WHERE client.external_client_id = $1
-		) AS policies
+		), ` + deniedActions + `
+		SELECT DISTINCT resource.path, permission.service, permission.method
+		FROM policies
+		INNER JOIN policy ON policy.id = policies.policy_id AND policy.effect = 'allow'
 		INNER JOIN policy_resource ON policy_resource.policy_id = policies.policy_id
 		INNER JOIN resource AS roots ON roots.id = policy_resource.resource_id
 		INNER JOIN policy_role ON policy_role.policy_id = policies.policy_id
 		INNER JOIN permission ON permission.role_id = policy_role.role_id
 		INNER JOIN resource ON resource.path <@ roots.path
-		WHERE ltree2text(resource.path) NOT LIKE ALL (`
+		WHERE ` + actionNotDenied + `
+		AND ltree2text(resource.path) NOT LIKE ALL (`
 
    	stmt += authMappingProjectExclusion
    	stmt += `
@@ -0,0 +1,95 @@
+package arborist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthContextValues(t *testing.T) {
+	context := AuthContext{}
+	err := json.Unmarshal([]byte(`{"project": "X", "groups": ["a", "b"], "none": []}`), &context)
+	if assert.NoError(t, err) {
+		expected := AuthContext{
+			"project": {"X"},
+			"groups":  {"a", "b"},
+			"none":    {},
+		}
+		assert.Equal(t, expected, context)
+	}
+
+	for _, invalid := range []string{`{"project": 1}`, `{"project": [1]}`, `{"project": {"a": "b"}}`} {
+		err := json.Unmarshal([]byte(invalid), &AuthContext{})
+		assert.Error(t, err, "input: %s", invalid)
+	}
+}
+
+func TestAttributesJSON(t *testing.T) {
+	request := &AuthRequest{
+		Constraints: Constraints{"env": "prod", "region": "us"},
+		Context:     AuthContext{"env": {"dev"}, "project": {"X", "Y"}},
+	}
+	encoded, err := attributesJSON(request)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"env": ["prod", "dev"], "region": ["us"], "project": ["X", "Y"]}`, encoded)
+	}
+
+	encoded, err = attributesJSON(&AuthRequest{})
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{}`, encoded)
+	}
+}
+
+func TestConstraintsFromQuery(t *testing.T) {
+	query := url.Values{
+		"resource":          {"/a"},
+		"constraint.env":    {"prod"},
+		"constraint.region": {"us"},
+	}
+	constraints, errResponse := constraintsFromQuery(query)
+	if assert.Nil(t, errResponse) {
+		assert.Equal(t, Constraints{"env": "prod", "region": "us"}, constraints)
+	}
+
+	constraints, errResponse = constraintsFromQuery(url.Values{"resource": {"/a"}})
+	if assert.Nil(t, errResponse) {
+		assert.Empty(t, constraints)
+	}
+
+	for _, invalid := range []url.Values{
+		{"constraint.": {"prod"}},
+		{"constraint.env": {"prod", "dev"}},
+	} {
+		_, errResponse := constraintsFromQuery(invalid)
+		if assert.NotNil(t, errResponse, "query: %v", invalid) {
+			assert.Equal(t, 400, errResponse.HTTPError.Code)
+		}
+	}
+}
+
+func TestAuthDecision(t *testing.T) {
+	t.Run("Allow", func(t *testing.T) {
+		decision := &AuthDecision{Auth: true, PolicyID: "p", RoleID: "r"}
+		assert.Equal(t, &AuthResponse{Auth: true, PolicyID: "p", RoleID: "r"}, decision.response())
+	})
+
+	t.Run("Deny", func(t *testing.T) {
+		// a denied request doesn't say which policy it came closest to
+		decision := &AuthDecision{Auth: false, PolicyID: "p", RoleID: "r", DeniedBy: AuthCheckClient}
+		assert.Equal(t, &AuthResponse{Auth: false}, decision.response())
+	})
+
+	t.Run("NoOne", func(t *testing.T) {
+		server := NewServer().WithLogger(log.New(&bytes.Buffer{}, "", 0))
+		decision, errResponse := server.decide(context.Background(), &AuthRequest{Resource: "/a"})
+		if assert.Nil(t, errResponse) {
+			assert.False(t, decision.Auth)
+			assert.Equal(t, AuthCheckUser, decision.DeniedBy)
+		}
+	})
+}
@@ -89,7 +89,7 @@ func (client *Client) createInDb(db *sqlx.DB, authzProvider sql.NullString) *Err
 		// this should only fail because the client was not unique. return error
 		// accordingly
 		msg := fmt.Sprintf("failed to insert client: client with this ID already exists: %s", client.ClientID)
-		return newErrorResponse(msg, 409, &err)
+		return newErrorResponse(msg, 409, &err).withCode(ErrorCodeClientExists)
 	}
 
 	if len(client.Policies) > 0 {
@@ -134,7 +134,7 @@ func (client *Client) createInDb(db *sqlx.DB, authzProvider sql.NullString) *Err
 				"failed to grant policy to client: policies does not exist: %v",
 				missingPolicies,
 			)
-			return newErrorResponse(msg, 404, &err)
+			return newErrorResponse(msg, 404, &err).withCode(ErrorCodePolicyNotFound)
 		}
 	}
 
@@ -154,7 +154,7 @@ func (client *Client) deleteInDb(db *sqlx.DB) *ErrorResponse {
 	if err != nil {
 		// TODO: verify correct error
 		msg := fmt.Sprintf("failed to delete client: client does not exist: %s", client.ClientID)
-		return newErrorResponse(msg, 404, nil)
+		return newErrorResponse(msg, 404, nil).withCode(ErrorCodeClientNotFound)
 	}
 	return nil
 }
@@ -172,7 +172,7 @@ func grantClientPolicy(db *sqlx.DB, clientID string, policyName string, authzPro
 				"failed to grant policy to client: client does not exist: %s",
 				clientID,
 			)
-			return newErrorResponse(msg, 404, nil)
+			return newErrorResponse(msg, 404, nil).withCode(ErrorCodeClientNotFound)
 		}
 		if err != nil {
 			msg := "client query failed"
@@ -184,7 +184,7 @@ func grantClientPolicy(db *sqlx.DB, clientID string, policyName string, authzPro
 				"failed to grant policy to client: policy does not exist: %s",
 				policyName,
 			)
-			return newErrorResponse(msg, 404, nil)
+			return newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
 		}
 		if err != nil {
 			msg := "policy query failed"
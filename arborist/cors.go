@@ -0,0 +1,45 @@
+package arborist
+
+import (
+	"net/http"
+
+	"github.com/gorilla/handlers"
+)
+
+// DefaultCORSMethods are the methods allowed in cross-origin requests unless
+// set otherwise with `WithCORSConfig`: every method arborist has routes for.
+var DefaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// DefaultCORSHeaders are the request headers allowed in cross-origin requests
+// unless set otherwise with `WithCORSConfig`, besides those browsers always
+// send (`Accept`, `Accept-Language`, `Content-Language`, `Origin`).
+var DefaultCORSHeaders = []string{"Authorization", "Content-Type", "X-AuthZ-Provider", requestIDHeader}
+
+// CORSConfig holds the settings for cross-origin requests from browsers. An
+// origin of `*` allows any origin; empty methods or headers use the defaults
+// above.
+type CORSConfig struct {
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+}
+
+// handler answers `OPTIONS` preflight requests for every route, and adds the
+// `Access-Control-Allow-*` headers to responses for allowed origins. It has to
+// wrap the whole router, since the router has no `OPTIONS` routes.
+func (config *CORSConfig) handler(next http.Handler) http.Handler {
+	methods := config.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	headers := config.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	return handlers.CORS(
+		handlers.AllowedOrigins(config.AllowedOrigins),
+		handlers.AllowedMethods(methods),
+		handlers.AllowedHeaders(headers),
+		handlers.ExposedHeaders([]string{requestIDHeader}),
+	)(next)
+}
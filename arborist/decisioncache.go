@@ -0,0 +1,141 @@
+package arborist
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// decisionCacheSize is how many decisions the cache holds before the least
+// recently used are evicted.
+const decisionCacheSize = 10000
+
+// decisionCache is a least-recently-used cache of authorization decisions,
+// each kept for a short TTL. Any change to policies, resources, roles or
+// grants made through this server clears it (see `invalidate`); changes made
+// elsewhere, such as by another replica, are only seen once entries expire.
+type decisionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[[sha256.Size]byte]*list.Element
+	// order has the most recently used entries at the front
+	order *list.List
+	// generation counts invalidations, so that a decision worked out before
+	// one is not cached after it
+	generation uint64
+}
+
+type decisionCacheEntry struct {
+	key      [sha256.Size]byte
+	decision AuthDecision
+	expires  time.Time
+}
+
+func newDecisionCache(ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		ttl:     ttl,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// decisionCacheKey hashes everything in `request` which the decision depends
+// on.
+func decisionCacheKey(request *AuthRequest) [sha256.Size]byte {
+	// marshalling a struct of strings, lists and maps can't fail, and maps
+	// come out with their keys sorted
+	encoded, _ := json.Marshal(struct {
+		Username    string
+		ClientID    string
+		Policies    []string
+		Resource    string
+		Service     string
+		Method      string
+		Constraints Constraints
+		Context     AuthContext
+	}{
+		request.Username,
+		request.ClientID,
+		request.Policies,
+		request.Resource,
+		request.Service,
+		request.Method,
+		request.Constraints,
+		request.Context,
+	})
+	return sha256.Sum256(encoded)
+}
+
+// get returns the cached decision for `request`, or nil if it isn't cached
+// or has expired by `now`, along with the generation to pass to `add` once
+// the decision has been worked out.
+func (cache *decisionCache) get(request *AuthRequest, now time.Time) (*AuthDecision, uint64) {
+	if cache == nil {
+		return nil, 0
+	}
+	key := decisionCacheKey(request)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, exists := cache.entries[key]
+	if !exists {
+		return nil, cache.generation
+	}
+	entry := element.Value.(*decisionCacheEntry)
+	if !now.Before(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, cache.generation
+	}
+	cache.order.MoveToFront(element)
+	decision := entry.decision
+	return &decision, cache.generation
+}
+
+// add caches `decision` for `request` until the TTL is up, unless the cache
+// has been invalidated since `generation` was returned by `get`.
+func (cache *decisionCache) add(request *AuthRequest, decision *AuthDecision, generation uint64, now time.Time) {
+	if cache == nil {
+		return
+	}
+	key := decisionCacheKey(request)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if generation != cache.generation {
+		return
+	}
+	if element, exists := cache.entries[key]; exists {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+	}
+	for cache.order.Len() >= decisionCacheSize {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*decisionCacheEntry).key)
+	}
+	entry := &decisionCacheEntry{key: key, decision: *decision, expires: now.Add(cache.ttl)}
+	cache.entries[key] = cache.order.PushFront(entry)
+}
+
+// invalidate drops every cached decision, and returns how many there were.
+func (cache *decisionCache) invalidate() int {
+	if cache == nil {
+		return 0
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	dropped := cache.order.Len()
+	cache.entries = make(map[[sha256.Size]byte]*list.Element)
+	cache.order.Init()
+	cache.generation++
+	return dropped
+}
+
+// len returns the number of cached decisions, including any that have
+// expired but not been looked up since.
+func (cache *decisionCache) len() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.order.Len()
+}
@@ -0,0 +1,148 @@
+package arborist
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecisionCache(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	request := &AuthRequest{Username: "a", Resource: "/a", Service: "s", Method: "m"}
+	allow := &AuthDecision{Auth: true, PolicyID: "p", RoleID: "r"}
+
+	t.Run("Expiry", func(t *testing.T) {
+		cache := newDecisionCache(time.Second)
+		_, generation := cache.get(request, now)
+		cache.add(request, allow, generation, now)
+		cached, _ := cache.get(request, now.Add(time.Second/2))
+		assert.Equal(t, allow, cached)
+		cached, _ = cache.get(request, now.Add(time.Second))
+		assert.Nil(t, cached, "expected entry to expire after the TTL")
+		assert.Equal(t, 0, cache.len(), "expected expired entry to be dropped")
+	})
+
+	t.Run("Key", func(t *testing.T) {
+		cache := newDecisionCache(time.Minute)
+		_, generation := cache.get(request, now)
+		cache.add(request, allow, generation, now)
+		others := []*AuthRequest{
+			{Username: "b", Resource: "/a", Service: "s", Method: "m"},
+			{Username: "a", Resource: "/b", Service: "s", Method: "m"},
+			{Username: "a", Resource: "/a", Service: "t", Method: "m"},
+			{Username: "a", Resource: "/a", Service: "s", Method: "n"},
+			{Username: "a", ClientID: "c", Resource: "/a", Service: "s", Method: "m"},
+			{Username: "a", Resource: "/a", Service: "s", Method: "m", Context: AuthContext{"k": {"v"}}},
+		}
+		for _, other := range others {
+			cached, _ := cache.get(other, now)
+			assert.Nil(t, cached, "expected no decision for %+v", other)
+		}
+	})
+
+	t.Run("Invalidate", func(t *testing.T) {
+		cache := newDecisionCache(time.Minute)
+		_, generation := cache.get(request, now)
+		cache.add(request, allow, generation, now)
+		assert.Equal(t, 1, cache.invalidate())
+		cached, _ := cache.get(request, now)
+		assert.Nil(t, cached)
+		assert.Equal(t, 0, cache.len())
+	})
+
+	t.Run("StaleGeneration", func(t *testing.T) {
+		cache := newDecisionCache(time.Minute)
+		_, generation := cache.get(request, now)
+		// something changes while the decision is being worked out
+		cache.invalidate()
+		cache.add(request, allow, generation, now)
+		cached, _ := cache.get(request, now)
+		assert.Nil(t, cached, "expected decision from before the change not to be cached")
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		cache := newDecisionCache(time.Minute)
+		_, generation := cache.get(request, now)
+		cache.add(request, allow, generation, now)
+		cached, _ := cache.get(request, now)
+		cached.Auth = false
+		cached, _ = cache.get(request, now)
+		assert.True(t, cached.Auth, "expected callers not to be able to change cached decisions")
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		var cache *decisionCache
+		cache.add(request, allow, 0, now)
+		assert.Equal(t, 0, cache.invalidate())
+		cached, _ := cache.get(request, now)
+		assert.Nil(t, cached)
+	})
+}
+
+func TestInvalidateDecisionsMiddleware(t *testing.T) {
+	now := time.Now()
+	request := &AuthRequest{Username: "a", Resource: "/a", Service: "s", Method: "m"}
+	server := NewServer().
+		WithLogger(log.New(&bytes.Buffer{}, "", 0)).
+		WithDecisionCacheTTL(time.Minute)
+	router := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200) }
+	router.HandleFunc("/policy", ok).Methods("GET", "POST")
+	router.HandleFunc("/policy/{policyID}/test", ok).Methods("POST")
+	router.HandleFunc("/role", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(400) }).Methods("POST")
+	router.Use(server.invalidateDecisionsMiddleware)
+
+	cases := []struct {
+		method     string
+		path       string
+		invalidate bool
+	}{
+		{"GET", "/policy", false},
+		{"POST", "/policy/foo/test", false},
+		{"POST", "/role", false},
+		{"POST", "/policy", true},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s %s", c.method, c.path), func(t *testing.T) {
+			_, generation := server.decisionCache.get(request, now)
+			server.decisionCache.add(request, &AuthDecision{Auth: true}, generation, now)
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(c.method, c.path, nil))
+			cached, _ := server.decisionCache.get(request, now)
+			if c.invalidate {
+				assert.Nil(t, cached, "expected cache to be cleared")
+			} else {
+				assert.NotNil(t, cached, "expected cache to be kept")
+			}
+		})
+	}
+}
+
+func BenchmarkDecisionCache(b *testing.B) {
+	now := time.Now()
+	cache := newDecisionCache(time.Minute)
+	requests := make([]*AuthRequest, 1000)
+	for i := range requests {
+		requests[i] = &AuthRequest{
+			Username: fmt.Sprintf("user-%d", i),
+			Policies: []string{"a", "b", "c"},
+			Resource: "/programs/a/projects/b",
+			Service:  "peregrine",
+			Method:   "read",
+		}
+		_, generation := cache.get(requests[i], now)
+		cache.add(requests[i], &AuthDecision{Auth: true}, generation, now)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cached, _ := cache.get(requests[i%len(requests)], now); cached == nil {
+			b.Fatal("expected cached decision")
+		}
+	}
+}
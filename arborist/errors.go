@@ -51,3 +51,87 @@ func containsUnexpectedFields(entity string, fields []string) error {
 	)
 	return &httpError{msg, http.StatusBadRequest}
 }
+
+func unknownConstraintKeys(entity string, field string, service string, keys []string, known []string) error {
+	formatted := func(names []string) string {
+		quoted := make([]string, len(names))
+		for i, name := range names {
+			quoted[i] = fmt.Sprintf("`%s`", name)
+		}
+		return strings.Join(quoted, ", ")
+	}
+	expected := "none"
+	if len(known) > 0 {
+		expected = "any of " + formatted(known)
+	}
+	msg := fmt.Sprintf(
+		"input %s field `%s` has constraints which service `%s` doesn't use: %s (expected %s)",
+		entity,
+		field,
+		service,
+		formatted(keys),
+		expected,
+	)
+	return &httpError{msg, http.StatusBadRequest}
+}
+
+func wrongFieldType(entity string, field string, expected string, got string) error {
+	msg := fmt.Sprintf("input %s field `%s` must be %s, not %s", entity, field, expected, got)
+	return &httpError{msg, http.StatusBadRequest}
+}
+
+// Error codes returned in the `error_code` field of error responses. These
+// are part of the API: add new ones, but don't change existing ones.
+const (
+	// generic codes, used for each HTTP status when nothing more specific
+	// applies
+	ErrorCodeBadRequest   = "bad_request"
+	ErrorCodeUnauthorized = "unauthorized"
+	ErrorCodeForbidden    = "forbidden"
+	ErrorCodeNotFound     = "not_found"
+	ErrorCodeConflict     = "conflict"
+	ErrorCodeInternal     = "internal_error"
+
+	ErrorCodeMissingToken = "missing_token"
+	ErrorCodeInvalidToken = "invalid_token"
+
+	ErrorCodeClientNotFound     = "client_not_found"
+	ErrorCodeGroupNotFound      = "group_not_found"
+	ErrorCodePermissionNotFound = "permission_not_found"
+	ErrorCodePolicyNotFound     = "policy_not_found"
+	ErrorCodeResourceNotFound   = "resource_not_found"
+	ErrorCodeRoleNotFound       = "role_not_found"
+	ErrorCodeServiceNotFound    = "service_not_found"
+	ErrorCodeUserNotFound       = "user_not_found"
+
+	ErrorCodeClientExists   = "client_exists"
+	ErrorCodeGroupExists    = "group_exists"
+	ErrorCodePolicyExists   = "policy_exists"
+	ErrorCodeResourceExists = "resource_exists"
+	ErrorCodeRoleExists     = "role_exists"
+	ErrorCodeUserExists     = "user_exists"
+
+	ErrorCodeBodyTooLarge = "body_too_large"
+	ErrorCodeRateLimited  = "rate_limited"
+
+	ErrorCodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	ErrorCodeIdempotencyKeyReused = "idempotency_key_reused"
+)
+
+// defaultErrorCode is the generic error code for an HTTP status.
+func defaultErrorCode(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrorCodeUnauthorized
+	case status == http.StatusForbidden:
+		return ErrorCodeForbidden
+	case status == http.StatusNotFound:
+		return ErrorCodeNotFound
+	case status == http.StatusConflict:
+		return ErrorCodeConflict
+	case status >= 500:
+		return ErrorCodeInternal
+	default:
+		return ErrorCodeBadRequest
+	}
+}
@@ -0,0 +1,205 @@
+package arborist
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// AuthExplanation is added to a denied `/auth/request` response with
+// `?explain=true`, to show why the request was denied: the permissions which
+// were considered for it, and which parts of each didn't match.
+type AuthExplanation struct {
+	Request ExplainedRequest `json:"request"`
+	// DeniedBy is which check refused the request: `user`, `client` or
+	// `anonymous`.
+	DeniedBy    string                `json:"denied_by"`
+	Permissions []ExplainedPermission `json:"permissions"`
+}
+
+// ExplainedRequest is the request which was denied.
+type ExplainedRequest struct {
+	Resource    string      `json:"resource"`
+	Action      Action      `json:"action"`
+	Constraints Constraints `json:"constraints,omitempty"`
+	Context     AuthContext `json:"context,omitempty"`
+}
+
+// ExplainedPermission is a permission, in a role in one of the policies
+// checked, which applies either to the requested resource or to the
+// requested action. Only a permission matching all three of the resource,
+// action and constraints would allow the request, if its policy's effect is
+// `allow`; if its effect is `deny` it is what refused the request.
+type ExplainedPermission struct {
+	Policy           string      `json:"policy"`
+	Effect           string      `json:"effect"`
+	ResourcePath     string      `json:"resource_path"`
+	Role             string      `json:"role"`
+	Permission       string      `json:"permission"`
+	Action           Action      `json:"action"`
+	Constraints      Constraints `json:"constraints"`
+	ResourceMatches  bool        `json:"resource_matches"`
+	ActionMatches    bool        `json:"action_matches"`
+	ConstraintsMatch bool        `json:"constraints_match"`
+}
+
+type explainedPermissionFromQuery struct {
+	Policy           string `db:"policy"`
+	Effect           string `db:"effect"`
+	ResourcePath     string `db:"resource_path"`
+	Role             string `db:"role"`
+	Permission       string `db:"permission"`
+	Service          string `db:"service"`
+	Method           string `db:"method"`
+	Constraints      []byte `db:"constraints"`
+	ResourceMatches  bool   `db:"resource_matches"`
+	ActionMatches    bool   `db:"action_matches"`
+	ConstraintsMatch bool   `db:"constraints_match"`
+}
+
+func (permissionFromQuery *explainedPermissionFromQuery) standardize() ExplainedPermission {
+	permission := ExplainedPermission{
+		Policy:       permissionFromQuery.Policy,
+		Effect:       permissionFromQuery.Effect,
+		ResourcePath: formatDbPath(permissionFromQuery.ResourcePath),
+		Role:         permissionFromQuery.Role,
+		Permission:   permissionFromQuery.Permission,
+		Action: Action{
+			Service: permissionFromQuery.Service,
+			Method:  permissionFromQuery.Method,
+		},
+		Constraints:      Constraints{},
+		ResourceMatches:  permissionFromQuery.ResourceMatches,
+		ActionMatches:    permissionFromQuery.ActionMatches,
+		ConstraintsMatch: permissionFromQuery.ConstraintsMatch,
+	}
+	// constraints which aren't an object of strings count as none, as in
+	// `constraintsMatch`
+	_ = json.Unmarshal(permissionFromQuery.Constraints, &permission.Constraints)
+	return permission
+}
+
+// AuthCheckAnonymous is the `DeniedBy` of an explanation for a request
+// without a user or client, which is checked against the `anonymous` group.
+const AuthCheckAnonymous = "anonymous"
+
+// explainPolicies returns a query for the policies the check `deniedBy`
+// looks at, as in `authorizeUser`, `authorizeClient` and
+// `authorizeAnonymous`, and its arguments, which are numbered from `$7`.
+func explainPolicies(request *AuthRequest, deniedBy string) (string, []interface{}) {
+	switch deniedBy {
+	case AuthCheckClient:
+		stmt := `
+			SELECT client_policy.policy_id FROM client
+			JOIN client_policy ON client_policy.client_id = client.id
+			WHERE client.external_client_id = $7
+		`
+		return stmt, []interface{}{request.ClientID}
+	case AuthCheckAnonymous:
+		stmt := `
+			SELECT grp_policy.policy_id FROM grp
+			INNER JOIN grp_policy ON grp_policy.grp_id = grp.id
+			WHERE grp.name = $7
+		`
+		return stmt, []interface{}{AnonymousGroup}
+	default:
+		stmt := `
+			SELECT usr_policy.policy_id FROM usr
+			INNER JOIN usr_policy ON usr_policy.usr_id = usr.id
+			WHERE usr.name = $7 AND (usr_policy.expires_at IS NULL OR $10 < usr_policy.expires_at)
+			UNION
+			SELECT grp_policy.policy_id FROM usr
+			INNER JOIN usr_grp ON usr_grp.usr_id = usr.id
+			INNER JOIN grp_policy ON grp_policy.grp_id = usr_grp.grp_id
+			WHERE usr.name = $7 AND (usr_grp.expires_at IS NULL OR $10 < usr_grp.expires_at)
+			UNION
+			SELECT grp_policy.policy_id FROM grp
+			INNER JOIN grp_policy ON grp_policy.grp_id = grp.id
+			WHERE grp.name IN ($8, $9)
+		`
+		return stmt, []interface{}{request.Username, AnonymousGroup, LoggedInGroup, request.now}
+	}
+}
+
+// explainAuthRequest lists the permissions the check `deniedBy` considered
+// for `request`: every permission, from a policy the user, client or
+// anonymous group has, which applies to the requested resource or action.
+func explainAuthRequest(db *sqlx.DB, request *AuthRequest, deniedBy string) (*AuthExplanation, error) {
+	explanation := &AuthExplanation{
+		Request: ExplainedRequest{
+			Resource:    request.Resource,
+			Action:      Action{Service: request.Service, Method: request.Method},
+			Constraints: request.Constraints,
+			Context:     request.Context,
+		},
+		DeniedBy:    deniedBy,
+		Permissions: []ExplainedPermission{},
+	}
+	constraints, err := attributesJSON(request)
+	if err != nil {
+		return nil, err
+	}
+	resource := ""
+	if strings.HasPrefix(request.Resource, "/") {
+		resource = FormatPathForDb(request.Resource)
+	} else {
+		var paths []string
+		err = db.Select(&paths, "SELECT ltree2text(path) FROM resource WHERE tag = $1", request.Resource)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) > 0 {
+			resource = paths[0]
+		}
+	}
+	// token policies narrow the allow policies users and anonymous requests
+	// have, but not clients, and never the deny policies
+	allPolicies := len(request.Policies) == 0 || deniedBy == AuthCheckClient
+	policiesStmt, policiesArgs := explainPolicies(request, deniedBy)
+	stmt := `
+		SELECT * FROM (
+			SELECT
+				policy.name AS policy,
+				policy.effect AS effect,
+				ltree2text(resource.path) AS resource_path,
+				role.name AS role,
+				permission.name AS permission,
+				permission.service AS service,
+				permission.method AS method,
+				permission.constraints AS constraints,
+				coalesce(text2ltree(nullif($5, '')) ~ ` + resourcePathLquery + `, FALSE) AS resource_matches,
+				(permission.service = $1 OR permission.service = '*')
+					AND (permission.method = $2 OR permission.method = '*') AS action_matches,
+				` + constraintsMatch("$6") + ` AS constraints_match
+			FROM (` + policiesStmt + `) AS policies
+			JOIN policy ON policy.id = policies.policy_id
+			JOIN policy_resource ON policy_resource.policy_id = policy.id
+			JOIN resource ON resource.id = policy_resource.resource_id
+			JOIN policy_role ON policy_role.policy_id = policy.id
+			JOIN role ON role.id = policy_role.role_id
+			JOIN permission ON permission.role_id = role.id
+			WHERE $3 OR policy.name = ANY($4) OR policy.effect = 'deny'
+		) AS considered
+		WHERE resource_matches OR action_matches
+		ORDER BY policy, resource_path, role, permission
+	`
+	permissionsFromQuery := []explainedPermissionFromQuery{}
+	args := []interface{}{
+		request.Service,            // $1
+		request.Method,             // $2
+		allPolicies,                // $3
+		pq.Array(request.Policies), // $4
+		resource,                   // $5
+		constraints,                // $6
+	}
+	err = db.Select(&permissionsFromQuery, stmt, append(args, policiesArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	for _, permissionFromQuery := range permissionsFromQuery {
+		explanation.Permissions = append(explanation.Permissions, permissionFromQuery.standardize())
+	}
+	return explanation, nil
+}
@@ -144,7 +144,7 @@ func (group *Group) createInDb(tx *sqlx.Tx, authzProvider sql.NullString) *Error
 		// this should only fail because the group was not unique. return error
 		// accordingly
 		msg := fmt.Sprintf("failed to insert group: group with this name already exists: %s", group.Name)
-		return newErrorResponse(msg, 409, &err)
+		return newErrorResponse(msg, 409, &err).withCode(ErrorCodeGroupExists)
 	}
 
 	return group.attachUsrAndPolicy(tx, groupID, authzProvider)
@@ -273,7 +273,7 @@ func grantGroupPolicy(db *sqlx.DB, groupName string, policyName string, authzPro
 				"failed to grant policy to group: group does not exist: %s",
 				groupName,
 			)
-			return newErrorResponse(msg, 404, nil)
+			return newErrorResponse(msg, 404, nil).withCode(ErrorCodeGroupNotFound)
 		}
 		if err != nil {
 			msg := "group query failed"
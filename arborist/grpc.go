@@ -0,0 +1,169 @@
+package arborist
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/uc-cdis/arborist/arborist/arboristpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcAuthorizeMethod is the full name of the one gRPC method arborist
+// serves, which is also the endpoint its audit records name.
+const grpcAuthorizeMethod = "/arborist.Authorization/Authorize"
+
+// grpcAuthorizationServer serves the `Authorization` service of
+// `arboristpb/arborist.proto` for the server.
+type grpcAuthorizationServer struct {
+	arboristpb.UnimplementedAuthorizationServer
+	server *Server
+}
+
+func (service *grpcAuthorizationServer) Authorize(ctx context.Context, request *arboristpb.AuthRequest) (*arboristpb.AuthResponse, error) {
+	return service.server.grpcAuthorize(ctx, request)
+}
+
+// grpcAuthorize checks an `Authorize` call the same way as `/auth/proxy`:
+// the token's user and client must both be allowed the action on the
+// resource. A denied request is a response with `auth` false rather than an
+// error; errors use the gRPC code closest to the HTTP status arborist would
+// have responded with (see `grpcStatus`).
+func (server *Server) grpcAuthorize(ctx context.Context, request *arboristpb.AuthRequest) (*arboristpb.AuthResponse, error) {
+	errResponse, _ := server.rateLimited(request.Token, grpcPeerHost(ctx))
+	var response *arboristpb.AuthResponse
+	if errResponse == nil {
+		response, errResponse = server.grpcDecide(ctx, request)
+	}
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(ctx))
+		return nil, errResponse.grpcStatus()
+	}
+	return response, nil
+}
+
+func (server *Server) grpcDecide(ctx context.Context, request *arboristpb.AuthRequest) (*arboristpb.AuthResponse, *ErrorResponse) {
+	if request.Token == "" {
+		msg := "auth request missing token"
+		return nil, newErrorResponse(msg, 401, nil).withCode(ErrorCodeMissingToken)
+	}
+	if request.Resource == "" || request.Service == "" || request.Method == "" {
+		msg := "auth request missing `resource`, `service` or `method`"
+		return nil, newErrorResponse(msg, 400, nil)
+	}
+	info, err := server.decodeToken(request.Token, server.expectedAudiences())
+	if err != nil {
+		return nil, newErrorResponse(err.Error(), 401, &err).withCode(ErrorCodeInvalidToken)
+	}
+	authRequest := &AuthRequest{
+		Username:    info.username,
+		ClientID:    info.clientID,
+		Policies:    info.policies,
+		Resource:    request.Resource,
+		Service:     request.Service,
+		Method:      request.Method,
+		Constraints: request.Constraints,
+		stmts:       server.stmts,
+		now:         server.clock(),
+	}
+	decision, errResponse := server.decide(ctx, authRequest)
+	if errResponse != nil {
+		return nil, errResponse
+	}
+	server.metrics.recordDecision(decision.Auth)
+	server.auditDecision(grpcAuthorizeMethod, authRequest, decision)
+	return &arboristpb.AuthResponse{
+		Auth:     decision.Auth,
+		PolicyId: decision.PolicyID,
+		RoleId:   decision.RoleID,
+	}, nil
+}
+
+// grpcStatus is the error as a gRPC status, with the code closest to its
+// HTTP status.
+func (errorResponse *ErrorResponse) grpcStatus() error {
+	code := codes.Internal
+	switch errorResponse.HTTPError.Code {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, errorResponse.HTTPError.Message)
+}
+
+// grpcPeerHost is the address a gRPC call came from, without the port.
+func grpcPeerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// newGRPCServer makes the gRPC server for `WithGRPC`, over TLS if the server
+// has a config from `WithTLS`. Besides `Authorize`, it serves the standard
+// gRPC health service.
+func (server *Server) newGRPCServer() *grpc.Server {
+	options := []grpc.ServerOption{}
+	if server.tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(server.tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(options...)
+	arboristpb.RegisterAuthorizationServer(grpcServer, &grpcAuthorizationServer{server: server})
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	return grpcServer
+}
+
+// serveGRPC serves `grpcServer` on `listener` until it is stopped, logging
+// why if it stops for any other reason.
+func (server *Server) serveGRPC(grpcServer *grpc.Server, listener net.Listener) {
+	server.logger.Info("arborist serving gRPC at %s", listener.Addr())
+	err := grpcServer.Serve(listener)
+	if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		server.logger.Error("gRPC server stopped: %s", err.Error())
+	}
+}
+
+// stopGRPC stops the gRPC server started by `Run`, if any, letting calls in
+// progress finish unless `ctx` is done first.
+func (server *Server) stopGRPC(ctx context.Context) {
+	server.httpServerMu.Lock()
+	grpcServer := server.grpcServer
+	server.httpServerMu.Unlock()
+	if grpcServer == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+		<-stopped
+	}
+}
@@ -0,0 +1,133 @@
+package arborist
+
+import (
+	"context"
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uc-cdis/arborist/arborist/arboristpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCAuthorize(t *testing.T) {
+	private, public := newSigningKey(t, "key")
+	jwks := &jwksServer{}
+	jwks.setKeys(public)
+	keys := httptest.NewServer(jwks)
+	defer keys.Close()
+	userToken := func(private *rsa.PrivateKey, name string) string {
+		return signToken(t, private, "key", map[string]interface{}{
+			"scope":   []string{"openid"},
+			"exp":     time.Now().Add(time.Hour).Unix(),
+			"context": map[string]interface{}{"user": map[string]interface{}{"name": name}},
+		})
+	}
+
+	server := NewServer().
+		WithLogger(log.New(ioutil.Discard, "", 0)).
+		WithJWTApp(NewJWTApplication(keys.URL)).
+		WithDecisionCacheTTL(time.Hour)
+	// there's no database here, so the decisions are put in the cache
+	decided := func(username string, resource string, decision AuthDecision) {
+		request := &AuthRequest{
+			Username: username,
+			Resource: resource,
+			Service:  "peregrine",
+			Method:   "read",
+		}
+		server.decisionCache.add(request, &decision, 0, server.clock())
+	}
+	decided("allowed", "/programs/a", AuthDecision{Auth: true, PolicyID: "programs", RoleID: "reader"})
+	decided("denied", "/programs/a", AuthDecision{Auth: false, DeniedBy: AuthCheckUser})
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := server.newGRPCServer()
+	go server.serveGRPC(grpcServer, listener)
+	defer grpcServer.Stop()
+	conn, err := grpc.DialContext(
+		context.Background(),
+		"bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := arboristpb.NewAuthorizationClient(conn)
+	authorize := func(request *arboristpb.AuthRequest) (*arboristpb.AuthResponse, error) {
+		return client.Authorize(context.Background(), request)
+	}
+	check := func(token string) *arboristpb.AuthRequest {
+		return &arboristpb.AuthRequest{
+			Token:    token,
+			Resource: "/programs/a",
+			Service:  "peregrine",
+			Method:   "read",
+		}
+	}
+
+	t.Run("Allowed", func(t *testing.T) {
+		response, err := authorize(check(userToken(private, "allowed")))
+		if assert.NoError(t, err) {
+			assert.True(t, response.Auth)
+			assert.Equal(t, "programs", response.PolicyId)
+			assert.Equal(t, "reader", response.RoleId)
+		}
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		response, err := authorize(check(userToken(private, "denied")))
+		if assert.NoError(t, err) {
+			assert.False(t, response.Auth)
+			assert.Equal(t, "", response.PolicyId)
+		}
+	})
+
+	t.Run("MissingToken", func(t *testing.T) {
+		_, err := authorize(check(""))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), err)
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		forger, _ := newSigningKey(t, "key")
+		_, err := authorize(check(userToken(forger, "allowed")))
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), err)
+	})
+
+	t.Run("MissingMethod", func(t *testing.T) {
+		request := check(userToken(private, "allowed"))
+		request.Method = ""
+		_, err := authorize(request)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), err)
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		response, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if assert.NoError(t, err) {
+			assert.Equal(t, healthpb.HealthCheckResponse_SERVING, response.Status)
+		}
+	})
+
+	t.Run("RateLimited", func(t *testing.T) {
+		server.WithRateLimit(1, 1)
+		defer server.WithRateLimit(0, 0)
+		token := userToken(private, "allowed")
+		_, err := authorize(check(token))
+		assert.NoError(t, err)
+		_, err = authorize(check(token))
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err), err)
+	})
+}
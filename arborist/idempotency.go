@@ -0,0 +1,267 @@
+package arborist
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader lets clients retry a create safely: the first request
+// with a key runs as usual and its response is stored, and later requests
+// with the same key get that response back instead of running again.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyReplayedHeader is set on responses which were replayed for a
+// repeated idempotency key.
+const idempotencyReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength bounds the keys accepted from callers, since they
+// are held in memory until they expire.
+const maxIdempotencyKeyLength = 255
+
+// idempotencyMaxKeys is how many keys are stored at once; past that the
+// oldest are dropped early.
+const idempotencyMaxKeys = 10000
+
+// DefaultIdempotencyTTL is how long idempotency keys are kept, unless
+// changed with `WithIdempotencyTTL`.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyStore holds the responses to requests which had an idempotency
+// key, until they expire. Keys are kept in memory, so a retry only gets the
+// stored response if it reaches the same arborist instance.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*list.Element
+	// order has the oldest entries at the front; since they all live for the
+	// same TTL, these also expire first
+	order *list.List
+}
+
+type idempotencyEntry struct {
+	key string
+	// fingerprint is a hash of the method, URL and body of the request
+	// which first used the key, so the key can't be reused for another one
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	// response is nil while the first request is still running
+	response *storedResponse
+}
+
+type storedResponse struct {
+	code   int
+	header http.Header
+	body   []byte
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// start looks up `key`. If the key is new, it is stored as in progress and
+// `start` returns true; the caller must then `finish` or `abandon` it.
+// Otherwise it returns a copy of the existing entry and false.
+func (store *idempotencyStore) start(key string, fingerprint [sha256.Size]byte, now time.Time) (idempotencyEntry, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.prune(now)
+	if element, exists := store.entries[key]; exists {
+		return *element.Value.(*idempotencyEntry), false
+	}
+	for store.order.Len() >= idempotencyMaxKeys {
+		oldest := store.order.Front()
+		store.order.Remove(oldest)
+		delete(store.entries, oldest.Value.(*idempotencyEntry).key)
+	}
+	entry := &idempotencyEntry{
+		key:         key,
+		fingerprint: fingerprint,
+		expires:     now.Add(store.ttl),
+	}
+	store.entries[key] = store.order.PushBack(entry)
+	return idempotencyEntry{}, true
+}
+
+// finish stores the response to the first request with `key`.
+func (store *idempotencyStore) finish(key string, response *storedResponse) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if element, exists := store.entries[key]; exists {
+		element.Value.(*idempotencyEntry).response = response
+	}
+}
+
+// abandon forgets `key` without storing a response, so that a retry runs the
+// request again.
+func (store *idempotencyStore) abandon(key string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if element, exists := store.entries[key]; exists {
+		store.order.Remove(element)
+		delete(store.entries, key)
+	}
+}
+
+// prune drops the entries which have expired by `now`. The caller must hold
+// the lock.
+func (store *idempotencyStore) prune(now time.Time) {
+	for store.order.Len() > 0 {
+		oldest := store.order.Front()
+		entry := oldest.Value.(*idempotencyEntry)
+		if now.Before(entry.expires) {
+			return
+		}
+		store.order.Remove(oldest)
+		delete(store.entries, entry.key)
+	}
+}
+
+// recordingWriter passes a response through, keeping a copy to store.
+type recordingWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// idempotent wraps the handler for a create endpoint, so that POST requests
+// with an `Idempotency-Key` header run once: repeating the key replays the
+// first response. Reusing a key for a different request is a 422, and
+// repeating it while the first request is still running is a 409. Server
+// errors and dry runs aren't stored, so the request can be retried, or
+// really made, with the same key.
+func (server *Server) idempotent(baseHandler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if server.idempotency == nil || r.Method != "POST" || key == "" {
+			baseHandler(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			msg := fmt.Sprintf("%s header is longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+			errResponse := newErrorResponse(msg, 400, nil)
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
+
+		// read the body to fingerprint the request, and put it back for the
+		// handler; reading one byte past the limit still lets the handler
+		// reject a body which is too large
+		var body []byte
+		if r.Body != nil {
+			var reader io.Reader = r.Body
+			if server.maxBodyBytes > 0 {
+				reader = io.LimitReader(r.Body, server.maxBodyBytes+1)
+			}
+			var err error
+			body, err = ioutil.ReadAll(reader)
+			if err != nil {
+				msg := fmt.Sprintf("could not read request body: %s", err.Error())
+				errResponse := newErrorResponse(msg, 400, nil)
+				errResponse.log.write(server.requestLogger(r.Context()))
+				_ = errResponse.write(w, r)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		fingerprint := sha256.Sum256([]byte(r.Method + " " + r.URL.RequestURI() + "\n" + string(body)))
+
+		entry, isNew := server.idempotency.start(key, fingerprint, server.clock())
+		if !isNew {
+			var errResponse *ErrorResponse
+			if entry.fingerprint != fingerprint {
+				msg := fmt.Sprintf("%s `%s` was already used for a different request", idempotencyKeyHeader, key)
+				errResponse = newErrorResponse(msg, http.StatusUnprocessableEntity, nil).withCode(ErrorCodeIdempotencyKeyReused)
+			} else if entry.response == nil {
+				msg := fmt.Sprintf("a request with %s `%s` is still in progress", idempotencyKeyHeader, key)
+				errResponse = newErrorResponse(msg, http.StatusConflict, nil).withCode(ErrorCodeIdempotencyKeyInUse)
+			}
+			if errResponse != nil {
+				errResponse.log.write(server.requestLogger(r.Context()))
+				_ = errResponse.write(w, r)
+				return
+			}
+			for name, values := range entry.response.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			w.WriteHeader(entry.response.code)
+			_, _ = w.Write(entry.response.body)
+			return
+		}
+
+		// only the headers from the handler are stored, not those set for
+		// this particular request, like the request ID
+		headerBefore := w.Header().Clone()
+		recorder := &recordingWriter{ResponseWriter: w}
+		stored := false
+		defer func() {
+			if !stored {
+				server.idempotency.abandon(key)
+			}
+		}()
+		baseHandler(recorder, r)
+		if recorder.code == 0 || recorder.code >= 500 {
+			return
+		}
+		if dryRun, _ := dryRunFlag(r); dryRun {
+			return
+		}
+		server.idempotency.finish(key, &storedResponse{
+			code:   recorder.code,
+			header: headerChanges(headerBefore, w.Header()),
+			body:   recorder.body.Bytes(),
+		})
+		stored = true
+	}
+}
+
+// headerChanges returns the headers in `after` which aren't the same in
+// `before`.
+func headerChanges(before http.Header, after http.Header) http.Header {
+	changes := http.Header{}
+	for name, values := range after {
+		if !sameValues(before[name], values) {
+			changes[name] = append([]string{}, values...)
+		}
+	}
+	return changes
+}
+
+func sameValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package arborist
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotent(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := NewServer().
+		WithLogger(log.New(&bytes.Buffer{}, "", 0)).
+		WithClock(func() time.Time { return now }).
+		WithIdempotencyTTL(time.Hour)
+
+	// the handler creates a numbered entity each time it runs, so a repeated
+	// run shows up as a different response
+	calls := 0
+	status := http.StatusCreated
+	handler := server.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte{byte('0' + calls)})
+	})
+	postTo := func(target string, key string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", target, bytes.NewBufferString(body))
+		if key != "" {
+			r.Header.Set(idempotencyKeyHeader, key)
+		}
+		handler(w, r)
+		return w
+	}
+	post := func(key string, body string) *httptest.ResponseRecorder {
+		return postTo("/policy", key, body)
+	}
+
+	t.Run("Replays", func(t *testing.T) {
+		calls = 0
+		first := post("replays", `{"id": "p"}`)
+		second := post("replays", `{"id": "p"}`)
+		assert.Equal(t, 1, calls, "handler should run once")
+		assert.Equal(t, http.StatusCreated, second.Code)
+		assert.Equal(t, first.Body.String(), second.Body.String())
+		assert.Equal(t, "application/json", second.Header().Get("Content-Type"))
+		assert.Equal(t, "", first.Header().Get(idempotencyReplayedHeader))
+		assert.Equal(t, "true", second.Header().Get(idempotencyReplayedHeader))
+	})
+
+	t.Run("NoKey", func(t *testing.T) {
+		calls = 0
+		post("", `{"id": "p"}`)
+		post("", `{"id": "p"}`)
+		assert.Equal(t, 2, calls, "handler should run every time without a key")
+	})
+
+	t.Run("DifferentRequest", func(t *testing.T) {
+		calls = 0
+		post("different", `{"id": "p"}`)
+		w := post("different", `{"id": "q"}`)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), ErrorCodeIdempotencyKeyReused)
+	})
+
+	t.Run("DifferentQuery", func(t *testing.T) {
+		calls = 0
+		postTo("/resource/a?p", "query", `{"name": "b"}`)
+		w := postTo("/resource/a", "query", `{"name": "b"}`)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), ErrorCodeIdempotencyKeyReused)
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		calls = 0
+		status = http.StatusOK
+		postTo("/policy?dry_run=true", "dry-run", `{"id": "p"}`)
+		status = http.StatusCreated
+		w := post("dry-run", `{"id": "p"}`)
+		assert.Equal(t, 2, calls, "dry runs should not be stored")
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "", w.Header().Get(idempotencyReplayedHeader))
+	})
+
+	t.Run("ServerError", func(t *testing.T) {
+		calls = 0
+		status = http.StatusInternalServerError
+		post("error", `{"id": "p"}`)
+		status = http.StatusCreated
+		w := post("error", `{"id": "p"}`)
+		assert.Equal(t, 2, calls, "server errors should not be stored")
+		assert.Equal(t, http.StatusCreated, w.Code)
+	})
+
+	t.Run("Expires", func(t *testing.T) {
+		calls = 0
+		post("expires", `{"id": "p"}`)
+		now = now.Add(time.Hour)
+		post("expires", `{"id": "p"}`)
+		assert.Equal(t, 2, calls, "expired keys should run again")
+	})
+
+	t.Run("InProgress", func(t *testing.T) {
+		var inner *httptest.ResponseRecorder
+		blocking := server.idempotent(func(w http.ResponseWriter, r *http.Request) {
+			inner = post("progress", `{"id": "p"}`)
+			w.WriteHeader(http.StatusCreated)
+		})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/policy", bytes.NewBufferString(`{"id": "p"}`))
+		r.Header.Set(idempotencyKeyHeader, "progress")
+		blocking(w, r)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, http.StatusConflict, inner.Code)
+		assert.Contains(t, inner.Body.String(), ErrorCodeIdempotencyKeyInUse)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		calls = 0
+		server.WithIdempotencyTTL(0)
+		defer server.WithIdempotencyTTL(time.Hour)
+		post("disabled", `{"id": "p"}`)
+		post("disabled", `{"id": "p"}`)
+		assert.Equal(t, 2, calls, "keys should be ignored when turned off")
+	})
+}
@@ -0,0 +1,91 @@
+package arborist
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the prometheus collectors exported on `/metrics`. Each server
+// has its own registry, so that several servers (in tests) don't collide.
+type metrics struct {
+	registry  *prometheus.Registry
+	requests  *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+	decisions *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "arborist_http_requests_total",
+				Help: "Number of HTTP requests handled, by route, method and status code.",
+			},
+			[]string{"route", "method", "code"},
+		),
+		latency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "arborist_http_request_duration_seconds",
+				Help:    "Time taken to handle HTTP requests, by route and method.",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"route", "method"},
+		),
+		decisions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "arborist_auth_decisions_total",
+				Help: "Number of authorization decisions, by decision (allow or deny).",
+			},
+			[]string{"decision"},
+		),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.latency,
+		m.decisions,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	// export both labels from the start, so rates work before the first deny
+	m.decisions.WithLabelValues("allow")
+	m.decisions.WithLabelValues("deny")
+	return m
+}
+
+// handler serves the metrics in the prometheus text format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// middleware records the count and latency of requests to each route. The
+// route is labelled with its template (like `/user/{username}`) rather than
+// the actual path, to keep the number of series bounded.
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		captured := httpsnoop.CaptureMetrics(next, w, r)
+		code := strconv.Itoa(captured.Code)
+		m.requests.WithLabelValues(route, r.Method, code).Inc()
+		m.latency.WithLabelValues(route, r.Method).Observe(captured.Duration.Seconds())
+	})
+}
+
+// recordDecision counts the result of one authorization check.
+func (m *metrics) recordDecision(allowed bool) {
+	if allowed {
+		m.decisions.WithLabelValues("allow").Inc()
+	} else {
+		m.decisions.WithLabelValues("deny").Inc()
+	}
+}
@@ -0,0 +1,43 @@
+package arborist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	router := mux.NewRouter()
+	router.HandleFunc("/user/{username}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	router.Handle("/metrics", m.handler())
+	router.Use(m.middleware)
+
+	for _, username := range []string{"a", "b"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/user/"+username, nil))
+	}
+	// labelled by route template, not by path
+	requests := m.requests.WithLabelValues("/user/{username}", "GET", "404")
+	assert.Equal(t, float64(2), testutil.ToFloat64(requests))
+
+	m.recordDecision(true)
+	m.recordDecision(false)
+	m.recordDecision(false)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.decisions.WithLabelValues("allow")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.decisions.WithLabelValues("deny")))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.True(t, strings.Contains(body, `arborist_auth_decisions_total{decision="deny"} 2`), body)
+	assert.True(t, strings.Contains(body, "arborist_http_request_duration_seconds_bucket"), body)
+}
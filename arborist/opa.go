@@ -0,0 +1,182 @@
+package arborist
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// opaRoot is the path under `data` where Open Policy Agent finds the model
+// from the `/bundle` endpoint, as `data.arborist.policies` and so on.
+const opaRoot = "arborist"
+
+// opaData is the authorization model as an OPA data document. Everything is
+// keyed by ID (by path, for resources) so that policies can look things up
+// directly.
+type opaData struct {
+	Policies  map[string]opaPolicy   `json:"policies"`
+	Roles     map[string]opaRole     `json:"roles"`
+	Resources map[string]opaResource `json:"resources"`
+}
+
+type opaPolicy struct {
+	Description   string   `json:"description"`
+	ResourcePaths []string `json:"resource_paths"`
+	RoleIDs       []string `json:"role_ids"`
+	Effect        string   `json:"effect"`
+}
+
+type opaRole struct {
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+}
+
+type opaResource struct {
+	Tag          string   `json:"tag"`
+	Description  string   `json:"description"`
+	Subresources []string `json:"subresources"`
+}
+
+func opaDataFromDb(db *sqlx.DB) (*opaData, error) {
+	policiesFromQuery, err := listPoliciesFromDb(db, PolicyListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rolesFromQuery, err := listRolesFromDb(db, RoleListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	resourcesFromQuery, err := listResourcesFromDb(db, nil)
+	if err != nil {
+		return nil, err
+	}
+	data := &opaData{
+		Policies:  make(map[string]opaPolicy, len(policiesFromQuery)),
+		Roles:     make(map[string]opaRole, len(rolesFromQuery)),
+		Resources: make(map[string]opaResource, len(resourcesFromQuery)),
+	}
+	for _, policyFromQuery := range policiesFromQuery {
+		policy := policyFromQuery.standardize()
+		effect := policy.Effect
+		if effect == "" {
+			effect = PolicyEffectAllow
+		}
+		data.Policies[policy.Name] = opaPolicy{
+			Description:   policy.Description,
+			ResourcePaths: policy.ResourcePaths,
+			RoleIDs:       policy.RoleIDs,
+			Effect:        effect,
+		}
+	}
+	for _, roleFromQuery := range rolesFromQuery {
+		role := roleFromQuery.standardize()
+		data.Roles[role.Name] = opaRole{
+			Description: role.Description,
+			Permissions: role.Permissions,
+		}
+	}
+	for _, resourceFromQuery := range resourcesFromQuery {
+		resource := resourceFromQuery.standardize()
+		data.Resources[resource.Path] = opaResource{
+			Tag:          resource.Tag,
+			Description:  resource.Description,
+			Subresources: resource.Subresources,
+		}
+	}
+	return data, nil
+}
+
+// opaBundle packs the data into an OPA bundle: a gzipped tarball with the
+// data in `data.json` and a `.manifest`. It also returns the bundle's
+// revision, a hash of the data, which is the same for the same model.
+func opaBundle(data *opaData) ([]byte, string, error) {
+	dataJSON, err := json.Marshal(map[string]interface{}{opaRoot: data})
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(dataJSON)
+	revision := hex.EncodeToString(sum[:])
+	manifest, err := json.Marshal(map[string]interface{}{
+		"revision": revision,
+		"roots":    []string{opaRoot},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	buf := &bytes.Buffer{}
+	zipped := gzip.NewWriter(buf)
+	archive := tar.NewWriter(zipped)
+	files := []struct {
+		name     string
+		contents []byte
+	}{
+		{"/data.json", dataJSON},
+		{"/.manifest", manifest},
+	}
+	for _, file := range files {
+		header := &tar.Header{
+			Name:     file.name,
+			Mode:     0644,
+			Size:     int64(len(file.contents)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return nil, "", err
+		}
+		if _, err := archive.Write(file.contents); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, "", err
+	}
+	if err := zipped.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), revision, nil
+}
+
+// handleOPABundle serves the whole authorization model as an OPA bundle, for
+// OPA to poll as a bundle source. The ETag is the bundle revision, so OPA's
+// conditional requests get a 304 until the model changes.
+func (server *Server) handleOPABundle(w http.ResponseWriter, r *http.Request) {
+	var data *opaData
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "opaDataFromDb")
+		data, err = opaDataFromDb(server.db)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("bundle query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	bundle, revision, err := opaBundle(data)
+	if err != nil {
+		msg := fmt.Sprintf("couldn't build bundle: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, &err)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	etag := `"` + revision + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(bundle)
+}
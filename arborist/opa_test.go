@@ -0,0 +1,141 @@
+package arborist
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readBundle unpacks the files in a gzipped tarball.
+func readBundle(t *testing.T, bundle []byte) map[string][]byte {
+	zipped, err := gzip.NewReader(bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(zipped)
+	files := map[string][]byte{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = contents
+	}
+	return files
+}
+
+func TestOPABundle(t *testing.T) {
+	data := &opaData{
+		Policies: map[string]opaPolicy{
+			"reader": {
+				ResourcePaths: []string{"/programs/a"},
+				RoleIDs:       []string{"read"},
+				Effect:        PolicyEffectAllow,
+			},
+		},
+		Roles: map[string]opaRole{
+			"read": {
+				Permissions: []Permission{
+					{
+						Name:        "read",
+						Action:      Action{Service: "peregrine", Method: "read"},
+						Constraints: Constraints{},
+					},
+				},
+			},
+		},
+		Resources: map[string]opaResource{
+			"/programs":   {Tag: "ABCD", Subresources: []string{"/programs/a"}},
+			"/programs/a": {Tag: "EFGH", Subresources: []string{}},
+		},
+	}
+	bundle, revision, err := opaBundle(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readBundle(t, bundle)
+	if !assert.Contains(t, files, "/data.json") || !assert.Contains(t, files, "/.manifest") {
+		return
+	}
+
+	manifest := struct {
+		Revision string   `json:"revision"`
+		Roots    []string `json:"roots"`
+	}{}
+	err = json.Unmarshal(files["/.manifest"], &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, revision, manifest.Revision)
+	assert.Equal(t, []string{"arborist"}, manifest.Roots)
+
+	exported := map[string]interface{}{}
+	err = json.Unmarshal(files["/data.json"], &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{}
+	err = json.Unmarshal([]byte(`{
+		"arborist": {
+			"policies": {
+				"reader": {
+					"description": "",
+					"resource_paths": ["/programs/a"],
+					"role_ids": ["read"],
+					"effect": "allow"
+				}
+			},
+			"roles": {
+				"read": {
+					"description": "",
+					"permissions": [{
+						"id": "read",
+						"description": "",
+						"action": {"service": "peregrine", "method": "read"},
+						"constraints": {}
+					}]
+				}
+			},
+			"resources": {
+				"/programs": {"tag": "ABCD", "description": "", "subresources": ["/programs/a"]},
+				"/programs/a": {"tag": "EFGH", "description": "", "subresources": []}
+			}
+		}
+	}`), &expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, exported)
+
+	t.Run("Revision", func(t *testing.T) {
+		_, again, err := opaBundle(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, revision, again, "same model should give the same revision")
+
+		data.Policies["reader"] = opaPolicy{
+			ResourcePaths: []string{"/programs"},
+			RoleIDs:       []string{"read"},
+			Effect:        PolicyEffectAllow,
+		}
+		_, changed, err := opaBundle(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NotEqual(t, revision, changed, "changed model should give a new revision")
+	})
+}
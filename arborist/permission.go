@@ -2,6 +2,9 @@ package arborist
 
 import (
 	"encoding/json"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
 )
 
 type Permission struct {
@@ -27,7 +30,11 @@ func (permission *Permission) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	// `id` and `action` are checked by `validate` instead, which can give
+	// the path to them in a role
 	optionalFields := map[string]struct{}{
+		"id":          {},
+		"action":      {},
 		"description": {},
 		"constraints": {},
 	}
@@ -35,6 +42,15 @@ func (permission *Permission) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	// the action's fields are type-checked above, but keys it doesn't have,
+	// like a misspelt `method`, would be dropped without this
+	if action, ok := fields["action"].(map[string]interface{}); ok {
+		actionFields := map[string]struct{}{"service": {}, "method": {}}
+		err = validateJSON("permission action", &Action{}, action, actionFields)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Trick to use `json.Unmarshal` inside here, making a type alias which we
 	// cast the permission to.
@@ -51,3 +67,131 @@ func (permission *Permission) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// validate returns an error naming the first required field which is empty,
+// as `<path>action.service` in the input `entity`.
+func (permission *Permission) validate(entity string, path string) error {
+	if permission.Name == "" {
+		return missingRequiredField(entity, path+"id")
+	}
+	if permission.Action.Service == "" {
+		return missingRequiredField(entity, path+"action.service")
+	}
+	if permission.Action.Method == "" {
+		return missingRequiredField(entity, path+"action.method")
+	}
+	return nil
+}
+
+// checkConstraintKeys returns an error naming any keys in the permission's
+// constraints which aren't among those registered for its service in
+// `constraintKeys` (see `WithConstraintKeys`). Services which aren't
+// registered, including `*`, can use any keys.
+func (permission *Permission) checkConstraintKeys(entity string, path string, constraintKeys map[string][]string) error {
+	known, registered := constraintKeys[permission.Action.Service]
+	if !registered {
+		return nil
+	}
+	unknown := []string{}
+	for key := range permission.Constraints {
+		found := false
+		for _, knownKey := range known {
+			if key == knownKey {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return unknownConstraintKeys(entity, path+"constraints", permission.Action.Service, unknown, known)
+}
+
+// Permission IDs are only unique within a role, so the same ID can be in
+// several roles, allowing different actions in each. These list permissions
+// across roles, like services.
+
+// PermissionRoles lists the roles with a permission of one ID, and what the
+// permission is in each of them.
+type PermissionRoles struct {
+	ID    string           `json:"id"`
+	Roles []RolePermission `json:"roles"`
+}
+
+// RolePermission is a permission as defined in one role.
+type RolePermission struct {
+	Role        string      `json:"role"`
+	Description string      `json:"description"`
+	Action      Action      `json:"action"`
+	Constraints Constraints `json:"constraints"`
+}
+
+type rolePermissionFromQuery struct {
+	Role        string  `db:"role"`
+	Description *string `db:"description"`
+	Service     string  `db:"service"`
+	Method      string  `db:"method"`
+	Constraints []byte  `db:"constraints"`
+}
+
+func (permissionFromQuery *rolePermissionFromQuery) standardize() RolePermission {
+	permission := RolePermission{
+		Role: permissionFromQuery.Role,
+		Action: Action{
+			Service: permissionFromQuery.Service,
+			Method:  permissionFromQuery.Method,
+		},
+		Constraints: Constraints{},
+	}
+	if permissionFromQuery.Description != nil {
+		permission.Description = *permissionFromQuery.Description
+	}
+	// constraints which aren't an object of strings count as none, as in
+	// `constraintsMatch`
+	_ = json.Unmarshal(permissionFromQuery.Constraints, &permission.Constraints)
+	return permission
+}
+
+// listPermissionNames returns the ID of every permission in any role.
+func listPermissionNames(db *sqlx.DB) ([]string, error) {
+	stmt := "SELECT DISTINCT name FROM permission ORDER BY name"
+	names := []string{}
+	err := db.Select(&names, stmt)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// permissionWithName returns the roles with a permission with the ID `name`,
+// or nil if no role has one.
+func permissionWithName(db *sqlx.DB, name string) (*PermissionRoles, error) {
+	stmt := `
+		SELECT role.name AS role, permission.description, permission.service, permission.method, permission.constraints
+		FROM permission
+		JOIN role ON role.id = permission.role_id
+		WHERE permission.name = $1
+		ORDER BY role.name
+	`
+	permissionsFromQuery := []rolePermissionFromQuery{}
+	err := db.Select(&permissionsFromQuery, stmt, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(permissionsFromQuery) == 0 {
+		return nil, nil
+	}
+	permission := PermissionRoles{
+		ID:    name,
+		Roles: []RolePermission{},
+	}
+	for _, permissionFromQuery := range permissionsFromQuery {
+		permission.Roles = append(permission.Roles, permissionFromQuery.standardize())
+	}
+	return &permission, nil
+}
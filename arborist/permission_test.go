@@ -0,0 +1,122 @@
+package arborist
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermissionFromJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			"ID",
+			`{"action": {"service": "s", "method": "m"}}`,
+			"input permission is missing required field `id`",
+		},
+		{
+			"Action",
+			`{"id": "p"}`,
+			"input permission is missing required field `action.service`",
+		},
+		{
+			"Service",
+			`{"id": "p", "action": {"method": "m"}}`,
+			"input permission is missing required field `action.service`",
+		},
+		{
+			"EmptyService",
+			`{"id": "p", "action": {"service": "", "method": "m"}}`,
+			"input permission is missing required field `action.service`",
+		},
+		{
+			"Method",
+			`{"id": "p", "action": {"service": "s"}}`,
+			"input permission is missing required field `action.method`",
+		},
+		{
+			"MisspeltMethod",
+			`{"id": "p", "action": {"service": "s", "methd": "m"}}`,
+			"input permission action contains the following unexpected fields: `methd`",
+		},
+		{
+			"ServiceType",
+			`{"id": "p", "action": {"service": 1, "method": "m"}}`,
+			"input permission field `action.service` must be a string, not a number",
+		},
+		{
+			"ActionType",
+			`{"id": "p", "action": "s.m"}`,
+			"input permission field `action` must be an object, not a string",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			permission := Permission{}
+			err := json.Unmarshal([]byte(test.input), &permission)
+			if err == nil {
+				err = permission.validate("permission", "")
+			}
+			if assert.Error(t, err) {
+				assert.Equal(t, test.expected, err.Error())
+			}
+		})
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		permission := Permission{}
+		err := json.Unmarshal([]byte(`{"id": "p", "action": {"service": "s", "method": "m"}}`), &permission)
+		assert.NoError(t, err)
+		assert.NoError(t, permission.validate("permission", ""))
+		assert.Equal(t, Action{Service: "s", Method: "m"}, permission.Action)
+	})
+}
+
+func TestPermissionConstraintKeys(t *testing.T) {
+	constraintKeys := map[string][]string{
+		"s":    {"project", "study"},
+		"none": {},
+	}
+	tests := []struct {
+		name        string
+		service     string
+		constraints Constraints
+		expected    string
+	}{
+		{"Registered", "s", Constraints{"project": "a", "study": "b"}, ""},
+		{"NoConstraints", "s", Constraints{}, ""},
+		{"Unregistered", "other", Constraints{"anything": "a"}, ""},
+		{"Wildcard", "*", Constraints{"anything": "a"}, ""},
+		{
+			"Unknown",
+			"s",
+			Constraints{"projct": "a", "study": "b", "age": "c"},
+			"input role field `permissions[0].constraints` has constraints which service `s` doesn't use: `age`, `projct` (expected any of `project`, `study`)",
+		},
+		{
+			"NoneAllowed",
+			"none",
+			Constraints{"project": "a"},
+			"input role field `permissions[0].constraints` has constraints which service `none` doesn't use: `project` (expected none)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			permission := Permission{
+				Name:        "p",
+				Action:      Action{Service: test.service, Method: "m"},
+				Constraints: test.constraints,
+			}
+			err := permission.checkConstraintKeys("role", "permissions[0].", constraintKeys)
+			if test.expected == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Equal(t, test.expected, err.Error())
+			}
+		})
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -15,6 +17,48 @@ type Policy struct {
 	Description   string   `json:"description"`
 	ResourcePaths []string `json:"resource_paths"`
 	RoleIDs       []string `json:"role_ids"`
+	// Effect is either PolicyEffectAllow (the default, left empty) or
+	// PolicyEffectDeny. See `resourcePathLquery` for how deny policies are
+	// applied during authorization.
+	Effect string `json:"effect,omitempty"`
+	// SchemaVersion is set to `OutputSchemaVersion` on policies read from
+	// the database, and ignored in input.
+	SchemaVersion int `json:"schema_version,omitempty"`
+}
+
+const (
+	PolicyEffectAllow = "allow"
+	PolicyEffectDeny  = "deny"
+)
+
+// PolicyTest is the body of `POST /policy/{policyID}/test`: an action on a
+// resource to check against the policy on its own. `constraints` and
+// `context` are the same as in an auth request, for policies with
+// constrained permissions.
+type PolicyTest struct {
+	Resource    string      `json:"resource"`
+	Service     string      `json:"service"`
+	Method      string      `json:"method"`
+	Constraints Constraints `json:"constraints,omitempty"`
+	Context     AuthContext `json:"context,omitempty"`
+}
+
+func (test *PolicyTest) UnmarshalJSON(data []byte) error {
+	fields := make(map[string]interface{})
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	optionalFields := map[string]struct{}{
+		"constraints": {},
+		"context":     {},
+	}
+	err = validateJSON("policy test", test, fields, optionalFields)
+	if err != nil {
+		return err
+	}
+	type loader PolicyTest
+	return json.Unmarshal(data, (*loader)(test))
 }
 
 // expanded policies need their own struct so that unused RoleIDs/Roles
@@ -24,6 +68,8 @@ type ExpandedPolicy struct {
 	Description   string   `json:"description"`
 	ResourcePaths []string `json:"resource_paths"`
 	Roles         []Role   `json:"roles"`
+	Effect        string   `json:"effect,omitempty"`
+	SchemaVersion int      `json:"schema_version,omitempty"`
 }
 
 // UnmarshalJSON defines the way that a `Policy` gets read when unmarshalling:
@@ -43,8 +89,10 @@ func (policy *Policy) UnmarshalJSON(data []byte) error {
 	// handlePolicyOverwrite will populate id later, from the URL.
 	// id is still validated later, in policy `validate` function.
 	optionalFields := map[string]struct{}{
-		"id":          {},
-		"description": {},
+		"id":             {},
+		"description":    {},
+		"effect":         {},
+		"schema_version": {},
 	}
 	err = validateJSON("policy", policy, fields, optionalFields)
 	if err != nil {
@@ -58,6 +106,8 @@ func (policy *Policy) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	// only for output, so a policy which was read can be sent back as it is
+	policy.SchemaVersion = 0
 
 	return nil
 }
@@ -70,6 +120,7 @@ type PolicyFromQuery struct {
 	Description   *string        `db:"description" json:"description,omitempty"`
 	ResourcePaths pq.StringArray `db:"resource_paths" json:"resource_paths"`
 	RoleIDs       pq.StringArray `db:"role_ids" json:"role_ids"`
+	Effect        string         `db:"effect" json:"effect,omitempty"`
 }
 
 func (policyFromQuery *PolicyFromQuery) standardize() Policy {
@@ -81,6 +132,10 @@ func (policyFromQuery *PolicyFromQuery) standardize() Policy {
 		Name:          policyFromQuery.Name,
 		ResourcePaths: paths,
 		RoleIDs:       policyFromQuery.RoleIDs,
+		SchemaVersion: OutputSchemaVersion,
+	}
+	if policyFromQuery.Effect != PolicyEffectAllow {
+		policy.Effect = policyFromQuery.Effect
 	}
 	if policyFromQuery.Description != nil {
 		policy.Description = *policyFromQuery.Description
@@ -94,6 +149,7 @@ func policyWithName(db *sqlx.DB, name string) (*PolicyFromQuery, error) {
 			policy.id,
 			policy.name,
 			policy.description,
+			policy.effect,
 			array_remove(array_agg(DISTINCT resource.path), NULL) AS resource_paths,
 			array_remove(array_agg(DISTINCT role.name), NULL) AS role_ids
 		FROM policy
@@ -117,12 +173,124 @@ func policyWithName(db *sqlx.DB, name string) (*PolicyFromQuery, error) {
 	return &policy, nil
 }
 
-func listPoliciesFromDb(db *sqlx.DB) ([]PolicyFromQuery, error) {
+// policyResourcesFromDb returns every resource the policy `name` applies to,
+// in order of path: the resources in its `resource_paths` and everything
+// under them, since a policy on a resource covers its subresources too.
+func policyResourcesFromDb(db *sqlx.DB, name string) ([]ResourceFromQuery, error) {
+	stmt := `
+		SELECT
+			parent.id,
+			parent.name,
+			parent.path,
+			parent.tag,
+			parent.description,
+			parent.tags,
+			array(
+				SELECT child.path
+				FROM resource AS child
+				WHERE child.path ~ (
+					CAST ((ltree2text(parent.path) || '.*{1}') AS lquery)
+				)
+			) AS subresources
+		FROM resource AS parent
+		WHERE parent.path <@ ARRAY(
+			SELECT resource.path
+			FROM policy
+			JOIN policy_resource ON policy_resource.policy_id = policy.id
+			JOIN resource ON resource.id = policy_resource.resource_id
+			WHERE policy.name = $1
+		)
+		ORDER BY parent.path
+	`
+	resources := []ResourceFromQuery{}
+	err := db.Select(&resources, stmt, name)
+	if err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// PolicyDiff is the response to `GET /policy/{policyID}/diff/{otherPolicyID}`:
+// what it would take to turn the first policy (`from`) into the second
+// (`to`). `added` lists what only the second policy has, and `removed` what
+// only the first one has.
+type PolicyDiff struct {
+	From          string     `json:"from"`
+	To            string     `json:"to"`
+	ResourcePaths ChangedIDs `json:"resource_paths"`
+	RoleIDs       ChangedIDs `json:"role_ids"`
+}
+
+// ChangedIDs is one half of a `PolicyDiff`, both lists in sorted order.
+type ChangedIDs struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+func diffPolicies(from Policy, to Policy) PolicyDiff {
+	return PolicyDiff{
+		From:          from.Name,
+		To:            to.Name,
+		ResourcePaths: diffIDs(from.ResourcePaths, to.ResourcePaths),
+		RoleIDs:       diffIDs(from.RoleIDs, to.RoleIDs),
+	}
+}
+
+func diffIDs(from []string, to []string) ChangedIDs {
+	inFrom := make(map[string]struct{}, len(from))
+	for _, id := range from {
+		inFrom[id] = struct{}{}
+	}
+	inTo := make(map[string]struct{}, len(to))
+	for _, id := range to {
+		inTo[id] = struct{}{}
+	}
+	changed := ChangedIDs{Added: []string{}, Removed: []string{}}
+	for id := range inTo {
+		if _, ok := inFrom[id]; !ok {
+			changed.Added = append(changed.Added, id)
+		}
+	}
+	for id := range inFrom {
+		if _, ok := inTo[id]; !ok {
+			changed.Removed = append(changed.Removed, id)
+		}
+	}
+	sort.Strings(changed.Added)
+	sort.Strings(changed.Removed)
+	return changed
+}
+
+// PolicyListOptions narrows down the policies returned by
+// `listPoliciesFromDb`. The zero value lists every policy.
+type PolicyListOptions struct {
+	// Limit is the maximum number of policies to return; 0 means no limit.
+	Limit int
+	// Offset is the number of policies to skip, in order of policy name
+	// (the `id` in the API).
+	Offset int
+	// Resource, if set, keeps only the policies which reference the resource
+	// with exactly this path.
+	Resource string
+}
+
+// policyListFilter is the WHERE clause shared by the list and count queries;
+// $1 is the resource path to filter on (formatted for the database), or empty.
+const policyListFilter = `
+	WHERE CAST ($1 AS TEXT) = '' OR policy.id IN (
+		SELECT policy_resource.policy_id FROM policy_resource
+		INNER JOIN resource ON resource.id = policy_resource.resource_id
+		WHERE resource.path = text2ltree(CAST ($1 AS TEXT))
+	)
+`
+
+func listPoliciesFromDb(db *sqlx.DB, options PolicyListOptions) ([]PolicyFromQuery, error) {
 	stmt := `
 		SELECT
 			policy.id,
 			policy.name,
 			policy.description,
+			policy.effect,
 			array_remove(array_agg(DISTINCT resource.path), NULL) AS resource_paths,
 			array_remove(array_agg(DISTINCT role.name), NULL) AS role_ids
 		FROM policy
@@ -130,16 +298,45 @@ func listPoliciesFromDb(db *sqlx.DB) ([]PolicyFromQuery, error) {
 		LEFT JOIN resource ON resource.id = policy_resource.resource_id
 		LEFT JOIN policy_role on policy.id = policy_role.policy_id
 		LEFT JOIN role on role.id = policy_role.role_id
+	` + policyListFilter + `
 		GROUP BY policy.id
+		ORDER BY policy.name
+		LIMIT $2
+		OFFSET $3
 	`
+	// LIMIT NULL is the same as no limit
+	var limit *int
+	if options.Limit > 0 {
+		limit = &options.Limit
+	}
+	resource := ""
+	if options.Resource != "" {
+		resource = FormatPathForDb(options.Resource)
+	}
 	var policies []PolicyFromQuery
-	err := db.Select(&policies, stmt)
+	err := db.Select(&policies, stmt, resource, limit, options.Offset)
 	if err != nil {
 		return nil, err
 	}
 	return policies, nil
 }
 
+// countPoliciesFromDb returns the total number of policies matching the
+// resource filter in `options`, ignoring the limit and offset.
+func countPoliciesFromDb(db *sqlx.DB, options PolicyListOptions) (int, error) {
+	stmt := "SELECT COUNT(*) FROM policy" + policyListFilter
+	resource := ""
+	if options.Resource != "" {
+		resource = FormatPathForDb(options.Resource)
+	}
+	var count int
+	err := db.Get(&count, stmt, resource)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 // resources looks up all the resources with paths in this policy. An error, if
 // returned, resulted from the database operation.
 func (policy *Policy) resources(tx *sqlx.Tx) ([]ResourceFromQuery, error) {
@@ -182,9 +379,28 @@ func (policy *Policy) validate() *ErrorResponse {
 	if len(policy.RoleIDs) == 0 {
 		return newErrorResponse("no role IDs specified", 400, nil)
 	}
+	switch policy.Effect {
+	case "", PolicyEffectAllow, PolicyEffectDeny:
+	default:
+		msg := fmt.Sprintf(
+			"invalid policy effect `%s`: must be `%s` or `%s`",
+			policy.Effect,
+			PolicyEffectAllow,
+			PolicyEffectDeny,
+		)
+		return newErrorResponse(msg, 400, nil)
+	}
 	return nil
 }
 
+// effect returns the effect to store for this policy, filling in the default.
+func (policy *Policy) effect() string {
+	if policy.Effect == "" {
+		return PolicyEffectAllow
+	}
+	return policy.Effect
+}
+
 // addResourcesAndRoles takes a policy and links it in the database
 // to each of its resources and roles.
 func (policy *Policy) addResourcesAndRoles(tx *sqlx.Tx, policyID int) *ErrorResponse {
@@ -271,15 +487,16 @@ func (policy *Policy) createInDb(tx *sqlx.Tx) *ErrorResponse {
 
 	var policyID int
 	// TODO: make sure description works as expected
-	stmt := "INSERT INTO policy(name, description) VALUES ($1, $2) RETURNING id"
-	row := tx.QueryRowx(stmt, policy.Name, policy.Description)
+	stmt := "INSERT INTO policy(name, description, effect) VALUES ($1, $2, $3) RETURNING id"
+	row := tx.QueryRowx(stmt, policy.Name, policy.Description, policy.effect())
 	err := row.Scan(&policyID)
-	if err != nil {
-		// should add more checking here to guarantee the correct error
-		// this should only fail because the policy was not unique. return error
-		// accordingly
+	if isUniqueViolation(err) {
 		msg := fmt.Sprintf("failed to insert policy: policy with this ID already exists: %s", policy.Name)
-		return newErrorResponse(msg, 409, &err)
+		return newErrorResponse(msg, 409, &err).withCode(ErrorCodePolicyExists)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("failed to insert policy %s: %s", policy.Name, err.Error())
+		return newErrorResponse(msg, 500, &err)
 	}
 
 	errResponse = policy.addResourcesAndRoles(tx, policyID)
@@ -290,13 +507,198 @@ func (policy *Policy) createInDb(tx *sqlx.Tx) *ErrorResponse {
 	return nil
 }
 
+// createManyInDb writes out every policy in the list inside the same
+// transaction. If any policy fails, the error message names its index in the
+// list so the caller can tell which element was rejected; the caller should
+// roll back the whole batch (`transactify` does this).
+func createManyInDb(tx *sqlx.Tx, policies []Policy) *ErrorResponse {
+	for i := range policies {
+		errResponse := policies[i].createInDb(tx)
+		if errResponse != nil {
+			errResponse.HTTPError.Message = fmt.Sprintf(
+				"policy at index %d: %s",
+				i,
+				errResponse.HTTPError.Message,
+			)
+			return errResponse
+		}
+	}
+	return nil
+}
+
+// deleteInDb removes the policy from the database. Returns 404 if there was
+// no policy with this name.
 func (policy *Policy) deleteInDb(tx *sqlx.Tx) *ErrorResponse {
 	stmt := "DELETE FROM policy WHERE name = $1"
-	_, err := tx.Exec(stmt, policy.Name)
+	result, err := tx.Exec(stmt, policy.Name)
 	if err != nil {
-		// TODO: verify correct error
-		// doesn't exist, this is fine
-		return nil
+		msg := fmt.Sprintf("failed to delete policy: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		msg := fmt.Sprintf("failed to delete policy: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	if deleted == 0 {
+		msg := fmt.Sprintf("failed to delete policy: no policy found with id: %s", policy.Name)
+		return newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
+	}
+	return nil
+}
+
+// archiveInDb soft-deletes the policy: it is copied to `policy_archive`,
+// along with its grants to users, groups and clients, and then deleted, so
+// that `restorePolicyInDb` can bring it back. An earlier soft-deleted policy
+// with the same name is replaced. Returns 404 if there was no policy with
+// this name.
+func (policy *Policy) archiveInDb(tx *sqlx.Tx, now time.Time) *ErrorResponse {
+	stmt := `
+		INSERT INTO policy_archive(
+			name, description, effect, resource_paths, role_ids,
+			usr_grants, grp_grants, client_grants, deleted_at
+		)
+		SELECT
+			policy.name,
+			policy.description,
+			policy.effect,
+			ARRAY(
+				SELECT resource.path
+				FROM policy_resource
+				JOIN resource ON resource.id = policy_resource.resource_id
+				WHERE policy_resource.policy_id = policy.id
+			),
+			ARRAY(
+				SELECT role.name
+				FROM policy_role
+				JOIN role ON role.id = policy_role.role_id
+				WHERE policy_role.policy_id = policy.id
+			),
+			COALESCE((
+				SELECT jsonb_agg(jsonb_build_object(
+					'name', usr.name,
+					'expires_at', usr_policy.expires_at,
+					'authz_provider', usr_policy.authz_provider
+				))
+				FROM usr_policy
+				JOIN usr ON usr.id = usr_policy.usr_id
+				WHERE usr_policy.policy_id = policy.id
+			), '[]'::jsonb),
+			COALESCE((
+				SELECT jsonb_agg(jsonb_build_object(
+					'name', grp.name,
+					'authz_provider', grp_policy.authz_provider
+				))
+				FROM grp_policy
+				JOIN grp ON grp.id = grp_policy.grp_id
+				WHERE grp_policy.policy_id = policy.id
+			), '[]'::jsonb),
+			COALESCE((
+				SELECT jsonb_agg(jsonb_build_object(
+					'name', client.external_client_id,
+					'authz_provider', client_policy.authz_provider
+				))
+				FROM client_policy
+				JOIN client ON client.id = client_policy.client_id
+				WHERE client_policy.policy_id = policy.id
+			), '[]'::jsonb),
+			$2
+		FROM policy
+		WHERE policy.name = $1
+		ON CONFLICT (name) DO UPDATE SET
+			description = EXCLUDED.description,
+			effect = EXCLUDED.effect,
+			resource_paths = EXCLUDED.resource_paths,
+			role_ids = EXCLUDED.role_ids,
+			usr_grants = EXCLUDED.usr_grants,
+			grp_grants = EXCLUDED.grp_grants,
+			client_grants = EXCLUDED.client_grants,
+			deleted_at = EXCLUDED.deleted_at
+	`
+	_, err := tx.Exec(stmt, policy.Name, now)
+	if err != nil {
+		msg := fmt.Sprintf("failed to archive policy: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	// with no policy to archive, this is the 404
+	return policy.deleteInDb(tx)
+}
+
+// restorePolicyInDb re-creates the soft-deleted policy `name` from
+// `policy_archive`, and grants it again to the users, groups and clients it
+// was granted to which still exist. It fails, leaving the policy archived,
+// if a policy with the name has been created since, or one of its resources
+// or roles has been deleted. Returns 404 if there is no archived policy with
+// this name.
+func restorePolicyInDb(tx *sqlx.Tx, name string) *ErrorResponse {
+	stmt := `
+		SELECT name, description, effect, resource_paths, role_ids
+		FROM policy_archive
+		WHERE name = $1
+	`
+	archived := []PolicyFromQuery{}
+	err := tx.Select(&archived, stmt, name)
+	if err != nil {
+		msg := fmt.Sprintf("archived policy query failed: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	if len(archived) == 0 {
+		msg := fmt.Sprintf("no deleted policy found with id: %s", name)
+		return newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
+	}
+	policy := archived[0].standardize()
+	errResponse := policy.createInDb(tx)
+	if errResponse != nil {
+		return errResponse
+	}
+
+	grants := []struct {
+		grantee string
+		stmt    string
+	}{
+		{"user", `
+			INSERT INTO usr_policy(usr_id, policy_id, expires_at, authz_provider)
+			SELECT usr.id, policy.id, grant_.expires_at, grant_.authz_provider
+			FROM policy_archive
+			CROSS JOIN LATERAL jsonb_to_recordset(policy_archive.usr_grants)
+				AS grant_(name text, expires_at timestamp with time zone, authz_provider varchar)
+			JOIN usr ON usr.name = grant_.name
+			JOIN policy ON policy.name = policy_archive.name
+			WHERE policy_archive.name = $1
+		`},
+		{"group", `
+			INSERT INTO grp_policy(grp_id, policy_id, authz_provider)
+			SELECT grp.id, policy.id, grant_.authz_provider
+			FROM policy_archive
+			CROSS JOIN LATERAL jsonb_to_recordset(policy_archive.grp_grants)
+				AS grant_(name text, authz_provider varchar)
+			JOIN grp ON grp.name = grant_.name
+			JOIN policy ON policy.name = policy_archive.name
+			WHERE policy_archive.name = $1
+		`},
+		{"client", `
+			INSERT INTO client_policy(client_id, policy_id, authz_provider)
+			SELECT client.id, policy.id, grant_.authz_provider
+			FROM policy_archive
+			CROSS JOIN LATERAL jsonb_to_recordset(policy_archive.client_grants)
+				AS grant_(name text, authz_provider varchar)
+			JOIN client ON client.external_client_id = grant_.name
+			JOIN policy ON policy.name = policy_archive.name
+			WHERE policy_archive.name = $1
+		`},
+	}
+	for _, grant := range grants {
+		_, err = tx.Exec(grant.stmt, name)
+		if err != nil {
+			msg := fmt.Sprintf("failed to restore %s grants of policy: %s", grant.grantee, err.Error())
+			return newErrorResponse(msg, 500, &err)
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM policy_archive WHERE name = $1", name)
+	if err != nil {
+		msg := fmt.Sprintf("failed to restore policy: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
 	}
 	return nil
 }
@@ -310,13 +712,13 @@ func (policy *Policy) updateInDb(tx *sqlx.Tx) *ErrorResponse {
 	}
 
 	var policyID int
-	stmt := "UPDATE policy SET description = $1 WHERE name = $2 RETURNING id"
-	row := tx.QueryRowx(stmt, policy.Description, policy.Name)
+	stmt := "UPDATE policy SET description = $1, effect = $2 WHERE name = $3 RETURNING id"
+	row := tx.QueryRowx(stmt, policy.Description, policy.effect(), policy.Name)
 	err := row.Scan(&policyID)
 	switch {
 	case err == sql.ErrNoRows:
 		msg := fmt.Sprintf("failed to update policy: no policy found with id: %s", policy.Name)
-		return newErrorResponse(msg, 404, &err)
+		return newErrorResponse(msg, 404, &err).withCode(ErrorCodePolicyNotFound)
 	case err != nil:
 		msg := fmt.Sprintf("failed to update policy: update description failed: %s", err.Error())
 		return newErrorResponse(msg, 500, &err)
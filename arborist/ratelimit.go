@@ -0,0 +1,148 @@
+package arborist
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiterSize is how many callers the rate limiter keeps buckets for
+// before the least recently seen are dropped. A dropped caller starts again
+// with a full bucket.
+const rateLimiterSize = 10000
+
+// rateLimiter is a token bucket for each caller: each request takes a token,
+// and tokens come back at `rate` per second up to `burst`.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*list.Element
+	// order has the most recently seen callers at the front
+	order *list.List
+}
+
+type rateLimitBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// allow takes a token from the bucket for `key` at `now`. If the bucket is
+// empty it returns false, along with how long until there's a token again.
+func (limiter *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	var bucket *rateLimitBucket
+	if element, exists := limiter.buckets[key]; exists {
+		limiter.order.MoveToFront(element)
+		bucket = element.Value.(*rateLimitBucket)
+		elapsed := now.Sub(bucket.last).Seconds()
+		if elapsed > 0 {
+			bucket.tokens = math.Min(limiter.burst, bucket.tokens+elapsed*limiter.rate)
+		}
+		bucket.last = now
+	} else {
+		for limiter.order.Len() >= rateLimiterSize {
+			oldest := limiter.order.Back()
+			limiter.order.Remove(oldest)
+			delete(limiter.buckets, oldest.Value.(*rateLimitBucket).key)
+		}
+		bucket = &rateLimitBucket{key: key, tokens: limiter.burst, last: now}
+		limiter.buckets[key] = limiter.order.PushFront(bucket)
+	}
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / limiter.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// rateLimitSubject is who a request with `token` from `host` is for, to rate
+// limit them by: the user if there is one, otherwise the client. Only a token
+// whose signature checks out can name a user or client, so nobody can use up
+// someone else's limit by sending tokens made up in their name; any other
+// token is limited by the caller's address instead. Returns "" for requests
+// without a token.
+func (server *Server) rateLimitSubject(token string, host string) string {
+	if token == "" {
+		return ""
+	}
+	claims, err := server.verifiedClaims(token, server.clock())
+	if err != nil {
+		return "address:" + host
+	}
+	if context, ok := (*claims)["context"].(map[string]interface{}); ok {
+		if user, ok := context["user"].(map[string]interface{}); ok {
+			if name, ok := user["name"].(string); ok && name != "" {
+				return "user:" + server.normalizeUsername(name)
+			}
+		}
+	}
+	if clientID, ok := (*claims)["azp"].(string); ok && clientID != "" {
+		return "client:" + clientID
+	}
+	return "address:" + host
+}
+
+// remoteHost is the address the request came from, without the port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited takes a token from the bucket of the caller with `token` from
+// `host`, if there's a limit set with `WithRateLimit`. Past the limit, it
+// returns the 429 to respond with and how many seconds until the caller can
+// retry.
+func (server *Server) rateLimited(token string, host string) (*ErrorResponse, int) {
+	if server.rateLimiter == nil {
+		return nil, 0
+	}
+	subject := server.rateLimitSubject(token, host)
+	if subject == "" {
+		return nil, 0
+	}
+	allowed, retryAfter := server.rateLimiter.allow(subject, server.clock())
+	if allowed {
+		return nil, 0
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	msg := fmt.Sprintf("too many requests for %s; retry in %d seconds", subject, seconds)
+	return newErrorResponse(msg, http.StatusTooManyRequests, nil).withCode(ErrorCodeRateLimited), seconds
+}
+
+// rateLimitMiddleware turns away requests past the rate set with
+// `WithRateLimit`, for each user or client going by the token in the auth
+// header, with a 429 saying when to retry. Requests without a token aren't
+// limited.
+func (server *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errResponse, seconds := server.rateLimited(server.requestToken(r), remoteHost(r))
+		if errResponse != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
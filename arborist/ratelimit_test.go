@@ -0,0 +1,123 @@
+package arborist
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(2, 3)
+
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.allow("user:a", now)
+		assert.True(t, allowed, "expected request %d in the burst to be allowed", i+1)
+	}
+	allowed, retryAfter := limiter.allow("user:a", now)
+	assert.False(t, allowed, "expected request past the burst to be limited")
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	allowed, _ = limiter.allow("user:b", now)
+	assert.True(t, allowed, "expected another caller to have their own bucket")
+
+	// two tokens a second come back, so half a second later there's one
+	allowed, _ = limiter.allow("user:a", now.Add(500*time.Millisecond))
+	assert.True(t, allowed, "expected a token to come back")
+	allowed, _ = limiter.allow("user:a", now.Add(500*time.Millisecond))
+	assert.False(t, allowed)
+
+	// and the bucket doesn't fill past the burst
+	for i := 0; i < 3; i++ {
+		allowed, _ = limiter.allow("user:a", now.Add(time.Hour))
+		assert.True(t, allowed)
+	}
+	allowed, _ = limiter.allow("user:a", now.Add(time.Hour))
+	assert.False(t, allowed)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	private, public := newSigningKey(t, "key")
+	jwks := &jwksServer{}
+	jwks.setKeys(public)
+	keys := httptest.NewServer(jwks)
+	defer keys.Close()
+	token := func(claims map[string]interface{}) string {
+		return signToken(t, private, "key", claims)
+	}
+	userToken := func(name string) string {
+		return token(map[string]interface{}{
+			"context": map[string]interface{}{"user": map[string]interface{}{"name": name}},
+		})
+	}
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	server := NewServer().
+		WithLogger(log.New(ioutil.Discard, "", 0)).
+		WithJWTApp(NewJWTApplication(keys.URL)).
+		WithClock(func() time.Time { return now }).
+		WithRateLimit(1, 2)
+	handler := server.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/auth/proxy", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	busy := userToken("busy")
+	assert.Equal(t, http.StatusOK, request(busy).Code)
+	assert.Equal(t, http.StatusOK, request(busy).Code)
+	w := request(busy)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), ErrorCodeRateLimited)
+
+	t.Run("OtherUser", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, request(userToken("quiet")).Code)
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		client := token(map[string]interface{}{"azp": "busy"})
+		assert.Equal(t, http.StatusOK, request(client).Code, "expected clients to be limited apart from users")
+	})
+
+	t.Run("ForgedToken", func(t *testing.T) {
+		// tokens naming a user but signed with some other key can't use up
+		// that user's limit; they're limited by the caller's address
+		forger, _ := newSigningKey(t, "key")
+		forged := signToken(t, forger, "key", map[string]interface{}{
+			"context": map[string]interface{}{"user": map[string]interface{}{"name": "victim"}},
+		})
+		assert.Equal(t, http.StatusOK, request(forged).Code)
+		assert.Equal(t, http.StatusOK, request(forged).Code)
+		w := request(forged)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.NotContains(t, w.Body.String(), "victim")
+
+		assert.Equal(t, http.StatusOK, request(userToken("victim")).Code)
+		assert.Equal(t, http.StatusOK, request(userToken("victim")).Code)
+	})
+
+	t.Run("NoToken", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, http.StatusOK, request("").Code)
+		}
+	})
+
+	t.Run("Off", func(t *testing.T) {
+		server.WithRateLimit(0, 0)
+		defer server.WithRateLimit(1, 2)
+		assert.Equal(t, http.StatusOK, request(busy).Code)
+	})
+}
@@ -0,0 +1,36 @@
+package arborist
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// ReloadResult is the response from `/admin/reload`: how many of each thing
+// authorization decisions are now worked out from, and how many cached
+// decisions were dropped.
+type ReloadResult struct {
+	Roles            int `json:"roles" db:"roles"`
+	Permissions      int `json:"permissions" db:"permissions"`
+	Services         int `json:"services" db:"services"`
+	Resources        int `json:"resources" db:"resources"`
+	Policies         int `json:"policies" db:"policies"`
+	DroppedDecisions int `json:"dropped_decisions" db:"-"`
+}
+
+// reloadCountsFromDb counts the roles, permissions, services, resources and
+// policies in the database.
+func reloadCountsFromDb(db *sqlx.DB) (*ReloadResult, error) {
+	stmt := `
+		SELECT
+			(SELECT count(*) FROM role) AS roles,
+			(SELECT count(*) FROM permission) AS permissions,
+			(SELECT count(DISTINCT service) FROM permission) AS services,
+			(SELECT count(*) FROM resource) AS resources,
+			(SELECT count(*) FROM policy) AS policies
+	`
+	result := ReloadResult{}
+	err := db.Get(&result, stmt)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
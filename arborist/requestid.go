@@ -0,0 +1,109 @@
+package arborist
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// requestIDHeader carries the ID used to match up a request with the log
+// lines and error response it caused. It is read from the request if the
+// caller set one, and always sent back in the response.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the IDs accepted from callers, since they end up
+// in every log line for the request.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDHandler gives every request an ID, taken from its `X-Request-ID`
+// header or else newly generated, stores it in the request context, and
+// echoes it in the response headers.
+func requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestID returns the ID stored by `requestIDHandler`, or "" if there is
+// none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether an ID from a caller is safe to use: not
+// empty, not too long, and printable ASCII without spaces, so it can't break
+// up a log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random (version 4) UUID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestLogger adds the request ID to every line written to the server's
+// logger while handling a request.
+type requestLogger struct {
+	logger Logger
+	id     string
+}
+
+// requestLogger returns a logger which tags each line with the ID of the
+// request in `ctx`, or just the server's logger if there is no request ID.
+func (server *Server) requestLogger(ctx context.Context) Logger {
+	id := requestID(ctx)
+	if id == "" {
+		return server.logger
+	}
+	return &requestLogger{logger: server.logger, id: id}
+}
+
+func (logger *requestLogger) tag(msg string) string {
+	return fmt.Sprintf("[%s] %s", logger.id, msg)
+}
+
+// The methods below call `logMsg` themselves, rather than the same methods on
+// the wrapped logger, so that the file and line logged are still the caller's.
+
+func (logger *requestLogger) Print(format string, a ...interface{}) {
+	logger.logger.Print(logger.tag(sprintf(format, a...)))
+}
+
+func (logger *requestLogger) Debug(format string, a ...interface{}) {
+	logger.logger.Print(logger.tag(logMsg(LogLevelDebug, format, a...)))
+}
+
+func (logger *requestLogger) Info(format string, a ...interface{}) {
+	logger.logger.Print(logger.tag(logMsg(LogLevelInfo, format, a...)))
+}
+
+func (logger *requestLogger) Warning(format string, a ...interface{}) {
+	logger.logger.Print(logger.tag(logMsg(LogLevelWarning, format, a...)))
+}
+
+func (logger *requestLogger) Error(format string, a ...interface{}) {
+	logger.logger.Print(logger.tag(logMsg(LogLevelError, format, a...)))
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"regexp"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
@@ -20,14 +21,20 @@ type ResourceIn struct {
 	Path         string       `json:"path"`
 	Description  *string      `json:"description"`
 	Subresources []ResourceIn `json:"subresources"`
+	// Tags are free-form key/value pairs for cataloging resources; unlike
+	// `tag`, they are set by the caller. nil leaves them alone on update.
+	Tags map[string]string `json:"tags"`
 }
 
 type ResourceOut struct {
-	Name         string   `json:"name"`
-	Path         string   `json:"path"`
-	Tag          string   `json:"tag"`
-	Description  string   `json:"description"`
-	Subresources []string `json:"subresources"`
+	Name         string            `json:"name"`
+	Path         string            `json:"path"`
+	Tag          string            `json:"tag"`
+	Description  string            `json:"description"`
+	Subresources []string          `json:"subresources"`
+	Tags         map[string]string `json:"tags"`
+	// SchemaVersion is always `OutputSchemaVersion`.
+	SchemaVersion int `json:"schema_version"`
 }
 
 func UnderscoreEncode(decoded string) string {
@@ -78,12 +85,14 @@ func (resource *ResourceIn) UnmarshalJSON(data []byte) error {
 
 	// delete fields which should be ignored in user input
 	delete(fields, "tag")
+	delete(fields, "schema_version")
 
 	optionalFieldsPath := map[string]struct{}{
 		"name":         {},
 		"tag":          {},
 		"description":  {},
 		"subresources": {},
+		"tags":         {},
 	}
 	errPath := validateJSON("resource", resource, fields, optionalFieldsPath)
 	optionalFieldsName := map[string]struct{}{
@@ -91,9 +100,16 @@ func (resource *ResourceIn) UnmarshalJSON(data []byte) error {
 		"tag":          {},
 		"description":  {},
 		"subresources": {},
+		"tags":         {},
 	}
 	errName := validateJSON("resource", resource, fields, optionalFieldsName)
 	if errPath != nil && errName != nil {
+		// report the problem with whichever of the two was given
+		if _, hasPath := fields["path"]; !hasPath {
+			if _, hasName := fields["name"]; hasName {
+				return errName
+			}
+		}
 		return errPath
 	}
 
@@ -122,6 +138,8 @@ type ResourceFromQuery struct {
 	Description  *string        `db:"description"`
 	Path         string         `db:"path"`
 	Subresources pq.StringArray `db:"subresources"`
+	// Tags is the JSON object from the `tags` column.
+	Tags []byte `db:"tags"`
 }
 
 // standardize takes a resource returned from a query and turns it into the
@@ -131,11 +149,20 @@ func (resourceFromQuery *ResourceFromQuery) standardize() ResourceOut {
 	for _, subresource := range resourceFromQuery.Subresources {
 		subresources = append(subresources, formatDbPath(subresource))
 	}
+	tags := map[string]string{}
+	if len(resourceFromQuery.Tags) > 0 {
+		err := json.Unmarshal(resourceFromQuery.Tags, &tags)
+		if err != nil {
+			panic("got bad resource tags format from database")
+		}
+	}
 	resource := ResourceOut{
-		Name:         UnderscoreDecode(resourceFromQuery.Name),
-		Path:         formatDbPath(resourceFromQuery.Path),
-		Tag:          resourceFromQuery.Tag,
-		Subresources: subresources,
+		Name:          UnderscoreDecode(resourceFromQuery.Name),
+		Path:          formatDbPath(resourceFromQuery.Path),
+		Tag:           resourceFromQuery.Tag,
+		Subresources:  subresources,
+		Tags:          tags,
+		SchemaVersion: OutputSchemaVersion,
 	}
 	if resourceFromQuery.Description != nil {
 		resource.Description = *resourceFromQuery.Description
@@ -175,6 +202,7 @@ func resourceWithPath(db *sqlx.DB, path string) (*ResourceFromQuery, error) {
 			parent.path,
 			parent.tag,
 			parent.description,
+			parent.tags,
 			array(
 				SELECT child.path
 				FROM resource AS child
@@ -212,6 +240,7 @@ func resourceWithTag(db *sqlx.DB, tag string) (*ResourceFromQuery, error) {
 			parent.path,
 			parent.tag,
 			parent.description,
+			parent.tags,
 			array(
 				SELECT child.path
 				FROM resource AS child
@@ -233,7 +262,32 @@ func resourceWithTag(db *sqlx.DB, tag string) (*ResourceFromQuery, error) {
 	return &resource, nil
 }
 
-func listResourcesFromDb(db *sqlx.DB) ([]ResourceFromQuery, error) {
+// listResourcesFromDb returns every resource which has all of `tags`; nil or
+// empty `tags` lists them all.
+func listResourcesFromDb(db *sqlx.DB, tags map[string]string) ([]ResourceFromQuery, error) {
+	rows, err := queryResources(db, tags)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var resources []ResourceFromQuery
+	err = sqlx.StructScan(rows, &resources)
+	if err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// queryResources is `listResourcesFromDb`, but returns the rows for the
+// caller to scan into `ResourceFromQuery` one at a time.
+func queryResources(db *sqlx.DB, tags map[string]string) (*sqlx.Rows, error) {
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return nil, err
+	}
 	stmt := `
 		SELECT
 			parent.id,
@@ -241,6 +295,7 @@ func listResourcesFromDb(db *sqlx.DB) ([]ResourceFromQuery, error) {
 			parent.path,
 			parent.tag,
 			parent.description,
+			parent.tags,
 			array(
 				SELECT child.path
 				FROM resource AS child
@@ -249,38 +304,236 @@ func listResourcesFromDb(db *sqlx.DB) ([]ResourceFromQuery, error) {
 				)
 			) AS subresources
 		FROM resource AS parent
+		WHERE parent.tags @> CAST ($1 AS jsonb)
 		GROUP BY parent.id
 	`
-	var resources []ResourceFromQuery
-	err := db.Select(&resources, stmt)
+	return db.Queryx(stmt, string(tagsJSON))
+}
+
+// ResourceSearchOptions are the search term and page for
+// `searchResourcesFromDb`.
+type ResourceSearchOptions struct {
+	// Query is matched, ignoring case, against any part of the resource paths
+	// and descriptions.
+	Query string
+	// Limit is the maximum number of resources to return; 0 means no limit.
+	Limit int
+	// Offset is the number of resources to skip, in order of path.
+	Offset int
+}
+
+// resourceSearchFilter is the WHERE clause shared by the search and count
+// queries; $1 is the LIKE pattern for the database path, which the trigram
+// index on `ltree2text(path)` serves, and $2 the one for the description.
+const resourceSearchFilter = `
+	WHERE ltree2text(parent.path) ILIKE $1 OR parent.description ILIKE $2
+`
+
+// likeContaining returns a LIKE pattern matching text which contains `s`.
+func likeContaining(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
+// resourceSearchPatterns returns the patterns for `resourceSearchFilter`. The
+// path is searched in its database form, so the query is encoded the same way.
+func resourceSearchPatterns(query string) (string, string) {
+	return likeContaining(FormatPathForDb(query)), likeContaining(query)
+}
+
+func searchResourcesFromDb(db *sqlx.DB, options ResourceSearchOptions) ([]ResourceFromQuery, error) {
+	stmt := `
+		SELECT
+			parent.id,
+			parent.name,
+			parent.path,
+			parent.tag,
+			parent.description,
+			parent.tags,
+			array(
+				SELECT child.path
+				FROM resource AS child
+				WHERE child.path ~ (
+					CAST ((ltree2text(parent.path) || '.*{1}') AS lquery)
+				)
+			) AS subresources
+		FROM resource AS parent
+	` + resourceSearchFilter + `
+		ORDER BY parent.path
+		LIMIT $3
+		OFFSET $4
+	`
+	// LIMIT NULL is the same as no limit
+	var limit *int
+	if options.Limit > 0 {
+		limit = &options.Limit
+	}
+	pathPattern, descriptionPattern := resourceSearchPatterns(options.Query)
+	resources := []ResourceFromQuery{}
+	err := db.Select(&resources, stmt, pathPattern, descriptionPattern, limit, options.Offset)
 	if err != nil {
 		return nil, err
 	}
 	return resources, nil
 }
 
+// countResourcesMatchingSearch returns the total number of resources matching
+// the search in `options`, ignoring the limit and offset.
+func countResourcesMatchingSearch(db *sqlx.DB, options ResourceSearchOptions) (int, error) {
+	stmt := "SELECT COUNT(*) FROM resource AS parent" + resourceSearchFilter
+	pathPattern, descriptionPattern := resourceSearchPatterns(options.Query)
+	var count int
+	err := db.Get(&count, stmt, pathPattern, descriptionPattern)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// SubresourceOut is a resource in a listing of the resources under another
+// one, down to some depth. `Subresources` is left out below that depth.
+type SubresourceOut struct {
+	Name         string            `json:"name"`
+	Path         string            `json:"path"`
+	Subresources []*SubresourceOut `json:"subresources,omitempty"`
+}
+
+// ResourceTreeOut is a resource with the whole tree of resources under it,
+// for reading a resource with `?expand`.
+type ResourceTreeOut struct {
+	Name         string             `json:"name"`
+	Path         string             `json:"path"`
+	Tag          string             `json:"tag"`
+	Description  string             `json:"description"`
+	Tags         map[string]string  `json:"tags"`
+	Subresources []*ResourceTreeOut `json:"subresources"`
+	// SchemaVersion is only set at the top of the tree.
+	SchemaVersion int `json:"schema_version,omitempty"`
+}
+
+// descendantsFromDb returns the resources up to `depth` levels below the
+// resource at `path`, without their own `subresources`. Ordering by path puts
+// every resource after its parent.
+func descendantsFromDb(db *sqlx.DB, path string, depth int) ([]ResourceFromQuery, error) {
+	stmt := `
+		SELECT child.id, child.name, child.path, child.tag, child.description, child.tags
+		FROM resource AS child
+		WHERE child.path ~ (
+			CAST ((CAST ($1 AS TEXT) || '.*{1,' || CAST ($2 AS TEXT) || '}') AS lquery)
+		)
+		ORDER BY child.path
+	`
+	descendants := []ResourceFromQuery{}
+	err := db.Select(&descendants, stmt, FormatPathForDb(path), depth)
+	if err != nil {
+		return nil, err
+	}
+	return descendants, nil
+}
+
+// dbParentPath returns the database path of the parent of the resource at
+// database path `path`.
+func dbParentPath(path string) string {
+	i := strings.LastIndex(path, ".")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// subresourcesFromDb returns the resources up to `depth` levels below the
+// resource at `path`, as a tree of the direct subresources.
+func subresourcesFromDb(db *sqlx.DB, path string, depth int) ([]*SubresourceOut, error) {
+	descendants, err := descendantsFromDb(db, path, depth)
+	if err != nil {
+		return nil, err
+	}
+	subresources := []*SubresourceOut{}
+	byPath := make(map[string]*SubresourceOut, len(descendants))
+	for _, descendant := range descendants {
+		node := &SubresourceOut{
+			Name: UnderscoreDecode(descendant.Name),
+			Path: formatDbPath(descendant.Path),
+		}
+		byPath[descendant.Path] = node
+		parent, isNested := byPath[dbParentPath(descendant.Path)]
+		if isNested {
+			parent.Subresources = append(parent.Subresources, node)
+		} else {
+			subresources = append(subresources, node)
+		}
+	}
+	return subresources, nil
+}
+
+// resourceTreeFromDb returns `resource` with the whole tree of resources under
+// it. The tree may be at most `maxDepth` levels deep below the resource;
+// `tooDeep` is true, and the tree is nil, if it's deeper than that.
+func resourceTreeFromDb(db *sqlx.DB, resource *ResourceFromQuery, maxDepth int) (tree *ResourceTreeOut, tooDeep bool, err error) {
+	// one more level than allowed, to tell if there is anything past it
+	descendants, err := descendantsFromDb(db, formatDbPath(resource.Path), maxDepth+1)
+	if err != nil {
+		return nil, false, err
+	}
+	rootLevel := strings.Count(resource.Path, ".")
+	byPath := make(map[string]*ResourceTreeOut, len(descendants)+1)
+	tree = resourceTreeNode(resource)
+	tree.SchemaVersion = OutputSchemaVersion
+	byPath[resource.Path] = tree
+	for i := range descendants {
+		if strings.Count(descendants[i].Path, ".")-rootLevel > maxDepth {
+			return nil, true, nil
+		}
+		node := resourceTreeNode(&descendants[i])
+		byPath[descendants[i].Path] = node
+		parent := byPath[dbParentPath(descendants[i].Path)]
+		parent.Subresources = append(parent.Subresources, node)
+	}
+	return tree, false, nil
+}
+
+func resourceTreeNode(resourceFromQuery *ResourceFromQuery) *ResourceTreeOut {
+	resource := resourceFromQuery.standardize()
+	return &ResourceTreeOut{
+		Name:         resource.Name,
+		Path:         resource.Path,
+		Tag:          resource.Tag,
+		Description:  resource.Description,
+		Tags:         resource.Tags,
+		Subresources: []*ResourceTreeOut{},
+	}
+}
+
 func (resource *ResourceIn) createInDb(tx *sqlx.Tx) *ErrorResponse {
-	errResponse := resource.createRecursively(tx)
+	errResponse := resource.createTreeInDb(tx)
 	if errResponse != nil {
 		return errResponse
 	}
 	return nil
 }
 
-func (resource *ResourceIn) createRecursively(tx *sqlx.Tx) *ErrorResponse {
+// createTreeInDb inserts this resource and the whole tree of subresources
+// under it, so a deep hierarchy can be set up with one request. The tree
+// should have been checked with `validatePaths` first.
+func (resource *ResourceIn) createTreeInDb(tx *sqlx.Tx) *ErrorResponse {
 	// arborist uses `/` for path separator; ltree in postgres uses `.`
 	path := FormatPathForDb(resource.Path)
-	stmt := "INSERT INTO resource(path, description) VALUES ($1, $2)"
-	_, err := tx.Exec(stmt, path, resource.Description)
+	tags, err := resource.tagsJSON()
 	if err != nil {
-		// should add more checking here to guarantee the correct error
-		// TODO (rudyardrichter, 2019-06-04): rollback probably not necessary,
-		// since this is probably called with `transactify`
-		_ = tx.Rollback()
-		// this should only fail because the resource was not unique. return error
-		// accordingly
+		msg := fmt.Sprintf("couldn't encode tags for resource `%s`: %s", resource.Path, err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	stmt := "INSERT INTO resource(path, description, tags) VALUES ($1, $2, $3)"
+	_, err = tx.Exec(stmt, path, resource.Description, tags)
+	// no rollback here: the caller (`transactify`) rolls back everything this
+	// tree inserted so far, so a failure partway leaves nothing behind.
+	if isUniqueViolation(err) {
 		msg := fmt.Sprintf("failed to insert resource: resource with this path already exists: `%s`", resource.Path)
-		return newErrorResponse(msg, 409, &err)
+		return newErrorResponse(msg, 409, &err).withCode(ErrorCodeResourceExists)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("failed to insert resource `%s`: %s", resource.Path, err.Error())
+		return newErrorResponse(msg, 500, &err)
 	}
 	// TODO (rudyardrichter, 2019-04-09): optimize (could be non-recursive)
 	for _, subresource := range resource.Subresources {
@@ -288,7 +541,8 @@ func (resource *ResourceIn) createRecursively(tx *sqlx.Tx) *ErrorResponse {
 		if subresource.Path == "" {
 			subresource.Path = resource.Path + "/" + subresource.Name
 		}
-		errResponse := subresource.createRecursively(tx)
+		subresource.Path = normalizeResourcePath(subresource.Path)
+		errResponse := subresource.createTreeInDb(tx)
 		if errResponse != nil {
 			return errResponse
 		}
@@ -296,6 +550,43 @@ func (resource *ResourceIn) createRecursively(tx *sqlx.Tx) *ErrorResponse {
 	return nil
 }
 
+// tagsJSON encodes the tags of this resource for the `tags` column.
+func (resource *ResourceIn) tagsJSON() (string, error) {
+	if resource.Tags == nil {
+		return "{}", nil
+	}
+	tags, err := json.Marshal(resource.Tags)
+	if err != nil {
+		return "", err
+	}
+	return string(tags), nil
+}
+
+// parseTagFilter reads a `key:value` tag filter from the resource list query.
+func parseTagFilter(filter string) (key string, value string, ok bool) {
+	i := strings.Index(filter, ":")
+	if i <= 0 {
+		return "", "", false
+	}
+	return filter[:i], filter[i+1:], true
+}
+
+// createParents inserts every ancestor of this resource which doesn't exist
+// yet, like `mkdir -p`.
+func (resource *ResourceIn) createParents(tx *sqlx.Tx) *ErrorResponse {
+	segments := strings.Split(strings.TrimLeft(resource.Path, "/"), "/")
+	stmt := "INSERT INTO resource(path) VALUES ($1) ON CONFLICT DO NOTHING"
+	for i := 0; i < len(segments)-1; i++ {
+		path := "/" + strings.Join(segments[:i+1], "/")
+		_, err := tx.Exec(stmt, FormatPathForDb(path))
+		if err != nil {
+			msg := fmt.Sprintf("failed to create parent resource `%s`: %s", path, err.Error())
+			return newErrorResponse(msg, 500, &err)
+		}
+	}
+	return nil
+}
+
 func (resource *ResourceIn) deleteInDb(tx *sqlx.Tx) *ErrorResponse {
 	if resource.Path == "" {
 		msg := "resource missing required field `path`"
@@ -310,6 +601,119 @@ func (resource *ResourceIn) deleteInDb(tx *sqlx.Tx) *ErrorResponse {
 	return nil
 }
 
+// moveResourceInDb moves the resource at `oldPath`, and everything under it,
+// to `newPath`, rewriting the paths (and so the names) of all of them. The
+// new parent has to exist already, and nothing can exist at the new path.
+//
+// Policies point at resources by ID, so they follow the move without any
+// change; soft-deleted policies keep paths, so those are rewritten here to
+// still restore onto the moved resources.
+func moveResourceInDb(tx *sqlx.Tx, oldPath string, newPath string) *ErrorResponse {
+	if newPath == "" || !strings.HasPrefix(newPath, "/") || newPath == "/" {
+		msg := fmt.Sprintf("`new_path` must be a full resource path; got `%s`", newPath)
+		return newErrorResponse(msg, 400, nil)
+	}
+	if invalid := invalidPathCharacters(newPath); len(invalid) > 0 {
+		msg := fmt.Sprintf(
+			"resource path %q contains characters which are not allowed: %q",
+			newPath,
+			string(invalid),
+		)
+		return newErrorResponse(msg, 400, nil)
+	}
+	if newPath == oldPath {
+		msg := fmt.Sprintf("resource `%s` is already at that path", oldPath)
+		return newErrorResponse(msg, 400, nil)
+	}
+	if strings.HasPrefix(newPath, oldPath+"/") {
+		msg := fmt.Sprintf("can't move resource `%s` under itself, to `%s`", oldPath, newPath)
+		return newErrorResponse(msg, 400, nil)
+	}
+	dbOldPath := FormatPathForDb(oldPath)
+	dbNewPath := FormatPathForDb(newPath)
+	var exists bool
+	err := tx.Get(&exists, "SELECT EXISTS (SELECT 1 FROM resource WHERE path = $1)", dbOldPath)
+	if err != nil {
+		msg := fmt.Sprintf("failed to look up resource `%s`: %s", oldPath, err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	if !exists {
+		msg := fmt.Sprintf("resource does not exist: %s", oldPath)
+		return newErrorResponse(msg, 404, nil).withCode(ErrorCodeResourceNotFound)
+	}
+	err = tx.Get(&exists, "SELECT EXISTS (SELECT 1 FROM resource WHERE path = $1)", dbNewPath)
+	if err != nil {
+		msg := fmt.Sprintf("failed to look up resource `%s`: %s", newPath, err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	if exists {
+		msg := fmt.Sprintf("can't move resource `%s`: resource with this path already exists: `%s`", oldPath, newPath)
+		return newErrorResponse(msg, 409, nil).withCode(ErrorCodeResourceExists)
+	}
+	if parent := dbParentPath(dbNewPath); parent != "" {
+		err = tx.Get(&exists, "SELECT EXISTS (SELECT 1 FROM resource WHERE path = $1)", parent)
+		if err != nil {
+			msg := fmt.Sprintf("failed to look up resource `%s`: %s", formatDbPath(parent), err.Error())
+			return newErrorResponse(msg, 500, &err)
+		}
+		if !exists {
+			msg := fmt.Sprintf(
+				"can't move resource `%s` to `%s`: parent resource `%s` does not exist",
+				oldPath,
+				newPath,
+				formatDbPath(parent),
+			)
+			return newErrorResponse(msg, 400, nil)
+		}
+	}
+	// The name is set here along with the path, since the update trigger
+	// computing it runs too late to change it. Rewriting the whole subtree in
+	// one statement also leaves nothing under the old path for the trigger
+	// `resource_path_update_children` to rewrite.
+	stmt := `
+		UPDATE resource
+		SET path = moved.path, name = ltree2text(subpath(moved.path, -1))
+		FROM (
+			SELECT
+				id,
+				CASE
+					WHEN path = text2ltree($1) THEN text2ltree($2)
+					ELSE text2ltree($2) || subpath(path, nlevel(text2ltree($1)))
+				END AS path
+			FROM resource
+			WHERE path <@ text2ltree($1)
+		) AS moved
+		WHERE resource.id = moved.id
+	`
+	_, err = tx.Exec(stmt, dbOldPath, dbNewPath)
+	if err != nil {
+		msg := fmt.Sprintf("failed to move resource `%s` to `%s`: %s", oldPath, newPath, err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	stmt = `
+		UPDATE policy_archive
+		SET resource_paths = ARRAY(
+			SELECT CASE
+				WHEN archived = text2ltree($1) THEN text2ltree($2)
+				WHEN archived <@ text2ltree($1) THEN text2ltree($2) || subpath(archived, nlevel(text2ltree($1)))
+				ELSE archived
+			END
+			FROM unnest(policy_archive.resource_paths) WITH ORDINALITY AS paths(archived, n)
+			ORDER BY n
+		)
+		WHERE EXISTS (
+			SELECT 1 FROM unnest(policy_archive.resource_paths) AS archived
+			WHERE archived <@ text2ltree($1)
+		)
+	`
+	_, err = tx.Exec(stmt, dbOldPath, dbNewPath)
+	if err != nil {
+		msg := fmt.Sprintf("failed to update soft-deleted policies for moved resource `%s`: %s", oldPath, err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	return nil
+}
+
 // addPathAndName fills out the path or name using the parent path. Resources
 // can input only `name` instead of `path` in the JSON body, and use the path
 // in the URL instead, so this fills out the path if necessary.
@@ -323,12 +727,153 @@ func (resource *ResourceIn) addPath(parent string) *ErrorResponse {
 		}
 		resource.Path = parent + "/" + resource.Name
 	}
-	// the resource creation is ok with having duplicate slashes but it'll
-	// mess with the queries using this resource, so let's clean it up now
-	resource.Path = regSlashes.ReplaceAllLiteralString(resource.Path, "/")
+	resource.Path = normalizeResourcePath(resource.Path)
 	return nil
 }
 
+var regSlashes *regexp.Regexp = regexp.MustCompile(`/+`)
+
+// normalizeResourcePath collapses duplicate slashes in a resource path and
+// strips any trailing slash, so that `/a//b/` and `/a/b` are the same
+// resource. The resource creation is ok with either, but they would be stored
+// as different rows and mess with the queries using them.
+//
+//     normalizeResourcePath("/a//b/") == "/a/b"
+func normalizeResourcePath(path string) string {
+	path = regSlashes.ReplaceAllLiteralString(path, "/")
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+// invalidPathCharacters returns the characters in `path` which aren't allowed
+// in a resource path. Paths may only use letters, digits, `_`, `-` and `/`,
+// besides a segment which is exactly `*`, the wildcard.
+func invalidPathCharacters(path string) []rune {
+	invalid := []rune{}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "*" {
+			continue
+		}
+		for _, char := range segment {
+			if !isPathCharacter(char) {
+				invalid = append(invalid, char)
+			}
+		}
+	}
+	return invalid
+}
+
+func isPathCharacter(char rune) bool {
+	return ('a' <= char && char <= 'z') ||
+		('A' <= char && char <= 'Z') ||
+		('0' <= char && char <= '9') ||
+		char == '_' ||
+		char == '-'
+}
+
+// checkDepth makes sure the subresources nested in this resource go at most
+// `maxDepth` levels deep, before anything walks the tree recursively. It
+// doesn't recurse itself, so a very deep input can't run it out of stack.
+func (resource *ResourceIn) checkDepth(maxDepth int) *ErrorResponse {
+	level := resource.Subresources
+	for depth := 1; len(level) > 0; depth++ {
+		if depth > maxDepth {
+			msg := fmt.Sprintf(
+				"resource `%s` nests more than %d levels of subresources; create the deeper ones separately",
+				resource.Path,
+				maxDepth,
+			)
+			return newErrorResponse(msg, 400, nil)
+		}
+		next := []ResourceIn{}
+		for _, subresource := range level {
+			next = append(next, subresource.Subresources...)
+		}
+		level = next
+	}
+	return nil
+}
+
+// validatePaths checks the path of this resource, and of every subresource
+// under it, for characters which aren't allowed (see
+// `invalidPathCharacters`). Subresources given only by name are checked by
+// their name, which is what ends up in their path. Each subresource also has
+// to name a resource directly under its parent (see `subresourcePath`).
+func (resource *ResourceIn) validatePaths() *ErrorResponse {
+	return resource.validateTree(resource.Path)
+}
+
+// validateTree does the work of `validatePaths` for a resource which ends up
+// at `fullPath`, or at a path not known yet if it's empty.
+func (resource *ResourceIn) validateTree(fullPath string) *ErrorResponse {
+	path := resource.Path
+	if path == "" {
+		path = resource.Name
+	}
+	invalid := invalidPathCharacters(path)
+	if len(invalid) > 0 {
+		msg := fmt.Sprintf(
+			"resource path %q contains characters which are not allowed: %q",
+			path,
+			string(invalid),
+		)
+		return newErrorResponse(msg, 400, nil)
+	}
+	for key := range resource.Tags {
+		if key == "" || strings.Contains(key, ":") {
+			msg := fmt.Sprintf("resource tag key %q must be non-empty and must not contain `:`", key)
+			return newErrorResponse(msg, 400, nil)
+		}
+	}
+	for _, subresource := range resource.Subresources {
+		subPath, errResponse := subresource.subresourcePath(fullPath)
+		if errResponse != nil {
+			return errResponse
+		}
+		errResponse = subresource.validateTree(subPath)
+		if errResponse != nil {
+			return errResponse
+		}
+	}
+	return nil
+}
+
+// subresourcePath returns where this subresource of the resource at `parent`
+// ends up, making sure it's one level below the parent: a subresource needs
+// a name without any `/`, or a path directly under the parent's. If the
+// parent's path isn't known, neither is the subresource's, unless it has a
+// full path.
+func (resource *ResourceIn) subresourcePath(parent string) (string, *ErrorResponse) {
+	if resource.Path != "" {
+		path := normalizeResourcePath(resource.Path)
+		if parent != "" {
+			parentOfPath := "/"
+			if i := strings.LastIndex(path, "/"); i > 0 {
+				parentOfPath = path[:i]
+			}
+			if parentOfPath != normalizeResourcePath(parent) {
+				msg := fmt.Sprintf("subresource path `%s` is not directly under `%s`", path, parent)
+				return "", newErrorResponse(msg, 400, nil)
+			}
+		}
+		return path, nil
+	}
+	if resource.Name == "" {
+		err := missingRequiredField("resource", "name")
+		return "", newErrorResponse(err.Error(), 400, &err)
+	}
+	if strings.Contains(resource.Name, "/") {
+		msg := fmt.Sprintf("subresource name `%s` must not contain `/`; nest it in `subresources` instead", resource.Name)
+		return "", newErrorResponse(msg, 400, nil)
+	}
+	if parent == "" {
+		return "", nil
+	}
+	return normalizeResourcePath(parent + "/" + resource.Name), nil
+}
+
 func (resource *ResourceIn) updateInDb(tx *sqlx.Tx, merge bool) *ErrorResponse {
 	// arborist uses `/` for path separator; ltree in postgres uses `.`
 	path := FormatPathForDb(resource.Path)
@@ -342,7 +887,7 @@ func (resource *ResourceIn) updateInDb(tx *sqlx.Tx, merge bool) *ErrorResponse {
 		// this should only fail because the resource was not unique. return error
 		// accordingly
 		msg := fmt.Sprintf("failed to insert resource: resource with this path already exists: `%s`", resource.Path)
-		return newErrorResponse(msg, 409, &err)
+		return newErrorResponse(msg, 409, &err).withCode(ErrorCodeResourceExists)
 	}
 
 	if resource.Description != nil {
@@ -351,6 +896,20 @@ func (resource *ResourceIn) updateInDb(tx *sqlx.Tx, merge bool) *ErrorResponse {
 		_, err = tx.Exec(stmt, path, resource.Description)
 	}
 
+	if resource.Tags != nil {
+		tags, err := resource.tagsJSON()
+		if err != nil {
+			msg := fmt.Sprintf("couldn't encode tags for resource `%s`: %s", resource.Path, err.Error())
+			return newErrorResponse(msg, 500, &err)
+		}
+		stmt = "UPDATE resource SET tags = $2 WHERE path = $1"
+		_, err = tx.Exec(stmt, path, tags)
+		if err != nil {
+			msg := fmt.Sprintf("couldn't update tags for resource `%s`: %s", resource.Path, err.Error())
+			return newErrorResponse(msg, 500, &err)
+		}
+	}
+
 	if !merge {
 		// delete the subresources not in the new request
 		if len(resource.Subresources) > 0 {
@@ -26,3 +26,156 @@ func TestEncodeDecode(t *testing.T) {
 		assert.True(t, regValidDbPath.MatchString(encoded), "encoded contains invalid characters")
 	}
 }
+
+func TestValidatePaths(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		resource := ResourceIn{
+			Path:         "/a_b/C-9",
+			Subresources: []ResourceIn{{Name: "*", Subresources: []ResourceIn{{Name: "d"}}}},
+		}
+		assert.Nil(t, resource.validatePaths())
+	})
+
+	t.Run("Space", func(t *testing.T) {
+		resource := ResourceIn{Path: "/a b"}
+		errResponse := resource.validatePaths()
+		if assert.NotNil(t, errResponse) {
+			assert.Equal(t, 400, errResponse.HTTPError.Code)
+			assert.Contains(t, errResponse.HTTPError.Message, `" "`)
+		}
+	})
+
+	t.Run("Colon", func(t *testing.T) {
+		resource := ResourceIn{Path: "/a:b"}
+		errResponse := resource.validatePaths()
+		if assert.NotNil(t, errResponse) {
+			assert.Equal(t, 400, errResponse.HTTPError.Code)
+			assert.Contains(t, errResponse.HTTPError.Message, `":"`)
+		}
+	})
+
+	t.Run("Punctuation", func(t *testing.T) {
+		resource := ResourceIn{Path: "/a.b/c*/(d)"}
+		errResponse := resource.validatePaths()
+		if assert.NotNil(t, errResponse) {
+			assert.Contains(t, errResponse.HTTPError.Message, `".*()"`)
+		}
+	})
+
+	t.Run("Subresource", func(t *testing.T) {
+		resource := ResourceIn{
+			Path:         "/a",
+			Subresources: []ResourceIn{{Name: "b\tc"}},
+		}
+		errResponse := resource.validatePaths()
+		if assert.NotNil(t, errResponse) {
+			assert.Contains(t, errResponse.HTTPError.Message, `"\t"`)
+		}
+	})
+
+	t.Run("SubresourcePaths", func(t *testing.T) {
+		resource := ResourceIn{
+			Path: "/a",
+			Subresources: []ResourceIn{
+				{Path: "/a/b", Subresources: []ResourceIn{{Name: "c"}}},
+				{Name: "d", Subresources: []ResourceIn{{Path: "/a/d/e"}}},
+			},
+		}
+		assert.Nil(t, resource.validatePaths())
+	})
+
+	t.Run("TagKeys", func(t *testing.T) {
+		resource := ResourceIn{
+			Path:         "/a",
+			Tags:         map[string]string{"team": "x:y"},
+			Subresources: []ResourceIn{{Name: "b", Tags: map[string]string{"a:b": "c"}}},
+		}
+		errResponse := resource.validatePaths()
+		if assert.NotNil(t, errResponse) {
+			assert.Contains(t, errResponse.HTTPError.Message, `"a:b"`)
+		}
+	})
+
+	t.Run("Depth", func(t *testing.T) {
+		resource := ResourceIn{Path: "/a"}
+		leaf := &resource
+		for i := 0; i < 3; i++ {
+			leaf.Subresources = []ResourceIn{{Name: "b"}}
+			leaf = &leaf.Subresources[0]
+		}
+		assert.Nil(t, resource.checkDepth(3))
+		errResponse := resource.checkDepth(2)
+		if assert.NotNil(t, errResponse) {
+			assert.Equal(t, 400, errResponse.HTTPError.Code)
+			assert.Contains(t, errResponse.HTTPError.Message, "more than 2 levels")
+		}
+	})
+
+	invalid := map[string]ResourceIn{
+		"MissingName": {
+			Path:         "/a",
+			Subresources: []ResourceIn{{Name: "b", Subresources: []ResourceIn{{}}}},
+		},
+		"NameWithSlash": {
+			Path:         "/a",
+			Subresources: []ResourceIn{{Name: "b", Subresources: []ResourceIn{{Name: "c/d"}}}},
+		},
+		"PathNotUnderParent": {
+			Path:         "/a",
+			Subresources: []ResourceIn{{Name: "b", Subresources: []ResourceIn{{Path: "/a/c/d"}}}},
+		},
+		"PathTooDeep": {
+			Path:         "/a",
+			Subresources: []ResourceIn{{Path: "/a/b/c"}},
+		},
+	}
+	for name, resource := range invalid {
+		resource := resource
+		t.Run(name, func(t *testing.T) {
+			errResponse := resource.validatePaths()
+			if assert.NotNil(t, errResponse) {
+				assert.Equal(t, 400, errResponse.HTTPError.Code)
+			}
+		})
+	}
+}
+
+func TestNormalizeResourcePath(t *testing.T) {
+	cases := map[string]string{
+		"/a/b":      "/a/b",
+		"/a/b/":     "/a/b",
+		"/a//b":     "/a/b",
+		"//a///b//": "/a/b",
+		"/":         "/",
+		"//":        "/",
+	}
+	for input, expected := range cases {
+		assert.Equal(t, expected, normalizeResourcePath(input), "input: %s", input)
+	}
+}
+
+func TestResourceSearchPatterns(t *testing.T) {
+	path, description := resourceSearchPatterns("/a/b_c")
+	assert.Equal(t, `%a.b\_S0c%`, path)
+	assert.Equal(t, `%/a/b\_c%`, description)
+
+	// LIKE wildcards in the query are matched literally
+	_, description = resourceSearchPatterns(`100% \ done`)
+	assert.Equal(t, `%100\% \\ done%`, description)
+}
+
+func TestParseTagFilter(t *testing.T) {
+	key, value, ok := parseTagFilter("team:data:science")
+	assert.True(t, ok)
+	assert.Equal(t, "team", key)
+	assert.Equal(t, "data:science", value)
+
+	_, value, ok = parseTagFilter("team:")
+	assert.True(t, ok)
+	assert.Equal(t, "", value)
+
+	for _, invalid := range []string{"team", ":data", ""} {
+		_, _, ok := parseTagFilter(invalid)
+		assert.False(t, ok, "filter: %q", invalid)
+	}
+}
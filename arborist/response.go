@@ -1,13 +1,27 @@
 package arborist
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
+// OutputSchemaVersion is sent as `schema_version` in the policies, resources
+// and roles arborist returns, so clients can tell which shape they got. Bump
+// it whenever the fields of any of them change in a way clients would notice.
+const OutputSchemaVersion = 1
+
 type jsonResponse struct {
 	content interface{}
 	code    int
+	// etag is set by `withETag`.
+	etag bool
+	// location is set by `withLocation`.
+	location string
 }
 
 func jsonResponseFrom(content interface{}, code int) *jsonResponse {
@@ -17,6 +31,50 @@ func jsonResponseFrom(content interface{}, code int) *jsonResponse {
 	}
 }
 
+// withETag sends a hash of the response body as its `ETag`, and turns the
+// response into a 304 with no body if the request's `If-None-Match` already
+// has that ETag, so clients polling for changes only download them once.
+func (response *jsonResponse) withETag() *jsonResponse {
+	response.etag = true
+	return response
+}
+
+// withLocation sets the `Location` header, for a 201 response to point at
+// where the created object can be read.
+func (response *jsonResponse) withLocation(location string) *jsonResponse {
+	response.location = location
+	return response
+}
+
+// locationPath is the URL path made of `segments`, each escaped.
+//
+//     locationPath("policy", "a/b") == "/policy/a%2Fb"
+func locationPath(segments ...string) string {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = url.PathEscape(segment)
+	}
+	return "/" + strings.Join(escaped, "/")
+}
+
+// bodyETag is the ETag for a response body: a hash of its contents.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// etagMatches reports whether the value of an `If-None-Match` header lists
+// `etag`, or is `*`. Weak ETags match too.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func wantPrettyJSON(r *http.Request) bool {
 	prettyJSON := false
 	if r.Method == "GET" {
@@ -26,23 +84,51 @@ func wantPrettyJSON(r *http.Request) bool {
 	return prettyJSON
 }
 
-func (response *jsonResponse) write(w http.ResponseWriter, r *http.Request) error {
-	w.Header().Set("Content-Type", "application/json")
-	if response.code > 0 {
-		w.WriteHeader(response.code)
-	} else {
-		w.WriteHeader(http.StatusOK)
-	}
+// encodeResponse marshals the content of a response as JSON, or as YAML if
+// the request asks for it (see `wantYAML`), and returns the content type.
+func encodeResponse(r *http.Request, content interface{}) ([]byte, string, error) {
 	var bytes []byte
 	var err error
 	if wantPrettyJSON(r) {
-		bytes, err = json.MarshalIndent(response.content, "", "    ")
+		bytes, err = json.MarshalIndent(content, "", "    ")
 	} else {
-		bytes, err = json.Marshal(response.content)
+		bytes, err = json.Marshal(content)
 	}
+	if err != nil {
+		return nil, "", err
+	}
+	if wantYAML(r) {
+		bytes, err = jsonToYAML(bytes)
+		if err != nil {
+			return nil, "", err
+		}
+		return bytes, "application/yaml", nil
+	}
+	return bytes, "application/json", nil
+}
+
+func (response *jsonResponse) write(w http.ResponseWriter, r *http.Request) error {
+	bytes, contentType, err := encodeResponse(r, response.content)
 	if err != nil {
 		return err
 	}
+	if response.etag && (response.code == 0 || response.code == http.StatusOK) {
+		etag := bodyETag(bytes)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	if response.location != "" {
+		w.Header().Set("Location", response.location)
+	}
+	if response.code > 0 {
+		w.WriteHeader(response.code)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
 	_, err = w.Write(bytes)
 	if err != nil {
 		return err
@@ -50,9 +136,52 @@ func (response *jsonResponse) write(w http.ResponseWriter, r *http.Request) erro
 	return nil
 }
 
+// writeJSONList writes `{"<key>":[...]}` to `w`, encoding each element as
+// `next` returns it, until `next` reports there are no more. The list is never
+// all in memory at once. If `next` or a write fails, the output stops there,
+// without the closing brackets.
+func writeJSONList(w io.Writer, key string, next func() (interface{}, bool, error)) error {
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte("{" + string(keyJSON) + ":["))
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	for first := true; ; first = false {
+		element, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if !first {
+			_, err = w.Write([]byte(","))
+			if err != nil {
+				return err
+			}
+		}
+		err = encoder.Encode(element)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Write([]byte("]}"))
+	return err
+}
+
 type HTTPError struct {
 	Message string `json:"message"`
 	Code    int    `json:"code"`
+	// ErrorCode is a stable, machine-readable name for the error (see
+	// `errors.go`), for clients to check instead of the message.
+	ErrorCode string `json:"error_code"`
+	// RequestID is the ID of the request which failed (see `requestid.go`),
+	// to find the server's logs for it.
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type ErrorResponse struct {
@@ -68,8 +197,9 @@ type ErrorResponse struct {
 func newErrorResponse(message string, code int, err *error) *ErrorResponse {
 	response := &ErrorResponse{
 		HTTPError: HTTPError{
-			Message: message,
-			Code:    code,
+			Message:   message,
+			Code:      code,
+			ErrorCode: defaultErrorCode(code),
 		},
 	}
 	if err != nil {
@@ -83,25 +213,21 @@ func newErrorResponse(message string, code int, err *error) *ErrorResponse {
 	return response
 }
 
-func (errorResponse *ErrorResponse) write(w http.ResponseWriter, r *http.Request) error {
-	var bytes []byte
-	var err error
+// withCode replaces the generic error code from the HTTP status with a more
+// specific one, like `ErrorCodePolicyNotFound`.
+func (errorResponse *ErrorResponse) withCode(errorCode string) *ErrorResponse {
+	errorResponse.HTTPError.ErrorCode = errorCode
+	return errorResponse
+}
 
-	prettyJSON := false
-	if r.Method == "GET" {
-		prettyJSON = prettyJSON || r.URL.Query().Get("pretty") == "true"
-		prettyJSON = prettyJSON || r.URL.Query().Get("prettyJSON") == "true"
-	}
+func (errorResponse *ErrorResponse) write(w http.ResponseWriter, r *http.Request) error {
+	errorResponse.HTTPError.RequestID = requestID(r.Context())
 
-	if prettyJSON {
-		bytes, err = json.MarshalIndent(errorResponse, "", "    ")
-	} else {
-		bytes, err = json.Marshal(errorResponse)
-	}
+	bytes, contentType, err := encodeResponse(r, errorResponse)
 	if err != nil {
 		return err
 	}
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(errorResponse.HTTPError.Code)
 	_, err = w.Write(bytes)
 	if err != nil {
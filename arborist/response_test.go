@@ -0,0 +1,109 @@
+package arborist
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETagMatches(t *testing.T) {
+	etag := `"abc"`
+	assert.True(t, etagMatches(`"abc"`, etag))
+	assert.True(t, etagMatches(`"xyz", "abc"`, etag))
+	assert.True(t, etagMatches(`W/"abc"`, etag))
+	assert.True(t, etagMatches(`*`, etag))
+	assert.False(t, etagMatches(``, etag))
+	assert.False(t, etagMatches(`"xyz"`, etag))
+	assert.False(t, etagMatches(`abc`, etag))
+}
+
+func TestWithETag(t *testing.T) {
+	get := func(ifNoneMatch string, content interface{}) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/policy/p", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		err := jsonResponseFrom(content, http.StatusOK).withETag().write(w, r)
+		assert.NoError(t, err)
+		return w
+	}
+
+	first := get("", map[string]string{"id": "p"})
+	assert.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	notModified := get(etag, map[string]string{"id": "p"})
+	assert.Equal(t, http.StatusNotModified, notModified.Code)
+	assert.Equal(t, etag, notModified.Header().Get("ETag"))
+	assert.Empty(t, notModified.Body.String())
+
+	changed := get(etag, map[string]string{"id": "p", "description": "new"})
+	assert.Equal(t, http.StatusOK, changed.Code)
+	assert.NotEqual(t, etag, changed.Header().Get("ETag"))
+
+	// responses without `withETag` don't get one
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/policy", nil)
+	_ = jsonResponseFrom("x", http.StatusOK).write(w, r)
+	assert.Empty(t, w.Header().Get("ETag"))
+}
+
+func TestWithLocation(t *testing.T) {
+	assert.Equal(t, "/policy/a%2Fb", locationPath("policy", "a/b"))
+	assert.Equal(t, "/resource/a/b%20c", locationPath("resource", "a", "b c"))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/policy", nil)
+	err := jsonResponseFrom("x", http.StatusCreated).withLocation("/policy/p").write(w, r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "/policy/p", w.Header().Get("Location"))
+
+	// responses without `withLocation` don't get one
+	w = httptest.NewRecorder()
+	_ = jsonResponseFrom("x", http.StatusCreated).write(w, r)
+	assert.Empty(t, w.Header().Get("Location"))
+}
+
+func TestWriteJSONList(t *testing.T) {
+	elements := func(n int, err error) func() (interface{}, bool, error) {
+		i := 0
+		return func() (interface{}, bool, error) {
+			if i == n {
+				return nil, false, err
+			}
+			i++
+			return map[string]int{"i": i}, true, nil
+		}
+	}
+
+	body := &bytes.Buffer{}
+	assert.NoError(t, writeJSONList(body, "items", elements(1000, nil)))
+	result := struct {
+		Items []struct {
+			I int `json:"i"`
+		} `json:"items"`
+	}{}
+	assert.NoError(t, json.Unmarshal(body.Bytes(), &result))
+	if assert.Len(t, result.Items, 1000) {
+		assert.Equal(t, 1, result.Items[0].I)
+		assert.Equal(t, 1000, result.Items[999].I)
+	}
+
+	body.Reset()
+	assert.NoError(t, writeJSONList(body, "items", elements(0, nil)))
+	assert.JSONEq(t, `{"items": []}`, body.String())
+
+	// an error partway leaves the list unfinished, so it doesn't parse
+	body.Reset()
+	failed := errors.New("connection lost")
+	assert.Equal(t, failed, writeJSONList(body, "items", elements(3, failed)))
+	assert.Error(t, json.Unmarshal(body.Bytes(), &result))
+}
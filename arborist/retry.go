@@ -0,0 +1,70 @@
+package arborist
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultReadAttempts is how many times the server tries a read query which
+// fails with a transient error, unless changed with `WithReadAttempts`.
+const DefaultReadAttempts = 3
+
+// retryBaseDelay is the wait before the first retry; it doubles after each
+// further attempt.
+var retryBaseDelay = 50 * time.Millisecond
+
+// isTransientDBError reports whether a query which failed with `err` might
+// succeed if run again: dropped connections, serialization failures and
+// deadlocks, and the database shutting down or not yet accepting connections.
+func isTransientDBError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code.Class() == "08": // connection_exception
+			return true
+		case pqErr.Code == "40001": // serialization_failure
+			return true
+		case pqErr.Code == "40P01": // deadlock_detected
+			return true
+		case pqErr.Code.Class() == "57" && pqErr.Code != "57014": // operator intervention, except query_canceled
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection reset")
+}
+
+// retryTransient calls `query` up to `attempts` times, stopping as soon as it
+// succeeds or fails with an error which is not transient. The wait between
+// attempts starts at `retryBaseDelay` and doubles each time.
+func retryTransient(attempts int, query func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := retryBaseDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = query()
+		if err == nil || attempt >= attempts || !isTransientDBError(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
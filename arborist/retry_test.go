@@ -0,0 +1,181 @@
+package arborist
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyDriver is a fake database driver whose queries fail with `failWith`
+// for the first `failures` queries, and after that return a single row
+// containing `result`. If `failExecAt` is set, that statement (counting from
+// 1) executed with `Exec` fails with `failWith` instead.
+type flakyDriver struct {
+	failures   int
+	failExecAt int
+	failWith   error
+	result     int64
+	queries    int
+	execs      int
+	commits    int
+	rollbacks  int
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	return &flakyConn{driver: d}, nil
+}
+
+type flakyConn struct {
+	driver *flakyDriver
+}
+
+func (c *flakyConn) Prepare(query string) (driver.Stmt, error) {
+	return &flakyStmt{driver: c.driver}, nil
+}
+
+func (c *flakyConn) Close() error {
+	return nil
+}
+
+func (c *flakyConn) Begin() (driver.Tx, error) {
+	return &flakyTx{driver: c.driver}, nil
+}
+
+type flakyTx struct {
+	driver *flakyDriver
+}
+
+func (tx *flakyTx) Commit() error {
+	tx.driver.commits++
+	return nil
+}
+
+func (tx *flakyTx) Rollback() error {
+	tx.driver.rollbacks++
+	return nil
+}
+
+type flakyStmt struct {
+	driver *flakyDriver
+}
+
+func (s *flakyStmt) Close() error {
+	return nil
+}
+
+func (s *flakyStmt) NumInput() int {
+	return -1
+}
+
+func (s *flakyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.driver.execs++
+	if s.driver.execs == s.driver.failExecAt {
+		return nil, s.driver.failWith
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *flakyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.driver.queries++
+	if s.driver.queries <= s.driver.failures {
+		return nil, s.driver.failWith
+	}
+	return &flakyRows{value: s.driver.result}, nil
+}
+
+type flakyRows struct {
+	value int64
+	done  bool
+}
+
+func (r *flakyRows) Columns() []string {
+	return []string{"count"}
+}
+
+func (r *flakyRows) Close() error {
+	return nil
+}
+
+func (r *flakyRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.value
+	return nil
+}
+
+// flakyDrivers counts registrations, since driver names must be unique.
+var flakyDrivers int
+
+func newFlakyDB(t *testing.T, d *flakyDriver) *sqlx.DB {
+	flakyDrivers++
+	name := fmt.Sprintf("flaky-%d", flakyDrivers)
+	sql.Register(name, d)
+	db, err := sqlx.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRetryTransient(t *testing.T) {
+	retryBaseDelay = time.Millisecond
+
+	t.Run("FailsOnceThenSucceeds", func(t *testing.T) {
+		d := &flakyDriver{failures: 1, failWith: &pq.Error{Code: "40001"}, result: 42}
+		db := newFlakyDB(t, d)
+		defer db.Close()
+		var count int
+		err := retryTransient(3, func() (err error) {
+			count, err = countPoliciesFromDb(db, PolicyListOptions{})
+			return err
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 42, count)
+		assert.Equal(t, 2, d.queries, "expected one failed query and one retry")
+	})
+
+	t.Run("GivesUpAfterAttempts", func(t *testing.T) {
+		d := &flakyDriver{failures: 5, failWith: &pq.Error{Code: "08006"}}
+		db := newFlakyDB(t, d)
+		defer db.Close()
+		err := retryTransient(3, func() error {
+			_, err := countPoliciesFromDb(db, PolicyListOptions{})
+			return err
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 3, d.queries)
+	})
+
+	t.Run("NotTransient", func(t *testing.T) {
+		d := &flakyDriver{failures: 1, failWith: &pq.Error{Code: "42P01"}}
+		db := newFlakyDB(t, d)
+		defer db.Close()
+		err := retryTransient(3, func() error {
+			_, err := countPoliciesFromDb(db, PolicyListOptions{})
+			return err
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 1, d.queries, "non-transient errors should not be retried")
+	})
+}
+
+func TestIsTransientDBError(t *testing.T) {
+	assert.True(t, isTransientDBError(driver.ErrBadConn))
+	assert.True(t, isTransientDBError(&pq.Error{Code: "40P01"}))
+	assert.True(t, isTransientDBError(&pq.Error{Code: "57P01"}))
+	assert.True(t, isTransientDBError(errors.New("read tcp: connection reset by peer")))
+	assert.False(t, isTransientDBError(&pq.Error{Code: "57014"}))
+	assert.False(t, isTransientDBError(&pq.Error{Code: "23505"}))
+	assert.False(t, isTransientDBError(sql.ErrNoRows))
+	assert.False(t, isTransientDBError(nil))
+}
@@ -0,0 +1,93 @@
+package arborist
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// RevokedToken is a token which was revoked before it expired, going by its
+// `jti` claim. It is rejected until `ExpiresAt`, the token's own expiry.
+type RevokedToken struct {
+	JTI       string    `json:"jti" db:"jti"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+// revokedTokenFromClaims reads the `jti` and `exp` of a decoded token, which
+// are what revoking it needs.
+func revokedTokenFromClaims(claims *map[string]interface{}) (*RevokedToken, error) {
+	jti, ok := (*claims)["jti"].(string)
+	if !ok || jti == "" {
+		return nil, errors.New("token has no `jti` claim, so it can't be revoked")
+	}
+	exp, ok := (*claims)["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token has no `exp` claim")
+	}
+	return &RevokedToken{JTI: jti, ExpiresAt: time.Unix(int64(exp), 0).UTC()}, nil
+}
+
+// createInDb records the token as revoked. Revoking a token twice is not an
+// error.
+func (token *RevokedToken) createInDb(tx *sqlx.Tx) *ErrorResponse {
+	stmt := `
+		INSERT INTO revoked_token(jti, expires_at) VALUES ($1, $2)
+		ON CONFLICT (jti) DO UPDATE SET expires_at = GREATEST(revoked_token.expires_at, EXCLUDED.expires_at)
+	`
+	_, err := tx.Exec(stmt, token.JTI, token.ExpiresAt)
+	if err != nil {
+		msg := fmt.Sprintf("failed to revoke token: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	return nil
+}
+
+// tokenIsRevoked checks whether the token with this `jti` was revoked.
+func tokenIsRevoked(db *sqlx.DB, jti string) (bool, error) {
+	var revoked bool
+	stmt := "SELECT EXISTS (SELECT 1 FROM revoked_token WHERE jti = $1)"
+	err := db.Get(&revoked, stmt, jti)
+	return revoked, err
+}
+
+// pruneRevokedTokens drops the revoked tokens which have expired by `now`,
+// since those are rejected anyway, and returns how many were dropped. Tokens
+// are kept for the server's token leeway past their expiry, because
+// `decodeToken` accepts them that long.
+func (server *Server) pruneRevokedTokens(now time.Time) (int64, error) {
+	stmt := "DELETE FROM revoked_token WHERE expires_at < $1"
+	result, err := server.db.Exec(stmt, now.Add(-server.tokenLeeway))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// PruneRevokedTokensEvery drops expired revoked tokens every `interval` in
+// the background. Failures are logged, and tried again at the next interval.
+// Call the returned function to stop.
+func (server *Server) PruneRevokedTokensEvery(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				pruned, err := server.pruneRevokedTokens(server.clock())
+				if err != nil {
+					server.logger.Warning("couldn't prune revoked tokens: %s", err.Error())
+				} else if pruned > 0 {
+					server.logger.Info("pruned %d expired revoked tokens", pruned)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,28 @@
+package arborist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevokedTokenFromClaims(t *testing.T) {
+	claims := &map[string]interface{}{"jti": "abc", "exp": float64(1600000000)}
+	revoked, err := revokedTokenFromClaims(claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", revoked.JTI)
+	assert.True(t, revoked.ExpiresAt.Equal(time.Unix(1600000000, 0)))
+
+	invalid := []map[string]interface{}{
+		{"exp": float64(1600000000)},
+		{"jti": "", "exp": float64(1600000000)},
+		{"jti": 1, "exp": float64(1600000000)},
+		{"jti": "abc"},
+	}
+	for _, claims := range invalid {
+		claims := claims
+		_, err := revokedTokenFromClaims(&claims)
+		assert.Error(t, err, "expected error for claims %v", claims)
+	}
+}
@@ -1,6 +1,7 @@
 package arborist
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -13,6 +14,9 @@ type Role struct {
 	Name        string       `json:"id"`
 	Description string       `json:"description"`
 	Permissions []Permission `json:"permissions"`
+	// SchemaVersion is set to `OutputSchemaVersion` on roles read from the
+	// database, and ignored in input.
+	SchemaVersion int `json:"schema_version,omitempty"`
 }
 
 func (role *Role) UnmarshalJSON(data []byte) error {
@@ -21,8 +25,13 @@ func (role *Role) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	// id is optional here because PATCH doesn't require it to be in the json;
+	// handleRoleAppend will populate id later, from the URL.
+	// id is still validated later, in role `validate` function.
 	optionalFields := map[string]struct{}{
-		"description": {},
+		"id":             {},
+		"description":    {},
+		"schema_version": {},
 	}
 	err = validateJSON("role", role, fields, optionalFields)
 	if err != nil {
@@ -37,14 +46,41 @@ func (role *Role) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	// only for output, so a role which was read can be sent back as it is
+	role.SchemaVersion = 0
 
 	return nil
 }
 
+// validate checks the role has everything it needs before it is written to
+// the database, naming the path to any field which is missing or empty.
 func (role *Role) validate() *ErrorResponse {
+	if len(role.Name) == 0 {
+		err := missingRequiredField("role", "id")
+		return newErrorResponse(err.Error(), 400, &err)
+	}
 	if len(role.Permissions) == 0 {
 		return newErrorResponse("role has no permissions", 400, nil)
 	}
+	// permission IDs are unique within a role; inserting a duplicate would
+	// either drop it silently or fail the whole write
+	seen := make(map[string]int, len(role.Permissions))
+	for i, permission := range role.Permissions {
+		err := permission.validate("role", fmt.Sprintf("permissions[%d].", i))
+		if err != nil {
+			return newErrorResponse(err.Error(), 400, &err)
+		}
+		if first, exists := seen[permission.Name]; exists {
+			msg := fmt.Sprintf(
+				"role has more than one permission with ID `%s`: permissions[%d] and permissions[%d]",
+				permission.Name,
+				first,
+				i,
+			)
+			return newErrorResponse(msg, 400, nil)
+		}
+		seen[permission.Name] = i
+	}
 	return nil
 }
 
@@ -58,7 +94,8 @@ type RoleFromQuery struct {
 
 func (roleFromQuery *RoleFromQuery) standardize() Role {
 	role := Role{
-		Name: roleFromQuery.Name,
+		Name:          roleFromQuery.Name,
+		SchemaVersion: OutputSchemaVersion,
 	}
 	permissions := []Permission{}
 	for _, permissionFromQuery := range roleFromQuery.Permissions {
@@ -139,7 +176,33 @@ func rolesWithNames(db *sqlx.DB, roleNames []string) ([]RoleFromQuery, error) {
 	return roles, nil
 }
 
-func listRolesFromDb(db *sqlx.DB) ([]RoleFromQuery, error) {
+// RoleListOptions picks which page of roles `listRolesFromDb` returns.
+type RoleListOptions struct {
+	// Limit is the maximum number of roles to return; 0 means no limit.
+	Limit int
+	// Offset is the number of roles to skip, in the order given by Sort.
+	Offset int
+	// Sort is one of the keys of `roleSortColumns`; empty means `id`.
+	Sort string
+}
+
+// roleSortColumns maps the `sort` values for listing roles to the column to
+// order by. A role's ID is its name in the database, so `name` is the same
+// order as `id`. Every column here must be unique, so paging is stable.
+var roleSortColumns = map[string]string{
+	"id":   "role.name",
+	"name": "role.name",
+}
+
+func listRolesFromDb(db *sqlx.DB, options RoleListOptions) ([]RoleFromQuery, error) {
+	sortBy := options.Sort
+	if sortBy == "" {
+		sortBy = "id"
+	}
+	column, ok := roleSortColumns[sortBy]
+	if !ok {
+		return nil, fmt.Errorf("can't sort roles by `%s`", sortBy)
+	}
 	stmt := `
 		SELECT
 			role.id,
@@ -148,15 +211,33 @@ func listRolesFromDb(db *sqlx.DB) ([]RoleFromQuery, error) {
 		FROM role
 		LEFT JOIN permission ON permission.role_id = role.id
 		GROUP BY role.id
+		ORDER BY ` + column + `
+		LIMIT $1
+		OFFSET $2
 	`
+	// LIMIT NULL is the same as no limit
+	var limit *int
+	if options.Limit > 0 {
+		limit = &options.Limit
+	}
 	roles := []RoleFromQuery{}
-	err := db.Select(&roles, stmt)
+	err := db.Select(&roles, stmt, limit, options.Offset)
 	if err != nil {
 		return nil, err
 	}
 	return roles, nil
 }
 
+// countRolesFromDb counts every role, for paging through them.
+func countRolesFromDb(db *sqlx.DB) (int, error) {
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM role")
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 func (role *Role) createInDb(db *sqlx.DB) *ErrorResponse {
 	errResponse := role.validate()
 	if errResponse != nil {
@@ -188,7 +269,7 @@ func (role *Role) createInDb(db *sqlx.DB) *ErrorResponse {
 		// this should only fail because the role was not unique. return error
 		// accordingly
 		msg := fmt.Sprintf("failed to insert role: role with this ID already exists: %s", role.Name)
-		return newErrorResponse(msg, 409, &err)
+		return newErrorResponse(msg, 409, &err).withCode(ErrorCodeRoleExists)
 	}
 
 	// create permissions as necessary
@@ -235,6 +316,9 @@ func (role *Role) createInDb(db *sqlx.DB) *ErrorResponse {
 	return nil
 }
 
+// overwriteInDb replaces the role with the same name with this one, in one
+// transaction: permissions are added or updated to match, and the ones which
+// aren't in this role any more are deleted.
 func (role *Role) overwriteInDb(db *sqlx.DB) *ErrorResponse {
 	errResponse := role.validate()
 	if errResponse != nil {
@@ -302,6 +386,122 @@ func (role *Role) overwriteInDb(db *sqlx.DB) *ErrorResponse {
 		}
 	}
 
+	permissionNames := make([]string, len(role.Permissions))
+	for i, permission := range role.Permissions {
+		permissionNames[i] = permission.Name
+	}
+	stmt = "DELETE FROM permission WHERE role_id = $1 AND NOT (name = ANY($2))"
+	_, err = tx.Exec(stmt, roleID, pq.Array(permissionNames))
+	if err != nil {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("couldn't remove old permissions: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("couldn't commit database transaction: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+
+	return nil
+}
+
+// appendInDb adds the permissions in this role to the existing role with the
+// same name, leaving the permissions it already has in place. The description
+// is only updated if one is given. If any of the new permissions has the same
+// ID as a permission already on the role, nothing is changed and a 409 is
+// returned.
+func (role *Role) appendInDb(db *sqlx.DB) *ErrorResponse {
+	errResponse := role.validate()
+	if errResponse != nil {
+		return errResponse
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("couldn't open database transaction: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+
+	var roleID int
+	stmt := "SELECT id FROM role WHERE name = $1"
+	err = tx.Get(&roleID, stmt, role.Name)
+	switch {
+	case err == sql.ErrNoRows:
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("failed to update role: no role found with id: %s", role.Name)
+		return newErrorResponse(msg, 404, &err).withCode(ErrorCodeRoleNotFound)
+	case err != nil:
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("role query failed: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+
+	if role.Description != "" {
+		stmt = "UPDATE role SET description = $1 WHERE id = $2"
+		_, err = tx.Exec(stmt, role.Description, roleID)
+		if err != nil {
+			_ = tx.Rollback()
+			msg := fmt.Sprintf("couldn't update role description: %s", err.Error())
+			return newErrorResponse(msg, 500, &err)
+		}
+	}
+
+	permissionNames := make([]string, len(role.Permissions))
+	for i, permission := range role.Permissions {
+		permissionNames[i] = permission.Name
+	}
+	existing := []string{}
+	stmt = "SELECT name FROM permission WHERE role_id = $1 AND name = ANY($2)"
+	err = tx.Select(&existing, stmt, roleID, pq.Array(permissionNames))
+	if err != nil {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("permissions query failed: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	if len(existing) > 0 {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf(
+			"failed to update role: role %s already has permissions with these IDs: %s",
+			role.Name,
+			strings.Join(existing, ", "),
+		)
+		return newErrorResponse(msg, 409, nil)
+	}
+
+	permissionTable := "permission(role_id, name, service, method, constraints, description)"
+	stmt = multiInsertStmt(permissionTable, len(role.Permissions))
+	permissionRows := []interface{}{}
+	for _, permission := range role.Permissions {
+		constraints, err := json.Marshal(permission.Constraints)
+		if err != nil {
+			_ = tx.Rollback()
+			msg := fmt.Sprintf(
+				"couldn't write constraints for permission %s: %s",
+				permission.Name,
+				err.Error(),
+			)
+			return newErrorResponse(msg, 500, &err)
+		}
+		row := []interface{}{
+			roleID,
+			permission.Name,
+			permission.Action.Service,
+			permission.Action.Method,
+			constraints,
+			permission.Description,
+		}
+		permissionRows = append(permissionRows, row...)
+	}
+	_, err = tx.Exec(stmt, permissionRows...)
+	if err != nil {
+		_ = tx.Rollback()
+		msg := fmt.Sprintf("couldn't create permissions: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		_ = tx.Rollback()
@@ -318,7 +518,7 @@ func (role *Role) deleteInDb(db *sqlx.DB) *ErrorResponse {
 	if err != nil {
 		// TODO: verify correct error
 		msg := fmt.Sprintf("failed to delete role: role does not exist: `%s", role.Name)
-		return newErrorResponse(msg, 404, nil)
+		return newErrorResponse(msg, 404, nil).withCode(ErrorCodeRoleNotFound)
 	}
 	return nil
 }
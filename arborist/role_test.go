@@ -0,0 +1,55 @@
+package arborist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleValidate(t *testing.T) {
+	permission := Permission{Name: "foo", Action: Action{Service: "test", Method: "foo"}}
+
+	valid := Role{Name: "foo", Permissions: []Permission{permission}}
+	assert.Nil(t, valid.validate())
+
+	tests := []struct {
+		name     string
+		role     Role
+		expected string
+	}{
+		{
+			"ID",
+			Role{Permissions: []Permission{permission}},
+			"input role is missing required field `id`",
+		},
+		{
+			"PermissionID",
+			Role{Name: "foo", Permissions: []Permission{permission, {Action: permission.Action}}},
+			"input role is missing required field `permissions[1].id`",
+		},
+		{
+			"PermissionService",
+			Role{Name: "foo", Permissions: []Permission{{Name: "bar", Action: Action{Method: "foo"}}}},
+			"input role is missing required field `permissions[0].action.service`",
+		},
+		{
+			"DuplicatePermissionID",
+			Role{Name: "foo", Permissions: []Permission{permission, {Name: "bar", Action: permission.Action}, permission}},
+			"role has more than one permission with ID `foo`: permissions[0] and permissions[2]",
+		},
+		{
+			"PermissionMethod",
+			Role{Name: "foo", Permissions: []Permission{{Name: "bar", Action: Action{Service: "test"}}}},
+			"input role is missing required field `permissions[0].action.method`",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errResponse := test.role.validate()
+			if assert.NotNil(t, errResponse) {
+				assert.Equal(t, 400, errResponse.HTTPError.Code)
+				assert.Equal(t, test.expected, errResponse.HTTPError.Message)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package arborist
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -9,25 +11,127 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/felixge/httpsnoop"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+
+	"github.com/uc-cdis/arborist/arborist/version"
+	"github.com/uc-cdis/arborist/migrations"
 )
 
 type JWTDecoder interface {
 	Decode(string) (*map[string]interface{}, error)
 }
 
+// JWTKeysChecker is implemented by JWT decoders which can report whether
+// they have usable keys for validating tokens (see `JWTApplication`). If the
+// server's decoder implements it, the readiness check calls it.
+type JWTKeysChecker interface {
+	CheckKeys() error
+}
+
 type Server struct {
-	db     *sqlx.DB
-	jwtApp JWTDecoder
-	logger *LogHandler
-	stmts  *CachedStmts
+	db        *sqlx.DB
+	jwtApp    JWTDecoder
+	logger    *LogHandler
+	stmts     *CachedStmts
+	startTime time.Time
+	// clock returns the current time; it is `time.Now` unless replaced with
+	// `WithClock` (for tests).
+	clock func() time.Time
+	// migrate is set by `WithMigrations`, to bring the database schema up to
+	// date in `Init`.
+	migrate bool
+	// dbConfig is set by `WithDBConfig`, and applied to the connection pool
+	// in `Init`.
+	dbConfig *DBConfig
+	// readAttempts is how many times to try read queries which fail with a
+	// transient database error.
+	readAttempts int
+	// metrics are the prometheus collectors served on `/metrics`.
+	metrics *metrics
+	// audit is set by `WithAuditLog` to record every authorization decision.
+	audit *auditLog
+	// tracer makes the spans for handlers, authorization checks and database
+	// queries; it does nothing unless set with `WithTracerProvider`.
+	tracer trace.Tracer
+	// audiences are the scopes a token must have, unless an `/auth/request`
+	// names its own (see `WithExpectedAudiences`).
+	audiences []string
+	// tokenLeeway is how far past its `exp` (or before its `nbf`) a token is
+	// still accepted, to allow for clock drift with the issuer.
+	tokenLeeway time.Duration
+	// tokenCache holds the claims of tokens already verified; nil (no cache)
+	// unless set with `WithTokenCache`.
+	tokenCache *tokenCache
+	// decisionCache holds recent authorization decisions; nil (no cache)
+	// unless set with `WithDecisionCacheTTL`.
+	decisionCache *decisionCache
+	// cors allows cross-origin requests from browsers; nil (none allowed)
+	// unless set with `WithCORS` or `WithCORSConfig`.
+	cors *CORSConfig
+	// maxBodyBytes is the largest request body accepted, or 0 for no limit.
+	maxBodyBytes int64
+	// maxResourceDepth is how many levels of subresources can be read at once.
+	maxResourceDepth int
+	// webhookURL is set by `WithWebhook`; `Init` starts `webhook` to deliver
+	// events to it.
+	webhookURL string
+	webhook    *webhook
+	// idempotency stores the responses to creates with an `Idempotency-Key`
+	// header; nil (keys are ignored) if turned off with `WithIdempotencyTTL`.
+	idempotency *idempotencyStore
+	// adminPolicy is the policy a caller needs to check the authorization of
+	// another user by name, or to test a policy (see `WithAdminPolicy`).
+	adminPolicy string
+	// policySoftDelete makes `DELETE /policy/{policyID}` archive policies
+	// so they can be restored, unless the request has `?soft=false`.
+	policySoftDelete bool
+	// proxyHeaders are the headers `/auth/proxy` sets in its responses.
+	proxyHeaders []string
+	// lowercaseUsernames is set by `WithCaseInsensitiveUsernames`.
+	lowercaseUsernames bool
+	// authHeader is the request header carrying the caller's token.
+	authHeader string
+	// rateLimiter is nil (no limit) unless set with `WithRateLimit`.
+	rateLimiter *rateLimiter
+	// constraintKeys are the constraint keys each service's permissions may
+	// use, for the services registered with `WithConstraintKeys`.
+	constraintKeys map[string][]string
+	// tlsConfig is set by `WithTLS` for `Run` to serve over TLS.
+	tlsConfig *tls.Config
+	// trustClientCerts is set by `WithClientCertAuth`.
+	trustClientCerts bool
+	// grpcAddr is set by `WithGRPC` for `Run` to serve gRPC on as well.
+	grpcAddr string
+	// httpServer and grpcServer are set by `Run` for `Shutdown` to stop.
+	httpServerMu sync.Mutex
+	httpServer   *http.Server
+	grpcServer   *grpc.Server
+}
+
+// DBConfig holds the connection pool settings for the database, applied as
+// in `database/sql`: a zero `MaxOpenConns` or `ConnMaxLifetime` means no
+// limit, but a zero `MaxIdleConns` keeps no idle connections at all, so every
+// query opens a new one. Reasonable starting points are a max of 20 open and
+// 10 idle connections with a 5 minute lifetime, keeping the total across all
+// replicas under postgres's `max_connections`.
+type DBConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
 }
 
 type RequestPolicy struct {
@@ -35,8 +139,315 @@ type RequestPolicy struct {
 	ExpiresAt  string `json:"expires_at"`
 }
 
+// DefaultMaxBodyBytes is the largest request body the server reads, unless
+// changed with `WithMaxBodyBytes`. It leaves plenty of room for bulk policy
+// updates.
+const DefaultMaxBodyBytes = 10 << 20
+
+// DefaultMaxResourceDepth is how many levels of subresources can be read, or
+// nested in a resource being created, in one request, unless changed with
+// `WithMaxResourceDepth`.
+const DefaultMaxResourceDepth = 50
+
+// The headers `/auth/proxy` can set for the services behind it (see
+// `WithProxyHeaders`). REMOTE_USER is the username, set whether or not the
+// request is allowed; the others are only set on allowed requests.
+const (
+	ProxyHeaderUser      = "REMOTE_USER"
+	ProxyHeaderResources = "X-Authorized-Resources"
+	ProxyHeaderPolicy    = "X-Authorized-Policy"
+	ProxyHeaderRole      = "X-Authorized-Role"
+)
+
+// DefaultAuthHeader is the request header the caller's token is read from,
+// unless changed with `WithAuthHeader`.
+const DefaultAuthHeader = "Authorization"
+
+// DefaultProxyHeaders are the headers `/auth/proxy` sets unless changed with
+// `WithProxyHeaders`.
+var DefaultProxyHeaders = []string{ProxyHeaderUser, ProxyHeaderResources}
+
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		startTime:        time.Now(),
+		clock:            time.Now,
+		readAttempts:     DefaultReadAttempts,
+		metrics:          newMetrics(),
+		tracer:           trace.NewNoopTracerProvider().Tracer(tracerName),
+		audiences:        []string{"openid"},
+		maxBodyBytes:     DefaultMaxBodyBytes,
+		maxResourceDepth: DefaultMaxResourceDepth,
+		idempotency:      newIdempotencyStore(DefaultIdempotencyTTL),
+		proxyHeaders:     DefaultProxyHeaders,
+		authHeader:       DefaultAuthHeader,
+	}
+}
+
+// WithClock replaces the clock the server reads the time from, for tests. It
+// covers token expiry, `expires_in` on user reads and the expiry of
+// idempotency keys, and the queries pass it to the database for whether a
+// grant with `expires_at` has expired, so moving it forward expires grants.
+func (server *Server) WithClock(clock func() time.Time) *Server {
+	server.clock = clock
+	return server
+}
+
+// WithDBConfig sets the database connection pool limits; see `DBConfig`.
+func (server *Server) WithDBConfig(maxOpen, maxIdle int, connMaxLifetime time.Duration) *Server {
+	server.dbConfig = &DBConfig{
+		MaxOpenConns:    maxOpen,
+		MaxIdleConns:    maxIdle,
+		ConnMaxLifetime: connMaxLifetime,
+	}
+	return server
+}
+
+// WithReadAttempts sets how many times read queries are tried in total when
+// they fail with a transient database error; 1 disables retries.
+func (server *Server) WithReadAttempts(attempts int) *Server {
+	server.readAttempts = attempts
+	return server
+}
+
+// WithAuditLog writes a JSON line to `out` for every authorization decision
+// made by `/auth/proxy` and `/auth/request`, allowed or denied.
+func (server *Server) WithAuditLog(out io.Writer) *Server {
+	server.audit = &auditLog{out: out}
+	return server
+}
+
+// WithExpectedAudiences sets the audiences (`scope` values) which tokens must
+// all include to be accepted. The default is `openid`. Requests to
+// `/auth/request` can still give their own list in `user.scope`.
+func (server *Server) WithExpectedAudiences(audiences []string) *Server {
+	server.audiences = audiences
+	return server
+}
+
+// WithTokenLeeway accepts tokens up to `leeway` after they expire or before
+// they become valid, to allow for the clocks of arborist and the token issuer
+// drifting apart. The default is no leeway.
+func (server *Server) WithTokenLeeway(leeway time.Duration) *Server {
+	server.tokenLeeway = leeway
+	return server
+}
+
+// WithTokenCache keeps the claims from up to `size` verified tokens until
+// they expire, so repeated requests with the same token skip checking its
+// signature. A size of 0 turns the cache off.
+func (server *Server) WithTokenCache(size int) *Server {
+	if size > 0 {
+		server.tokenCache = newTokenCache(size)
+	} else {
+		server.tokenCache = nil
+	}
+	return server
+}
+
+// WithDecisionCacheTTL keeps each authorization decision for `ttl`, so the
+// same check made again within that time skips the database. Any change made
+// through this server to policies, resources, roles or grants clears the
+// cache, but changes made through other replicas are only seen once cached
+// decisions expire, so keep `ttl` short. A TTL of 0 turns the cache off.
+func (server *Server) WithDecisionCacheTTL(ttl time.Duration) *Server {
+	if ttl > 0 {
+		server.decisionCache = newDecisionCache(ttl)
+	} else {
+		server.decisionCache = nil
+	}
+	return server
+}
+
+// WithCORS allows browsers to call arborist from pages served on any of
+// `allowedOrigins` (`*` for any origin), with the default methods and headers.
+func (server *Server) WithCORS(allowedOrigins []string) *Server {
+	return server.WithCORSConfig(CORSConfig{AllowedOrigins: allowedOrigins})
+}
+
+// WithCORSConfig is like `WithCORS`, but also sets which methods and request
+// headers cross-origin requests may use.
+func (server *Server) WithCORSConfig(config CORSConfig) *Server {
+	server.cors = &config
+	return server
+}
+
+// WithMaxBodyBytes sets the largest request body, in bytes, which the server
+// reads; larger bodies get a 413 response. 0 removes the limit. The default
+// is `DefaultMaxBodyBytes`.
+func (server *Server) WithMaxBodyBytes(limit int64) *Server {
+	server.maxBodyBytes = limit
+	return server
+}
+
+// WithMaxResourceDepth sets how many levels of subresources can be read in one
+// request, with `?expand` or `/subresources?depth=`, so that reading a very
+// deep hierarchy can't tie up the server. It also limits how deeply
+// subresources can be nested in a resource being created. The default is
+// `DefaultMaxResourceDepth`.
+func (server *Server) WithMaxResourceDepth(depth int) *Server {
+	server.maxResourceDepth = depth
+	return server
+}
+
+// WithIdempotencyTTL sets how long the responses to creates with an
+// `Idempotency-Key` header are kept for replaying to retries of the same
+// request. 0 turns idempotency keys off. The default is
+// `DefaultIdempotencyTTL`.
+func (server *Server) WithIdempotencyTTL(ttl time.Duration) *Server {
+	if ttl > 0 {
+		server.idempotency = newIdempotencyStore(ttl)
+	} else {
+		server.idempotency = nil
+	}
+	return server
+}
+
+// WithWebhook POSTs a `WebhookEvent` to `url` after every policy, resource
+// or role is created, updated or deleted. Events are delivered in the
+// background, with retries, so they don't hold up the requests.
+func (server *Server) WithWebhook(url string) *Server {
+	server.webhookURL = url
+	return server
+}
+
+// WithAdminPolicy restricts `/auth/request` checks which name a user with
+// `user_id`, instead of passing their token, and testing policies with
+// `/policy/{policyID}/test`, to callers whose own token (in the
+// `Authorization` header) belongs to a user holding the policy `name`.
+// Without it anyone can check any user by name or test any policy.
+func (server *Server) WithAdminPolicy(name string) *Server {
+	server.adminPolicy = name
+	return server
+}
+
+// WithPolicySoftDelete makes deleting a policy archive it, along with who it
+// was granted to, so that it can be brought back with
+// `POST /policy/{policyID}/restore`. Either way, a delete request can choose
+// with `?soft=true` or `?soft=false`.
+func (server *Server) WithPolicySoftDelete(enabled bool) *Server {
+	server.policySoftDelete = enabled
+	return server
+}
+
+// WithCaseInsensitiveUsernames lowercases usernames everywhere they come in,
+// from tokens and from requests, so that a user matches their grants however
+// the identity provider cases their name. Users already stored with capitals
+// won't be found by name once this is on, so rename them to lowercase
+// beforehand.
+func (server *Server) WithCaseInsensitiveUsernames(enabled bool) *Server {
+	server.lowercaseUsernames = enabled
+	return server
+}
+
+// WithAuthHeader reads callers' tokens from the header `name` instead of
+// `Authorization`, for deployments which pass them along in a header of
+// their own, like `X-Access-Token`. An empty name keeps `Authorization`. For
+// browsers to send the header cross-origin, add it to the allowed headers
+// with `WithCORSConfig`.
+func (server *Server) WithAuthHeader(name string) *Server {
+	if name == "" {
+		name = DefaultAuthHeader
+	}
+	server.authHeader = name
+	return server
+}
+
+// WithConstraintKeys registers the constraint keys which permissions for
+// `service` may use, so that a role or permission using any other key (such
+// as a misspelling, which would never match) is rejected. Services which
+// aren't registered can use any keys. Nil `keys` unregisters the service; an
+// empty list allows it no constraints at all. Roles already in the database
+// aren't checked.
+func (server *Server) WithConstraintKeys(service string, keys []string) *Server {
+	if keys == nil {
+		delete(server.constraintKeys, service)
+		return server
+	}
+	if server.constraintKeys == nil {
+		server.constraintKeys = make(map[string][]string)
+	}
+	sorted := make([]string, len(keys))
+	copy(sorted, keys)
+	sort.Strings(sorted)
+	server.constraintKeys[service] = sorted
+	return server
+}
+
+// checkConstraintKeys checks the constraints of each of the role's
+// permissions against the keys registered for its service.
+func (server *Server) checkConstraintKeys(role *Role) *ErrorResponse {
+	for i, permission := range role.Permissions {
+		err := permission.checkConstraintKeys("role", fmt.Sprintf("permissions[%d].", i), server.constraintKeys)
+		if err != nil {
+			return newErrorResponse(err.Error(), 400, &err)
+		}
+	}
+	return nil
+}
+
+// WithTLS has `Run` serve over TLS with `config`, which must have the
+// server's certificate, rather than plain HTTP. A nil config serves plain
+// HTTP, which is the default.
+func (server *Server) WithTLS(config *tls.Config) *Server {
+	server.tlsConfig = config
+	return server
+}
+
+// WithClientCertAuth has `/auth/proxy` and `/auth/request` take the common
+// name of a verified client certificate as the caller's client ID, as if
+// from a token's `azp`, so services can call arborist with a certificate
+// instead of a token. `/auth/proxy` then ignores the auth header. Only
+// certificates checked against the `ClientCAs` of the config from `WithTLS`
+// count, so the config should set `ClientAuth` to
+// `tls.VerifyClientCertIfGiven` (or stricter).
+func (server *Server) WithClientCertAuth(trust bool) *Server {
+	server.trustClientCerts = trust
+	return server
+}
+
+// WithGRPC makes `Run` also serve the `Authorize` gRPC method on `addr` (like
+// `:8090`), over TLS if `WithTLS` is set. See `arboristpb/arborist.proto`. An
+// empty address, the default, serves no gRPC.
+func (server *Server) WithGRPC(addr string) *Server {
+	server.grpcAddr = addr
+	return server
+}
+
+// WithRateLimit limits each user or client, going by the token in the auth
+// header, to `perSecond` requests a second on average, with bursts of up to
+// `burst`. Requests past that get a 429 with a `Retry-After` header. Tokens
+// whose signature doesn't check out are limited by the caller's address. A
+// rate of 0 or less turns the limit off, which is the default.
+func (server *Server) WithRateLimit(perSecond float64, burst int) *Server {
+	if perSecond <= 0 {
+		server.rateLimiter = nil
+		return server
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	server.rateLimiter = newRateLimiter(perSecond, burst)
+	return server
+}
+
+// WithProxyHeaders sets which of the `ProxyHeader...` headers `/auth/proxy`
+// responses include, for nginx to pass on to the service behind it. The
+// default is `DefaultProxyHeaders`; an empty list sets none.
+func (server *Server) WithProxyHeaders(headers []string) *Server {
+	server.proxyHeaders = headers
+	return server
+}
+
+// WithTracerProvider sends OpenTelemetry spans for every request, and every
+// authorization check and database query within it, to `provider`.
+func (server *Server) WithTracerProvider(provider trace.TracerProvider) *Server {
+	server.tracer = provider.Tracer(tracerName)
+	return server
+}
+
+func (server *Server) WithMigrations() *Server {
+	server.migrate = true
+	return server
 }
 
 func (server *Server) WithLogger(logger *log.Logger) *Server {
@@ -49,6 +460,14 @@ func (server *Server) WithJWTApp(jwtApp JWTDecoder) *Server {
 	return server
 }
 
+// WithTrustedIssuers accepts tokens from each issuer in `jwkURLs`, validated
+// with the keys from that issuer's JWKS URL, and rejects tokens from any
+// other issuer. It replaces the decoder set with `WithJWTApp`.
+func (server *Server) WithTrustedIssuers(jwkURLs map[string]string) *Server {
+	server.jwtApp = NewIssuersJWTApplication(jwkURLs)
+	return server
+}
+
 func (server *Server) WithDB(db *sqlx.DB) *Server {
 	server.db = db
 	server.stmts = NewCachedStmts(db)
@@ -65,10 +484,72 @@ func (server *Server) Init() (*Server, error) {
 	if server.logger == nil {
 		return nil, errors.New("arborist server initialized without logger")
 	}
+	if server.dbConfig != nil {
+		config := server.dbConfig
+		if config.MaxOpenConns < 0 || config.MaxIdleConns < 0 || config.ConnMaxLifetime < 0 {
+			return nil, errors.New("arborist server initialized with negative database pool settings")
+		}
+		server.db.SetMaxOpenConns(config.MaxOpenConns)
+		server.db.SetMaxIdleConns(config.MaxIdleConns)
+		server.db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	}
+	if len(server.audiences) == 0 {
+		return nil, errors.New("arborist server initialized without expected token audiences")
+	}
+	for _, audience := range server.audiences {
+		if audience == "" {
+			return nil, errors.New("arborist server initialized with an empty token audience")
+		}
+	}
+	if server.tokenLeeway < 0 {
+		return nil, errors.New("arborist server initialized with negative token leeway")
+	}
+	if server.cors != nil && len(server.cors.AllowedOrigins) == 0 {
+		return nil, errors.New("arborist server initialized with CORS but no allowed origins")
+	}
+	if server.maxResourceDepth < 1 {
+		return nil, errors.New("arborist server initialized with max resource depth below 1")
+	}
+	if server.readAttempts < 1 {
+		return nil, errors.New("arborist server initialized with fewer than 1 read attempt")
+	}
+	for _, header := range server.proxyHeaders {
+		switch header {
+		case ProxyHeaderUser, ProxyHeaderResources, ProxyHeaderPolicy, ProxyHeaderRole:
+		default:
+			return nil, fmt.Errorf("arborist server initialized with unknown proxy header: %s", header)
+		}
+	}
+	if server.webhookURL != "" {
+		parsed, err := url.ParseRequestURI(server.webhookURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("arborist server initialized with invalid webhook URL: %s", server.webhookURL)
+		}
+		server.webhook = newWebhook(server.webhookURL, server.logger)
+	}
+	if server.migrate {
+		err := migrations.RunMigrations(server.db)
+		if err != nil {
+			return nil, fmt.Errorf("arborist server could not migrate database: %s", err.Error())
+		}
+	}
 
 	return server, nil
 }
 
+// expectedAudiences returns a copy of the audiences tokens must have.
+func (server *Server) expectedAudiences() []string {
+	audiences := make([]string, len(server.audiences))
+	copy(audiences, server.audiences)
+	return audiences
+}
+
+// retryRead runs a read query, retrying it if it fails with a transient
+// database error (see `retryTransient`).
+func (server *Server) retryRead(query func() error) error {
+	return retryTransient(server.readAttempts, query)
+}
+
 // For some reason this is not allowed:
 //
 //	`{resourcePath:/.+}`
@@ -82,7 +563,21 @@ func parseResourcePath(r *http.Request) string {
 		return ""
 	}
 	// We have to add a slash at the front here; see resourcePath constant.
-	return strings.Join([]string{"/", path}, "")
+	return normalizeResourcePath(strings.Join([]string{"/", path}, ""))
+}
+
+// normalizeUsername lowercases `name` if usernames are case-insensitive (see
+// `WithCaseInsensitiveUsernames`), and otherwise leaves it alone.
+func (server *Server) normalizeUsername(name string) string {
+	if server.lowercaseUsernames {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// usernameVar is the `{username}` in the route, normalized.
+func (server *Server) usernameVar(r *http.Request) string {
+	return server.normalizeUsername(mux.Vars(r)["username"])
 }
 
 func getAuthZProvider(r *http.Request) sql.NullString {
@@ -99,76 +594,145 @@ func (server *Server) MakeRouter(out io.Writer) http.Handler {
 
 	//router.Handle("/", server.handleRoot).Methods("GET")
 
+	router.HandleFunc("/_status", server.handleStatus).Methods("GET")
 	router.HandleFunc("/health", server.handleHealth).Methods("GET")
+	router.Handle("/metrics", server.metrics.handler()).Methods("GET")
 
 	router.Handle("/auth/mapping", http.HandlerFunc(server.handleAuthMappingGET)).Methods("GET")
 	router.Handle("/auth/mapping", http.HandlerFunc(server.handleAuthMappingPOST)).Methods("POST")
 	router.Handle("/auth/proxy", http.HandlerFunc(server.handleAuthProxy)).Methods("GET")
 	router.Handle("/auth/request", http.HandlerFunc(server.parseJSON(server.handleAuthRequest))).Methods("POST")
 	router.Handle("/auth/resources", http.HandlerFunc(server.handleListAuthResourcesGET)).Methods("GET")
+	router.Handle("/auth/policies", http.HandlerFunc(server.handleAuthPoliciesGET)).Methods("GET")
+	router.Handle("/auth/policies", http.HandlerFunc(server.parseJSON(server.handleAuthPoliciesPOST))).Methods("POST")
 	router.Handle("/auth/resources", http.HandlerFunc(server.parseJSON(server.handleListAuthResourcesPOST))).Methods("POST")
+	router.Handle("/token/revoke", http.HandlerFunc(server.parseJSON(server.handleTokenRevoke))).Methods("POST")
+	router.Handle("/admin/reload", http.HandlerFunc(server.handleAdminReload)).Methods("POST")
 
 	router.Handle("/policy", http.HandlerFunc(server.handlePolicyList)).Methods("GET")
-	router.Handle("/policy", http.HandlerFunc(server.parseJSON(server.handlePolicyCreate))).Methods("POST")
+	router.Handle("/policy", server.idempotent(server.parseJSON(server.handlePolicyCreate))).Methods("POST")
 	// delete this (PUT /policy) route after 3.0.0
 	router.Handle("/policy", http.HandlerFunc(server.parseJSON(server.handlePolicyOverwrite))).Methods("PUT")
-	router.Handle("/policy/{policyID}", http.HandlerFunc(server.parseJSON(server.handlePolicyOverwrite))).Methods("PUT")
+	router.Handle("/policy/{policyID}", http.HandlerFunc(server.parseJSON(server.handlePolicyUpdate))).Methods("PUT")
 	router.Handle("/policy/{policyID}", http.HandlerFunc(server.handlePolicyRead)).Methods("GET")
 	router.Handle("/policy/{policyID}", http.HandlerFunc(server.handlePolicyDelete)).Methods("DELETE")
+	router.Handle("/policy/{policyID}/grant", http.HandlerFunc(server.parseJSON(server.handlePolicyGrantUsers))).Methods("POST")
+	router.Handle("/policy/{policyID}/revoke", http.HandlerFunc(server.parseJSON(server.handlePolicyRevokeUsers))).Methods("POST")
+	router.Handle("/policy/{policyID}/resources", http.HandlerFunc(server.handlePolicyResources)).Methods("GET")
+	router.Handle("/policy/{policyID}/diff/{otherPolicyID}", http.HandlerFunc(server.handlePolicyDiff)).Methods("GET")
+	router.Handle("/policy/{policyID}/test", http.HandlerFunc(server.parseJSON(server.handlePolicyTest))).Methods("POST")
+	router.Handle("/policy/{policyID}/restore", http.HandlerFunc(server.handlePolicyRestore)).Methods("POST")
 	router.Handle("/bulk/policy", http.HandlerFunc(server.parseJSON(server.handleBulkPoliciesOverwrite))).Methods("PUT")
 
 	router.Handle("/resource", http.HandlerFunc(server.handleResourceList)).Methods("GET")
-	router.Handle("/resource", http.HandlerFunc(server.parseJSON(server.handleResourceCreate))).Methods("POST", "PUT")
+	router.Handle("/resource", server.idempotent(server.parseJSON(server.handleResourceCreate))).Methods("POST", "PUT")
 	router.Handle("/resource/tag/{tag}", http.HandlerFunc(server.handleResourceReadByTag)).Methods("GET")
+	// only with `q`, so a top-level resource named `search` can still be read
+	router.Handle("/resource/search", http.HandlerFunc(server.handleResourceSearch)).Methods("GET").Queries("q", "{q}")
+	// before the read and create routes, which would take `subresources` and
+	// `move` as part of the path
+	router.Handle("/resource"+resourcePath+"/subresources", http.HandlerFunc(server.handleResourceSubresources)).Methods("GET")
+	router.Handle("/resource"+resourcePath+"/move", http.HandlerFunc(server.parseJSON(server.handleResourceMove))).Methods("POST")
 	router.Handle("/resource"+resourcePath, http.HandlerFunc(server.handleResourceRead)).Methods("GET")
-	router.Handle("/resource"+resourcePath, http.HandlerFunc(server.parseJSON(server.handleResourceCreate))).Methods("POST", "PUT")
+	router.Handle("/resource"+resourcePath, server.idempotent(server.parseJSON(server.handleResourceCreate))).Methods("POST", "PUT")
 	router.Handle("/resource"+resourcePath, http.HandlerFunc(server.handleResourceDelete)).Methods("DELETE")
 
 	router.Handle("/role", http.HandlerFunc(server.handleRoleList)).Methods("GET")
-	router.Handle("/role", http.HandlerFunc(server.parseJSON(server.handleRoleCreate))).Methods("POST")
+	router.Handle("/role", server.idempotent(server.parseJSON(server.handleRoleCreate))).Methods("POST")
 	router.Handle("/role/{roleID}", http.HandlerFunc(server.handleRoleRead)).Methods("GET")
 	router.Handle("/role/{roleID}", http.HandlerFunc(server.parseJSON(server.handleRoleOverwrite))).Methods("PUT")
+	router.Handle("/role/{roleID}", http.HandlerFunc(server.parseJSON(server.handleRoleAppend))).Methods("PATCH")
 	router.Handle("/role/{roleID}", http.HandlerFunc(server.handleRoleDelete)).Methods("DELETE")
+	router.Handle("/role/{roleID}/permission", http.HandlerFunc(server.handleRolePermissionList)).Methods("GET")
+	router.Handle("/role/{roleID}/permission", server.idempotent(server.parseJSON(server.handleRolePermissionCreate))).Methods("POST")
+
+	router.Handle("/permission", http.HandlerFunc(server.handlePermissionList)).Methods("GET")
+	router.Handle("/permission/{permissionID}", http.HandlerFunc(server.handlePermissionRead)).Methods("GET")
+
+	router.Handle("/service", http.HandlerFunc(server.handleServiceList)).Methods("GET")
+	router.Handle("/service/{serviceID}", http.HandlerFunc(server.handleServiceRead)).Methods("GET")
+
+	router.Handle("/bundle", http.HandlerFunc(server.handleOPABundle)).Methods("GET")
 
 	router.Handle("/user", http.HandlerFunc(server.handleUserList)).Methods("GET")
-	router.Handle("/user", http.HandlerFunc(server.parseJSON(server.handleUserCreate))).Methods("POST")
+	router.Handle("/user", server.idempotent(server.parseJSON(server.handleUserCreate))).Methods("POST")
 	router.Handle("/user/{username}", http.HandlerFunc(server.handleUserRead)).Methods("GET")
 	router.Handle("/user/{username}", http.HandlerFunc(server.parseJSON(server.handleUserUpdate))).Methods("PATCH")
 	router.Handle("/user/{username}", http.HandlerFunc(server.handleUserDelete)).Methods("DELETE")
-	router.Handle("/user/{username}/policy", http.HandlerFunc(server.parseJSON(server.handleUserGrantPolicy))).Methods("POST")
-	router.Handle("/user/{username}/bulk/policy", http.HandlerFunc(server.parseJSON(server.handleBulkUserGrantPolicy))).Methods("POST") // NEW bulk grant policy
+	router.Handle("/user/{username}/policy", server.idempotent(server.parseJSON(server.handleUserGrantPolicy))).Methods("POST")
+	router.Handle("/user/{username}/bulk/policy", server.idempotent(server.parseJSON(server.handleBulkUserGrantPolicy))).Methods("POST") // NEW bulk grant policy
 	router.Handle("/user/{username}/policy", http.HandlerFunc(server.handleUserRevokeAll)).Methods("DELETE")
 	router.Handle("/user/{username}/policy/{policyName}", http.HandlerFunc(server.handleUserRevokePolicy)).Methods("DELETE")
 	router.Handle("/user/{username}/resources", http.HandlerFunc(server.handleUserListResources)).Methods("GET")
 
 	router.Handle("/client", http.HandlerFunc(server.handleClientList)).Methods("GET")
-	router.Handle("/client", http.HandlerFunc(server.parseJSON(server.handleClientCreate))).Methods("POST")
+	router.Handle("/client", server.idempotent(server.parseJSON(server.handleClientCreate))).Methods("POST")
 	router.Handle("/client/{clientID}", http.HandlerFunc(server.handleClientRead)).Methods("GET")
 	router.Handle("/client/{clientID}", http.HandlerFunc(server.handleClientDelete)).Methods("DELETE")
-	router.Handle("/client/{clientID}/policy", http.HandlerFunc(server.parseJSON(server.handleClientGrantPolicy))).Methods("POST")
+	router.Handle("/client/{clientID}/policy", server.idempotent(server.parseJSON(server.handleClientGrantPolicy))).Methods("POST")
 	router.Handle("/client/{clientID}/policy", http.HandlerFunc(server.handleClientRevokeAll)).Methods("DELETE")
 	router.Handle("/client/{clientID}/policy/{policyName}", http.HandlerFunc(server.handleClientRevokePolicy)).Methods("DELETE")
 
 	router.Handle("/group", http.HandlerFunc(server.handleGroupList)).Methods("GET")
-	router.Handle("/group", http.HandlerFunc(server.parseJSON(server.handleGroupCreate))).Methods("POST", "PUT")
+	router.Handle("/group", server.idempotent(server.parseJSON(server.handleGroupCreate))).Methods("POST", "PUT")
 	router.Handle("/group/{groupName}", http.HandlerFunc(server.handleGroupRead)).Methods("GET")
 	router.Handle("/group/{groupName}", http.HandlerFunc(server.handleGroupDelete)).Methods("DELETE")
-	router.Handle("/group/{groupName}/user", http.HandlerFunc(server.parseJSON(server.handleGroupAddUser))).Methods("POST")
+	router.Handle("/group/{groupName}/user", server.idempotent(server.parseJSON(server.handleGroupAddUser))).Methods("POST")
 	router.Handle("/group/{groupName}/user/{username}", http.HandlerFunc(server.handleGroupRemoveUser)).Methods("DELETE")
-	router.Handle("/group/{groupName}/policy", http.HandlerFunc(server.parseJSON(server.handleGroupGrantPolicy))).Methods("POST")
+	router.Handle("/group/{groupName}/policy", server.idempotent(server.parseJSON(server.handleGroupGrantPolicy))).Methods("POST")
 	router.Handle("/group/{groupName}/policy/{policyName}", http.HandlerFunc(server.handleGroupRevokePolicy)).Methods("DELETE")
 
 	router.NotFoundHandler = http.HandlerFunc(handleNotFound)
+	router.Use(server.traceMiddleware)
+	router.Use(server.metrics.middleware)
+	router.Use(server.rateLimitMiddleware)
+	router.Use(server.invalidateDecisionsMiddleware)
 
 	// remove trailing slashes sent in URLs
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.URL.Path = strings.TrimSuffix(r.URL.Path, "/")
 		router.ServeHTTP(w, r)
 	})
+	if server.cors != nil {
+		handler = server.cors.handler(handler)
+	}
+	handler = requestIDHandler(handler)
 
 	return handlers.CombinedLoggingHandler(out, handler)
 }
 
+// readOnlyRoutes are the routes taking POST requests which don't change
+// anything, so they leave cached decisions alone.
+var readOnlyRoutes = map[string]bool{
+	"/auth/mapping":           true,
+	"/auth/policies":          true,
+	"/auth/request":           true,
+	"/auth/resources":         true,
+	"/policy/{policyID}/test": true,
+}
+
+// invalidateDecisionsMiddleware clears the decision cache after every
+// successful request which may have changed policies, resources, roles or
+// grants.
+func (server *Server) invalidateDecisionsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.decisionCache == nil || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil && readOnlyRoutes[template] {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		captured := httpsnoop.CaptureMetrics(next, w, r)
+		if captured.Code < 400 {
+			server.decisionCache.invalidate()
+		}
+	})
+}
+
 // parseJSON abstracts JSON parsing for handler functions that should
 // receive a valid JSON input in the request body. It takes a modified
 // handler function as input, which should include the body in `[]byte`
@@ -178,13 +742,13 @@ func (server *Server) parseJSON(baseHandler func(http.ResponseWriter, *http.Requ
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		body, err := server.parseJsonBody(w, r)
 		if err != nil {
-			err.log.write(server.logger)
+			err.log.write(server.requestLogger(r.Context()))
 			_ = err.write(w, r)
 			return
 		}
-		if body == nil {
+		if len(body) == 0 {
 			err := newErrorResponse("expected JSON body in the request", 400, nil)
-			err.log.write(server.logger)
+			err.log.write(server.requestLogger(r.Context()))
 			_ = err.write(w, r)
 			return
 		}
@@ -197,12 +761,28 @@ func (server *Server) parseJsonBody(w http.ResponseWriter, r *http.Request) ([]b
 	if r.Body == nil {
 		return nil, nil
 	}
+	if server.maxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, server.maxBodyBytes)
+	}
 	body, err := ioutil.ReadAll(r.Body)
+	// the reader stops at the limit, so only an error there means the body
+	// was too large
+	if err != nil && server.maxBodyBytes > 0 && int64(len(body)) >= server.maxBodyBytes {
+		msg := fmt.Sprintf("request body is larger than the limit of %d bytes", server.maxBodyBytes)
+		return nil, newErrorResponse(msg, http.StatusRequestEntityTooLarge, nil).withCode(ErrorCodeBodyTooLarge)
+	}
 	if err != nil {
 		msg := fmt.Sprintf("could not parse valid JSON from request: %s", err.Error())
 		err := newErrorResponse(msg, 400, nil)
 		return nil, err
 	}
+	if sendsYAML(r) {
+		body, err = yamlToJSON(body)
+		if err != nil {
+			msg := fmt.Sprintf("could not parse valid YAML from request: %s", err.Error())
+			return nil, newErrorResponse(msg, 400, nil)
+		}
+	}
 	return body, nil
 }
 
@@ -212,15 +792,68 @@ func loggableJSON(bytes []byte) []byte {
 	return regWhitespace.ReplaceAll(bytes, []byte(""))
 }
 
+// handleStatus is the liveness check: it always responds 200 as long as the
+// server is up and serving requests, without checking any dependencies.
+func (server *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	_ = jsonResponseFrom("Healthy", http.StatusOK).write(w, r)
+}
+
+// HealthResponse is returned from a successful health check, so operators can
+// tell which build is deployed. Version and commit are set at build time
+// through the `version` package.
+type HealthResponse struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Uptime  string `json:"uptime"`
+}
+
+// handleHealth is the readiness check. It responds 200 with the build info if
+// the database is reachable and the JWT app has keys to validate tokens with,
+// and 500 if either of those fails. It responds 503 if the database is
+// missing migrations this build has, since queries may fail until they are
+// applied.
 func (server *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	err := server.db.Ping()
 	if err != nil {
-		server.logger.Error("database ping failed; returning unhealthy")
+		server.requestLogger(r.Context()).Error("database ping failed; returning unhealthy")
 		response := newErrorResponse("database unavailable", 500, nil)
 		_ = response.write(w, r)
 		return
 	}
-	_ = jsonResponseFrom("Healthy", http.StatusOK).write(w, r)
+	span := server.traceDB(r.Context(), "migrations.Pending")
+	pending, err := migrations.Pending(server.db)
+	endDBSpan(span, err)
+	if err != nil {
+		server.requestLogger(r.Context()).Error("couldn't check database version; returning unhealthy: %s", err.Error())
+		response := newErrorResponse("couldn't check database version", 500, nil)
+		_ = response.write(w, r)
+		return
+	}
+	if len(pending) > 0 {
+		msg := fmt.Sprintf(
+			"database schema is out of date; migrations not applied: %s",
+			strings.Join(pending, ", "),
+		)
+		server.requestLogger(r.Context()).Error("%s; returning unready", msg)
+		response := newErrorResponse(msg, http.StatusServiceUnavailable, nil)
+		_ = response.write(w, r)
+		return
+	}
+	if keysChecker, ok := server.jwtApp.(JWTKeysChecker); ok {
+		err = keysChecker.CheckKeys()
+		if err != nil {
+			server.requestLogger(r.Context()).Error("JWT keys unavailable; returning unhealthy: %s", err.Error())
+			response := newErrorResponse("JWT keys unavailable", 500, nil)
+			_ = response.write(w, r)
+			return
+		}
+	}
+	health := HealthResponse{
+		Version: version.GitVersion,
+		Commit:  version.GitCommit,
+		Uptime:  time.Since(server.startTime).Round(time.Second).String(),
+	}
+	_ = jsonResponseFrom(health, http.StatusOK).write(w, r)
 }
 
 func handleNotFound(w http.ResponseWriter, r *http.Request) {
@@ -244,28 +877,28 @@ func handleNotFound(w http.ResponseWriter, r *http.Request) {
 func (server *Server) handleAuthMappingGET(w http.ResponseWriter, r *http.Request) {
 	// Try to get username from the JWT.
 	username := ""
-	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
-		server.logger.Info("Attempting to get username from jwt...")
-		userJWT := strings.TrimPrefix(authHeader, "Bearer ")
-		userJWT = strings.TrimPrefix(userJWT, "bearer ")
-		scopes := []string{"openid"}
+	if userJWT := server.requestToken(r); userJWT != "" {
+		server.requestLogger(r.Context()).Info("Attempting to get username from jwt...")
+		scopes := server.expectedAudiences()
 		info, err := server.decodeToken(userJWT, scopes)
 		if err != nil {
 			// Return 400 on failure to decode JWT
 			msg := fmt.Sprintf("tried to get username from jwt, but jwt decode failed: %s", err.Error())
-			server.logger.Info(msg)
+			server.requestLogger(r.Context()).Info(msg)
 			_ = jsonResponseFrom(msg, http.StatusBadRequest).write(w, r)
 			return
 		}
-		server.logger.Info("found username in jwt: %s", info.username)
+		server.requestLogger(r.Context()).Info("found username in jwt: %s", info.username)
 		username = info.username
 	}
 
 	usernameProvided := username != ""
 	if usernameProvided {
-		mappings, errResponse := authMappingForUser(server.db, username)
+		span := server.traceDB(r.Context(), "authMappingForUser")
+		mappings, errResponse := authMappingForUser(server.db, username, server.clock())
+		endDBSpan(span, dbSpanError(errResponse))
 		if errResponse != nil {
-			errResponse.log.write(server.logger)
+			errResponse.log.write(server.requestLogger(r.Context()))
 			_ = errResponse.write(w, r)
 			return
 		}
@@ -274,9 +907,11 @@ func (server *Server) handleAuthMappingGET(w http.ResponseWriter, r *http.Reques
 	} else {
 		// If no username provided in query string or JWT, return the
 		// auth mapping for the `anonymous` group. (See `docs/username.md` for more detail)
+		span := server.traceDB(r.Context(), "authMappingForGroups")
 		mappings, errResponse := authMappingForGroups(server.db, AnonymousGroup)
+		endDBSpan(span, dbSpanError(errResponse))
 		if errResponse != nil {
-			errResponse.log.write(server.logger)
+			errResponse.log.write(server.requestLogger(r.Context()))
 			_ = errResponse.write(w, r)
 			return
 		}
@@ -294,25 +929,23 @@ func (server *Server) handleAuthMappingPOST(w http.ResponseWriter, r *http.Reque
 
 	body, err := server.parseJsonBody(w, r)
 	if err != nil {
-		err.log.write(server.logger)
+		err.log.write(server.requestLogger(r.Context()))
 		_ = err.write(w, r)
 		return
 	}
 
 	username := ""
 	clientID := ""
-	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+	if userJWT := server.requestToken(r); userJWT != "" {
 		// Try to get username or clientID from the JWT.
-		server.logger.Info("Attempting to get username or client ID from jwt...")
-		userJWT := strings.TrimPrefix(authHeader, "Bearer ")
-		userJWT = strings.TrimPrefix(userJWT, "bearer ")
-		scopes := []string{"openid"}
+		server.requestLogger(r.Context()).Info("Attempting to get username or client ID from jwt...")
+		scopes := server.expectedAudiences()
 		info, err := server.decodeToken(userJWT, scopes)
 		if err != nil {
 			// Return 401 on failure to decode JWT
 			msg := fmt.Sprintf("tried to get username/client ID from jwt, but jwt decode failed: %s", err.Error())
-			server.logger.Info(msg)
-			errResponse = newErrorResponse(msg, 401, nil)
+			server.requestLogger(r.Context()).Info(msg)
+			errResponse = newErrorResponse(msg, 401, nil).withCode(ErrorCodeInvalidToken)
 			_ = errResponse.write(w, r)
 			return
 		}
@@ -322,31 +955,31 @@ func (server *Server) handleAuthMappingPOST(w http.ResponseWriter, r *http.Reque
 		// the combination of user+client access. So ignore the client ID.
 		if info.username != "" {
 			username = info.username
-			server.logger.Info("found username in jwt: %s", username)
+			server.requestLogger(r.Context()).Info("found username in jwt: %s", username)
 		} else if info.clientID != "" {
 			clientID = info.clientID
-			server.logger.Info("found client ID in jwt: %s", clientID)
+			server.requestLogger(r.Context()).Info("found client ID in jwt: %s", clientID)
 		} else {
 			msg := "invalid token (no username or client ID)"
-			server.logger.Error(msg)
-			errResponse = newErrorResponse(msg, 401, nil)
+			server.requestLogger(r.Context()).Error(msg)
+			errResponse = newErrorResponse(msg, 401, nil).withCode(ErrorCodeInvalidToken)
 			_ = errResponse.write(w, r)
 			return
 		}
 	} else if len(body) > 0 {
 		// If they are not present in the token, fallback on the request body
-		server.logger.Info("No jwt provided, checking request body")
+		server.requestLogger(r.Context()).Info("No jwt provided, checking request body")
 		err := json.Unmarshal(body, &requestBody)
 		if err != nil {
 			msg := fmt.Sprintf("could not parse JSON: %s", err.Error())
-			server.logger.Error("tried to handle auth mapping request but input was invalid: %s", msg)
+			server.requestLogger(r.Context()).Error("tried to handle auth mapping request but input was invalid: %s", msg)
 			errResponse = newErrorResponse(msg, 400, nil)
 		} else {
-			username = requestBody.Username
+			username = server.normalizeUsername(requestBody.Username)
 			clientID = requestBody.ClientID
 			if (username == "") == (clientID == "") {
 				msg := "must provide a token or specify exactly one of `username` or `clientID` in the request body"
-				server.logger.Info(msg)
+				server.requestLogger(r.Context()).Info(msg)
 				errResponse = newErrorResponse(msg, 400, nil)
 			}
 		}
@@ -357,9 +990,11 @@ func (server *Server) handleAuthMappingPOST(w http.ResponseWriter, r *http.Reque
 	} else {
 		// If no username or client ID provided in query string or JWT, return the
 		// auth mapping for the `anonymous` group. (See `docs/username.md` for more detail)
+		span := server.traceDB(r.Context(), "authMappingForGroups")
 		mappings, errResponse := authMappingForGroups(server.db, AnonymousGroup)
+		endDBSpan(span, dbSpanError(errResponse))
 		if errResponse != nil {
-			errResponse.log.write(server.logger)
+			errResponse.log.write(server.requestLogger(r.Context()))
 			_ = errResponse.write(w, r)
 			return
 		}
@@ -369,12 +1004,16 @@ func (server *Server) handleAuthMappingPOST(w http.ResponseWriter, r *http.Reque
 
 	var mappings AuthMapping
 	if clientID != "" {
+		span := server.traceDB(r.Context(), "authMappingForClient")
 		mappings, errResponse = authMappingForClient(server.db, clientID)
+		endDBSpan(span, dbSpanError(errResponse))
 	} else {
-		mappings, errResponse = authMappingForUser(server.db, username)
+		span := server.traceDB(r.Context(), "authMappingForUser")
+		mappings, errResponse = authMappingForUser(server.db, username, server.clock())
+		endDBSpan(span, dbSpanError(errResponse))
 	}
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -382,12 +1021,27 @@ func (server *Server) handleAuthMappingPOST(w http.ResponseWriter, r *http.Reque
 }
 
 func (server *Server) handleAuthProxy(w http.ResponseWriter, r *http.Request) {
-	authRequest, errResponse := authRequestFromGET(server.decodeToken, r)
+	var authRequest *AuthRequest
+	var errResponse *ErrorResponse
+	// a trusted client certificate names the caller without a token
+	if info := server.clientCertInfo(r); info != nil {
+		authRequest = authRequestFromQuery(info, r)
+	} else {
+		authRequest, errResponse = authRequestFromGET(server.decodeToken, server.expectedAudiences(), server.requestToken(r), r)
+	}
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
+	// For nginx `auth_request` subrequests, fall back to the headers carrying
+	// the original request. The query string always takes precedence.
+	if authRequest.Method == "" {
+		authRequest.Method = r.Header.Get("X-Forwarded-Method")
+	}
+	if authRequest.Resource == "" {
+		authRequest.Resource = requestURIPath(r.Header.Get("X-Request-URI"))
+	}
 	if authRequest.Resource == "" {
 		msg := "auth proxy request missing `resource` argument"
 		errResponse = newErrorResponse(msg, 400, nil)
@@ -400,222 +1054,454 @@ func (server *Server) handleAuthProxy(w http.ResponseWriter, r *http.Request) {
 		msg := "auth request missing `method` argument"
 		errResponse = newErrorResponse(msg, 400, nil)
 	}
+	if errResponse == nil {
+		authRequest.Constraints, errResponse = constraintsFromQuery(r.URL.Query())
+	}
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	authRequest.stmts = server.stmts
-	w.Header().Set("REMOTE_USER", authRequest.Username)
+	authRequest.now = server.clock()
+	if server.sendsProxyHeader(ProxyHeaderUser) {
+		w.Header().Set(ProxyHeaderUser, authRequest.Username)
+	}
 
 	if (authRequest.Username == "") && (authRequest.ClientID == "") {
+		server.metrics.recordDecision(false)
+		server.auditDecision("/auth/proxy", authRequest, &AuthDecision{})
 		msg := "unauthorized: did not provide a username and/or client ID in request"
 		_ = newErrorResponse(msg, 403, nil).write(w, r)
 		return
 	}
 
-	rv := &AuthResponse{}
-	rv.Auth = true
-	var err error = nil
-	if authRequest.Username != "" {
-		rv, err = authorizeUser(authRequest)
-		if err != nil {
-			msg := fmt.Sprintf("could not authorize user: %s", err.Error())
-			server.logger.Info("tried to handle auth request but input was invalid: %s", msg)
-			response := newErrorResponse(msg, 400, nil)
-			_ = response.write(w, r)
-			return
-		}
-		if rv.Auth {
-			server.logger.Debug("user is authorized")
-		} else {
-			server.logger.Debug("user is unauthorized")
-		}
-	}
-	if rv.Auth && authRequest.ClientID != "" {
-		rv, err = authorizeClient(authRequest)
-		if err != nil {
-			msg := fmt.Sprintf("could not authorize client: %s", err.Error())
-			server.logger.Info("error during client auth check: %s", msg)
-			response := newErrorResponse(msg, 400, nil)
-			_ = response.write(w, r)
-			return
-		}
-		if rv.Auth {
-			server.logger.Debug("client is authorized")
-		} else {
-			server.logger.Debug("client is unauthorized")
-		}
+	decision, errResponse := server.decide(r.Context(), authRequest)
+	if errResponse != nil {
+		_ = errResponse.write(w, r)
+		return
 	}
-	if !rv.Auth {
+	server.metrics.recordDecision(decision.Auth)
+	server.auditDecision("/auth/proxy", authRequest, decision)
+	if !decision.Auth {
 		errResponse := newErrorResponse(
 			"Unauthorized: user does not have access to this resource", 403, nil)
 		_ = errResponse.write(w, r)
+		return
+	}
+	if server.sendsProxyHeader(ProxyHeaderResources) {
+		w.Header().Set(ProxyHeaderResources, authRequest.Resource)
+	}
+	// a request from only a client has no user policy or role to name
+	if server.sendsProxyHeader(ProxyHeaderPolicy) && decision.PolicyID != "" {
+		w.Header().Set(ProxyHeaderPolicy, decision.PolicyID)
+	}
+	if server.sendsProxyHeader(ProxyHeaderRole) && decision.RoleID != "" {
+		w.Header().Set(ProxyHeaderRole, decision.RoleID)
+	}
+}
+
+func (server *Server) sendsProxyHeader(header string) bool {
+	for _, sent := range server.proxyHeaders {
+		if sent == header {
+			return true
+		}
+	}
+	return false
+}
+
+// requestURIPath returns the unescaped path of a request URI such as the one
+// in an `X-Request-URI` header, without its query string.
+func requestURIPath(requestURI string) string {
+	if requestURI == "" {
+		return ""
+	}
+	parsed, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return strings.SplitN(requestURI, "?", 2)[0]
 	}
+	return parsed.Path
 }
 
 func (server *Server) handleAuthRequest(w http.ResponseWriter, r *http.Request, body []byte) {
+	// a JSON array checks a batch of requests, with a result for each
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		server.handleAuthRequestBatch(w, r, body)
+		return
+	}
 	authRequestJSON := &AuthRequestJSON{}
 	err := json.Unmarshal(body, authRequestJSON)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse auth request from JSON: %s", err.Error())
-		server.logger.Info("tried to handle auth request but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to handle auth request but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
-
-	var scopes []string
-	if authRequestJSON.User.Scopes == nil {
-		scopes = []string{"openid"}
-	} else {
-		scopes = make([]string, len(authRequestJSON.User.Scopes))
-		copy(scopes, authRequestJSON.User.Scopes)
-	}
-
-	var isAnonymous bool
-	if authRequestJSON.User.UserId == "" && authRequestJSON.User.Token == "" {
-		isAnonymous = true
-	} else {
-		isAnonymous = false
-	}
-
-	var info *TokenInfo
-	if !isAnonymous && authRequestJSON.User.Token != "" {
-		info, err = server.decodeToken(authRequestJSON.User.Token, scopes)
-		if err != nil {
-			server.logger.Info(err.Error())
-			errResponse := newErrorResponse(err.Error(), 401, &err)
+	if namesUser(authRequestJSON) {
+		if errResponse := server.authorizeAdmin(r, checkUserByName); errResponse != nil {
+			errResponse.log.write(server.requestLogger(r.Context()))
 			_ = errResponse.write(w, r)
 			return
 		}
 	}
-	policies := []string{}
-	var username string
-	var clientID string
-	if info != nil {
-		policies = info.policies
-		username = info.username
-		clientID = info.clientID
-	} else {
-		username = authRequestJSON.User.UserId
-		clientID = ""
+	explain, errResponse := explainFlag(r)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
 	}
-	if authRequestJSON.User.Policies != nil {
-		policies = authRequestJSON.User.Policies
+	rv, errResponse := server.authorizeRequestJSON(r.Context(), authRequestJSON, server.clientCertInfo(r), map[string]*TokenInfo{}, explain)
+	if errResponse != nil {
+		_ = errResponse.write(w, r)
+		return
 	}
+	server.metrics.recordDecision(rv.Auth)
+	_ = jsonResponseFrom(rv, 200).write(w, r)
+}
 
-	requests := []AuthRequestJSON_Request{}
-	if authRequestJSON.Request != nil {
-		requests = append(requests, *authRequestJSON.Request)
-	}
+// handleAuthRequestBatch handles an `/auth/request` body which is a JSON array
+// of auth requests, and responds with an array of results in the same order.
+// Any entry which is invalid fails the whole batch. A token shared between
+// entries is only decoded once.
+func (server *Server) handleAuthRequestBatch(w http.ResponseWriter, r *http.Request, body []byte) {
+	rawRequests := []json.RawMessage{}
+	err := json.Unmarshal(body, &rawRequests)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse auth requests from JSON: %s", err.Error())
+		server.requestLogger(r.Context()).Info("tried to handle auth request but input was invalid: %s", msg)
+		response := newErrorResponse(msg, 400, nil)
+		_ = response.write(w, r)
+		return
+	}
+	if len(rawRequests) == 0 {
+		_ = newErrorResponse("auth request missing resources", 400, nil).write(w, r)
+		return
+	}
+	explain, errResponse := explainFlag(r)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	certInfo := server.clientCertInfo(r)
+	tokens := map[string]*TokenInfo{}
+	results := make([]*AuthResponse, len(rawRequests))
+	adminChecked := false
+	for i, raw := range rawRequests {
+		authRequestJSON := &AuthRequestJSON{}
+		err = json.Unmarshal(raw, authRequestJSON)
+		if err != nil {
+			msg := fmt.Sprintf("could not parse auth request at index %d from JSON: %s", i, err.Error())
+			server.requestLogger(r.Context()).Info("tried to handle auth request but input was invalid: %s", msg)
+			response := newErrorResponse(msg, 400, nil)
+			_ = response.write(w, r)
+			return
+		}
+		if namesUser(authRequestJSON) && !adminChecked {
+			if errResponse := server.authorizeAdmin(r, checkUserByName); errResponse != nil {
+				errResponse.log.write(server.requestLogger(r.Context()))
+				_ = errResponse.write(w, r)
+				return
+			}
+			adminChecked = true
+		}
+		rv, errResponse := server.authorizeRequestJSON(r.Context(), authRequestJSON, certInfo, tokens, explain)
+		if errResponse != nil {
+			errResponse.HTTPError.Message = fmt.Sprintf("auth request at index %d: %s", i, errResponse.HTTPError.Message)
+			_ = errResponse.write(w, r)
+			return
+		}
+		results[i] = rv
+	}
+	for _, rv := range results {
+		server.metrics.recordDecision(rv.Auth)
+	}
+	_ = jsonResponseFrom(results, 200).write(w, r)
+}
+
+// namesUser reports whether an `/auth/request` checks a user given by name in
+// `user_id`, rather than the user a token belongs to.
+func namesUser(authRequestJSON *AuthRequestJSON) bool {
+	return authRequestJSON.User.UserId != "" && authRequestJSON.User.Token == ""
+}
+
+// checkUserByName is what `authorizeAdmin` guards for an `/auth/request`
+// naming a user with `user_id`.
+const checkUserByName = "checking the authorization of a user by `user_id`"
+
+// authorizeAdmin checks that the caller, going by the token in the auth
+// header (see `WithAuthHeader`), holds the policy set with `WithAdminPolicy`. It
+// allows any caller if no admin policy is set. `action` describes what the
+// caller is trying to do, for the error messages.
+func (server *Server) authorizeAdmin(r *http.Request, action string) *ErrorResponse {
+	if server.adminPolicy == "" {
+		return nil
+	}
+	callerJWT := server.requestToken(r)
+	if callerJWT == "" {
+		msg := fmt.Sprintf("%s requires an auth header", action)
+		return newErrorResponse(msg, 401, nil).withCode(ErrorCodeMissingToken)
+	}
+	info, err := server.decodeToken(callerJWT, server.expectedAudiences())
+	if err != nil {
+		return newErrorResponse(err.Error(), 401, &err).withCode(ErrorCodeInvalidToken)
+	}
+	isAdmin := false
+	if info.username != "" {
+		err = server.retryRead(func() (err error) {
+			span := server.traceDB(r.Context(), "userHasPolicy")
+			isAdmin, err = userHasPolicy(server.db, info.username, server.adminPolicy, server.clock())
+			endDBSpan(span, err)
+			return err
+		})
+		if err != nil {
+			msg := fmt.Sprintf("admin policy query failed: %s", err.Error())
+			return newErrorResponse(msg, 500, &err)
+		}
+	}
+	if !isAdmin {
+		msg := fmt.Sprintf("%s requires the `%s` policy", action, server.adminPolicy)
+		return newErrorResponse(msg, 403, nil)
+	}
+	return nil
+}
+
+// decide checks an auth request for its user, if it has one, and then for its
+// client, if it has one and the user was allowed; a request with neither is
+// denied. Errors from the checks are the caller's fault, like a resource
+// which doesn't exist, so they are 400s.
+//
+// Decisions are kept in the decision cache, if there is one (see
+// `WithDecisionCacheTTL`); errors are not.
+func (server *Server) decide(ctx context.Context, request *AuthRequest) (*AuthDecision, *ErrorResponse) {
+	cached, generation := server.decisionCache.get(request, server.clock())
+	if cached != nil {
+		server.requestLogger(ctx).Debug("using cached decision")
+		return cached, nil
+	}
+	decision, errResponse := server.decideUncached(ctx, request)
+	if errResponse == nil {
+		server.decisionCache.add(request, decision, generation, server.clock())
+	}
+	return decision, errResponse
+}
+
+func (server *Server) decideUncached(ctx context.Context, request *AuthRequest) (*AuthDecision, *ErrorResponse) {
+	if request.Username == "" && request.ClientID == "" {
+		// there's no one to allow
+		return &AuthDecision{Auth: false, DeniedBy: AuthCheckUser}, nil
+	}
+	decision := &AuthDecision{Auth: true}
+	if request.Username != "" {
+		rv, err := server.traceAuthorize(ctx, "authorizeUser", authorizeUser, request)
+		if err != nil {
+			msg := fmt.Sprintf("could not authorize user: %s", err.Error())
+			server.requestLogger(ctx).Info("tried to handle auth request but input was invalid: %s", msg)
+			return nil, newErrorResponse(msg, 400, nil)
+		}
+		if !rv.Auth {
+			server.requestLogger(ctx).Debug("user is unauthorized")
+			return &AuthDecision{Auth: false, DeniedBy: AuthCheckUser}, nil
+		}
+		server.requestLogger(ctx).Debug("user is authorized")
+		decision.PolicyID = rv.PolicyID
+		decision.RoleID = rv.RoleID
+	}
+	// the client check only says yes or no, so the granting policy and role
+	// are the user's
+	if request.ClientID != "" {
+		rv, err := server.traceAuthorize(ctx, "authorizeClient", authorizeClient, request)
+		if err != nil {
+			msg := fmt.Sprintf("could not authorize client: %s", err.Error())
+			server.requestLogger(ctx).Info("tried to handle auth request but input was invalid: %s", msg)
+			return nil, newErrorResponse(msg, 400, nil)
+		}
+		if !rv.Auth {
+			server.requestLogger(ctx).Debug("client is unauthorized")
+			return &AuthDecision{Auth: false, DeniedBy: AuthCheckClient}, nil
+		}
+		server.requestLogger(ctx).Debug("client is authorized")
+	}
+	return decision, nil
+}
+
+// authorizeRequestJSON checks every request in a parsed `/auth/request` body,
+// returning an authorized response only if all of them are allowed. Decoded
+// tokens are kept in `tokens`, keyed by the token and its scopes, so that
+// repeated tokens are not decoded again. With `explain`, a denied response
+// says why (see `AuthExplanation`). A body with no token or `user_id` checks
+// `certInfo`, the caller's client certificate (see `clientCertInfo`), if
+// there is one, and otherwise the anonymous group.
+func (server *Server) authorizeRequestJSON(ctx context.Context, authRequestJSON *AuthRequestJSON, certInfo *TokenInfo, tokens map[string]*TokenInfo, explain bool) (*AuthResponse, *ErrorResponse) {
+	var err error
+	var scopes []string
+	if authRequestJSON.User.Scopes == nil {
+		scopes = server.expectedAudiences()
+	} else {
+		scopes = make([]string, len(authRequestJSON.User.Scopes))
+		copy(scopes, authRequestJSON.User.Scopes)
+	}
+
+	var isAnonymous bool
+	if authRequestJSON.User.UserId == "" && authRequestJSON.User.Token == "" {
+		isAnonymous = true
+	} else {
+		isAnonymous = false
+	}
+
+	var info *TokenInfo
+	if isAnonymous && certInfo != nil {
+		info = certInfo
+		isAnonymous = false
+	} else if !isAnonymous && authRequestJSON.User.Token != "" {
+		tokenKey := authRequestJSON.User.Token + " " + strings.Join(scopes, " ")
+		if cached, ok := tokens[tokenKey]; ok {
+			info = cached
+		} else {
+			info, err = server.decodeToken(authRequestJSON.User.Token, scopes)
+			if err != nil {
+				server.requestLogger(ctx).Info(err.Error())
+				return nil, newErrorResponse(err.Error(), 401, &err).withCode(ErrorCodeInvalidToken)
+			}
+			tokens[tokenKey] = info
+		}
+	}
+	policies := []string{}
+	var username string
+	var clientID string
+	if info != nil {
+		policies = info.policies
+		username = info.username
+		clientID = info.clientID
+	} else {
+		username = server.normalizeUsername(authRequestJSON.User.UserId)
+		clientID = ""
+	}
+	if authRequestJSON.User.Policies != nil {
+		policies = authRequestJSON.User.Policies
+	}
+
+	requests := []AuthRequestJSON_Request{}
+	if authRequestJSON.Request != nil {
+		requests = append(requests, *authRequestJSON.Request)
+	}
 	requests = append(requests, authRequestJSON.Requests...)
 
 	if len(requests) == 0 {
-		_ = newErrorResponse("auth request missing resources", 400, nil).write(w, r)
-		return
+		return nil, newErrorResponse("auth request missing resources", 400, nil)
 	}
 
+	var granted *AuthResponse
 	for _, authRequest := range requests {
 		// if no token is provided, use anonymous group to check auth
 		if isAnonymous {
 			request := AuthRequest{
-				Resource: authRequest.Resource,
-				Service:  authRequest.Action.Service,
-				Method:   authRequest.Action.Method,
-				stmts:    server.stmts,
+				Resource:    authRequest.Resource,
+				Service:     authRequest.Action.Service,
+				Method:      authRequest.Action.Method,
+				Constraints: authRequest.Constraints,
+				Context:     authRequest.Context,
+				stmts:       server.stmts,
+				now:         server.clock(),
 			}
-			rv, err := authorizeAnonymous(&request)
+			rv, err := server.traceAuthorize(ctx, "authorizeAnonymous", authorizeAnonymous, &request)
 			if err != nil {
 				msg := fmt.Sprintf("could not authorize: %s", err.Error())
-				server.logger.Info("tried to handle auth request but input was invalid: %s", msg)
-				response := newErrorResponse(msg, 400, nil)
-				_ = response.write(w, r)
-				return
+				server.requestLogger(ctx).Info("tried to handle auth request but input was invalid: %s", msg)
+				return nil, newErrorResponse(msg, 400, nil)
 			}
+			server.auditDecision("/auth/request", &request, &AuthDecision{Auth: rv.Auth})
 			if !rv.Auth {
-				_ = jsonResponseFrom(rv, 200).write(w, r)
-				return
+				if explain {
+					var errResponse *ErrorResponse
+					rv.Explain, errResponse = server.explainDenial(ctx, &request, AuthCheckAnonymous)
+					if errResponse != nil {
+						return nil, errResponse
+					}
+				}
+				return rv, nil
 			}
 			continue
 		}
 
 		if (clientID == "") && (username == "") && (info.policies == nil || len(info.policies) == 0) {
 			msg := "missing both username and policies in request (at least one is required when no client ID is provided)"
-			_ = newErrorResponse(msg, 400, nil).write(w, r)
-			return
+			return nil, newErrorResponse(msg, 400, nil)
 		}
 
 		if (username == "") && (clientID == "") {
 			msg := "unauthorized: did not provide a username and/or client ID in request"
-			_ = newErrorResponse(msg, 403, nil).write(w, r)
-			return
+			return nil, newErrorResponse(msg, 403, nil)
 		}
 
 		// username = UserID or username
 		request := &AuthRequest{
-			Username: username,
-			ClientID: clientID,
-			Policies: policies,
-			Resource: authRequest.Resource,
-			Service:  authRequest.Action.Service,
-			Method:   authRequest.Action.Method,
-			stmts:    server.stmts,
-		}
-		server.logger.Info("handling auth request: %#v", *request)
-		rv := &AuthResponse{}
-		rv.Auth = true
-		if request.Username != "" {
-			rv, err = authorizeUser(request)
-			if err != nil {
-				msg := fmt.Sprintf("could not authorize user: %s", err.Error())
-				server.logger.Info("tried to handle auth request but input was invalid: %s", msg)
-				response := newErrorResponse(msg, 400, nil)
-				_ = response.write(w, r)
-				return
-			}
-			if rv.Auth {
-				server.logger.Debug("user is authorized")
-			} else {
-				server.logger.Debug("user is unauthorized")
-			}
+			Username:    username,
+			ClientID:    clientID,
+			Policies:    policies,
+			Resource:    authRequest.Resource,
+			Service:     authRequest.Action.Service,
+			Method:      authRequest.Action.Method,
+			Constraints: authRequest.Constraints,
+			Context:     authRequest.Context,
+			stmts:       server.stmts,
+			now:         server.clock(),
 		}
-		if rv.Auth && request.ClientID != "" {
-			rv, err = authorizeClient(request)
-			if err == nil && rv.Auth {
-				server.logger.Debug("client is authorized")
-			} else {
-				server.logger.Debug("client is unauthorized")
-			}
-			if err != nil {
-				msg := fmt.Sprintf("could not authorize client: %s", err.Error())
-				server.logger.Info("tried to handle auth request but input was invalid: %s", msg)
-				response := newErrorResponse(msg, 400, nil)
-				_ = response.write(w, r)
-				return
-			}
+		server.requestLogger(ctx).Info("handling auth request: %#v", *request)
+		decision, errResponse := server.decide(ctx, request)
+		if errResponse != nil {
+			return nil, errResponse
 		}
-		if !rv.Auth {
-			_ = jsonResponseFrom(rv, 200).write(w, r)
-			return
+		server.auditDecision("/auth/request", request, decision)
+		if !decision.Auth {
+			rv := decision.response()
+			if explain {
+				rv.Explain, errResponse = server.explainDenial(ctx, request, decision.DeniedBy)
+				if errResponse != nil {
+					return nil, errResponse
+				}
+			}
+			return rv, nil
 		}
+		granted = decision.response()
+	}
+
+	// with several requests, each may be allowed by a different policy, so
+	// only a single request reports what allowed it
+	if len(requests) == 1 && granted != nil {
+		return granted, nil
 	}
+	return &AuthResponse{Auth: true}, nil
+}
 
-	result := AuthResponse{
-		Auth: true,
+// explainDenial works out why `request` was denied by the check `deniedBy`.
+func (server *Server) explainDenial(ctx context.Context, request *AuthRequest, deniedBy string) (*AuthExplanation, *ErrorResponse) {
+	var explanation *AuthExplanation
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(ctx, "explainAuthRequest")
+		explanation, err = explainAuthRequest(server.db, request, deniedBy)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("could not explain auth request: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, &err)
+		errResponse.log.write(server.requestLogger(ctx))
+		return nil, errResponse
 	}
-	_ = jsonResponseFrom(result, 200).write(w, r)
+	return explanation, nil
 }
 
 func (server *Server) handleListAuthResourcesGET(w http.ResponseWriter, r *http.Request) {
 	authRequest := &AuthRequest{}
 	var errResponse *ErrorResponse
-	hasJWT := r.Header.Get("Authorization") != ""
+	hasJWT := server.requestToken(r) != ""
 	usernameInJWT := false
 	if hasJWT {
-		authRequest, errResponse = authRequestFromGET(server.decodeToken, r)
+		authRequest, errResponse = authRequestFromGET(server.decodeToken, server.expectedAudiences(), server.requestToken(r), r)
 		if errResponse != nil {
-			errResponse.log.write(server.logger)
+			errResponse.log.write(server.requestLogger(r.Context()))
 			_ = errResponse.write(w, r)
 			return
 		}
@@ -623,13 +1509,18 @@ func (server *Server) handleListAuthResourcesGET(w http.ResponseWriter, r *http.
 	}
 
 	if hasJWT && usernameInJWT {
+		authRequest.now = server.clock()
+		span := server.traceDB(r.Context(), "authorizedResources")
 		authResources, errResponse := authorizedResources(server.db, authRequest)
+		endDBSpan(span, dbSpanError(errResponse))
 		server.makeAuthResourcesResponse(w, r, authResources, errResponse)
 		return
 	} else {
 		// If no JWT is provided or no username in JWT, return only `anonymous` policies.
 		// See `docs/username.md` for more details.
+		span := server.traceDB(r.Context(), "authorizedResourcesForGroups")
 		authResources, errResponse := authorizedResourcesForGroups(server.db, AnonymousGroup)
+		endDBSpan(span, dbSpanError(errResponse))
 		server.makeAuthResourcesResponse(w, r, authResources, errResponse)
 		return
 	}
@@ -644,7 +1535,7 @@ func (server *Server) handleListAuthResourcesPOST(w http.ResponseWriter, r *http
 	err := json.Unmarshal(body, &request)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse auth request from JSON: %s", err.Error())
-		server.logger.Info("tried to handle auth request but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to handle auth request but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
@@ -653,7 +1544,7 @@ func (server *Server) handleListAuthResourcesPOST(w http.ResponseWriter, r *http
 	// make sure not empty
 	/*
 		if (request.User == AuthRequestJSON_User{}) {
-			server.logger.Info("auth resources request missing user field", msg)
+			server.requestLogger(r.Context()).Info("auth resources request missing user field", msg)
 			response := newErrorResponse(msg, 400, nil)
 			_ = response.write(w, r)
 			return
@@ -661,7 +1552,7 @@ func (server *Server) handleListAuthResourcesPOST(w http.ResponseWriter, r *http
 	*/
 	var scopes []string
 	if request.User.Scopes == nil {
-		scopes = []string{"openid"}
+		scopes = server.expectedAudiences()
 	} else {
 		scopes = make([]string, len(request.User.Scopes))
 		copy(scopes, request.User.Scopes)
@@ -669,8 +1560,8 @@ func (server *Server) handleListAuthResourcesPOST(w http.ResponseWriter, r *http
 
 	info, err := server.decodeToken(request.User.Token, scopes)
 	if err != nil {
-		server.logger.Info(err.Error())
-		errResponse := newErrorResponse(err.Error(), 401, &err)
+		server.requestLogger(r.Context()).Info(err.Error())
+		errResponse := newErrorResponse(err.Error(), 401, &err).withCode(ErrorCodeInvalidToken)
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -681,13 +1572,178 @@ func (server *Server) handleListAuthResourcesPOST(w http.ResponseWriter, r *http
 	if request.User.Policies != nil {
 		authRequest.Policies = request.User.Policies
 	}
+	authRequest.now = server.clock()
+	span := server.traceDB(r.Context(), "authorizedResources")
 	authResources, errResponse := authorizedResources(server.db, authRequest)
+	endDBSpan(span, dbSpanError(errResponse))
 	server.makeAuthResourcesResponse(w, r, authResources, errResponse)
 }
 
+// handleAuthPoliciesGET lists the policies granted by the token in the
+// `Authorization` header, without checking any resource.
+func (server *Server) handleAuthPoliciesGET(w http.ResponseWriter, r *http.Request) {
+	authRequest, errResponse := authRequestFromGET(server.decodeToken, server.expectedAudiences(), server.requestToken(r), r)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	authRequest.now = server.clock()
+	server.writeEffectivePolicies(w, r, authRequest)
+}
+
+// handleAuthPoliciesPOST lists the policies granted by the token in the
+// body, as `{"user": {"token": "..."}}`, like `/auth/resources`.
+func (server *Server) handleAuthPoliciesPOST(w http.ResponseWriter, r *http.Request, body []byte) {
+	request := struct {
+		User AuthRequestJSON_User `json:"user"`
+	}{}
+	err := json.Unmarshal(body, &request)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse auth request from JSON: %s", err.Error())
+		server.requestLogger(r.Context()).Info("tried to handle auth request but input was invalid: %s", msg)
+		response := newErrorResponse(msg, 400, nil)
+		_ = response.write(w, r)
+		return
+	}
+	if request.User.Token == "" {
+		msg := "auth request missing `user.token`"
+		errResponse := newErrorResponse(msg, 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	scopes := request.User.Scopes
+	if scopes == nil {
+		scopes = server.expectedAudiences()
+	}
+	info, err := server.decodeToken(request.User.Token, scopes)
+	if err != nil {
+		server.requestLogger(r.Context()).Info(err.Error())
+		errResponse := newErrorResponse(err.Error(), 401, &err).withCode(ErrorCodeInvalidToken)
+		_ = errResponse.write(w, r)
+		return
+	}
+	authRequest := &AuthRequest{
+		Username: info.username,
+		ClientID: info.clientID,
+		Policies: info.policies,
+		now:      server.clock(),
+	}
+	server.writeEffectivePolicies(w, r, authRequest)
+}
+
+func (server *Server) writeEffectivePolicies(w http.ResponseWriter, r *http.Request, authRequest *AuthRequest) {
+	var policies *EffectivePolicies
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "effectivePolicies")
+		policies, err = effectivePolicies(server.db, authRequest)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("policies query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, &err)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	_ = jsonResponseFrom(policies, http.StatusOK).write(w, r)
+}
+
+// handleTokenRevoke records a token as revoked, so that `decodeToken`
+// rejects it from then until it expires. The token must be signed by a key
+// arborist trusts and have a `jti` claim.
+func (server *Server) handleTokenRevoke(w http.ResponseWriter, r *http.Request, body []byte) {
+	if errResponse := server.authorizeAdmin(r, "revoking a token"); errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	request := struct {
+		Token string `json:"token"`
+	}{}
+	err := json.Unmarshal(body, &request)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse revoke request from JSON: %s", err.Error())
+		errResponse := newErrorResponse(msg, 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if request.Token == "" {
+		errResponse := newErrorResponse("revoke request missing `token`", 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	claims, err := server.jwtApp.Decode(request.Token)
+	if err != nil {
+		msg := fmt.Sprintf("couldn't decode token to revoke: %s", err.Error())
+		errResponse := newErrorResponse(msg, 400, &err).withCode(ErrorCodeInvalidToken)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	revoked, err := revokedTokenFromClaims(claims)
+	if err != nil {
+		errResponse := newErrorResponse(err.Error(), 400, &err).withCode(ErrorCodeInvalidToken)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	span := server.traceDB(r.Context(), "transactify")
+	errResponse := transactify(server.db, func(tx *sqlx.Tx) *ErrorResponse {
+		return revoked.createInDb(tx)
+	})
+	endDBSpan(span, dbSpanError(errResponse))
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	server.requestLogger(r.Context()).Info("revoked token %s", revoked.JTI)
+	result := struct {
+		Revoked *RevokedToken `json:"revoked"`
+	}{
+		Revoked: revoked,
+	}
+	_ = jsonResponseFrom(result, http.StatusCreated).write(w, r)
+}
+
+// handleAdminReload drops every cached authorization decision, for after the
+// database has been changed other than through this server (such as by hand,
+// or by another replica), and reports what decisions are now made from.
+// Nothing else is held in memory: decisions are otherwise always read from
+// the database.
+func (server *Server) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if errResponse := server.authorizeAdmin(r, "reloading"); errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	var result *ReloadResult
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "reloadCountsFromDb")
+		result, err = reloadCountsFromDb(server.db)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("reload query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	result.DroppedDecisions = server.decisionCache.invalidate()
+	server.requestLogger(r.Context()).Info("reloaded; dropped %d cached decisions", result.DroppedDecisions)
+	_ = jsonResponseFrom(result, http.StatusOK).write(w, r)
+}
+
 func (server *Server) makeAuthResourcesResponse(w http.ResponseWriter, r *http.Request, resourcesFromQuery []ResourceFromQuery, errResponse *ErrorResponse) {
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -719,16 +1775,110 @@ func (server *Server) makeAuthResourcesResponse(w http.ResponseWriter, r *http.R
 	_ = jsonResponseFrom(response, http.StatusOK).write(w, r)
 }
 
+// pageOptions reads the `limit` and `offset` query parameters for paging
+// through a list; both default to 0.
+func pageOptions(r *http.Request) (limit int, offset int, errResponse *ErrorResponse) {
+	for _, param := range []string{"limit", "offset"} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			msg := fmt.Sprintf("`%s` must be a non-negative integer; got `%s`", param, value)
+			return 0, 0, newErrorResponse(msg, 400, nil)
+		}
+		if param == "limit" {
+			limit = n
+		} else {
+			offset = n
+		}
+	}
+	return limit, offset, nil
+}
+
+// policyListOptions reads the `limit`, `offset` and `resource` query
+// parameters for listing policies.
+func policyListOptions(r *http.Request) (PolicyListOptions, *ErrorResponse) {
+	options := PolicyListOptions{}
+	limit, offset, errResponse := pageOptions(r)
+	if errResponse != nil {
+		return options, errResponse
+	}
+	options.Limit = limit
+	options.Offset = offset
+	options.Resource = r.URL.Query().Get("resource")
+	return options, nil
+}
+
+// dryRunFlag reads the `dry_run` query parameter, which asks a create
+// endpoint to check its input against the database without saving anything.
+func dryRunFlag(r *http.Request) (bool, *ErrorResponse) {
+	value := r.URL.Query().Get("dry_run")
+	if value == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		msg := fmt.Sprintf("`dry_run` must be true or false; got `%s`", value)
+		return false, newErrorResponse(msg, 400, nil)
+	}
+	return dryRun, nil
+}
+
+// explainFlag reads the `explain` query parameter, which asks `/auth/request`
+// to say why a request was denied.
+func explainFlag(r *http.Request) (bool, *ErrorResponse) {
+	value := r.URL.Query().Get("explain")
+	if value == "" {
+		return false, nil
+	}
+	explain, err := strconv.ParseBool(value)
+	if err != nil {
+		msg := fmt.Sprintf("`explain` must be true or false; got `%s`", value)
+		return false, newErrorResponse(msg, 400, nil)
+	}
+	return explain, nil
+}
+
 func (server *Server) handlePolicyList(w http.ResponseWriter, r *http.Request) {
 	_, expandFlag := r.URL.Query()["expand"]
-	policiesFromQuery, err := listPoliciesFromDb(server.db)
+	options, errResponse := policyListOptions(r)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	var policiesFromQuery []PolicyFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "listPoliciesFromDb")
+		policiesFromQuery, err = listPoliciesFromDb(server.db, options)
+		endDBSpan(span, err)
+		return err
+	})
 	if err != nil {
 		msg := fmt.Sprintf("policies query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	var total int
+	err = server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "countPoliciesFromDb")
+		total, err = countPoliciesFromDb(server.db, options)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("policies count query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
+	// total number of matching policies, so clients can page through them
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 
 	// query policies
 	policies := []Policy{}
@@ -744,11 +1894,13 @@ func (server *Server) handlePolicyList(w http.ResponseWriter, r *http.Request) {
 	if expandFlag {
 		// query role details
 		roleMap := make(map[string]Role) // {role ID: role instance} map
+		span := server.traceDB(r.Context(), "rolesWithNames")
 		rolesFromQuery, err := rolesWithNames(server.db, allPoliciesRoleIDs)
+		endDBSpan(span, err)
 		if err != nil {
 			msg := fmt.Sprintf("unable to list roles with IDs %v: %s", allPoliciesRoleIDs, err.Error())
 			errResponse := newErrorResponse(msg, 400, nil)
-			errResponse.log.write(server.logger)
+			errResponse.log.write(server.requestLogger(r.Context()))
 			_ = errResponse.write(w, r)
 			return
 		}
@@ -763,6 +1915,8 @@ func (server *Server) handlePolicyList(w http.ResponseWriter, r *http.Request) {
 				Name:          policy.Name,
 				Description:   policy.Description,
 				ResourcePaths: policy.ResourcePaths,
+				Effect:        policy.Effect,
+				SchemaVersion: policy.SchemaVersion,
 			}
 			roles := []Role{}
 			for _, roleID := range policy.RoleIDs {
@@ -791,44 +1945,130 @@ func (server *Server) handlePolicyList(w http.ResponseWriter, r *http.Request) {
 }
 
 func (server *Server) handlePolicyCreate(w http.ResponseWriter, r *http.Request, body []byte) {
+	// a JSON array creates a batch of policies all at once
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		server.handlePolicyCreateMany(w, r, body)
+		return
+	}
 	policy := &Policy{}
 	err := json.Unmarshal(body, policy)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse policy from JSON: %s", err.Error())
-		server.logger.Info("tried to create policy but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to create policy but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
-	errResponse := transactify(server.db, policy.createInDb)
+	dryRun, errResponse := dryRunFlag(r)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	transact := transactify
+	if dryRun {
+		transact = transactifyDryRun
+	}
+	span := server.traceDB(r.Context(), "transactify")
+	errResponse = transact(server.db, policy.createInDb)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("created policy %s", policy.Name)
 	created := struct {
 		Created *Policy `json:"created"`
 	}{
 		Created: policy,
 	}
-	_ = jsonResponseFrom(created, 201).write(w, r)
+	if dryRun {
+		server.requestLogger(r.Context()).Info("policy %s could be created (dry run)", policy.Name)
+		_ = jsonResponseFrom(created, http.StatusOK).write(w, r)
+		return
+	}
+	server.requestLogger(r.Context()).Info("created policy %s", policy.Name)
+	server.notify("policy", "create", policy.Name)
+	_ = jsonResponseFrom(created, 201).withLocation(locationPath("policy", policy.Name)).write(w, r)
 }
 
-func (server *Server) overwritePolicy(w http.ResponseWriter, r *http.Request, policy Policy) *ErrorResponse {
-	// Overwrite policy name from json with policy name from query arg.
-	// After 3.0.0, when PUT /policy is deprecated and only PUT /policy/{policyID} is allowed,
-	// can remove the !="" check. For now, if policy name not found in url, default to name in json.
-	if mux.Vars(r)["policyID"] != "" {
-		policy.Name = mux.Vars(r)["policyID"]
-	}
+// handlePolicyCreateMany creates every policy in a JSON array in a single
+// transaction, so either all of them are created or none are.
+func (server *Server) handlePolicyCreateMany(w http.ResponseWriter, r *http.Request, body []byte) {
+	var rawPolicies []json.RawMessage
+	err := json.Unmarshal(body, &rawPolicies)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse policies from JSON: %s", err.Error())
+		server.requestLogger(r.Context()).Info("tried to create policies but input was invalid: %s", msg)
+		response := newErrorResponse(msg, 400, nil)
+		_ = response.write(w, r)
+		return
+	}
+	policies := make([]Policy, len(rawPolicies))
+	for i, rawPolicy := range rawPolicies {
+		err = json.Unmarshal(rawPolicy, &policies[i])
+		if err != nil {
+			msg := fmt.Sprintf("could not parse policy at index %d from JSON: %s", i, err.Error())
+			server.requestLogger(r.Context()).Info("tried to create policies but input was invalid: %s", msg)
+			response := newErrorResponse(msg, 400, nil)
+			_ = response.write(w, r)
+			return
+		}
+	}
+	dryRun, errResponse := dryRunFlag(r)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	transact := transactify
+	if dryRun {
+		transact = transactifyDryRun
+	}
+	span := server.traceDB(r.Context(), "transactify")
+	errResponse = transact(server.db, func(tx *sqlx.Tx) *ErrorResponse {
+		return createManyInDb(tx, policies)
+	})
+	endDBSpan(span, dbSpanError(errResponse))
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	created := struct {
+		Created []Policy `json:"created"`
+	}{
+		Created: policies,
+	}
+	if dryRun {
+		server.requestLogger(r.Context()).Info("%d policies could be created (dry run)", len(policies))
+		_ = jsonResponseFrom(created, http.StatusOK).write(w, r)
+		return
+	}
+	server.requestLogger(r.Context()).Info("created %d policies", len(policies))
+	for _, policy := range policies {
+		server.notify("policy", "create", policy.Name)
+	}
+	_ = jsonResponseFrom(created, 201).write(w, r)
+}
+
+func (server *Server) overwritePolicy(w http.ResponseWriter, r *http.Request, policy Policy) *ErrorResponse {
+	// Overwrite policy name from json with policy name from query arg.
+	// After 3.0.0, when PUT /policy is deprecated and only PUT /policy/{policyID} is allowed,
+	// can remove the !="" check. For now, if policy name not found in url, default to name in json.
+	if mux.Vars(r)["policyID"] != "" {
+		policy.Name = mux.Vars(r)["policyID"]
+	}
+	span := server.traceDB(r.Context(), "transactify")
 	errResponse := transactify(server.db, policy.updateInDb)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return errResponse
 	}
-	server.logger.Info("overwrote policy %s", policy.Name)
+	server.requestLogger(r.Context()).Info("overwrote policy %s", policy.Name)
+	server.notify("policy", "update", policy.Name)
 	return nil
 }
 
@@ -837,7 +2077,7 @@ func (server *Server) handlePolicyOverwrite(w http.ResponseWriter, r *http.Reque
 	err := json.Unmarshal(body, policy)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse policy from JSON: %s", err.Error())
-		server.logger.Info("tried to create policy but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to create policy but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
@@ -853,7 +2093,35 @@ func (server *Server) handlePolicyOverwrite(w http.ResponseWriter, r *http.Reque
 	}{
 		Updated: policy,
 	}
-	_ = jsonResponseFrom(updated, 201).write(w, r)
+	_ = jsonResponseFrom(updated, 201).withLocation(locationPath("policy", policy.Name)).write(w, r)
+}
+
+// handlePolicyUpdate replaces the description, resource paths and role IDs of
+// an existing policy in one transaction. The policy ID always comes from the
+// URL. Returns 404 if the policy does not exist.
+func (server *Server) handlePolicyUpdate(w http.ResponseWriter, r *http.Request, body []byte) {
+	policy := &Policy{}
+	err := json.Unmarshal(body, policy)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse policy from JSON: %s", err.Error())
+		server.requestLogger(r.Context()).Info("tried to update policy but input was invalid: %s", msg)
+		response := newErrorResponse(msg, 400, nil)
+		_ = response.write(w, r)
+		return
+	}
+	policy.Name = mux.Vars(r)["policyID"]
+
+	errResponse := server.overwritePolicy(w, r, *policy)
+	if errResponse != nil {
+		return
+	}
+
+	updated := struct {
+		Updated *Policy `json:"updated"`
+	}{
+		Updated: policy,
+	}
+	_ = jsonResponseFrom(updated, http.StatusOK).write(w, r)
 }
 
 func (server *Server) handleBulkPoliciesOverwrite(w http.ResponseWriter, r *http.Request, body []byte) {
@@ -861,7 +2129,7 @@ func (server *Server) handleBulkPoliciesOverwrite(w http.ResponseWriter, r *http
 	err := json.Unmarshal(body, &policies)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse policies from JSON: %s", err.Error())
-		server.logger.Info("tried to create policies but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to create policies but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
@@ -880,98 +2148,518 @@ func (server *Server) handleBulkPoliciesOverwrite(w http.ResponseWriter, r *http
 
 func (server *Server) handlePolicyRead(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["policyID"]
-	policyFromQuery, err := policyWithName(server.db, name)
+	var policyFromQuery *PolicyFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "policyWithName")
+		policyFromQuery, err = policyWithName(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
 	if policyFromQuery == nil {
 		msg := fmt.Sprintf("no policy found with id: %s", name)
-		errResponse := newErrorResponse(msg, 404, nil)
-		errResponse.log.write(server.logger)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	if err != nil {
 		msg := fmt.Sprintf("policy query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	policy := policyFromQuery.standardize()
-	_ = jsonResponseFrom(policy, http.StatusOK).write(w, r)
+	_ = jsonResponseFrom(policy, http.StatusOK).withETag().write(w, r)
 }
 
+// handlePolicyResources lists the resources a policy applies to, including
+// the ones under the resources it names.
+func (server *Server) handlePolicyResources(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["policyID"]
+	var policyFromQuery *PolicyFromQuery
+	var resourcesFromQuery []ResourceFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "policyWithName")
+		policyFromQuery, err = policyWithName(server.db, name)
+		endDBSpan(span, err)
+		if err != nil || policyFromQuery == nil {
+			return err
+		}
+		span = server.traceDB(r.Context(), "policyResourcesFromDb")
+		resourcesFromQuery, err = policyResourcesFromDb(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("policy resources query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if policyFromQuery == nil {
+		msg := fmt.Sprintf("no policy found with id: %s", name)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	resources := []ResourceOut{}
+	for _, resourceFromQuery := range resourcesFromQuery {
+		resources = append(resources, resourceFromQuery.standardize())
+	}
+	result := struct {
+		Resources []ResourceOut `json:"resources"`
+	}{
+		Resources: resources,
+	}
+	_ = jsonResponseFrom(result, http.StatusOK).write(w, r)
+}
+
+// handlePolicyDiff compares two policies, listing the resource paths and
+// roles the second one adds to or removes from the first.
+func (server *Server) handlePolicyDiff(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	names := []string{vars["policyID"], vars["otherPolicyID"]}
+	policiesFromQuery := make([]*PolicyFromQuery, len(names))
+	err := server.retryRead(func() (err error) {
+		for i, name := range names {
+			span := server.traceDB(r.Context(), "policyWithName")
+			policiesFromQuery[i], err = policyWithName(server.db, name)
+			endDBSpan(span, err)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		msg := fmt.Sprintf("policy diff query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	for i, policyFromQuery := range policiesFromQuery {
+		if policyFromQuery == nil {
+			msg := fmt.Sprintf("no policy found with id: %s", names[i])
+			errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
+	}
+	diff := diffPolicies(policiesFromQuery[0].standardize(), policiesFromQuery[1].standardize())
+	_ = jsonResponseFrom(diff, http.StatusOK).write(w, r)
+}
+
+// handlePolicyGrantUsers grants a policy to every user in the body's
+// `usernames`, with an optional `expires_at`.
+func (server *Server) handlePolicyGrantUsers(w http.ResponseWriter, r *http.Request, body []byte) {
+	server.policyBulkGrant(w, r, body, false)
+}
+
+// handlePolicyRevokeUsers revokes a policy from every user in the body's
+// `usernames`.
+func (server *Server) handlePolicyRevokeUsers(w http.ResponseWriter, r *http.Request, body []byte) {
+	server.policyBulkGrant(w, r, body, true)
+}
+
+// policyBulkGrant grants or revokes a policy for a list of users, all in one
+// transaction. Users which can't be granted or revoked are reported in the
+// results without stopping the others; if any are, the response is a 207
+// rather than a 200.
+func (server *Server) policyBulkGrant(w http.ResponseWriter, r *http.Request, body []byte, revoke bool) {
+	policyName := mux.Vars(r)["policyID"]
+	request := struct {
+		Usernames []string `json:"usernames"`
+		ExpiresAt string   `json:"expires_at"`
+	}{}
+	err := json.Unmarshal(body, &request)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse usernames from JSON: %s", err.Error())
+		errResponse := newErrorResponse(msg, 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if len(request.Usernames) == 0 {
+		errResponse := newErrorResponse("request missing `usernames`", 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	var expiresAt *time.Time
+	if request.ExpiresAt != "" && !revoke {
+		exp, err := time.Parse(time.RFC3339, request.ExpiresAt)
+		if err != nil {
+			msg := "could not parse `expires_at` (must be in RFC 3339 format; see specification: https://tools.ietf.org/html/rfc3339#section-5.8)"
+			errResponse := newErrorResponse(msg, 400, nil)
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
+		expiresAt = &exp
+	}
+	usernames := make([]string, len(request.Usernames))
+	for i, username := range request.Usernames {
+		usernames[i] = server.normalizeUsername(username)
+	}
+	authzProvider := getAuthZProvider(r)
+	var results *BulkGrantResults
+	span := server.traceDB(r.Context(), "transactify")
+	errResponse := transactify(server.db, func(tx *sqlx.Tx) *ErrorResponse {
+		var errResponse *ErrorResponse
+		if revoke {
+			results, errResponse = revokePolicyFromUsers(tx, policyName, usernames, authzProvider)
+		} else {
+			results, errResponse = grantPolicyToUsers(tx, policyName, usernames, expiresAt, authzProvider)
+		}
+		return errResponse
+	})
+	endDBSpan(span, dbSpanError(errResponse))
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	action := "granted policy %s to %d users (%d failed)"
+	if revoke {
+		action = "revoked policy %s from %d users (%d failed)"
+	}
+	server.requestLogger(r.Context()).Info(action, policyName, results.Succeeded, results.Failed)
+	status := http.StatusOK
+	if results.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	_ = jsonResponseFrom(results, status).write(w, r)
+}
+
+// handlePolicyTest reports whether the policy, on its own, would allow an
+// action on a resource, so a policy can be checked before it is granted to
+// anyone.
+func (server *Server) handlePolicyTest(w http.ResponseWriter, r *http.Request, body []byte) {
+	if errResponse := server.authorizeAdmin(r, "testing a policy"); errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	name := mux.Vars(r)["policyID"]
+	test := &PolicyTest{}
+	errResponse := unmarshal(body, test)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	var policyFromQuery *PolicyFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "policyWithName")
+		policyFromQuery, err = policyWithName(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("policy query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if policyFromQuery == nil {
+		msg := fmt.Sprintf("no policy found with id: %s", name)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	request := &AuthRequest{
+		Policies:    []string{name},
+		Resource:    test.Resource,
+		Service:     test.Service,
+		Method:      test.Method,
+		Constraints: test.Constraints,
+		Context:     test.Context,
+		stmts:       server.stmts,
+	}
+	rv, err := server.traceAuthorize(r.Context(), "authorizePolicy", authorizePolicy, request)
+	if err != nil {
+		msg := fmt.Sprintf("could not test policy: %s", err.Error())
+		errResponse := newErrorResponse(msg, 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	_ = jsonResponseFrom(rv, http.StatusOK).write(w, r)
+}
+
+// handlePolicyDelete deletes a policy, or with a soft delete (see
+// `WithPolicySoftDelete`) archives it so it can be restored.
 func (server *Server) handlePolicyDelete(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["policyID"]
+	soft := server.policySoftDelete
+	if softParam := r.URL.Query().Get("soft"); softParam != "" {
+		var err error
+		soft, err = strconv.ParseBool(softParam)
+		if err != nil {
+			msg := fmt.Sprintf("`soft` must be true or false; got `%s`", softParam)
+			errResponse := newErrorResponse(msg, 400, nil)
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
+	}
 	policy := &Policy{Name: name}
-	errResponse := transactify(server.db, policy.deleteInDb)
+	var errResponse *ErrorResponse
+	if soft {
+		span := server.traceDB(r.Context(), "transactify")
+		errResponse = transactify(server.db, func(tx *sqlx.Tx) *ErrorResponse {
+			return policy.archiveInDb(tx, server.clock())
+		})
+		endDBSpan(span, dbSpanError(errResponse))
+	} else {
+		span := server.traceDB(r.Context(), "transactify")
+		errResponse = transactify(server.db, policy.deleteInDb)
+		endDBSpan(span, dbSpanError(errResponse))
+	}
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("deleted policy %s", name)
+	if soft {
+		server.requestLogger(r.Context()).Info("archived policy %s", name)
+	} else {
+		server.requestLogger(r.Context()).Info("deleted policy %s", name)
+	}
+	server.notify("policy", "delete", name)
 	_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 }
 
-func (server *Server) handleResourceList(w http.ResponseWriter, r *http.Request) {
-	resourcesFromQuery, err := listResourcesFromDb(server.db)
-	resources := []ResourceOut{}
-	for _, resourceFromQuery := range resourcesFromQuery {
-		resources = append(resources, resourceFromQuery.standardize())
+// handlePolicyRestore brings back a policy which was soft-deleted, with its
+// grants, and responds with the policy.
+func (server *Server) handlePolicyRestore(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["policyID"]
+	span := server.traceDB(r.Context(), "transactify")
+	errResponse := transactify(server.db, func(tx *sqlx.Tx) *ErrorResponse {
+		return restorePolicyInDb(tx, name)
+	})
+	endDBSpan(span, dbSpanError(errResponse))
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
 	}
+	server.requestLogger(r.Context()).Info("restored policy %s", name)
+	server.notify("policy", "create", name)
+	var policyFromQuery *PolicyFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "policyWithName")
+		policyFromQuery, err = policyWithName(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
 	if err != nil {
-		msg := fmt.Sprintf("resources query failed: %s", err.Error())
-		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		msg := fmt.Sprintf("restored policy but couldn't read it back: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, &err)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	result := struct {
-		Resources []ResourceOut `json:"resources"`
+	if policyFromQuery == nil {
+		// deleted again since
+		msg := fmt.Sprintf("no policy found with id: %s", name)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	restored := struct {
+		Restored Policy `json:"restored"`
 	}{
-		Resources: resources,
+		Restored: policyFromQuery.standardize(),
 	}
-	_ = jsonResponseFrom(result, http.StatusOK).write(w, r)
+	_ = jsonResponseFrom(restored, http.StatusOK).write(w, r)
 }
 
-var regSlashes *regexp.Regexp = regexp.MustCompile(`/+`)
+// writeListFromRows responds with `{"<key>": [...]}`, with an element made by
+// `element` for each row of the query `query` runs. Plain JSON is streamed as
+// the rows are read, so a long list is never all in memory; YAML and pretty
+// JSON are built up in full first. Once streaming has started an error can't
+// change the status any more, so it is logged and the response is cut short,
+// which leaves the client with invalid JSON rather than a partial list.
+func (server *Server) writeListFromRows(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+	query func() (*sqlx.Rows, error),
+	element func(*sqlx.Rows) (interface{}, error),
+) {
+	var rows *sqlx.Rows
+	err := server.retryRead(func() (err error) {
+		rows, err = query()
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("%s query failed: %s", key, err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	defer rows.Close()
+	next := func() (interface{}, bool, error) {
+		if !rows.Next() {
+			return nil, false, rows.Err()
+		}
+		result, err := element(rows)
+		return result, err == nil, err
+	}
+
+	if wantYAML(r) || wantPrettyJSON(r) {
+		elements := []interface{}{}
+		for {
+			result, ok, err := next()
+			if err != nil {
+				msg := fmt.Sprintf("%s query failed: %s", key, err.Error())
+				errResponse := newErrorResponse(msg, 500, nil)
+				errResponse.log.write(server.requestLogger(r.Context()))
+				_ = errResponse.write(w, r)
+				return
+			}
+			if !ok {
+				break
+			}
+			elements = append(elements, result)
+		}
+		_ = jsonResponseFrom(map[string]interface{}{key: elements}, http.StatusOK).write(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = writeJSONList(w, key, next)
+	if err != nil {
+		server.requestLogger(r.Context()).Error("%s list cut short: %s", key, err.Error())
+	}
+}
+
+// handleResourceList lists every resource, or with `?tag=key:value` (which
+// can be repeated) only the resources with all of those tags.
+func (server *Server) handleResourceList(w http.ResponseWriter, r *http.Request) {
+	tags := map[string]string{}
+	noMatch := false
+	for _, filter := range r.URL.Query()["tag"] {
+		key, value, ok := parseTagFilter(filter)
+		if !ok {
+			msg := fmt.Sprintf("`tag` must look like `key:value`; got `%s`", filter)
+			errResponse := newErrorResponse(msg, 400, nil)
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
+		if existing, exists := tags[key]; exists && existing != value {
+			// no resource can have two values for one key
+			noMatch = true
+		}
+		tags[key] = value
+	}
+	if noMatch {
+		result := struct {
+			Resources []ResourceOut `json:"resources"`
+		}{
+			Resources: []ResourceOut{},
+		}
+		_ = jsonResponseFrom(result, http.StatusOK).write(w, r)
+		return
+	}
+	server.writeListFromRows(
+		w,
+		r,
+		"resources",
+		func() (rows *sqlx.Rows, err error) {
+			span := server.traceDB(r.Context(), "queryResources")
+			rows, err = queryResources(server.db, tags)
+			endDBSpan(span, err)
+			return rows, err
+		},
+		func(rows *sqlx.Rows) (interface{}, error) {
+			resourceFromQuery := ResourceFromQuery{}
+			err := rows.StructScan(&resourceFromQuery)
+			if err != nil {
+				return nil, err
+			}
+			return resourceFromQuery.standardize(), nil
+		},
+	)
+}
 
 func (server *Server) handleResourceCreate(w http.ResponseWriter, r *http.Request, body []byte) {
 	// parse & validate resource input
 	resource := &ResourceIn{}
 	errResponse := unmarshal(body, resource)
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 
 	parentPath := parseResourcePath(r)
 	resource.addPath(parentPath)
+	errResponse = resource.checkDepth(server.maxResourceDepth)
+	if errResponse == nil {
+		errResponse = resource.validatePaths()
+	}
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+
+	// a dry run only applies to creating; PUT ignores it
+	dryRun := false
+	if r.Method != "PUT" {
+		dryRun, errResponse = dryRunFlag(r)
+		if errResponse != nil {
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
+	}
+	transact := transactify
+	if dryRun {
+		transact = transactifyDryRun
+	}
 
 	// check if the `p` flag is added in which case we want to create the
 	// parent resources first.
 	_, createParentsFlag := r.URL.Query()["p"]
 	if createParentsFlag {
-		server.logger.Info("creating parent resources for %s", resource.Path)
-		segments := strings.Split(strings.TrimLeft(resource.Path, "/"), "/")
-		for i := 0; i < len(segments)-1; i++ {
-			path := "/" + strings.Join(segments[:i+1], "/")
-			toCreate := ResourceIn{Path: path}
-			_ = transactify(server.db, toCreate.createRecursively)
-		}
+		server.requestLogger(r.Context()).Info("creating parent resources for %s", resource.Path)
 	}
 
-	errResponse = nil
+	var write func(tx *sqlx.Tx) *ErrorResponse
 	if r.Method == "PUT" {
 		_, mergeFlag := r.URL.Query()["merge"]
-		updateResource := func(tx *sqlx.Tx) *ErrorResponse {
+		write = func(tx *sqlx.Tx) *ErrorResponse {
 			resource.updateInDb(tx, mergeFlag)
 			return nil
 		}
-		errResponse = transactify(server.db, updateResource)
 	} else {
-		errResponse = transactify(server.db, resource.createInDb)
+		write = resource.createInDb
 	}
+	span := server.traceDB(r.Context(), "transactify")
+	errResponse = transact(server.db, func(tx *sqlx.Tx) *ErrorResponse {
+		if createParentsFlag {
+			errResponse := resource.createParents(tx)
+			if errResponse != nil {
+				return errResponse
+			}
+		}
+		return write(tx)
+	})
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil && errResponse.HTTPError.Code != 409 {
 		// `transactify` returns 500 if there was a SQL error. Here we'll assume
 		// that this would be because of an invalid resource input from the caller.
@@ -979,86 +2667,245 @@ func (server *Server) handleResourceCreate(w http.ResponseWriter, r *http.Reques
 		// this is accurate.
 		if errResponse.HTTPError.Code == 500 {
 			errResponse.HTTPError.Code = 400
+			errResponse.HTTPError.ErrorCode = ErrorCodeBadRequest
 		}
 		// TODO: patch error message to be intelligible if dumping resource path
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
+	if dryRun && errResponse == nil {
+		server.requestLogger(r.Context()).Info("resource %s could be created (dry run)", resource.Path)
+		result := struct {
+			Created *ResourceIn `json:"created"`
+		}{
+			Created: resource,
+		}
+		_ = jsonResponseFrom(result, http.StatusOK).write(w, r)
+		return
+	}
+	span = server.traceDB(r.Context(), "resourceWithPath")
 	resourceFromQuery, err := resourceWithPath(server.db, resource.Path)
+	endDBSpan(span, err)
 	if err != nil {
 		errResponse := newErrorResponse(err.Error(), 500, &err)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if resourceFromQuery == nil {
+		msg := fmt.Sprintf(
+			"couldn't return resource for %s, but it may have been created OK",
+			resource.Path,
+		)
+		errResponse := newErrorResponse(msg, 500, &err)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	out := resourceFromQuery.standardize()
+	if errResponse != nil {
+		// otherwise, must be 409 (already handled non-409 errors).
+		server.requestLogger(r.Context()).Info("not creating resource %s (%s), already exists", out.Path, out.Tag)
+		result := struct {
+			Error  HTTPError    `json:"error"`
+			Exists *ResourceOut `json:"exists"`
+		}{
+			Error:  errResponse.HTTPError,
+			Exists: &out,
+		}
+		_ = jsonResponseFrom(result, 409).write(w, r)
+		return
+	}
+
+	server.requestLogger(r.Context()).Info("created resource %s (%s)", out.Path, out.Tag)
+	if r.Method == "PUT" {
+		server.notify("resource", "update", out.Path)
+	} else {
+		server.notify("resource", "create", out.Path)
+	}
+	result := struct {
+		Created *ResourceOut `json:"created"`
+	}{
+		Created: &out,
+	}
+	segments := append([]string{"resource"}, strings.Split(strings.TrimPrefix(out.Path, "/"), "/")...)
+	_ = jsonResponseFrom(result, 201).withLocation(locationPath(segments...)).write(w, r)
+}
+
+// handleResourceRead reads a resource; with `?expand`, its `subresources` are
+// the whole tree under it instead of just the paths of the direct children.
+func (server *Server) handleResourceRead(w http.ResponseWriter, r *http.Request) {
+	path := parseResourcePath(r)
+	_, expandFlag := r.URL.Query()["expand"]
+	var resourceFromQuery *ResourceFromQuery
+	var tree *ResourceTreeOut
+	tooDeep := false
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "resourceWithPath")
+		resourceFromQuery, err = resourceWithPath(server.db, path)
+		endDBSpan(span, err)
+		if err != nil || resourceFromQuery == nil || !expandFlag {
+			return err
+		}
+		span = server.traceDB(r.Context(), "resourceTreeFromDb")
+		tree, tooDeep, err = resourceTreeFromDb(server.db, resourceFromQuery, server.maxResourceDepth)
+		endDBSpan(span, err)
+		return err
+	})
+	if resourceFromQuery == nil {
+		msg := fmt.Sprintf("no resource found with path: `%s`", path)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeResourceNotFound)
+		_ = errResponse.write(w, r)
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("resource query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if tooDeep {
+		msg := fmt.Sprintf(
+			"resource `%s` has more than %d levels of subresources; list them with `/subresources?depth=` instead",
+			path,
+			server.maxResourceDepth,
+		)
+		errResponse := newErrorResponse(msg, 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if tree != nil {
+		_ = jsonResponseFrom(tree, http.StatusOK).withETag().write(w, r)
+		return
+	}
+	resource := resourceFromQuery.standardize()
+	_ = jsonResponseFrom(resource, http.StatusOK).withETag().write(w, r)
+}
+
+// handleResourceSearch finds the resources with `?q=` in their path or
+// description, ignoring case, a page at a time with `limit` and `offset`.
+func (server *Server) handleResourceSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		errResponse := newErrorResponse("missing search term `q`", 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	if resourceFromQuery == nil {
-		msg := fmt.Sprintf(
-			"couldn't return resource for %s, but it may have been created OK",
-			resource.Path,
-		)
-		errResponse := newErrorResponse(msg, 500, &err)
-		errResponse.log.write(server.logger)
+	limit, offset, errResponse := pageOptions(r)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	out := resourceFromQuery.standardize()
-	if errResponse != nil {
-		// otherwise, must be 409 (already handled non-409 errors).
-		server.logger.Info("not creating resource %s (%s), already exists", out.Path, out.Tag)
-		result := struct {
-			Error  HTTPError    `json:"error"`
-			Exists *ResourceOut `json:"exists"`
-		}{
-			Error:  errResponse.HTTPError,
-			Exists: &out,
+	options := ResourceSearchOptions{Query: query, Limit: limit, Offset: offset}
+	var resourcesFromQuery []ResourceFromQuery
+	var total int
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "searchResourcesFromDb")
+		resourcesFromQuery, err = searchResourcesFromDb(server.db, options)
+		endDBSpan(span, err)
+		if err != nil {
+			return err
 		}
-		_ = jsonResponseFrom(result, 409).write(w, r)
+		span = server.traceDB(r.Context(), "countResourcesMatchingSearch")
+		total, err = countResourcesMatchingSearch(server.db, options)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("resource search failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
 		return
 	}
-
-	server.logger.Info("created resource %s (%s)", out.Path, out.Tag)
-	result := struct {
-		Created *ResourceOut `json:"created"`
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	resources := []ResourceOut{}
+	for _, resourceFromQuery := range resourcesFromQuery {
+		resources = append(resources, resourceFromQuery.standardize())
+	}
+	response := struct {
+		Resources []ResourceOut `json:"resources"`
 	}{
-		Created: &out,
+		Resources: resources,
 	}
-	_ = jsonResponseFrom(result, 201).write(w, r)
+	_ = jsonResponseFrom(response, http.StatusOK).write(w, r)
 }
 
-func (server *Server) handleResourceRead(w http.ResponseWriter, r *http.Request) {
+// handleResourceSubresources lists the resources directly under a resource,
+// or with `?depth=` more levels of them.
+func (server *Server) handleResourceSubresources(w http.ResponseWriter, r *http.Request) {
 	path := parseResourcePath(r)
-	resourceFromQuery, err := resourceWithPath(server.db, path)
-	if resourceFromQuery == nil {
-		msg := fmt.Sprintf("no resource found with path: `%s`", path)
-		errResponse := newErrorResponse(msg, 404, nil)
+	depth := 1
+	if value := r.URL.Query().Get("depth"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > server.maxResourceDepth {
+			msg := fmt.Sprintf("`depth` must be an integer from 1 to %d; got `%s`", server.maxResourceDepth, value)
+			errResponse := newErrorResponse(msg, 400, nil)
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
+		depth = n
+	}
+	var resourceFromQuery *ResourceFromQuery
+	var subresources []*SubresourceOut
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "resourceWithPath")
+		resourceFromQuery, err = resourceWithPath(server.db, path)
+		endDBSpan(span, err)
+		if err != nil || resourceFromQuery == nil {
+			return err
+		}
+		span = server.traceDB(r.Context(), "subresourcesFromDb")
+		subresources, err = subresourcesFromDb(server.db, path, depth)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("subresources query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	if err != nil {
-		msg := fmt.Sprintf("resource query failed: %s", err.Error())
-		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+	if resourceFromQuery == nil {
+		msg := fmt.Sprintf("no resource found with path: `%s`", path)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeResourceNotFound)
 		_ = errResponse.write(w, r)
 		return
 	}
-	resource := resourceFromQuery.standardize()
-	_ = jsonResponseFrom(resource, http.StatusOK).write(w, r)
+	result := struct {
+		Subresources []*SubresourceOut `json:"subresources"`
+	}{
+		Subresources: subresources,
+	}
+	_ = jsonResponseFrom(result, http.StatusOK).write(w, r)
 }
 
 func (server *Server) handleResourceReadByTag(w http.ResponseWriter, r *http.Request) {
 	tag := mux.Vars(r)["tag"]
-	resourceFromQuery, err := resourceWithTag(server.db, tag)
+	var resourceFromQuery *ResourceFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "resourceWithTag")
+		resourceFromQuery, err = resourceWithTag(server.db, tag)
+		endDBSpan(span, err)
+		return err
+	})
 	if resourceFromQuery == nil {
 		msg := fmt.Sprintf("no resource found with tag: `%s`", tag)
-		errResponse := newErrorResponse(msg, 404, nil)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeResourceNotFound)
 		_ = errResponse.write(w, r)
 		return
 	}
 	if err != nil {
 		msg := fmt.Sprintf("resource query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1069,25 +2916,117 @@ func (server *Server) handleResourceReadByTag(w http.ResponseWriter, r *http.Req
 func (server *Server) handleResourceDelete(w http.ResponseWriter, r *http.Request) {
 	path := parseResourcePath(r)
 	resource := ResourceIn{Path: path}
+	span := server.traceDB(r.Context(), "transactify")
 	errResponse := transactify(server.db, resource.deleteInDb)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("deleted resource %s", resource.Path)
+	server.requestLogger(r.Context()).Info("deleted resource %s", resource.Path)
+	server.notify("resource", "delete", resource.Path)
 	_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 }
 
+// handleResourceMove moves a resource, with everything under it, to the
+// `new_path` in the body, and responds with the resource at its new path.
+func (server *Server) handleResourceMove(w http.ResponseWriter, r *http.Request, body []byte) {
+	path := parseResourcePath(r)
+	request := struct {
+		NewPath string `json:"new_path"`
+	}{}
+	err := json.Unmarshal(body, &request)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse resource move from JSON: %s", err.Error())
+		errResponse := newErrorResponse(msg, 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if request.NewPath == "" {
+		errResponse := newErrorResponse("resource move missing `new_path`", 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	newPath := normalizeResourcePath(request.NewPath)
+	span := server.traceDB(r.Context(), "transactify")
+	errResponse := transactify(server.db, func(tx *sqlx.Tx) *ErrorResponse {
+		return moveResourceInDb(tx, path, newPath)
+	})
+	endDBSpan(span, dbSpanError(errResponse))
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	span = server.traceDB(r.Context(), "resourceWithPath")
+	resourceFromQuery, err := resourceWithPath(server.db, newPath)
+	endDBSpan(span, err)
+	if err != nil || resourceFromQuery == nil {
+		msg := fmt.Sprintf("couldn't return resource for %s, but it may have been moved OK", newPath)
+		errResponse := newErrorResponse(msg, 500, &err)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	server.requestLogger(r.Context()).Info("moved resource %s to %s", path, newPath)
+	// resources are identified by path, so to the webhook a move is the old
+	// path going away and the new one appearing
+	server.notify("resource", "delete", path)
+	server.notify("resource", "create", newPath)
+	_ = jsonResponseFrom(resourceFromQuery.standardize(), http.StatusOK).write(w, r)
+}
+
+// handleRoleList lists the roles, in order of `?sort=` (by ID unless given), a
+// page at a time with `limit` and `offset`. Roles have no parents or
+// subroles, so the only `?format=` there is, and the default, is `flat`.
 func (server *Server) handleRoleList(w http.ResponseWriter, r *http.Request) {
-	rolesFromQuery, err := listRolesFromDb(server.db)
+	if format := r.URL.Query().Get("format"); format != "" && format != "flat" {
+		msg := fmt.Sprintf("unsupported role list format `%s`; roles aren't nested, so only `flat` is available", format)
+		errResponse := newErrorResponse(msg, 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	limit, offset, errResponse := pageOptions(r)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	options := RoleListOptions{Limit: limit, Offset: offset, Sort: r.URL.Query().Get("sort")}
+	if _, ok := roleSortColumns[options.Sort]; options.Sort != "" && !ok {
+		msg := fmt.Sprintf("`sort` must be `id` or `name`; got `%s`", options.Sort)
+		errResponse := newErrorResponse(msg, 400, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	var rolesFromQuery []RoleFromQuery
+	var total int
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "listRolesFromDb")
+		rolesFromQuery, err = listRolesFromDb(server.db, options)
+		endDBSpan(span, err)
+		if err != nil {
+			return err
+		}
+		span = server.traceDB(r.Context(), "countRolesFromDb")
+		total, err = countRolesFromDb(server.db)
+		endDBSpan(span, err)
+		return err
+	})
 	if err != nil {
 		msg := fmt.Sprintf("roles query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
+	// total number of roles, so clients can page through them
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	roles := []Role{}
 	for _, roleFromQuery := range rolesFromQuery {
 		roles = append(roles, roleFromQuery.standardize())
@@ -1105,45 +3044,60 @@ func (server *Server) handleRoleCreate(w http.ResponseWriter, r *http.Request, b
 	err := json.Unmarshal(body, role)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse role from JSON: %s", err.Error())
-		server.logger.Info("tried to create role but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to create role but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
-	errResponse := role.createInDb(server.db)
+	errResponse := server.checkConstraintKeys(role)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	span := server.traceDB(r.Context(), "role.createInDb")
+	errResponse = role.createInDb(server.db)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("created role %s", role.Name)
+	server.requestLogger(r.Context()).Info("created role %s", role.Name)
+	server.notify("role", "create", role.Name)
 	created := struct {
 		Created *Role `json:"created"`
 	}{
 		Created: role,
 	}
-	_ = jsonResponseFrom(created, 201).write(w, r)
+	_ = jsonResponseFrom(created, 201).withLocation(locationPath("role", role.Name)).write(w, r)
 }
 
 func (server *Server) handleRoleRead(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["roleID"]
-	roleFromQuery, err := roleWithName(server.db, name)
+	var roleFromQuery *RoleFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "roleWithName")
+		roleFromQuery, err = roleWithName(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
 	if roleFromQuery == nil {
 		msg := fmt.Sprintf("no role found with id: %s", name)
-		errResponse := newErrorResponse(msg, 404, nil)
-		errResponse.log.write(server.logger)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeRoleNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	if err != nil {
 		msg := fmt.Sprintf("role query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	role := roleFromQuery.standardize()
-	_ = jsonResponseFrom(role, http.StatusOK).write(w, r)
+	_ = jsonResponseFrom(role, http.StatusOK).withETag().write(w, r)
 }
 
 func (server *Server) handleRoleOverwrite(w http.ResponseWriter, r *http.Request, body []byte) {
@@ -1151,7 +3105,7 @@ func (server *Server) handleRoleOverwrite(w http.ResponseWriter, r *http.Request
 	err := json.Unmarshal(body, role)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse role from JSON: %s", err.Error())
-		server.logger.Info("tried to overwrite role but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to overwrite role but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
@@ -1160,46 +3114,59 @@ func (server *Server) handleRoleOverwrite(w http.ResponseWriter, r *http.Request
 	name := mux.Vars(r)["roleID"]
 	if name != role.Name {
 		msg := fmt.Sprintf("roleID '%s' from URL did not match roleID '%s' from JSON", name, role.Name)
-		server.logger.Info("tried to overwrite role but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to overwrite role but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
+	errResponse := server.checkConstraintKeys(role)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
 
+	span := server.traceDB(r.Context(), "roleWithName")
 	roleFromQuery, err := roleWithName(server.db, name)
+	endDBSpan(span, err)
 	if err != nil {
 		msg := fmt.Sprintf("role query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 
-	var errResponse *ErrorResponse
 	if roleFromQuery == nil {
+		span := server.traceDB(r.Context(), "role.createInDb")
 		errResponse = role.createInDb(server.db)
+		endDBSpan(span, dbSpanError(errResponse))
 		if errResponse != nil {
-			errResponse.log.write(server.logger)
+			errResponse.log.write(server.requestLogger(r.Context()))
 			_ = errResponse.write(w, r)
 			return
 		}
-		server.logger.Info("created role %s", role.Name)
+		server.requestLogger(r.Context()).Info("created role %s", role.Name)
+		server.notify("role", "create", role.Name)
 		created := struct {
 			Created *Role `json:"created"`
 		}{
 			Created: role,
 		}
-		_ = jsonResponseFrom(created, 201).write(w, r)
+		_ = jsonResponseFrom(created, 201).withLocation(locationPath("role", role.Name)).write(w, r)
 		return
 	}
 
+	span = server.traceDB(r.Context(), "role.overwriteInDb")
 	errResponse = role.overwriteInDb(server.db)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("updated role %s", role.Name)
+	server.requestLogger(r.Context()).Info("updated role %s", role.Name)
+	server.notify("role", "update", role.Name)
 	updated := struct {
 		Updated *Role `json:"updated"`
 	}{
@@ -1208,88 +3175,334 @@ func (server *Server) handleRoleOverwrite(w http.ResponseWriter, r *http.Request
 	_ = jsonResponseFrom(updated, 200).write(w, r)
 }
 
+// handleRoleAppend adds permissions to an existing role without removing any
+// of the permissions it already has.
+func (server *Server) handleRoleAppend(w http.ResponseWriter, r *http.Request, body []byte) {
+	role := &Role{}
+	err := json.Unmarshal(body, role)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse role from JSON: %s", err.Error())
+		server.requestLogger(r.Context()).Info("tried to update role but input was invalid: %s", msg)
+		response := newErrorResponse(msg, 400, nil)
+		_ = response.write(w, r)
+		return
+	}
+
+	name := mux.Vars(r)["roleID"]
+	if role.Name != "" && name != role.Name {
+		msg := fmt.Sprintf("roleID '%s' from URL did not match roleID '%s' from JSON", name, role.Name)
+		server.requestLogger(r.Context()).Info("tried to update role but input was invalid: %s", msg)
+		response := newErrorResponse(msg, 400, nil)
+		_ = response.write(w, r)
+		return
+	}
+	role.Name = name
+
+	errResponse := server.checkConstraintKeys(role)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	span := server.traceDB(r.Context(), "role.appendInDb")
+	errResponse = role.appendInDb(server.db)
+	endDBSpan(span, dbSpanError(errResponse))
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	server.requestLogger(r.Context()).Info("updated role %s", role.Name)
+	server.notify("role", "update", role.Name)
+
+	span = server.traceDB(r.Context(), "roleWithName")
+	roleFromQuery, err := roleWithName(server.db, name)
+	endDBSpan(span, err)
+	if err != nil || roleFromQuery == nil {
+		msg := fmt.Sprintf("couldn't return role %s, but it may have been updated OK", name)
+		errResponse := newErrorResponse(msg, 500, &err)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	merged := roleFromQuery.standardize()
+	updated := struct {
+		Updated *Role `json:"updated"`
+	}{
+		Updated: &merged,
+	}
+	_ = jsonResponseFrom(updated, http.StatusOK).write(w, r)
+}
+
+func (server *Server) handleRolePermissionList(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["roleID"]
+	var roleFromQuery *RoleFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "roleWithName")
+		roleFromQuery, err = roleWithName(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("role query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if roleFromQuery == nil {
+		msg := fmt.Sprintf("no role found with id: %s", name)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeRoleNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	result := struct {
+		Permissions []Permission `json:"permissions"`
+	}{
+		Permissions: roleFromQuery.standardize().Permissions,
+	}
+	_ = jsonResponseFrom(result, http.StatusOK).write(w, r)
+}
+
+// handleRolePermissionCreate adds a single permission to an existing role,
+// the same as appending a role with only that permission.
+func (server *Server) handleRolePermissionCreate(w http.ResponseWriter, r *http.Request, body []byte) {
+	permission := Permission{}
+	err := json.Unmarshal(body, &permission)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse permission from JSON: %s", err.Error())
+		server.requestLogger(r.Context()).Info("tried to add permission but input was invalid: %s", msg)
+		response := newErrorResponse(msg, 400, nil)
+		_ = response.write(w, r)
+		return
+	}
+	err = permission.validate("permission", "")
+	if err == nil {
+		err = permission.checkConstraintKeys("permission", "", server.constraintKeys)
+	}
+	if err != nil {
+		errResponse := newErrorResponse(err.Error(), 400, &err)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	role := &Role{
+		Name:        mux.Vars(r)["roleID"],
+		Permissions: []Permission{permission},
+	}
+	span := server.traceDB(r.Context(), "role.appendInDb")
+	errResponse := role.appendInDb(server.db)
+	endDBSpan(span, dbSpanError(errResponse))
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	server.requestLogger(r.Context()).Info("added permission %s to role %s", permission.Name, role.Name)
+	server.notify("role", "update", role.Name)
+	created := struct {
+		Created Permission `json:"created"`
+	}{
+		Created: permission,
+	}
+	_ = jsonResponseFrom(created, http.StatusCreated).write(w, r)
+}
+
 func (server *Server) handleRoleDelete(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["roleID"]
 	role := &Role{Name: name}
+	span := server.traceDB(r.Context(), "role.deleteInDb")
 	errResponse := role.deleteInDb(server.db)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("deleted role %s", role.Name)
+	server.requestLogger(r.Context()).Info("deleted role %s", role.Name)
+	server.notify("role", "delete", role.Name)
 	_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 }
 
-func (server *Server) handleUserList(w http.ResponseWriter, r *http.Request) {
-	usersFromQuery, err := listUsersFromDb(server.db)
+func (server *Server) handlePermissionList(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "listPermissionNames")
+		names, err = listPermissionNames(server.db)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("permissions query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	result := struct {
+		Permissions []string `json:"permissions"`
+	}{
+		Permissions: names,
+	}
+	_ = jsonResponseFrom(result, http.StatusOK).write(w, r)
+}
+
+func (server *Server) handlePermissionRead(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["permissionID"]
+	var permission *PermissionRoles
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "permissionWithName")
+		permission, err = permissionWithName(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
 	if err != nil {
-		msg := fmt.Sprintf("users query failed: %s", err.Error())
+		msg := fmt.Sprintf("permission query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	users := []User{}
-	for _, userFromQuery := range usersFromQuery {
-		users = append(users, userFromQuery.standardize())
+	if permission == nil {
+		msg := fmt.Sprintf("no role has a permission with id: %s", name)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodePermissionNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	_ = jsonResponseFrom(permission, http.StatusOK).write(w, r)
+}
+
+func (server *Server) handleServiceList(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "listServiceNames")
+		names, err = listServiceNames(server.db)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("services query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
 	}
 	result := struct {
-		Users []User `json:"users"`
+		Services []string `json:"services"`
 	}{
-		Users: users,
+		Services: names,
 	}
 	_ = jsonResponseFrom(result, http.StatusOK).write(w, r)
 }
 
+func (server *Server) handleServiceRead(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["serviceID"]
+	var service *Service
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "serviceWithName")
+		service, err = serviceWithName(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
+	if err != nil {
+		msg := fmt.Sprintf("service query failed: %s", err.Error())
+		errResponse := newErrorResponse(msg, 500, nil)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	if service == nil {
+		msg := fmt.Sprintf("no permissions found for service: %s", name)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeServiceNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
+	_ = jsonResponseFrom(service, http.StatusOK).write(w, r)
+}
+
+func (server *Server) handleUserList(w http.ResponseWriter, r *http.Request) {
+	now := server.clock()
+	server.writeListFromRows(
+		w,
+		r,
+		"users",
+		func() (rows *sqlx.Rows, err error) {
+			span := server.traceDB(r.Context(), "queryUsers")
+			rows, err = queryUsers(server.db)
+			endDBSpan(span, err)
+			return rows, err
+		},
+		func(rows *sqlx.Rows) (interface{}, error) {
+			userFromQuery := UserFromQuery{}
+			err := rows.StructScan(&userFromQuery)
+			if err != nil {
+				return nil, err
+			}
+			return userFromQuery.standardize(now), nil
+		},
+	)
+}
+
 func (server *Server) handleUserCreate(w http.ResponseWriter, r *http.Request, body []byte) {
 	user := &User{}
 	err := json.Unmarshal(body, user)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse user from JSON: %s", err.Error())
-		server.logger.Info("tried to create user but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to create user but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
+	user.Name = server.normalizeUsername(user.Name)
+	span := server.traceDB(r.Context(), "user.createInDb")
 	errResponse := user.createInDb(server.db)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("created user %s", user.Name)
+	server.requestLogger(r.Context()).Info("created user %s", user.Name)
 	created := struct {
 		Created *User `json:"created"`
 	}{
 		Created: user,
 	}
-	_ = jsonResponseFrom(created, 201).write(w, r)
+	_ = jsonResponseFrom(created, 201).withLocation(locationPath("user", user.Name)).write(w, r)
 }
 
 func (server *Server) handleUserRead(w http.ResponseWriter, r *http.Request) {
-	name := mux.Vars(r)["username"]
-	userFromQuery, err := userWithName(server.db, name)
+	name := server.usernameVar(r)
+	var userFromQuery *UserFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "userWithName")
+		userFromQuery, err = userWithName(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
 	if err != nil {
 		msg := fmt.Sprintf("user query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	if userFromQuery == nil {
 		msg := fmt.Sprintf("no user found with username: %s", name)
-		errResponse := newErrorResponse(msg, 404, nil)
-		errResponse.log.write(server.logger)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeUserNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	user := userFromQuery.standardize()
+	user := userFromQuery.standardize(server.clock())
 	_ = jsonResponseFrom(user, http.StatusOK).write(w, r)
 }
 
 func (server *Server) handleUserUpdate(w http.ResponseWriter, r *http.Request, body []byte) {
-	name := mux.Vars(r)["username"]
+	name := server.usernameVar(r)
 	user := User{Name: name}
 
 	userWithScalars := &UserWithScalars{}
@@ -1297,7 +3510,7 @@ func (server *Server) handleUserUpdate(w http.ResponseWriter, r *http.Request, b
 	if err != nil {
 		msg := fmt.Sprintf("could not unmarshal body: %s", err.Error())
 		errResponse := newErrorResponse(msg, 400, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1305,114 +3518,135 @@ func (server *Server) handleUserUpdate(w http.ResponseWriter, r *http.Request, b
 	if userWithScalars.Name == nil && userWithScalars.Email == nil {
 		msg := `body must contain at least one valid field. possible valid fields are "name" and "email"`
 		errResponse := newErrorResponse(msg, 400, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 
+	if userWithScalars.Name != nil {
+		newName := server.normalizeUsername(*userWithScalars.Name)
+		userWithScalars.Name = &newName
+	}
+	span := server.traceDB(r.Context(), "user.updateInDb")
 	errResponse := user.updateInDb(server.db, userWithScalars.Name, userWithScalars.Email)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("updated user %s", user.Name)
+	server.requestLogger(r.Context()).Info("updated user %s", user.Name)
 	_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 }
 
 func (server *Server) handleUserDelete(w http.ResponseWriter, r *http.Request) {
-	name := mux.Vars(r)["username"]
+	name := server.usernameVar(r)
 	user := User{Name: name}
+	span := server.traceDB(r.Context(), "user.deleteInDb")
 	errResponse := user.deleteInDb(server.db)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("deleted user %s", name)
+	server.requestLogger(r.Context()).Info("deleted user %s", name)
 	_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 }
 
-func (server *Server) userGrantPolicy(w http.ResponseWriter, r *http.Request, requestPolicy RequestPolicy, username string) {
+func (server *Server) userGrantPolicy(r *http.Request, requestPolicy RequestPolicy, username string) *ErrorResponse {
 	var expiresAt *time.Time
 	if requestPolicy.ExpiresAt != "" {
 		exp, err := time.Parse(time.RFC3339, requestPolicy.ExpiresAt)
 		if err != nil {
 			msg := "could not parse `expires_at` (must be in RFC 3339 format; see specification: https://tools.ietf.org/html/rfc3339#section-5.8)"
-			server.logger.Info("tried to grant policy to user but `expires_at` was invalid format")
-			response := newErrorResponse(msg, 400, nil)
-			_ = response.write(w, r)
-			return
+			server.requestLogger(r.Context()).Info("tried to grant policy to user but `expires_at` was invalid format")
+			return newErrorResponse(msg, 400, nil)
 		}
 		expiresAt = &exp
 	}
+	span := server.traceDB(r.Context(), "grantUserPolicy")
 	errResponse := grantUserPolicy(server.db, username, requestPolicy.PolicyName, expiresAt, getAuthZProvider(r))
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
-		_ = errResponse.write(w, r)
-		return
+		return errResponse
 	}
-	server.logger.Info("granted policy %s to user %s", requestPolicy.PolicyName, username)
+	server.requestLogger(r.Context()).Info("granted policy %s to user %s", requestPolicy.PolicyName, username)
+	return nil
 }
 
 func (server *Server) handleUserGrantPolicy(w http.ResponseWriter, r *http.Request, body []byte) {
-	username := mux.Vars(r)["username"]
+	username := server.usernameVar(r)
 	requestPolicy := &RequestPolicy{}
 	err := json.Unmarshal(body, &requestPolicy)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse policy name in JSON: %s", err.Error())
-		server.logger.Info("tried to grant policy to user but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to grant policy to user but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
-	server.userGrantPolicy(w, r, *requestPolicy, username)
+	errResponse := server.userGrantPolicy(r, *requestPolicy, username)
+	if errResponse != nil {
+		errResponse.log.write(server.requestLogger(r.Context()))
+		_ = errResponse.write(w, r)
+		return
+	}
 	_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 }
 
 func (server *Server) handleBulkUserGrantPolicy(w http.ResponseWriter, r *http.Request, body []byte) {
-	username := mux.Vars(r)["username"]
+	username := server.usernameVar(r)
 	var requestPolicies []RequestPolicy
 	err := json.Unmarshal(body, &requestPolicies)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse policy name in JSON: %s", err.Error())
-		server.logger.Info("tried to grant policy to user but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to grant policy to user but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
 
 	for _, requestPolicy := range requestPolicies {
-		server.userGrantPolicy(w, r, requestPolicy, username)
+		errResponse := server.userGrantPolicy(r, requestPolicy, username)
+		if errResponse != nil {
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
 	}
 	_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 }
 
 func (server *Server) handleUserRevokeAll(w http.ResponseWriter, r *http.Request) {
-	username := mux.Vars(r)["username"]
+	username := server.usernameVar(r)
 	authzProvider := getAuthZProvider(r)
+	span := server.traceDB(r.Context(), "revokeUserPolicyAll")
 	errResponse := revokeUserPolicyAll(server.db, username, authzProvider)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	if authzProvider.Valid {
-		server.logger.Info("revoked all %s policies for user %s", authzProvider.String, username)
+		server.requestLogger(r.Context()).Info("revoked all %s policies for user %s", authzProvider.String, username)
 	} else {
-		server.logger.Info("revoked all policies for user %s", username)
+		server.requestLogger(r.Context()).Info("revoked all policies for user %s", username)
 	}
 	_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 }
 
 func (server *Server) handleUserRevokePolicy(w http.ResponseWriter, r *http.Request) {
-	username := mux.Vars(r)["username"]
+	username := server.usernameVar(r)
 	policyName := mux.Vars(r)["policyName"]
 	authzProvider := getAuthZProvider(r)
+	span := server.traceDB(r.Context(), "fetchUserPolicyInfo")
 	policyInfo, err := fetchUserPolicyInfo(server.db, username, policyName)
+	endDBSpan(span, err)
 
 	if err != nil {
-		server.logger.Info("Error Fetching policy Info: %s", err.Error())
+		server.requestLogger(r.Context()).Info("Error Fetching policy Info: %s", err.Error())
 		msg := fmt.Sprintf("Error Fetching policy Info: %s", err.Error())
 		response := newErrorResponse(msg, http.StatusInternalServerError, nil)
 		_ = response.write(w, r)
@@ -1426,43 +3660,55 @@ func (server *Server) handleUserRevokePolicy(w http.ResponseWriter, r *http.Requ
 		if providerExists {
 			dbAuthzProvider = policyInfo.AuthzProvider.String
 		}
-		server.logger.Debug("Policy - {name: %s, authz_provider: %s, expires_at: %s} assigned to user %s",
+		server.requestLogger(r.Context()).Debug("Policy - {name: %s, authz_provider: %s, expires_at: %s} assigned to user %s",
 			policyInfo.PolicyName, dbAuthzProvider, policyInfo.ExpiresAt, policyInfo.Username)
 
 		if !authzProvider.Valid || (providerExists && dbAuthzProvider == authzProvider.String) {
+			span := server.traceDB(r.Context(), "revokeUserPolicy")
 			errResponse := revokeUserPolicy(
 				server.db, username, policyName, authzProvider)
+			endDBSpan(span, dbSpanError(errResponse))
 			if errResponse != nil {
-				errResponse.log.write(server.logger)
+				errResponse.log.write(server.requestLogger(r.Context()))
 				_ = errResponse.write(w, r)
 				return
 			}
-			server.logger.Info("revoked policy %s for user %s", policyName, username)
+			server.requestLogger(r.Context()).Info("revoked policy %s for user %s", policyName, username)
 			_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 		} else {
-			server.logger.Info("Cannot revoke policy `%s`. Policy authz_provider `%s` and request authz_provider `%s` mismatch",
+			server.requestLogger(r.Context()).Info("Cannot revoke policy `%s`. Policy authz_provider `%s` and request authz_provider `%s` mismatch",
 				policyName, policyInfo.AuthzProvider.String, authzProvider.String)
 			msg := fmt.Sprintf("Cannot revoke policy `%s`. Authz_provider Mismatch", policyName)
 			errResponse := newErrorResponse(msg, http.StatusUnauthorized, nil)
-			errResponse.log.write(server.logger)
+			errResponse.log.write(server.requestLogger(r.Context()))
 			_ = errResponse.write(w, r)
 		}
 	} else {
-		server.logger.Info("Policy `%s` does not exist for user `%s`: not revoking. Check if it is assigned through a group.",
+		span := server.traceDB(r.Context(), "userAndPolicyExist")
+		errResponse := userAndPolicyExist(server.db, username, policyName)
+		endDBSpan(span, dbSpanError(errResponse))
+		if errResponse != nil {
+			errResponse.log.write(server.requestLogger(r.Context()))
+			_ = errResponse.write(w, r)
+			return
+		}
+		server.requestLogger(r.Context()).Info("Policy `%s` does not exist for user `%s`: not revoking. Check if it is assigned through a group.",
 			policyName, username)
 		_ = jsonResponseFrom(nil, http.StatusBadRequest).write(w, r)
 	}
 }
 
 func (server *Server) handleUserListResources(w http.ResponseWriter, r *http.Request) {
-	username := mux.Vars(r)["username"]
+	username := server.usernameVar(r)
 
 	// check if user exists at all first
+	span := server.traceDB(r.Context(), "userWithName")
 	user, err := userWithName(server.db, username)
+	endDBSpan(span, err)
 	if user == nil || err != nil {
 		msg := fmt.Sprintf("no user found with username: `%s`", username)
-		errResponse := newErrorResponse(msg, 404, nil)
-		errResponse.log.write(server.logger)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeUserNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1481,8 +3727,11 @@ func (server *Server) handleUserListResources(w http.ResponseWriter, r *http.Req
 		Username: username,
 		Service:  service,
 		Method:   method,
+		now:      server.clock(),
 	}
+	span = server.traceDB(r.Context(), "authorizedResources")
 	resourcesFromQuery, errResponse := authorizedResources(server.db, request)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
 		_ = errResponse.write(w, r)
 		return
@@ -1509,11 +3758,17 @@ func (server *Server) handleUserListResources(w http.ResponseWriter, r *http.Req
 }
 
 func (server *Server) handleClientList(w http.ResponseWriter, r *http.Request) {
-	clientsFromQuery, err := listClientsFromDb(server.db)
+	var clientsFromQuery []ClientFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "listClientsFromDb")
+		clientsFromQuery, err = listClientsFromDb(server.db)
+		endDBSpan(span, err)
+		return err
+	})
 	if err != nil {
 		msg := fmt.Sprintf("clients query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1534,14 +3789,16 @@ func (server *Server) handleClientCreate(w http.ResponseWriter, r *http.Request,
 	err := json.Unmarshal(body, client)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse client from JSON: %s", err.Error())
-		server.logger.Info("tried to create client but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to create client but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
+	span := server.traceDB(r.Context(), "client.createInDb")
 	errResponse := client.createInDb(server.db, getAuthZProvider(r))
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1550,23 +3807,25 @@ func (server *Server) handleClientCreate(w http.ResponseWriter, r *http.Request,
 	}{
 		Created: client,
 	}
-	_ = jsonResponseFrom(created, 201).write(w, r)
+	_ = jsonResponseFrom(created, 201).withLocation(locationPath("client", client.ClientID)).write(w, r)
 }
 
 func (server *Server) handleClientRead(w http.ResponseWriter, r *http.Request) {
 	clientID := mux.Vars(r)["clientID"]
+	span := server.traceDB(r.Context(), "clientWithClientID")
 	clientFromQuery, err := clientWithClientID(server.db, clientID)
+	endDBSpan(span, err)
 	if clientFromQuery == nil {
 		msg := fmt.Sprintf("no client found with clientID: %s", clientID)
-		errResponse := newErrorResponse(msg, 404, nil)
-		errResponse.log.write(server.logger)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeClientNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	if err != nil {
 		msg := fmt.Sprintf("client query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1577,9 +3836,11 @@ func (server *Server) handleClientRead(w http.ResponseWriter, r *http.Request) {
 func (server *Server) handleClientDelete(w http.ResponseWriter, r *http.Request) {
 	clientID := mux.Vars(r)["clientID"]
 	client := Client{ClientID: clientID}
+	span := server.traceDB(r.Context(), "client.deleteInDb")
 	errResponse := client.deleteInDb(server.db)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1594,15 +3855,17 @@ func (server *Server) handleClientGrantPolicy(w http.ResponseWriter, r *http.Req
 	err := json.Unmarshal(body, &requestPolicy)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse policy name in JSON: %s", err.Error())
-		server.logger.Info("tried to grant policy to client but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to grant policy to client but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
-	server.logger.Info("attempting to grant policy %s to client %s", requestPolicy.PolicyName, clientID)
+	server.requestLogger(r.Context()).Info("attempting to grant policy %s to client %s", requestPolicy.PolicyName, clientID)
+	span := server.traceDB(r.Context(), "grantClientPolicy")
 	errResponse := grantClientPolicy(server.db, clientID, requestPolicy.PolicyName, getAuthZProvider(r))
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1611,9 +3874,11 @@ func (server *Server) handleClientGrantPolicy(w http.ResponseWriter, r *http.Req
 
 func (server *Server) handleClientRevokeAll(w http.ResponseWriter, r *http.Request) {
 	clientID := mux.Vars(r)["clientID"]
+	span := server.traceDB(r.Context(), "revokeClientPolicyAll")
 	errResponse := revokeClientPolicyAll(server.db, clientID, getAuthZProvider(r))
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1623,9 +3888,11 @@ func (server *Server) handleClientRevokeAll(w http.ResponseWriter, r *http.Reque
 func (server *Server) handleClientRevokePolicy(w http.ResponseWriter, r *http.Request) {
 	clientID := mux.Vars(r)["clientID"]
 	policyName := mux.Vars(r)["policyName"]
+	span := server.traceDB(r.Context(), "revokeClientPolicy")
 	errResponse := revokeClientPolicy(server.db, clientID, policyName, getAuthZProvider(r))
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1633,11 +3900,17 @@ func (server *Server) handleClientRevokePolicy(w http.ResponseWriter, r *http.Re
 }
 
 func (server *Server) handleGroupList(w http.ResponseWriter, r *http.Request) {
-	groupsFromQuery, err := listGroupsFromDb(server.db)
+	var groupsFromQuery []GroupFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "listGroupsFromDb")
+		groupsFromQuery, err = listGroupsFromDb(server.db)
+		endDBSpan(span, err)
+		return err
+	})
 	if err != nil {
 		msg := fmt.Sprintf("groups query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1658,12 +3931,16 @@ func (server *Server) handleGroupCreate(w http.ResponseWriter, r *http.Request,
 	err := json.Unmarshal(body, group)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse group from JSON: %s", err.Error())
-		server.logger.Info("tried to create group but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to create group but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
+	for i, username := range group.Users {
+		group.Users[i] = server.normalizeUsername(username)
+	}
 	authzProvider := getAuthZProvider(r)
+	span := server.traceDB(r.Context(), "transactify")
 	errResponse := transactify(server.db, func(tx *sqlx.Tx) *ErrorResponse {
 		if r.Method == "PUT" {
 			return group.overwriteInDb(tx, authzProvider)
@@ -1671,38 +3948,45 @@ func (server *Server) handleGroupCreate(w http.ResponseWriter, r *http.Request,
 			return group.createInDb(tx, authzProvider)
 		}
 	})
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	if r.Method == "PUT" {
-		server.logger.Info("overwrote group %s", group.Name)
+		server.requestLogger(r.Context()).Info("overwrote group %s", group.Name)
 	} else {
-		server.logger.Info("created group %s", group.Name)
+		server.requestLogger(r.Context()).Info("created group %s", group.Name)
 	}
 	created := struct {
 		Created *Group `json:"created"`
 	}{
 		Created: group,
 	}
-	_ = jsonResponseFrom(created, 201).write(w, r)
+	_ = jsonResponseFrom(created, 201).withLocation(locationPath("group", group.Name)).write(w, r)
 }
 
 func (server *Server) handleGroupRead(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["groupName"]
-	groupFromQuery, err := groupWithName(server.db, name)
+	var groupFromQuery *GroupFromQuery
+	err := server.retryRead(func() (err error) {
+		span := server.traceDB(r.Context(), "groupWithName")
+		groupFromQuery, err = groupWithName(server.db, name)
+		endDBSpan(span, err)
+		return err
+	})
 	if groupFromQuery == nil {
 		msg := fmt.Sprintf("no group found with name: %s", name)
-		errResponse := newErrorResponse(msg, 404, nil)
-		errResponse.log.write(server.logger)
+		errResponse := newErrorResponse(msg, 404, nil).withCode(ErrorCodeGroupNotFound)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
 	if err != nil {
 		msg := fmt.Sprintf("group query failed: %s", err.Error())
 		errResponse := newErrorResponse(msg, 500, nil)
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1713,9 +3997,11 @@ func (server *Server) handleGroupRead(w http.ResponseWriter, r *http.Request) {
 func (server *Server) handleGroupDelete(w http.ResponseWriter, r *http.Request) {
 	groupName := mux.Vars(r)["groupName"]
 	group := Group{Name: groupName}
+	span := server.traceDB(r.Context(), "transactify")
 	errResponse := transactify(server.db, group.deleteInDb)
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1731,7 +4017,7 @@ func (server *Server) handleGroupAddUser(w http.ResponseWriter, r *http.Request,
 	err := json.Unmarshal(body, &requestUser)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse username in JSON: %s", err.Error())
-		server.logger.Info("tried to add user to group but input was invalid: %s", msg)
+		server.requestLogger(r.Context()).Info("tried to add user to group but input was invalid: %s", msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
@@ -1741,29 +4027,34 @@ func (server *Server) handleGroupAddUser(w http.ResponseWriter, r *http.Request,
 		exp, err := time.Parse(time.RFC3339, requestUser.ExpiresAt)
 		if err != nil {
 			msg := "could not parse `expires_at` (must be in RFC 3339 format; see specification: https://tools.ietf.org/html/rfc3339#section-5.8)"
-			server.logger.Info("tried to grant policy to user but `expires_at` was invalid format")
+			server.requestLogger(r.Context()).Info("tried to grant policy to user but `expires_at` was invalid format")
 			response := newErrorResponse(msg, 400, nil)
 			_ = response.write(w, r)
 			return
 		}
 		expiresAt = &exp
 	}
+	requestUser.Username = server.normalizeUsername(requestUser.Username)
+	span := server.traceDB(r.Context(), "addUserToGroup")
 	errResponse := addUserToGroup(server.db, requestUser.Username, groupName, expiresAt, getAuthZProvider(r))
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
-	server.logger.Info("added user %s to group %s", requestUser.Username, groupName)
+	server.requestLogger(r.Context()).Info("added user %s to group %s", requestUser.Username, groupName)
 	_ = jsonResponseFrom(nil, http.StatusNoContent).write(w, r)
 }
 
 func (server *Server) handleGroupRemoveUser(w http.ResponseWriter, r *http.Request) {
 	groupName := mux.Vars(r)["groupName"]
-	username := mux.Vars(r)["username"]
+	username := server.usernameVar(r)
+	span := server.traceDB(r.Context(), "removeUserFromGroup")
 	errResponse := removeUserFromGroup(server.db, username, groupName, getAuthZProvider(r))
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1778,14 +4069,16 @@ func (server *Server) handleGroupGrantPolicy(w http.ResponseWriter, r *http.Requ
 	err := json.Unmarshal(body, &requestPolicy)
 	if err != nil {
 		msg := fmt.Sprintf("could not parse policy name in JSON: %s", err.Error())
-		server.logger.Info("tried to grant policy to group %s but input was invalid: %s", groupName, msg)
+		server.requestLogger(r.Context()).Info("tried to grant policy to group %s but input was invalid: %s", groupName, msg)
 		response := newErrorResponse(msg, 400, nil)
 		_ = response.write(w, r)
 		return
 	}
+	span := server.traceDB(r.Context(), "grantGroupPolicy")
 	errResponse := grantGroupPolicy(server.db, groupName, requestPolicy.PolicyName, getAuthZProvider(r))
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1795,9 +4088,11 @@ func (server *Server) handleGroupGrantPolicy(w http.ResponseWriter, r *http.Requ
 func (server *Server) handleGroupRevokePolicy(w http.ResponseWriter, r *http.Request) {
 	groupName := mux.Vars(r)["groupName"]
 	policyName := mux.Vars(r)["policyName"]
+	span := server.traceDB(r.Context(), "revokeGroupPolicy")
 	errResponse := revokeGroupPolicy(server.db, groupName, policyName, getAuthZProvider(r))
+	endDBSpan(span, dbSpanError(errResponse))
 	if errResponse != nil {
-		errResponse.log.write(server.logger)
+		errResponse.log.write(server.requestLogger(r.Context()))
 		_ = errResponse.write(w, r)
 		return
 	}
@@ -1,13 +1,20 @@
 package arborist_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -19,7 +26,10 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 
@@ -30,11 +40,14 @@ import (
 // claims without trying to make HTTP calls or validating the token. The test
 // server is set up using this mock JWT app to skip validation.
 type mockJWTApp struct {
+	// decodes counts the calls to Decode.
+	decodes int
 }
 
 // Decode lets us use this mock JWT decoder for testing. It does zero validation
 // of any tokens it receives, and just returns the decoded claims.
 func (jwtApp *mockJWTApp) Decode(token string) (*map[string]interface{}, error) {
+	jwtApp.decodes++
 	decodedToken, err := jwt.ParseSigned(token)
 	if err != nil {
 		return nil, err
@@ -47,6 +60,28 @@ func (jwtApp *mockJWTApp) Decode(token string) (*map[string]interface{}, error)
 	return &result, nil
 }
 
+// mockJWTAppNoKeys is the same as mockJWTApp, except it reports that it has
+// no keys available, for testing the health check.
+type mockJWTAppNoKeys struct {
+	mockJWTApp
+}
+
+func (jwtApp *mockJWTAppNoKeys) CheckKeys() error {
+	return errors.New("no keys")
+}
+
+// countingRecorder counts the writes to the response body, to tell a
+// streamed response from one written all at once.
+type countingRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (recorder *countingRecorder) Write(b []byte) (int, error) {
+	recorder.writes++
+	return recorder.ResponseRecorder.Write(b)
+}
+
 // TestJWT is a utility for making fake JWTs suitable for testing.
 //
 // Example:
@@ -59,6 +94,8 @@ type TestJWT struct {
 	clientID string
 	policies []string
 	exp      int64
+	// jti is the token's ID, which revoking it needs
+	jti string
 }
 
 // Encode takes the information in the TestJWT and creates a string of an
@@ -95,11 +132,13 @@ func (testJWT *TestJWT) Encode() string {
 							"name": "%s"
 						}
 					},
-					"azp": "%s"
+					"azp": "%s",
+					"jti": "%s"
 				}`,
 				exp,
 				testJWT.username,
 				testJWT.clientID,
+				testJWT.jti,
 			))
 		} else { // client_credentials token
 			payload = []byte(fmt.Sprintf(
@@ -107,10 +146,12 @@ func (testJWT *TestJWT) Encode() string {
 					"scope": ["openid"],
 					"exp": %d,
 					"context": {},
-					"azp": "%s"
+					"azp": "%s",
+					"jti": "%s"
 				}`,
 				exp,
 				testJWT.clientID,
+				testJWT.jti,
 			))
 		}
 	} else {
@@ -126,12 +167,14 @@ func (testJWT *TestJWT) Encode() string {
 						"policies": %s
 					}
 				},
-				"azp": "%s"
+				"azp": "%s",
+				"jti": "%s"
 			}`,
 			time.Now().Unix()+10000,
 			testJWT.username,
 			policies,
 			testJWT.clientID,
+			testJWT.jti,
 		))
 	}
 	jws, err := signer.Sign(payload)
@@ -145,6 +188,34 @@ func (testJWT *TestJWT) Encode() string {
 	return result
 }
 
+// errorCode reads the `error_code` from an error response.
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	result := struct {
+		Error struct {
+			ErrorCode string `json:"error_code"`
+		} `json:"error"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &result)
+	if err != nil {
+		t.Errorf("couldn't read error response: %s", w.Body.String())
+	}
+	return result.Error.ErrorCode
+}
+
+// errorMessage reads the `message` from an error response.
+func errorMessage(t *testing.T, w *httptest.ResponseRecorder) string {
+	result := struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &result)
+	if err != nil {
+		t.Errorf("couldn't read error response: %s", w.Body.String())
+	}
+	return result.Error.Message
+}
+
 var logTo = flag.String(
 	"log",
 	"buffer",
@@ -181,11 +252,17 @@ func TestServer(t *testing.T) {
 		fmt.Println("couldn't reach db; make sure arborist has correct database configuration!")
 		t.Fatal(err)
 	}
+	// audit records and spans are checked in the Auth/Audit and Auth/Tracing
+	// tests
+	auditLog := &bytes.Buffer{}
+	spans := tracetest.NewInMemoryExporter()
 	server, err := arborist.
 		NewServer().
 		WithLogger(logger).
 		WithJWTApp(jwtApp).
 		WithDB(db).
+		WithAuditLog(auditLog).
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans))).
 		Init()
 	if err != nil {
 		t.Fatal(err)
@@ -193,7 +270,7 @@ func TestServer(t *testing.T) {
 	handler := server.MakeRouter(logDest)
 
 	// some test data to work with
-	resourcePath := "/example(123)-X.Y*"
+	resourcePath := "/example_123-X_Y"
 	resourceBody := []byte(fmt.Sprintf(`{"path": "%s"}`, resourcePath))
 	serviceName := "zxcv"
 	roleName := "hjkl"
@@ -571,7 +648,7 @@ func TestServer(t *testing.T) {
 		grantGroupPolicy(t, arborist.AnonymousGroup, policyName)
 
 		// return policy and authMapping
-		policy := arborist.Policy{policyName, "", []string{resourcePath}, []string{roleName}}
+		policy := arborist.Policy{policyName, "", []string{resourcePath}, []string{roleName}, "", 0}
 		authMapping := map[string][]arborist.Action{
 			resourcePath: []arborist.Action{arborist.Action{serviceName, methodName}},
 		}
@@ -623,7 +700,7 @@ func TestServer(t *testing.T) {
 		grantGroupPolicy(t, arborist.LoggedInGroup, policyName)
 
 		// return policy and authMapping
-		policy := arborist.Policy{policyName, "", []string{resourcePath}, []string{roleName}}
+		policy := arborist.Policy{policyName, "", []string{resourcePath}, []string{roleName}, "", 0}
 		authMapping := map[string][]arborist.Action{
 			resourcePath: []arborist.Action{arborist.Action{serviceName, methodName}},
 		}
@@ -641,6 +718,8 @@ func TestServer(t *testing.T) {
 		_ = db.MustExec("DELETE FROM client_policy")
 		_ = db.MustExec("DELETE FROM grp_policy")
 		_ = db.MustExec("DELETE FROM policy")
+		_ = db.MustExec("DELETE FROM policy_archive")
+		_ = db.MustExec("DELETE FROM revoked_token")
 		_ = db.MustExec("DELETE FROM usr")
 		_ = db.MustExec("DELETE FROM client")
 		deleteGroups := fmt.Sprintf(
@@ -711,6 +790,72 @@ func TestServer(t *testing.T) {
 		if w.Code != http.StatusOK {
 			httpError(t, w, "health check failed")
 		}
+		result := arborist.HealthResponse{}
+		err = json.Unmarshal(w.Body.Bytes(), &result)
+		if err != nil {
+			httpError(t, w, "couldn't read response from health check")
+		}
+		assert.NotEmpty(t, result.Uptime, "health check should include uptime")
+
+		t.Run("Status", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/_status", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "status check failed")
+			}
+		})
+
+		t.Run("KeysUnavailable", func(t *testing.T) {
+			noKeysServer, err := arborist.
+				NewServer().
+				WithLogger(logger).
+				WithJWTApp(&mockJWTAppNoKeys{}).
+				WithDB(db).
+				Init()
+			if err != nil {
+				t.Fatal(err)
+			}
+			noKeysHandler := noKeysServer.MakeRouter(logDest)
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/health", nil)
+			noKeysHandler.ServeHTTP(w, req)
+			if w.Code != http.StatusInternalServerError {
+				httpError(t, w, "expected health check to fail without JWT keys")
+			}
+			// liveness doesn't depend on the keys
+			w = httptest.NewRecorder()
+			req = newRequest("GET", "/_status", nil)
+			noKeysHandler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "status check failed")
+			}
+		})
+
+		t.Run("MigrationMissing", func(t *testing.T) {
+			var version string
+			err := db.Get(&version, "SELECT version FROM db_version")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// pretend only the first migration was applied
+			_ = db.MustExec("UPDATE db_version SET version = '2019-02-18T214320Z_init'")
+			defer db.MustExec("UPDATE db_version SET version = $1", version)
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/health", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusServiceUnavailable {
+				httpError(t, w, "expected health check to fail with migrations missing")
+			}
+			assert.Contains(t, errorMessage(t, w), version, "expected missing migrations to be named")
+			// liveness doesn't depend on the schema
+			w = httptest.NewRecorder()
+			req = newRequest("GET", "/_status", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "status check failed")
+			}
+		})
 
 		tearDown(t)
 	})
@@ -808,16 +953,120 @@ func TestServer(t *testing.T) {
 			assert.Equal(t, name, result.Resource.Name, msg)
 			assert.Equal(t, path, result.Resource.Path, msg)
 			assert.NotEqual(t, "", result.Resource.Tag, msg)
+			assert.Equal(t, "/resource/a", w.Header().Get("Location"), "expected Location of the new resource")
 			resourceTag = result.Resource.Tag
 
 			t.Run("Punctuation", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				body := []byte(`{"path": "/!@#punctuation$%^-_is_-&*(allowed)-==[].<>{},?\\"}`)
+				body := []byte(`{"path": "/!@#punctuation$%^-_is_-&*(not_allowed)-==[].<>{},?\\"}`)
+				req := newRequest("POST", "/resource", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected error from creating resource with punctuation")
+				}
+			})
+
+			t.Run("WrongType", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{"path": 123}`)
+				req := newRequest("POST", "/resource", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected error creating resource with non-string path")
+				}
+				assert.Contains(t, errorMessage(t, w), "field `path` must be a string, not a number")
+			})
+
+			t.Run("DryRun", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{"path": "/dryrun", "subresources": [{"name": "child"}]}`)
+				req := newRequest("POST", "/resource?dry_run=true", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't dry-run resource creation")
+				}
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/resource/dryrun", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "dry run created a resource")
+				}
+
+				t.Run("MissingParent", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(`{"path": "/dryrun/doesnt/exist"}`)
+					req := newRequest("POST", "/resource?dry_run=true", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusBadRequest {
+						httpError(t, w, "expected error from dry run before parent exists")
+					}
+				})
+
+				t.Run("CreateParents", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(`{"path": "/dryrun/doesnt/exist"}`)
+					req := newRequest("POST", "/resource?p&dry_run=true", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "couldn't dry-run resource creation with parents")
+					}
+					w = httptest.NewRecorder()
+					req = newRequest("GET", "/resource/dryrun", nil)
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusNotFound {
+						httpError(t, w, "dry run created a parent resource")
+					}
+				})
+			})
+
+			t.Run("NormalizedSlashes", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{"path": "/normalize/"}`)
 				req := newRequest("POST", "/resource", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusCreated {
-					httpError(t, w, "couldn't create resource with punctuation")
+					httpError(t, w, "couldn't create resource with trailing slash")
+				}
+				w = httptest.NewRecorder()
+				body = []byte(`{"name": "child"}`)
+				req = newRequest("POST", "/resource/normalize/", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't create subresource under path with trailing slash")
+				}
+				// the same resource, spelled differently, is a duplicate
+				w = httptest.NewRecorder()
+				body = []byte(`{"path": "//normalize//child/"}`)
+				req = newRequest("POST", "/resource", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusConflict {
+					httpError(t, w, "expected un-normalized path to conflict with existing resource")
+				}
+				// and it reads back with the normalized path
+				result := getResourceWithPath(t, "/normalize/child/")
+				assert.Equal(t, "/normalize/child", result.Path)
+			})
+
+			t.Run("Space", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{"path": "/with space"}`)
+				req := newRequest("POST", "/resource", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected error from creating resource with a space")
+				}
+				assert.Contains(t, w.Body.String(), `\" \"`)
+			})
+
+			t.Run("Colon", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{"path": "/with:colon"}`)
+				req := newRequest("POST", "/resource", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected error from creating resource with a colon")
 				}
+				assert.Contains(t, w.Body.String(), `\":\"`)
 			})
 
 			t.Run("AlreadyExists", func(t *testing.T) {
@@ -828,6 +1077,7 @@ func TestServer(t *testing.T) {
 				if w.Code != http.StatusConflict {
 					httpError(t, w, "expected error from creating resource that already exists")
 				}
+				assert.Equal(t, "resource_exists", errorCode(t, w))
 			})
 
 			t.Run("MissingParent", func(t *testing.T) {
@@ -1052,2604 +1302,6366 @@ func TestServer(t *testing.T) {
 			}
 		})
 
-		t.Run("ListSubresources", func(t *testing.T) {
+		t.Run("CreateWithSubresourcesRollsBack", func(t *testing.T) {
+			// the second "dup" fails to insert after the parent and the first
+			// "dup" were inserted; none of the tree should be left behind
 			w := httptest.NewRecorder()
-			req := newRequest("GET", "/resource/a", nil)
+			body := []byte(`{
+				"name": "rollback",
+				"subresources": [{"name": "dup"}, {"name": "dup"}]
+			}`)
+			req := newRequest("POST", "/resource", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read resource")
+			if w.Code != http.StatusConflict {
+				httpError(t, w, "expected conflict creating duplicate subresources")
 			}
-			result := struct {
-				Path         string   `json:"path"`
-				Name         string   `json:"name"`
-				Subresources []string `json:"subresources"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from resource listing")
+			w = httptest.NewRecorder()
+			req = newRequest("GET", "/resource/rollback", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "resource tree was partially created")
 			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, "a", result.Name, msg)
-			assert.Equal(t, "/a", result.Path, msg)
-			assert.Equal(t, []string{"/a/b"}, result.Subresources, msg)
 		})
 
-		t.Run("Overwrite", func(t *testing.T) {
+		t.Run("CreateTree", func(t *testing.T) {
 			w := httptest.NewRecorder()
 			body := []byte(`{
-				"name": "Godel",
+				"path": "/tree",
 				"subresources": [
 					{
-						"name": "Escher",
-						"subresources": [{"name": "Bach"}]
+						"name": "left",
+						"subresources": [{"name": "leaf1"}, {"name": "leaf2"}]
+					},
+					{
+						"path": "/tree/right",
+						"subresources": [{"name": "leaf3"}]
 					}
 				]
 			}`)
-			req := newRequest("PUT", "/resource", bytes.NewBuffer(body))
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create resource using PUT")
-			}
-			expected := struct {
-				I interface{} `json:"created"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &expected)
-			if err != nil {
-				httpError(t, w, "couldn't read response from resource creation")
-			}
-			escherTag, err := getTagForResource("Godel.Escher")
-			if err != nil {
-				httpError(t, w, "couldn't get tag for resource Godel.Escher")
-			}
-			bachTag, err := getTagForResource("Godel.Escher.Bach")
-			if err != nil {
-				httpError(t, w, "couldn't get tag for resource Godel.Escher.Bach")
-			}
-			// now PUT over the same resource, but keep the subresources
-			w = httptest.NewRecorder()
-			body = []byte(`{
-				"name": "Godel,",
-				"subresources": [
-					{"name": "Escher,", "subresources": [{"name": "Bach"}]},
-					{"name": "completeness_theorem"}
-				]
-			}`)
-			req = newRequest("PUT", "/resource", bytes.NewBuffer(body))
+			req := newRequest("POST", "/resource", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't update resource using PUT")
+				httpError(t, w, "couldn't create resource tree")
 			}
-			newEscherTag, err := getTagForResource("Godel.Escher")
-			if err != nil {
-				httpError(t, w, "couldn't get tag for resource Godel.Escher")
+			paths := []string{
+				"/tree",
+				"/tree/left",
+				"/tree/left/leaf1",
+				"/tree/left/leaf2",
+				"/tree/right",
+				"/tree/right/leaf3",
 			}
-			newBachTag, err := getTagForResource("Godel.Escher.Bach")
-			if err != nil {
-				httpError(t, w, "couldn't get tag for resource Godel.Escher.Bach")
+			for _, path := range paths {
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/resource"+path, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't find resource "+path)
+				}
 			}
-			assert.Equal(t, escherTag, newEscherTag, "subresource tag changed after PUT")
-			assert.Equal(t, bachTag, newBachTag, "subresource tag changed after PUT")
-			getResourceWithPath(t, "/Godel,/completeness_theorem")
-		})
-
-		t.Run("Merge", func(t *testing.T) {
-			createResourceBytes(t, []byte(`{
-				"name": "animal",
-				"subresources": [
-					{"name": "dinosaur", "subresources": [{"name": "pterodactyl"}]},
-					{"name": "dog", "subresources": [{"name": "corgi"}]}
-				]
-			}`))
 
-			t.Run("UpdateTopLevelResource", func(t *testing.T) {
+			t.Run("InvalidName", func(t *testing.T) {
+				// the bad name is checked before anything is inserted
 				w := httptest.NewRecorder()
 				body := []byte(`{
-					"name": "animal",
-					"subresources": [
-						{"name": "bird", "subresources": [{"name": "goose"}]},
-						{"name": "cat", "subresources": [{"name": "lion"}]}
-					]
+					"path": "/badtree",
+					"subresources": [{"name": "a", "subresources": [{"name": "b/c"}]}]
 				}`)
-				req := newRequest("PUT", "/resource?merge", bytes.NewBuffer(body))
+				req := newRequest("POST", "/resource", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusCreated {
-					httpError(t, w, "couldn't update resource using PUT")
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 for subresource name with a slash")
 				}
-				// verify that resources created before update were not overwritten
-				getResourceWithPath(t, "/animal/dinosaur/pterodactyl")
-				getResourceWithPath(t, "/animal/dog/corgi")
-				// verify that update actually created resources
-				getResourceWithPath(t, "/animal/bird/goose")
-				getResourceWithPath(t, "/animal/cat/lion")
-			})
-
-			t.Run("UpdateSubresource", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				body := []byte(`{
-					"path": "/animal/dog",
-					"subresources": [
-						{"name": "goldenretriever", "subresources": []}
-					]
-				}`)
-				req := newRequest("PUT", "/resource?merge", bytes.NewBuffer(body))
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/resource/badtree", nil)
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusCreated {
-					httpError(t, w, "couldn't update resource using PUT")
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "resource tree was partially created")
 				}
-				// verify that resources created before update were not overwritten
-				getResourceWithPath(t, "/animal/dinosaur/pterodactyl")
-				getResourceWithPath(t, "/animal/dog/corgi")
-				getResourceWithPath(t, "/animal/bird/goose")
-				getResourceWithPath(t, "/animal/cat/lion")
-				// verify that update actually created resource
-				getResourceWithPath(t, "/animal/dog/goldenretriever")
 			})
 		})
 
-		t.Run("Delete", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("DELETE", "/resource/a", nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't delete resource")
+		t.Run("DirectSubresources", func(t *testing.T) {
+			// uses the tree from `CreateTree`
+			type node struct {
+				Name         string `json:"name"`
+				Path         string `json:"path"`
+				Subresources []node `json:"subresources"`
 			}
-		})
-
-		t.Run("CheckDeleted", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", "/resource/a", nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNotFound {
-				httpError(t, w, "deleted resource still present")
+			getSubresources := func(t *testing.T, url string) []node {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't list subresources")
+				}
+				result := struct {
+					Subresources []node `json:"subresources"`
+				}{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from subresources listing")
+				}
+				return result.Subresources
 			}
-		})
 
-		t.Run("CheckDeletedSubresource", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", "/resource/a/b", nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNotFound {
-				httpError(t, w, "deleted subresource still present")
-			}
-		})
+			t.Run("Depth1", func(t *testing.T) {
+				expected := []node{
+					{Name: "left", Path: "/tree/left"},
+					{Name: "right", Path: "/tree/right"},
+				}
+				assert.Equal(t, expected, getSubresources(t, "/resource/tree/subresources"))
+			})
 
-		tearDown(t)
-	})
+			t.Run("Depth2", func(t *testing.T) {
+				expected := []node{
+					{
+						Name: "left",
+						Path: "/tree/left",
+						Subresources: []node{
+							{Name: "leaf1", Path: "/tree/left/leaf1"},
+							{Name: "leaf2", Path: "/tree/left/leaf2"},
+						},
+					},
+					{
+						Name:         "right",
+						Path:         "/tree/right",
+						Subresources: []node{{Name: "leaf3", Path: "/tree/right/leaf3"}},
+					},
+				}
+				assert.Equal(t, expected, getSubresources(t, "/resource/tree/subresources?depth=2"))
+			})
 
-	t.Run("Role", func(t *testing.T) {
-		tearDown := testSetup(t)
+			t.Run("Leaf", func(t *testing.T) {
+				assert.Equal(t, []node{}, getSubresources(t, "/resource/tree/left/leaf1/subresources"))
+			})
 
-		t.Run("Create", func(t *testing.T) {
+			t.Run("NotFound", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/resource/notexist/subresources", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 for subresources of missing resource")
+				}
+				assert.Equal(t, "resource_not_found", errorCode(t, w))
+			})
+
+			t.Run("BadDepth", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/resource/tree/subresources?depth=0", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 for depth 0")
+				}
+			})
+		})
+
+		t.Run("ReadExpanded", func(t *testing.T) {
+			// uses the tree from `CreateTree`
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/resource/tree?expand=true", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read expanded resource")
+			}
+			result := arborist.ResourceTreeOut{}
+			err := json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from expanded resource read")
+			}
+			leaf := func(name string, path string) *arborist.ResourceTreeOut {
+				return &arborist.ResourceTreeOut{
+					Name:         name,
+					Path:         path,
+					Tags:         map[string]string{},
+					Subresources: []*arborist.ResourceTreeOut{},
+				}
+			}
+			expected := arborist.ResourceTreeOut{
+				Name: "tree",
+				Path: "/tree",
+				Tags: map[string]string{},
+				Subresources: []*arborist.ResourceTreeOut{
+					{
+						Name: "left",
+						Path: "/tree/left",
+						Tags: map[string]string{},
+						Subresources: []*arborist.ResourceTreeOut{
+							leaf("leaf1", "/tree/left/leaf1"),
+							leaf("leaf2", "/tree/left/leaf2"),
+						},
+					},
+					{
+						Name: "right",
+						Path: "/tree/right",
+						Tags: map[string]string{},
+						Subresources: []*arborist.ResourceTreeOut{
+							leaf("leaf3", "/tree/right/leaf3"),
+						},
+					},
+				},
+			}
+			// tags are generated, so just check they're there
+			var checkTags func(node *arborist.ResourceTreeOut)
+			checkTags = func(node *arborist.ResourceTreeOut) {
+				assert.NotEmpty(t, node.Tag, "missing tag for %s", node.Path)
+				node.Tag = ""
+				for _, child := range node.Subresources {
+					checkTags(child)
+				}
+			}
+			checkTags(&result)
+			assert.Equal(t, expected, result)
+
+			t.Run("TooDeep", func(t *testing.T) {
+				shallow, err := arborist.
+					NewServer().
+					WithLogger(logger).
+					WithJWTApp(jwtApp).
+					WithDB(db).
+					WithMaxResourceDepth(1).
+					Init()
+				if err != nil {
+					t.Fatal(err)
+				}
+				shallowHandler := shallow.MakeRouter(logDest)
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/resource/tree?expand=true", nil)
+				shallowHandler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 expanding a tree deeper than the max")
+				}
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/resource/tree/left?expand=true", nil)
+				shallowHandler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't expand a tree within the max depth")
+				}
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/resource/tree/subresources?depth=2", nil)
+				shallowHandler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 for depth over the max")
+				}
+			})
+		})
+
+		t.Run("Tags", func(t *testing.T) {
 			w := httptest.NewRecorder()
 			body := []byte(`{
-				"id": "foo",
-				"permissions": [
-					{"id": "foo", "action": {"service": "test", "method": "foo"}}
+				"path": "/catalog",
+				"description": "tagged resources",
+				"tags": {"team": "data", "env": "prod"},
+				"subresources": [
+					{"name": "staging", "tags": {"team": "data", "env": "staging"}},
+					{"name": "untagged"}
 				]
 			}`)
-			req := newRequest("POST", "/role", bytes.NewBuffer(body))
+			req := newRequest("POST", "/resource", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create role")
+				httpError(t, w, "couldn't create tagged resources")
 			}
-			// make one-off struct to read the response into
-			result := struct {
-				I interface{} `json:"created"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
+
+			w = httptest.NewRecorder()
+			req = newRequest("GET", "/resource/catalog", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read tagged resource")
+			}
+			resource := arborist.ResourceOut{}
+			err := json.Unmarshal(w.Body.Bytes(), &resource)
 			if err != nil {
-				httpError(t, w, "couldn't read response from role creation")
+				httpError(t, w, "couldn't read response from resource read")
 			}
+			assert.Equal(t, map[string]string{"team": "data", "env": "prod"}, resource.Tags)
+			assert.Equal(t, "tagged resources", resource.Description)
 
-			t.Run("OverwriteCreate", func(t *testing.T) {
+			list := func(t *testing.T, url string) []string {
 				w := httptest.NewRecorder()
-				body := []byte(`{
-					"id": "thisNewRole",
-					"permissions": [
-						{"id": "thisNewID", "action": {"service": "test-overwrite", "method": "bar"}}
-					]
-				}`)
-				req := newRequest("PUT", "/role/thisNewRole", bytes.NewBuffer(body))
+				req := newRequest("GET", url, nil)
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusCreated {
-					httpError(t, w, "couldn't create role")
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't list resources by tag")
 				}
-				// make one-off struct to read the response into
 				result := struct {
-					I interface{} `json:"created"`
+					Resources []arborist.ResourceOut `json:"resources"`
 				}{}
-				err = json.Unmarshal(w.Body.Bytes(), &result)
+				err := json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from role creation")
+					httpError(t, w, "couldn't read response from resource list")
+				}
+				paths := []string{}
+				for _, resource := range result.Resources {
+					paths = append(paths, resource.Path)
 				}
+				return paths
+			}
+
+			t.Run("Filter", func(t *testing.T) {
+				paths := list(t, "/resource?tag=team:data")
+				assert.ElementsMatch(t, []string{"/catalog", "/catalog/staging"}, paths)
+				paths = list(t, "/resource?tag=team:data&tag=env:staging")
+				assert.Equal(t, []string{"/catalog/staging"}, paths)
+				paths = list(t, "/resource?tag=team:nobody")
+				assert.Equal(t, []string{}, paths)
+				paths = list(t, "/resource?tag=env:prod&tag=env:staging")
+				assert.Equal(t, []string{}, paths)
 			})
 
-			t.Run("AlreadyExists", func(t *testing.T) {
+			t.Run("Update", func(t *testing.T) {
 				w := httptest.NewRecorder()
 				body := []byte(`{
-					"id": "foo",
-					"permissions": [
-						{"id": "foo", "action": {"service": "test", "method": "foo"}}
-					]
+					"path": "/catalog",
+					"tags": {"team": "ops"},
+					"subresources": [{"name": "staging"}, {"name": "untagged"}]
 				}`)
-				req := newRequest("POST", "/role", bytes.NewBuffer(body))
+				req := newRequest("PUT", "/resource", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusConflict {
-					httpError(t, w, "expected conflict error from trying to create role again")
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't update resource tags")
 				}
+				assert.Equal(t, []string{"/catalog"}, list(t, "/resource?tag=team:ops"))
+				// leaving out tags keeps the ones there were
+				assert.Equal(t, []string{"/catalog/staging"}, list(t, "/resource?tag=env:staging"))
 			})
 
-			t.Run("MissingPermissions", func(t *testing.T) {
+			t.Run("InvalidFilter", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				body := []byte(`{"id": "no-permissions", "permissions": []}`)
-				req := newRequest("POST", "/role", bytes.NewBuffer(body))
+				req := newRequest("GET", "/resource?tag=team", nil)
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusBadRequest {
-					httpError(t, w, "expected error from trying to create role with no permissions")
+					httpError(t, w, "expected 400 for tag filter without a value")
+				}
+			})
+
+			t.Run("InvalidKey", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{"path": "/badtag", "tags": {"a:b": "c"}}`)
+				req := newRequest("POST", "/resource", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 for tag key with `:`")
 				}
 			})
 		})
 
-		t.Run("Read", func(t *testing.T) {
+		t.Run("Search", func(t *testing.T) {
+			// uses the tree from `CreateTree`
+			search := func(t *testing.T, url string) ([]string, string) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't search resources")
+				}
+				result := struct {
+					Resources []arborist.ResourceOut `json:"resources"`
+				}{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from resource search")
+				}
+				if result.Resources == nil {
+					t.Errorf("expected a list of resources; got response body: %s", w.Body.String())
+				}
+				paths := []string{}
+				for _, resource := range result.Resources {
+					paths = append(paths, resource.Path)
+				}
+				return paths, w.Header().Get("X-Total-Count")
+			}
+
+			t.Run("Prefix", func(t *testing.T) {
+				paths, total := search(t, "/resource/search?q=/tree/le")
+				expected := []string{"/tree/left", "/tree/left/leaf1", "/tree/left/leaf2"}
+				assert.Equal(t, expected, paths)
+				assert.Equal(t, "3", total)
+			})
+
+			t.Run("IgnoresCase", func(t *testing.T) {
+				paths, _ := search(t, "/resource/search?q=LEAF")
+				expected := []string{"/tree/left/leaf1", "/tree/left/leaf2", "/tree/right/leaf3"}
+				assert.Equal(t, expected, paths)
+			})
+
+			t.Run("Page", func(t *testing.T) {
+				paths, total := search(t, "/resource/search?q=leaf&limit=2&offset=1")
+				assert.Equal(t, []string{"/tree/left/leaf2", "/tree/right/leaf3"}, paths)
+				assert.Equal(t, "3", total)
+			})
+
+			t.Run("NoMatch", func(t *testing.T) {
+				paths, total := search(t, "/resource/search?q=no_such%25resource")
+				assert.Equal(t, []string{}, paths)
+				assert.Equal(t, "0", total)
+			})
+
+			t.Run("EmptyQuery", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/resource/search?q=", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 searching without a term")
+				}
+			})
+		})
+
+		t.Run("ListSubresources", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := newRequest("GET", "/role/foo", nil)
+			req := newRequest("GET", "/resource/a", nil)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't create role")
+				httpError(t, w, "couldn't read resource")
 			}
 			result := struct {
-				Name string `json:"id"`
+				Path         string   `json:"path"`
+				Name         string   `json:"name"`
+				Subresources []string `json:"subresources"`
 			}{}
 			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from role read")
+				httpError(t, w, "couldn't read response from resource listing")
 			}
 			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, "foo", result.Name, msg)
+			assert.Equal(t, "a", result.Name, msg)
+			assert.Equal(t, "/a", result.Path, msg)
+			assert.Equal(t, []string{"/a/b"}, result.Subresources, msg)
 		})
 
 		t.Run("Overwrite", func(t *testing.T) {
 			w := httptest.NewRecorder()
 			body := []byte(`{
-				"id": "foo",
-				"permissions": [
-					{"id": "foo", "action": {"service": "*", "method": "bar"}}
+				"name": "Godel",
+				"subresources": [
+					{
+						"name": "Escher",
+						"subresources": [{"name": "Bach"}]
+					}
 				]
 			}`)
-			req := newRequest("PUT", "/role/foo", bytes.NewBuffer(body))
+			req := newRequest("PUT", "/resource", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't update role")
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create resource using PUT")
 			}
-			// make one-off struct to read the response into
-			result := struct {
-				I interface{} `json:"updated"`
+			expected := struct {
+				I interface{} `json:"created"`
 			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
+			err = json.Unmarshal(w.Body.Bytes(), &expected)
 			if err != nil {
-				httpError(t, w, "couldn't read response from role overwrite")
+				httpError(t, w, "couldn't read response from resource creation")
 			}
-		})
-
-		t.Run("FailOverwrite", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			body := []byte(`{
-				"id": "notFoo",
-				"permissions": [
-					{"id": "foo", "action": {"service": "*", "method": "bar"}}
+			escherTag, err := getTagForResource("Godel.Escher")
+			if err != nil {
+				httpError(t, w, "couldn't get tag for resource Godel.Escher")
+			}
+			bachTag, err := getTagForResource("Godel.Escher.Bach")
+			if err != nil {
+				httpError(t, w, "couldn't get tag for resource Godel.Escher.Bach")
+			}
+			// now PUT over the same resource, but keep the subresources
+			w = httptest.NewRecorder()
+			body = []byte(`{
+				"name": "Godel",
+				"subresources": [
+					{"name": "Escher", "subresources": [{"name": "Bach"}]},
+					{"name": "completeness_theorem"}
 				]
 			}`)
-			req := newRequest("PUT", "/role/foo", bytes.NewBuffer(body))
+			req = newRequest("PUT", "/resource", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusBadRequest {
-				httpError(t, w, "wrong response code from invalid role overwrite request")
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't update resource using PUT")
 			}
-		})
-
-		t.Run("List", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", "/role", nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "can't list roles")
+			newEscherTag, err := getTagForResource("Godel.Escher")
+			if err != nil {
+				httpError(t, w, "couldn't get tag for resource Godel.Escher")
 			}
-			result := struct {
-				Roles []interface{} `json:"roles"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
+			newBachTag, err := getTagForResource("Godel.Escher.Bach")
 			if err != nil {
-				httpError(t, w, "couldn't read response from roles list")
+				httpError(t, w, "couldn't get tag for resource Godel.Escher.Bach")
 			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, 2, len(result.Roles), msg)
+			assert.Equal(t, escherTag, newEscherTag, "subresource tag changed after PUT")
+			assert.Equal(t, bachTag, newBachTag, "subresource tag changed after PUT")
+			getResourceWithPath(t, "/Godel/completeness_theorem")
 		})
 
-		t.Run("Delete", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("DELETE", "/role/foo", nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't delete role")
-			}
-		})
+		t.Run("Merge", func(t *testing.T) {
+			createResourceBytes(t, []byte(`{
+				"name": "animal",
+				"subresources": [
+					{"name": "dinosaur", "subresources": [{"name": "pterodactyl"}]},
+					{"name": "dog", "subresources": [{"name": "corgi"}]}
+				]
+			}`))
 
-		t.Run("CheckDeleted", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", "/role/foo", nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNotFound {
-				httpError(t, w, "role was not actually deleted")
-			}
-		})
-
-		tearDown(t)
-	})
-
-	t.Run("Policy", func(t *testing.T) {
-		tearDown := testSetup(t)
+			t.Run("UpdateTopLevelResource", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{
+					"name": "animal",
+					"subresources": [
+						{"name": "bird", "subresources": [{"name": "goose"}]},
+						{"name": "cat", "subresources": [{"name": "lion"}]}
+					]
+				}`)
+				req := newRequest("PUT", "/resource?merge", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't update resource using PUT")
+				}
+				// verify that resources created before update were not overwritten
+				getResourceWithPath(t, "/animal/dinosaur/pterodactyl")
+				getResourceWithPath(t, "/animal/dog/corgi")
+				// verify that update actually created resources
+				getResourceWithPath(t, "/animal/bird/goose")
+				getResourceWithPath(t, "/animal/cat/lion")
+			})
 
-		roleName := "bazgo-create"
-		policyName := "bazgo-create-b"
-		policyNameA := "bazgoA-create-b"
+			t.Run("UpdateSubresource", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{
+					"path": "/animal/dog",
+					"subresources": [
+						{"name": "goldenretriever", "subresources": []}
+					]
+				}`)
+				req := newRequest("PUT", "/resource?merge", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't update resource using PUT")
+				}
+				// verify that resources created before update were not overwritten
+				getResourceWithPath(t, "/animal/dinosaur/pterodactyl")
+				getResourceWithPath(t, "/animal/dog/corgi")
+				getResourceWithPath(t, "/animal/bird/goose")
+				getResourceWithPath(t, "/animal/cat/lion")
+				// verify that update actually created resource
+				getResourceWithPath(t, "/animal/dog/goldenretriever")
+			})
+		})
 
-		t.Run("Create", func(t *testing.T) {
+		t.Run("Move", func(t *testing.T) {
+			for _, path := range []string{"/moving", "/moving/a", "/moving/a/b", "/moving/a/b/c", "/moving/x"} {
+				createResourceBytes(t, []byte(fmt.Sprintf(`{"path": "%s"}`, path)))
+			}
+			createRoleBytes(t, []byte(`{
+				"id": "moving-reader",
+				"permissions": [
+					{"id": "read", "action": {"service": "test", "method": "read"}}
+				]
+			}`))
+			createPolicyBytes(t, []byte(`{"id": "moving", "resource_paths": ["/moving/a/b"], "role_ids": ["moving-reader"]}`))
+			createPolicyBytes(t, []byte(`{"id": "moving-archived", "resource_paths": ["/moving/a/b/c"], "role_ids": ["moving-reader"]}`))
 			w := httptest.NewRecorder()
-			// set up some resources to work with
-			// TODO: make more of this setup into "fixtures", not hard-coded
-			body := []byte(`{"path": "/a"}`)
-			req := newRequest("POST", "/resource", bytes.NewBuffer(body))
+			req := newRequest("DELETE", "/policy/moving-archived?soft=true", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create resource")
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't soft-delete policy")
 			}
-			w = httptest.NewRecorder()
-			body = []byte(`{"path": "/a/b"}`)
-			req = newRequest("POST", "/resource", bytes.NewBuffer(body))
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create resource")
+			move := func(t *testing.T, path string, newPath string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(`{"new_path": "%s"}`, newPath))
+				req := newRequest("POST", "/resource"+path+"/move", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				return w
 			}
-			w = httptest.NewRecorder()
-			body = []byte(`{"path": "/a/b/c"}`)
-			req = newRequest("POST", "/resource", bytes.NewBuffer(body))
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create resource")
+
+			w = move(t, "/moving/a", "/moving/x/a")
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't move resource")
 			}
-			// set up roles
-			w = httptest.NewRecorder()
-			body = []byte(fmt.Sprintf(
-				`{
-					"id": "%s",
-					"permissions": [
-						{
-							"id": "foo",
-							"action": {"service": "bazgo", "method": "create"}
-						}
-					]
-				}`,
-				roleName,
-			))
-			req = newRequest("POST", "/role", bytes.NewBuffer(body))
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create role")
+			result := arborist.ResourceOut{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from resource move")
+			}
+			assert.Equal(t, "/moving/x/a", result.Path, w.Body.String())
+			assert.Equal(t, "a", result.Name, w.Body.String())
+			assert.Equal(t, []string{"/moving/x/a/b"}, result.Subresources, w.Body.String())
+			descendant := getResourceWithPath(t, "/moving/x/a/b/c")
+			assert.Equal(t, "c", descendant.Name)
+			for _, path := range []string{"/moving/a", "/moving/a/b", "/moving/a/b/c"} {
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/resource"+path, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected moved resource to be gone from its old path")
+				}
 			}
-			// create policies
+
+			// the policy follows the resource it points at
 			w = httptest.NewRecorder()
-			body = []byte(fmt.Sprintf(
-				`{
-					"id": "%s",
-					"resource_paths": ["/a/b"],
-					"role_ids": ["%s"]
-				}`,
-				policyName,
-				roleName,
-			))
-			req = newRequest("POST", "/policy", bytes.NewBuffer(body))
+			req = newRequest("GET", "/policy/moving", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create policy")
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read policy")
 			}
-			result := struct {
-				I interface{} `json:"created"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
+			policy := arborist.Policy{}
+			err = json.Unmarshal(w.Body.Bytes(), &policy)
 			if err != nil {
-				httpError(t, w, "couldn't read response from resource creation")
+				httpError(t, w, "couldn't read response from policy read")
 			}
+			assert.Equal(t, []string{"/moving/x/a/b"}, policy.ResourcePaths, w.Body.String())
+
+			// and a soft-deleted one restores onto the resource's new path
 			w = httptest.NewRecorder()
-			body = []byte(fmt.Sprintf(
-				`{
-					"id": "%s",
-					"resource_paths": ["/a/b"],
-					"role_ids": ["%s"]
-				}`,
-				policyNameA,
-				roleName,
-			))
-			req = newRequest("POST", "/policy", bytes.NewBuffer(body))
+			req = newRequest("POST", "/policy/moving-archived/restore", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create policy")
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't restore policy on moved resource")
 			}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
+			restored := struct {
+				Restored arborist.Policy `json:"restored"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &restored)
 			if err != nil {
-				httpError(t, w, "couldn't read response from resource creation")
+				httpError(t, w, "couldn't read response from policy restore")
 			}
+			assert.Equal(t, []string{"/moving/x/a/b/c"}, restored.Restored.ResourcePaths, w.Body.String())
 
-			t.Run("RoleNotExist", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				createResourceBytes(t, []byte(`{"path": "/test_resource"}`))
-				body := []byte(`{
-					"id": "testPolicyRoleNotExist",
-					"resource_paths": ["/test_resource"],
-					"role_ids": ["does_not_exist"]
-				}`)
-				req = newRequest("POST", "/policy", bytes.NewBuffer(body))
-				handler.ServeHTTP(w, req)
+			t.Run("UnderItself", func(t *testing.T) {
+				w := move(t, "/moving/x", "/moving/x/a/y")
 				if w.Code != http.StatusBadRequest {
-					httpError(t, w, "expected error creating policy with nonexistent role")
+					httpError(t, w, "expected 400 moving resource under itself")
 				}
 			})
 
-			t.Run("ResourceNotExist", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				body := []byte(fmt.Sprintf(
-					`{
-						"id": "testPolicyResourceNotExist",
-						"resource_paths": ["/does/not/exist"],
-						"role_ids": ["%s"]
-					}`,
-					roleName,
-				))
-				req = newRequest("POST", "/policy", bytes.NewBuffer(body))
-				handler.ServeHTTP(w, req)
+			t.Run("Collision", func(t *testing.T) {
+				w := move(t, "/moving/x/a/b", "/moving/x")
+				if w.Code != http.StatusConflict {
+					httpError(t, w, "expected 409 moving resource onto an existing one")
+				}
+				getResourceWithPath(t, "/moving/x/a/b/c")
+			})
+
+			t.Run("ParentMissing", func(t *testing.T) {
+				w := move(t, "/moving/x/a", "/nowhere/a")
 				if w.Code != http.StatusBadRequest {
-					httpError(t, w, "expected error creating policy with nonexistent resource")
+					httpError(t, w, "expected 400 moving resource under a missing parent")
 				}
 			})
 
-			t.Run("BulkPolicyOverwrite", func(t *testing.T) {
+			t.Run("NotFound", func(t *testing.T) {
+				w := move(t, "/moving/a", "/moving/y")
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 moving missing resource")
+				}
+			})
+		})
+
+		t.Run("ListLarge", func(t *testing.T) {
+			createResourceBytes(t, []byte(`{"path": "/streamed"}`))
+			defer func() {
 				w := httptest.NewRecorder()
-				body := []byte(fmt.Sprintf(
-					`[
-						{
-							"id": "%s",
-							"resource_paths": ["/a/b"],
-							"role_ids": ["%s"]
-						},
-						{
-							"id": "%s",
-							"resource_paths": ["/a/b"],
-							"role_ids": ["%s"]
-						}
-					]`,
-					policyName, roleName, policyNameA, roleName,
-				))
-				req = newRequest("PUT", "/bulk/policy", bytes.NewBuffer(body))
+				req := newRequest("DELETE", "/resource/streamed", nil)
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusCreated {
-					httpError(t, w, "couldn't put policies")
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "couldn't delete resource")
+				}
+			}()
+			n := 2000
+			_ = db.MustExec(
+				"INSERT INTO resource(path) SELECT text2ltree('streamed.r' || i) FROM generate_series(1, CAST($1 AS integer)) AS i",
+				n,
+			)
+			countStreamed := func(t *testing.T, url string) (int, int) {
+				w := &countingRecorder{ResponseRecorder: httptest.NewRecorder()}
+				req := newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w.ResponseRecorder, "can't list resources")
 				}
 				result := struct {
-					Policies struct {
-						Policy []string `json:"policy"`
-					}
+					Resources []struct {
+						Path string `json:"path"`
+					} `json:"resources"`
 				}{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from resource creation")
+					httpError(t, w.ResponseRecorder, "couldn't read response from resources list")
 				}
-			})
+				streamed := 0
+				for _, resource := range result.Resources {
+					if strings.HasPrefix(resource.Path, "/streamed/") {
+						streamed++
+					}
+				}
+				return streamed, w.writes
+			}
+
+			streamed, writes := countStreamed(t, "/resource")
+			assert.Equal(t, n, streamed)
+			assert.Greater(t, writes, n, "expected the list to be written a resource at a time")
+
+			// pretty JSON is still written all at once
+			streamed, writes = countStreamed(t, "/resource?pretty=true")
+			assert.Equal(t, n, streamed)
+			assert.Equal(t, 1, writes)
 		})
 
-		t.Run("Read", func(t *testing.T) {
+		t.Run("Delete", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/policy/%s", policyName)
-			req := newRequest("GET", url, nil)
+			req := newRequest("DELETE", "/resource/a", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "policy not found")
-			}
-			result := struct {
-				Name      string   `json:"id"`
-				Resources []string `json:"resource_paths"`
-				Roles     []string `json:"role_ids"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from GET policy")
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't delete resource")
 			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, policyName, result.Name, msg)
-			assert.Equal(t, []string{"/a/b"}, result.Resources, msg)
-			assert.Equal(t, []string{roleName}, result.Roles, msg)
 		})
 
-		t.Run("Overwrite", func(t *testing.T) {
-			createResourceBytes(t, []byte(`{"path": "/a/z"}`))
+		t.Run("CheckDeleted", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			body := []byte(fmt.Sprintf(
-				`{
-					"id": "%s",
-					"resource_paths": ["/a/z"],
-					"role_ids": ["%s"]
-				}`,
-				policyName,
-				roleName,
-			))
-			url := fmt.Sprintf("/policy/%s", policyName)
-			req := newRequest("PUT", url, bytes.NewBuffer(body))
+			req := newRequest("GET", "/resource/a", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't put policy")
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "deleted resource still present")
 			}
-			result := struct {
-				Policy struct {
-					Paths []string `json:"resource_paths"`
-				} `json:"updated"`
+		})
+
+		t.Run("CheckDeletedSubresource", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/resource/a/b", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "deleted subresource still present")
+			}
+		})
+
+		tearDown(t)
+	})
+
+	t.Run("Role", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		t.Run("Create", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			body := []byte(`{
+				"id": "foo",
+				"permissions": [
+					{"id": "foo", "action": {"service": "test", "method": "foo"}}
+				]
+			}`)
+			req := newRequest("POST", "/role", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create role")
+			}
+			assert.Equal(t, "/role/foo", w.Header().Get("Location"), "expected Location of the new role")
+			// make one-off struct to read the response into
+			result := struct {
+				I interface{} `json:"created"`
 			}{}
 			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from resource creation")
+				httpError(t, w, "couldn't read response from role creation")
 			}
-			assert.Equal(t, []string{"/a/z"}, result.Policy.Paths)
+
+			t.Run("OverwriteCreate", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{
+					"id": "thisNewRole",
+					"permissions": [
+						{"id": "thisNewID", "action": {"service": "test-overwrite", "method": "bar"}}
+					]
+				}`)
+				req := newRequest("PUT", "/role/thisNewRole", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't create role")
+				}
+				// make one-off struct to read the response into
+				result := struct {
+					I interface{} `json:"created"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from role creation")
+				}
+			})
+
+			t.Run("AlreadyExists", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{
+					"id": "foo",
+					"permissions": [
+						{"id": "foo", "action": {"service": "test", "method": "foo"}}
+					]
+				}`)
+				req := newRequest("POST", "/role", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusConflict {
+					httpError(t, w, "expected conflict error from trying to create role again")
+				}
+			})
+
+			t.Run("MissingPermissions", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{"id": "no-permissions", "permissions": []}`)
+				req := newRequest("POST", "/role", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected error from trying to create role with no permissions")
+				}
+			})
+
+			t.Run("DuplicatePermissionID", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{
+					"id": "duplicate-permissions",
+					"permissions": [
+						{"id": "foo", "action": {"service": "test", "method": "foo"}},
+						{"id": "foo", "action": {"service": "test", "method": "bar"}}
+					]
+				}`)
+				req := newRequest("POST", "/role", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 creating role with duplicate permission IDs")
+				}
+				assert.Contains(t, errorMessage(t, w), "more than one permission with ID `foo`")
+				// and nothing was written
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/role/duplicate-permissions", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected role with duplicate permission IDs not to be created")
+				}
+			})
+
+			t.Run("MissingFields", func(t *testing.T) {
+				tests := []struct {
+					name     string
+					body     string
+					expected string
+				}{
+					{
+						"ID",
+						`{"permissions": [{"id": "foo", "action": {"service": "test", "method": "foo"}}]}`,
+						"input role is missing required field `id`",
+					},
+					{
+						"PermissionAction",
+						`{"id": "no-action", "permissions": [
+							{"id": "foo", "action": {"service": "test", "method": "foo"}},
+							{"id": "bar"}
+						]}`,
+						"input role is missing required field `permissions[1].action.service`",
+					},
+					{
+						"PermissionMethod",
+						`{"id": "no-method", "permissions": [{"id": "foo", "action": {"service": "test", "method": ""}}]}`,
+						"input role is missing required field `permissions[0].action.method`",
+					},
+					{
+						"PermissionID",
+						`{"id": "no-permission-id", "permissions": [{"action": {"service": "test", "method": "foo"}}]}`,
+						"input role is missing required field `permissions[0].id`",
+					},
+					{
+						"PermissionActionField",
+						`{"id": "misspelt-method", "permissions": [{"id": "foo", "action": {"service": "test", "methd": "foo"}}]}`,
+						"could not parse role from JSON: input permission action contains the following unexpected fields: `methd`",
+					},
+				}
+				for _, test := range tests {
+					t.Run(test.name, func(t *testing.T) {
+						w := httptest.NewRecorder()
+						req := newRequest("POST", "/role", bytes.NewBufferString(test.body))
+						handler.ServeHTTP(w, req)
+						if w.Code != http.StatusBadRequest {
+							httpError(t, w, "expected 400 creating role with a missing field")
+						}
+						assert.Equal(t, test.expected, errorMessage(t, w))
+					})
+				}
+			})
 		})
 
-		t.Run("List", func(t *testing.T) {
+		t.Run("Read", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := newRequest("GET", "/policy", nil)
+			req := newRequest("GET", "/role/foo", nil)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusOK {
-				httpError(t, w, "can't list policies")
+				httpError(t, w, "couldn't create role")
 			}
 			result := struct {
-				Policies []arborist.Policy `json:"policies"`
+				Name string `json:"id"`
 			}{}
 			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from policies list")
+				httpError(t, w, "couldn't read response from role read")
 			}
 			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, 2, len(result.Policies), msg)
-			msg = fmt.Sprintf("non expanded policies should contain 'role_ids'. got response body: %s", w.Body.String())
-			assert.NotNil(t, result.Policies[0].RoleIDs, msg)
-			// TODO (rudyardrichter, 2019-04-15): more checks here on response
+			assert.Equal(t, "foo", result.Name, msg)
 		})
 
-		t.Run("ListExpanded", func(t *testing.T) {
+		t.Run("Overwrite", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := newRequest("GET", "/policy?expand", nil)
+			body := []byte(`{
+				"id": "foo",
+				"permissions": [
+					{"id": "foo", "action": {"service": "*", "method": "bar"}}
+				]
+			}`)
+			req := newRequest("PUT", "/role/foo", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusOK {
-				httpError(t, w, "can't list policies")
+				httpError(t, w, "couldn't update role")
 			}
+			// make one-off struct to read the response into
 			result := struct {
-				Policies []arborist.ExpandedPolicy `json:"policies"`
+				I interface{} `json:"updated"`
 			}{}
 			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from policies list")
+				httpError(t, w, "couldn't read response from role overwrite")
 			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, 2, len(result.Policies), msg)
-			msg = fmt.Sprintf("expanded policies should contain 'roles'. got response body: %s", w.Body.String())
-			assert.NotNil(t, result.Policies[0].Roles, msg)
 		})
 
-		t.Run("Delete", func(t *testing.T) {
+		t.Run("FailOverwrite", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := newRequest("DELETE", "/policy/foo", nil)
+			body := []byte(`{
+				"id": "notFoo",
+				"permissions": [
+					{"id": "foo", "action": {"service": "*", "method": "bar"}}
+				]
+			}`)
+			req := newRequest("PUT", "/role/foo", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't delete policy")
+			if w.Code != http.StatusBadRequest {
+				httpError(t, w, "wrong response code from invalid role overwrite request")
 			}
+		})
 
-			t.Run("NotExist", func(t *testing.T) {
+		t.Run("OverwriteReplaces", func(t *testing.T) {
+			put := func(t *testing.T, body string) {
 				w := httptest.NewRecorder()
-				req := newRequest("DELETE", "/policy/does-not-exist", nil)
+				req := newRequest("PUT", "/role/replaced", bytes.NewBufferString(body))
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNoContent {
-					httpError(t, w, "expected 204 trying delete nonexistent policy")
+				if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't overwrite role")
 				}
-			})
-		})
-
-		t.Run("CheckDeleted", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", "/policy/foo", nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNotFound {
-				httpError(t, w, "policy was not actually deleted")
 			}
-		})
-
-		tearDown(t)
-	})
-
-	t.Run("User", func(t *testing.T) {
-		tearDown := testSetup(t)
-
-		username := "foo"
-		userEmail := "foo@planx.net"
+			put(t, `{
+				"id": "replaced",
+				"description": "old",
+				"permissions": [
+					{"id": "a", "action": {"service": "test", "method": "a"}},
+					{"id": "b", "action": {"service": "test", "method": "b"}}
+				]
+			}`)
+			put(t, `{
+				"id": "replaced",
+				"permissions": [
+					{"id": "b", "action": {"service": "test", "method": "b2"}},
+					{"id": "c", "action": {"service": "test", "method": "c"}}
+				]
+			}`)
 
-		t.Run("ListEmpty", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := newRequest("GET", "/user", nil)
+			req := newRequest("GET", "/role/replaced", nil)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusOK {
-				httpError(t, w, "can't list users")
+				httpError(t, w, "couldn't read role")
 			}
-			result := struct {
-				Users interface{} `json:"users"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
+			role := arborist.Role{}
+			err := json.Unmarshal(w.Body.Bytes(), &role)
 			if err != nil {
-				httpError(t, w, "couldn't read response from users list")
+				httpError(t, w, "couldn't read response from role read")
+			}
+			methods := map[string]string{}
+			for _, permission := range role.Permissions {
+				methods[permission.Name] = permission.Action.Method
 			}
 			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, []interface{}{}, result.Users, msg)
-		})
+			assert.Equal(t, map[string]string{"b": "b2", "c": "c"}, methods, msg)
 
-		t.Run("NotFound", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", "/user/nonexistent", nil)
+			// the permission left out is deleted, not just detached
+			var count int
+			err = db.Get(
+				&count,
+				"SELECT COUNT(*) FROM permission JOIN role ON role.id = permission.role_id WHERE role.name = 'replaced'",
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 2, count)
+			err = db.Get(&count, "SELECT COUNT(*) FROM permission WHERE role_id IS NULL")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 0, count, "no permissions should be left without a role")
+
+			w = httptest.NewRecorder()
+			req = newRequest("DELETE", "/role/replaced", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNotFound {
-				httpError(t, w, "didn't get 404 for nonexistent user")
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't delete role")
 			}
 		})
 
-		t.Run("Create", func(t *testing.T) {
+		t.Run("Append", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			body := []byte(fmt.Sprintf(
-				`{
-					"name": "%s",
-					"email": "%s"
-				}`,
-				username,
-				userEmail,
-			))
-			req := newRequest("POST", "/user", bytes.NewBuffer(body))
+			body := []byte(`{
+				"permissions": [
+					{"id": "baz", "action": {"service": "test", "method": "baz"}}
+				]
+			}`)
+			req := newRequest("PATCH", "/role/foo", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create user")
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't append to role")
 			}
 			result := struct {
-				I interface{} `json:"created"`
+				Updated arborist.Role `json:"updated"`
 			}{}
 			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from user creation")
+				httpError(t, w, "couldn't read response from role append")
+			}
+			permissionIDs := []string{}
+			for _, permission := range result.Updated.Permissions {
+				permissionIDs = append(permissionIDs, permission.Name)
 			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.ElementsMatch(t, []string{"foo", "baz"}, permissionIDs, msg)
 
-			t.Run("AlreadyExists", func(t *testing.T) {
+			t.Run("PermissionConflict", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				body := []byte(fmt.Sprintf(
-					`{
-						"name": "%s",
-						"email": "%s"
-					}`,
-					username,
-					userEmail,
-				))
-				req := newRequest("POST", "/user", bytes.NewBuffer(body))
-				handler.ServeHTTP(w, req)
+				body := []byte(`{
+					"permissions": [
+						{"id": "qux", "action": {"service": "test", "method": "qux"}},
+						{"id": "foo", "action": {"service": "other", "method": "foo"}}
+					]
+				}`)
+				req := newRequest("PATCH", "/role/foo", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusConflict {
-					httpError(t, w, "expected 409 from trying to create same user again")
+					httpError(t, w, "expected 409 appending permission with existing ID")
+				}
+				// the role should be unchanged, including the non-conflicting permission
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/role/foo", nil)
+				handler.ServeHTTP(w, req)
+				role := arborist.Role{}
+				err = json.Unmarshal(w.Body.Bytes(), &role)
+				if err != nil {
+					httpError(t, w, "couldn't read response from role read")
 				}
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, 2, len(role.Permissions), msg)
 			})
 
-			t.Run("MissingName", func(t *testing.T) {
+			t.Run("NotExist", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				body := []byte(`{"email": "asdf"}`)
-				req := newRequest("POST", "/user", bytes.NewBuffer(body))
+				body := []byte(`{
+					"permissions": [
+						{"id": "baz", "action": {"service": "test", "method": "baz"}}
+					]
+				}`)
+				req := newRequest("PATCH", "/role/does-not-exist", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusBadRequest {
-					httpError(t, w, "expected 400 from trying to create user without name")
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 appending to nonexistent role")
 				}
 			})
 		})
 
-		anonymousPolicies, anonymousResourcePaths, _ := setupAnonymousPolicies(t)
-		loggedInPolicies, loggedInResourcePaths, _ := setupLoggedInPolicies(t)
-		t.Run("Read", func(t *testing.T) {
+		t.Run("Permission", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/user/%s", username)
-			req := newRequest("GET", url, nil)
+			body := []byte(`{"id": "quux", "action": {"service": "test", "method": "quux"}}`)
+			req := newRequest("POST", "/role/foo/permission", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read user")
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't add permission to role")
 			}
-			result := struct {
-				Name     string `json:"name"`
-				Email    string `json:"email"`
-				Policies []struct {
-					Policy    string  `json:"policy"`
-					ExpiresAt *string `json:"expires_at"`
-				} `json:"policies"`
-				Groups []string `json:"groups"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
+			// it shows up in the role
+			w = httptest.NewRecorder()
+			req = newRequest("GET", "/role/foo", nil)
+			handler.ServeHTTP(w, req)
+			role := arborist.Role{}
+			err = json.Unmarshal(w.Body.Bytes(), &role)
 			if err != nil {
-				httpError(t, w, "couldn't read response from user read")
-			}
-			assert.Equalf(t, username, result.Name, "Wanted username: %v \t Got: %v", username, result.Name)
-			assert.Equalf(t, userEmail, result.Email, "Wanted email: %v \t Got: %v", userEmail, result.Email)
-			// expect to receive policies from user's groups (in this case, 0 policies
-			// are assigned to user) as well as policies from Anonymous and LoggedIn groups.
-			var expectedPolicyNames []string
-			for _, policy := range anonymousPolicies {
-				expectedPolicyNames = append(expectedPolicyNames, policy.Name)
-			}
-			for _, policy := range loggedInPolicies {
-				expectedPolicyNames = append(expectedPolicyNames, policy.Name)
+				httpError(t, w, "couldn't read response from role read")
 			}
-			var actualPolicyNames []string
-			for _, policy := range result.Policies {
-				actualPolicyNames = append(actualPolicyNames, policy.Policy)
+			permissionIDs := []string{}
+			for _, permission := range role.Permissions {
+				permissionIDs = append(permissionIDs, permission.Name)
 			}
-			assert.ElementsMatchf(t, expectedPolicyNames, actualPolicyNames, "Wanted policies: %v \t Got: %v", expectedPolicyNames, actualPolicyNames)
-			// expect to receive user's groups (in this case, 0 groups) as well
-			// as Anonymous and LoggedIn groups.
-			expectedGroups := []string{arborist.LoggedInGroup, arborist.AnonymousGroup}
-			assert.ElementsMatchf(t, expectedGroups, result.Groups, "Wanted groups: %v \t Got: %v", expectedGroups, result.Groups)
-		})
-
-		t.Run("Update", func(t *testing.T) {
-			originalUsername := "johnsmith"
-			originalUserEmail := "johnsmith@domain.tld"
-			createUserBytes(t, []byte(fmt.Sprintf(`{"name": "%s", "email": "%s"}`, originalUsername, originalUserEmail)))
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.ElementsMatch(t, []string{"foo", "baz", "quux"}, permissionIDs, msg)
 
-			t.Run("OnlyName", func(t *testing.T) {
-				newUsername := "jsmith"
-				updateUserBytes(
-					t,
-					originalUsername,
-					[]byte(fmt.Sprintf(`{"name": "%s"}`, newUsername)),
-					http.StatusNoContent,
-				)
-				assertUsernameAndEmail(t, newUsername, originalUserEmail)
+			t.Run("List", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/role/foo/permission", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't list role permissions")
+				}
+				result := struct {
+					Permissions []arborist.Permission `json:"permissions"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from role permissions list")
+				}
+				permissionIDs := []string{}
+				for _, permission := range result.Permissions {
+					permissionIDs = append(permissionIDs, permission.Name)
+				}
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.ElementsMatch(t, []string{"foo", "baz", "quux"}, permissionIDs, msg)
 			})
 
-			originalUsername = "jsmith"
-			t.Run("OnlyEmail", func(t *testing.T) {
-				newUserEmail := "jsmith@domain.tld"
-				updateUserBytes(
-					t,
-					originalUsername,
-					[]byte(fmt.Sprintf(`{"email": "%s"}`, newUserEmail)),
-					http.StatusNoContent,
-				)
-				assertUsernameAndEmail(t, originalUsername, newUserEmail)
+			t.Run("Conflict", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/role/foo/permission", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusConflict {
+					httpError(t, w, "expected 409 adding permission with existing ID")
+				}
 			})
 
-			t.Run("BothNameAndEmail", func(t *testing.T) {
-				newUsername := "janesmith"
-				newUserEmail := "janesmith@domain.tld"
-				updateUserBytes(
-					t,
-					originalUsername,
-					[]byte(fmt.Sprintf(`{"name": "%s", "email": "%s"}`, newUsername, newUserEmail)),
-					http.StatusNoContent,
-				)
-				assertUsernameAndEmail(t, newUsername, newUserEmail)
+			t.Run("Invalid", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{"id": "nope"}`)
+				req := newRequest("POST", "/role/foo/permission", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 adding permission without action")
+				}
+				assert.Equal(t, "input permission is missing required field `action.service`", errorMessage(t, w))
 			})
 
-			originalUsername = "janesmith"
-			t.Run("NeitherNameNorEmail", func(t *testing.T) {
-				updateUserBytes(
-					t,
-					originalUsername,
-					[]byte("{}"),
-					http.StatusBadRequest,
-				)
+			t.Run("RoleNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/role/does-not-exist/permission", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 adding permission to nonexistent role")
+				}
+				assert.Equal(t, "role_not_found", errorCode(t, w))
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/role/does-not-exist/permission", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 listing permissions of nonexistent role")
+				}
 			})
+		})
 
-			t.Run("InvalidName", func(t *testing.T) {
-				updateUserBytes(
+		t.Run("ConstraintKeys", func(t *testing.T) {
+			server.WithConstraintKeys("constrained", []string{"study", "project"})
+			defer server.WithConstraintKeys("constrained", nil)
+			roleBody := func(constraints string) []byte {
+				return []byte(fmt.Sprintf(
+					`{
+						"id": "constrained",
+						"permissions": [
+							{"id": "other", "action": {"service": "test", "method": "read"}, "constraints": {"anything": "x"}},
+							{"id": "read", "action": {"service": "constrained", "method": "read"}, "constraints": %s}
+						]
+					}`,
+					constraints,
+				))
+			}
+
+			t.Run("Rejected", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/role", bytes.NewBuffer(roleBody(`{"projct": "a", "study": "b"}`)))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 creating role with unknown constraint key")
+				}
+				assert.Equal(
 					t,
-					originalUsername,
-					[]byte(`{"name": 42}`),
-					http.StatusBadRequest,
+					"input role field `permissions[1].constraints` has constraints which service `constrained` doesn't use: `projct` (expected any of `project`, `study`)",
+					errorMessage(t, w),
 				)
-			})
 
-			t.Run("NonExistentUsername", func(t *testing.T) {
-				updateUserBytes(
+				w = httptest.NewRecorder()
+				body := []byte(`{"id": "constrained", "action": {"service": "constrained", "method": "read"}, "constraints": {"projct": "a"}}`)
+				req = newRequest("POST", "/role/foo/permission", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 adding permission with unknown constraint key")
+				}
+				assert.Equal(
 					t,
-					"nonexistentuser",
-					[]byte(`{"name": "existentuser"}`),
-					http.StatusNotFound,
+					"input permission field `constraints` has constraints which service `constrained` doesn't use: `projct` (expected any of `project`, `study`)",
+					errorMessage(t, w),
 				)
 			})
 
-			t.Run("ConflictingName", func(t *testing.T) {
-				otherUsername := "joesmith"
-				createUserBytes(t, []byte(fmt.Sprintf(`{"name": "%s"}`, otherUsername)))
-				updateUserBytes(
-					t,
-					originalUsername,
-					[]byte(fmt.Sprintf(`{"name": "%s"}`, otherUsername)),
-					http.StatusConflict,
-				)
+			t.Run("Accepted", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/role", bytes.NewBuffer(roleBody(`{"project": "a", "study": "b"}`)))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't create role with registered constraint keys")
+				}
+				w = httptest.NewRecorder()
+				req = newRequest("DELETE", "/role/constrained", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "couldn't delete role")
+				}
 			})
 		})
 
-		// do some preliminary setup so we have a policy to work with
-		createResourceBytes(t, resourceBody)
-		createRoleBytes(t, roleBody)
-		createPolicyBytes(t, policyBody)
-
-		t.Run("GrantPolicy", func(t *testing.T) {
+		t.Run("List", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/user/%s/policy", username)
-			req := newRequest(
-				"POST",
-				url,
-				bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
-			)
-			req.Header.Add("X-AuthZ-Provider", "xxx")
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't grant policy to user")
-			}
-			// look up user again and check that policy is there
-			w = httptest.NewRecorder()
-			url = fmt.Sprintf("/user/%s", username)
-			req = newRequest("GET", url, nil)
+			req := newRequest("GET", "/role", nil)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read user")
+				httpError(t, w, "can't list roles")
 			}
 			result := struct {
-				Name     string `json:"name"`
-				Email    string `json:"email"`
-				Policies []struct {
-					Policy    string  `json:"policy"`
-					ExpiresAt *string `json:"expires_at"`
-				} `json:"policies"`
-				Groups []string `json:"groups"`
+				Roles []interface{} `json:"roles"`
 			}{}
 			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from user read")
-			}
-			msg := fmt.Sprintf(
-				"didn't grant policy correctly; got response body: %s",
-				w.Body.String(),
-			)
-			// expect that policy with policyName is in response
-			var actualPolicy struct {
-				Policy    string  `json:"policy"`
-				ExpiresAt *string `json:"expires_at"`
-			}
-			for _, policy := range result.Policies {
-				if policy.Policy == policyName {
-					actualPolicy = policy
-				}
+				httpError(t, w, "couldn't read response from roles list")
 			}
-			assert.NotNil(t, actualPolicy, msg)
-			// expect the expiresAt field to be nil, because expiration was not set.
-			assert.Nil(t, actualPolicy.ExpiresAt, msg)
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, 2, len(result.Roles), msg)
 
-			t.Run("BulkGrantPolicy", func(t *testing.T) {
-				// create test policy
-				policyNameA := "pqrs"
-				createPolicyBytes(
-					t,
-					[]byte(fmt.Sprintf(
-						`{
-							"id": "%s",
-							"resource_paths": ["%s"],
-							"role_ids": ["%s"]
-						}`,
-						policyNameA,
-						resourcePath,
-						roleName,
-					)),
-				)
+			t.Run("Flat", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/user/%s/bulk/policy", username)
-				body := []byte(fmt.Sprintf(
-					`
-					[
-						{"policy": "%s"},
-						{"policy": "%s"}
-					]`,
-					policyName, policyNameA,
-				))
-				req := newRequest(
-					"POST",
-					url,
-					bytes.NewBuffer(body))
-				req.Header.Set("X-AuthZ-Provider", "xxx")
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNoContent {
-					httpError(t, w, "couldn't grant policies to user")
-				}
-				w = httptest.NewRecorder()
-				url = fmt.Sprintf("/user/%s", username)
-				req = newRequest("GET", url, nil)
+				req := newRequest("GET", "/role?format=flat", nil)
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
-					httpError(t, w, "couldn't read user")
-				}
-			})
-
-			t.Run("PolicyNotExist", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/user/%s/policy", username)
-				req := newRequest(
-					"POST",
-					url,
-					bytes.NewBuffer([]byte(`{"policy": "nonexistent"}`)),
-				)
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusBadRequest {
-					httpError(t, w, "didn't get 400 for nonexistent policy")
+					httpError(t, w, "can't list roles with format=flat")
 				}
-			})
-
-			t.Run("UserNotExist", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				url := "/user/nonexistent/policy"
-				req := newRequest(
-					"POST",
-					url,
-					bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
-				)
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNotFound {
-					httpError(t, w, "didn't get 404 for nonexistent user")
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from roles list")
 				}
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, 2, len(result.Roles), msg)
 			})
-		})
-
-		t.Run("ListResources", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/user/%s/resources", username)
-			req := newRequest("GET", url, nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't list user's authed resources")
-			}
-			result := struct {
-				Resources []string `json:"resources"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from user resources")
-			}
-			// expect to see resources from user's policies, as well as
-			// resources from Anonymous and LoggedIn policies.
-			expectedResources := append(anonymousResourcePaths, loggedInResourcePaths...)
-			expectedResources = append(expectedResources, resourcePath)
-			msg := fmt.Sprintf(
-				"didn't get expected resources; got response body: %s \t Wanted resources: %v",
-				w.Body.String(),
-				expectedResources,
-			)
-			assert.ElementsMatch(t, expectedResources, result.Resources, msg)
 
-			t.Run("UserNotFound", func(t *testing.T) {
+			t.Run("Tree", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				req := newRequest("GET", "/user/nonexistent/resources", nil)
+				req := newRequest("GET", "/role?format=tree", nil)
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNotFound {
-					httpError(t, w, "expected 404 trying to list resources for fake user")
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 listing roles with format=tree")
 				}
 			})
 
-			// TODO (rudyardrichter, 2019-05-09): also test response with tag
-		})
-
-		t.Run("RevokePolicy", func(t *testing.T) {
-			test := func(authzProvider string, httpStatusCode int, expected bool, msg string) {
+			listRoleIDs := func(t *testing.T, query string) ([]string, string) {
 				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/user/%s/policy/%s", username, policyName)
-				req := newRequest("DELETE", url, nil)
-				if authzProvider != "" {
-					req.Header.Add("X-AuthZ-Provider", authzProvider)
-				}
-				handler.ServeHTTP(w, req)
-				if w.Code != httpStatusCode {
-					httpError(t, w, fmt.Sprintf("revoke policy: expected status code `%d`, got status code `%d`", httpStatusCode, w.Code))
-				}
-				// look up user again and check if policy is still there
-				w = httptest.NewRecorder()
-				url = fmt.Sprintf("/user/%s", username)
-				req = newRequest("GET", url, nil)
+				req := newRequest("GET", "/role"+query, nil)
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
-					httpError(t, w, "couldn't read user")
+					httpError(t, w, "can't list roles with "+query)
 				}
 				result := struct {
-					Name     string `json:"name"`
-					Email    string `json:"email"`
-					Policies []struct {
-						Name      string `json:"policy"`
-						ExpiresAt string `json:"expires_at"`
-					} `json:"policies"`
-					Groups []string `json:"groups"`
+					Roles []arborist.Role `json:"roles"`
 				}{}
-				err = json.Unmarshal(w.Body.Bytes(), &result)
+				err := json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from user read")
-				}
-				found := false
-				for _, policy := range result.Policies {
-					if policy.Name == policyName {
-						found = true
-						break
-					}
+					httpError(t, w, "couldn't read response from roles list")
 				}
-				if found != expected {
-					assert.Fail(t, fmt.Sprintf(msg, w.Body.String()))
+				ids := []string{}
+				for _, role := range result.Roles {
+					ids = append(ids, role.Name)
 				}
+				return ids, w.Header().Get("X-Total-Count")
 			}
-			test("yyy", http.StatusUnauthorized, true, "shouldn't revoke policy; got response body: %s")
-			test("xxx", http.StatusNoContent, false, "didn't revoke policy correctly; got response body: %s")
 
-			// If no authz header is provided, the policy should still be revoked.
-			grantUserPolicy(t, username, policyName, "") // Granting policy again to revoke
-			test("", http.StatusNoContent, false, "didn't revoke policy correctly; got response body: %s")
-		})
+			t.Run("Sorted", func(t *testing.T) {
+				ids, total := listRoleIDs(t, "")
+				assert.Equal(t, "2", total, "wrong total count")
+				assert.True(t, sort.StringsAreSorted(ids), "roles not sorted by ID: %v", ids)
+				again, _ := listRoleIDs(t, "?sort=id")
+				assert.Equal(t, ids, again, "expected the same order every time")
+				byName, _ := listRoleIDs(t, "?sort=name")
+				assert.Equal(t, ids, byName)
+			})
 
-		timestamp := time.Now().Add(time.Hour).Format(time.RFC3339)
+			t.Run("Paged", func(t *testing.T) {
+				all, _ := listRoleIDs(t, "")
+				paged := []string{}
+				for offset := 0; offset <= len(all); offset++ {
+					page, total := listRoleIDs(t, fmt.Sprintf("?limit=1&offset=%d", offset))
+					assert.Equal(t, "2", total, "wrong total count")
+					assert.LessOrEqual(t, len(page), 1)
+					paged = append(paged, page...)
+				}
+				assert.Equal(t, all, paged, "expected each role exactly once")
+			})
 
-		t.Run("GrantPolicyWithExpiration", func(t *testing.T) {
+			t.Run("BadOptions", func(t *testing.T) {
+				for _, query := range []string{"?sort=description", "?limit=-1", "?offset=x"} {
+					w := httptest.NewRecorder()
+					req := newRequest("GET", "/role"+query, nil)
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusBadRequest {
+						httpError(t, w, "expected 400 listing roles with "+query)
+					}
+				}
+			})
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			var roleID int
+			err := db.Get(&roleID, "SELECT id FROM role WHERE name = 'foo'")
+			if err != nil {
+				t.Fatal(err)
+			}
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/user/%s/policy", username)
-			req := newRequest(
-				"POST",
-				url,
-				bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s", "expires_at": "%s"}`, policyName, timestamp))),
-			)
+			req := newRequest("DELETE", "/role/foo", nil)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't grant policy to user with expiration")
+				httpError(t, w, "couldn't delete role")
+			}
+			// permissions belong to a single role, so they go with it
+			var permissions int
+			err = db.Get(&permissions, "SELECT COUNT(*) FROM permission WHERE role_id = $1", roleID)
+			if err != nil {
+				t.Fatal(err)
 			}
+			assert.Equal(t, 0, permissions, "permissions of deleted role were left behind")
 		})
 
-		t.Run("CheckPolicyHasExpiration", func(t *testing.T) {
+		t.Run("CheckDeleted", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/user/%s", username)
-			req := newRequest("GET", url, nil)
+			req := newRequest("GET", "/role/foo", nil)
 			handler.ServeHTTP(w, req)
-			result := struct {
-				Policies []struct {
-					Policy    string  `json:"policy"`
-					ExpiresAt *string `json:"expires_at"`
-				} `json:"policies"`
-			}{}
-			err := json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from user info")
-			}
-			// Assert that the policy we added in GrantPolicyWithExpiration has expiration.
-			var addedPolicy struct {
-				Policy    string  `json:"policy"`
-				ExpiresAt *string `json:"expires_at"`
-			}
-			for _, policy := range result.Policies {
-				if policy.Policy == policyName {
-					addedPolicy = policy
-				}
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "role was not actually deleted")
 			}
-			assert.NotNilf(t, addedPolicy, "Expected to find policy %v in response: %v", addedPolicy, result.Policies)
-			assert.NotNil(t, addedPolicy.ExpiresAt, "missing `expires_at` in response")
-			expect, _ := time.Parse(time.RFC3339, timestamp)
-			got, _ := time.Parse(time.RFC3339, *addedPolicy.ExpiresAt)
-			assert.True(t, expect.Equal(got), "wrong value for `expires_at`")
 		})
 
-		t.Run("Delete", func(t *testing.T) {
+		tearDown(t)
+	})
+
+	t.Run("Service", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		createRoleBytes(t, []byte(`{
+			"id": "service-reader",
+			"permissions": [
+				{"id": "read", "action": {"service": "service-a", "method": "read"}},
+				{"id": "list", "action": {"service": "service-b", "method": "list"}}
+			]
+		}`))
+		createRoleBytes(t, []byte(`{
+			"id": "service-writer",
+			"permissions": [
+				{"id": "write", "action": {"service": "service-a", "method": "write"}}
+			]
+		}`))
+
+		t.Run("List", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := newRequest("DELETE", "/user/foo", nil)
+			req := newRequest("GET", "/service", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't delete user")
+			if w.Code != http.StatusOK {
+				httpError(t, w, "can't list services")
 			}
-
-			t.Run("NotExist", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				req := newRequest("DELETE", "/user/foo", nil)
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNoContent {
-					httpError(t, w, "expected 204 from trying to delete nonexistent user")
-				}
-			})
+			result := struct {
+				Services []string `json:"services"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from services list")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, []string{"service-a", "service-b"}, result.Services, msg)
 		})
 
-		t.Run("DeleteNotExist", func(t *testing.T) {
+		t.Run("Read", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/user/%s", username)
-			req := newRequest("DELETE", url, nil)
+			req := newRequest("GET", "/service/service-a", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "wrong response from deleting user that doesn't exist")
+			if w.Code != http.StatusOK {
+				httpError(t, w, "can't read service")
+			}
+			result := arborist.Service{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from service read")
+			}
+			expected := arborist.Service{
+				Name: "service-a",
+				Permissions: []arborist.ServicePermission{
+					{Role: "service-reader", ID: "read", Method: "read"},
+					{Role: "service-writer", ID: "write", Method: "write"},
+				},
 			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, expected, result, msg)
 		})
 
-		t.Run("CheckDeleted", func(t *testing.T) {
+		t.Run("NotExist", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := newRequest("GET", "/user/foo", nil)
+			req := newRequest("GET", "/service/service-z", nil)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusNotFound {
-				httpError(t, w, "user was not actually deleted")
+				httpError(t, w, "expected 404 reading service without permissions")
 			}
+			assert.Equal(t, "service_not_found", errorCode(t, w))
 		})
 
 		tearDown(t)
 	})
 
-	t.Run("Client", func(t *testing.T) {
+	t.Run("Permission", func(t *testing.T) {
 		tearDown := testSetup(t)
 
-		clientID := "foo"
+		createRoleBytes(t, []byte(`{
+			"id": "permission-reader",
+			"permissions": [
+				{"id": "read", "description": "read anything", "action": {"service": "service-a", "method": "read"}},
+				{"id": "list", "action": {"service": "service-b", "method": "list"}}
+			]
+		}`))
+		createRoleBytes(t, []byte(`{
+			"id": "permission-prod-reader",
+			"permissions": [
+				{"id": "read", "action": {"service": "service-a", "method": "read"}, "constraints": {"env": "prod"}}
+			]
+		}`))
 
-		t.Run("ListEmpty", func(t *testing.T) {
+		t.Run("List", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := newRequest("GET", "/client", nil)
+			req := newRequest("GET", "/permission", nil)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusOK {
-				httpError(t, w, "can't list clients")
+				httpError(t, w, "can't list permissions")
 			}
 			result := struct {
-				Clients interface{} `json:"clients"`
+				Permissions []string `json:"permissions"`
 			}{}
 			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from clients list")
+				httpError(t, w, "couldn't read response from permissions list")
 			}
 			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, []interface{}{}, result.Clients, msg)
+			assert.Equal(t, []string{"list", "read"}, result.Permissions, msg)
 		})
 
-		t.Run("NotFound", func(t *testing.T) {
+		t.Run("Read", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			req := newRequest("GET", "/client/nonexistent", nil)
+			req := newRequest("GET", "/permission/read", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNotFound {
-				httpError(t, w, "didn't get 404 for nonexistent client")
+			if w.Code != http.StatusOK {
+				httpError(t, w, "can't read permission")
+			}
+			result := arborist.PermissionRoles{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from permission read")
+			}
+			expected := arborist.PermissionRoles{
+				ID: "read",
+				Roles: []arborist.RolePermission{
+					{
+						Role:        "permission-prod-reader",
+						Action:      arborist.Action{Service: "service-a", Method: "read"},
+						Constraints: arborist.Constraints{"env": "prod"},
+					},
+					{
+						Role:        "permission-reader",
+						Description: "read anything",
+						Action:      arborist.Action{Service: "service-a", Method: "read"},
+						Constraints: arborist.Constraints{},
+					},
+				},
 			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, expected, result, msg)
 		})
 
-		// do some preliminary setup so we have a policy to work with
-		createResourceBytes(t, resourceBody)
-		createRoleBytes(t, roleBody)
-		createPolicyBytes(t, policyBody)
-
-		t.Run("Create", func(t *testing.T) {
+		t.Run("NotExist", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			body := []byte(fmt.Sprintf(
-				`{
-					"clientID": "%s",
-					"policies": ["%s"]
-				}`,
-				clientID, policyName,
-			))
-			req := newRequest("POST", "/client", bytes.NewBuffer(body))
-			req.Header.Add("X-AuthZ-Provider", "xxx")
+			req := newRequest("GET", "/permission/write", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create client")
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "expected 404 reading permission no role has")
+			}
+			assert.Equal(t, "permission_not_found", errorCode(t, w))
+		})
+
+		tearDown(t)
+	})
+
+	t.Run("Bundle", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		createResourceBytes(t, []byte(`{"path": "/bundle", "subresources": [{"name": "a"}]}`))
+		createRoleBytes(t, []byte(`{
+			"id": "bundle-reader",
+			"permissions": [
+				{"id": "read", "action": {"service": "bundle-service", "method": "read"}}
+			]
+		}`))
+		createPolicyBytes(t, []byte(`{
+			"id": "bundle-policy",
+			"resource_paths": ["/bundle/a"],
+			"role_ids": ["bundle-reader"]
+		}`))
+
+		w := httptest.NewRecorder()
+		req := newRequest("GET", "/bundle", nil)
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			httpError(t, w, "can't get bundle")
+		}
+		assert.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+		etag := w.Header().Get("ETag")
+		assert.NotEqual(t, "", etag)
+
+		zipped, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive := tar.NewReader(zipped)
+		var dataJSON []byte
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
 			}
-			result := struct {
-				I interface{} `json:"created"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from client creation")
+				t.Fatal(err)
+			}
+			if header.Name == "/data.json" {
+				dataJSON, err = ioutil.ReadAll(archive)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		data := struct {
+			Arborist struct {
+				Policies map[string]struct {
+					ResourcePaths []string `json:"resource_paths"`
+					RoleIDs       []string `json:"role_ids"`
+					Effect        string   `json:"effect"`
+				} `json:"policies"`
+				Roles map[string]struct {
+					Permissions []struct {
+						ID     string            `json:"id"`
+						Action map[string]string `json:"action"`
+					} `json:"permissions"`
+				} `json:"roles"`
+				Resources map[string]struct {
+					Subresources []string `json:"subresources"`
+				} `json:"resources"`
+			} `json:"arborist"`
+		}{}
+		err = json.Unmarshal(dataJSON, &data)
+		if err != nil {
+			t.Fatalf("couldn't read data.json from bundle: %s", err.Error())
+		}
+		policy, ok := data.Arborist.Policies["bundle-policy"]
+		if assert.True(t, ok, "policy missing from bundle") {
+			assert.Equal(t, []string{"/bundle/a"}, policy.ResourcePaths)
+			assert.Equal(t, []string{"bundle-reader"}, policy.RoleIDs)
+			assert.Equal(t, "allow", policy.Effect)
+		}
+		role, ok := data.Arborist.Roles["bundle-reader"]
+		if assert.True(t, ok, "role missing from bundle") && assert.Len(t, role.Permissions, 1) {
+			assert.Equal(t, "read", role.Permissions[0].ID)
+			assert.Equal(t, "bundle-service", role.Permissions[0].Action["service"])
+		}
+		resource, ok := data.Arborist.Resources["/bundle"]
+		if assert.True(t, ok, "resource missing from bundle") {
+			assert.Equal(t, []string{"/bundle/a"}, resource.Subresources)
+		}
+
+		t.Run("NotModified", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/bundle", nil)
+			req.Header.Set("If-None-Match", etag)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotModified {
+				httpError(t, w, "expected 304 for bundle with the same ETag")
 			}
+			assert.Equal(t, 0, w.Body.Len())
 		})
 
-		t.Run("Read", func(t *testing.T) {
+		t.Run("Modified", func(t *testing.T) {
+			createResourceBytes(t, []byte(`{"path": "/bundle/b"}`))
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/client/%s", clientID)
-			req := newRequest("GET", url, nil)
+			req := newRequest("GET", "/bundle", nil)
+			req.Header.Set("If-None-Match", etag)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read client")
-			}
-			result := struct {
-				ClientID string   `json:"clientID"`
-				Policies []string `json:"policies"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from client read")
+				httpError(t, w, "expected new bundle after the model changed")
 			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, clientID, result.ClientID, msg)
-			assert.Equal(t, []string{policyName}, result.Policies, msg)
+			assert.NotEqual(t, etag, w.Header().Get("ETag"))
 		})
 
-		t.Run("RevokePolicy", func(t *testing.T) {
-			test := func(authzProvider string, expected bool, msg string) {
+		tearDown(t)
+	})
+
+	t.Run("ETag", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		createResourceBytes(t, []byte(`{"path": "/etag"}`))
+		createRoleBytes(t, []byte(`{
+			"id": "etag-reader",
+			"permissions": [
+				{"id": "read", "action": {"service": "etag-service", "method": "read"}}
+			]
+		}`))
+		createPolicyBytes(t, []byte(`{
+			"id": "etag-policy",
+			"resource_paths": ["/etag"],
+			"role_ids": ["etag-reader"]
+		}`))
+
+		get := func(t *testing.T, url string, etag string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", url, nil)
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			handler.ServeHTTP(w, req)
+			return w
+		}
+		change := func(t *testing.T, method string, url string, body string) {
+			w := httptest.NewRecorder()
+			req := newRequest(method, url, bytes.NewBufferString(body))
+			handler.ServeHTTP(w, req)
+			if w.Code >= 300 {
+				httpError(t, w, "couldn't change "+url)
+			}
+		}
+
+		cases := []struct {
+			name   string
+			url    string
+			method string
+			change string
+		}{
+			{
+				name:   "Policy",
+				url:    "/policy/etag-policy",
+				method: "PUT",
+				change: `{"description": "changed", "resource_paths": ["/etag"], "role_ids": ["etag-reader"]}`,
+			},
+			{
+				name:   "Resource",
+				url:    "/resource/etag",
+				method: "PUT",
+				change: `{"path": "/etag", "description": "changed"}`,
+			},
+			{
+				name:   "Role",
+				url:    "/role/etag-reader",
+				method: "PATCH",
+				change: `{"id": "etag-reader", "permissions": [{"id": "write", "action": {"service": "etag-service", "method": "write"}}]}`,
+			},
+		}
+		for _, c := range cases {
+			c := c
+			t.Run(c.name, func(t *testing.T) {
+				w := get(t, c.url, "")
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read "+c.url)
+				}
+				etag := w.Header().Get("ETag")
+				assert.NotEmpty(t, etag)
+
+				w = get(t, c.url, etag)
+				assert.Equal(t, http.StatusNotModified, w.Code, "unchanged entity should be a 304")
+				assert.Empty(t, w.Body.String())
+
+				change(t, c.method, c.url, c.change)
+				w = get(t, c.url, etag)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "expected 200 after change")
+				}
+				assert.NotEqual(t, etag, w.Header().Get("ETag"), "ETag should change with the entity")
+			})
+		}
+
+		tearDown(t)
+	})
+
+	t.Run("SchemaVersion", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		createResourceBytes(t, []byte(`{"path": "/versioned"}`))
+		createRoleBytes(t, []byte(`{
+			"id": "versioned-reader",
+			"permissions": [
+				{"id": "read", "action": {"service": "versioned-service", "method": "read"}}
+			]
+		}`))
+		createPolicyBytes(t, []byte(`{
+			"id": "versioned-policy",
+			"resource_paths": ["/versioned"],
+			"role_ids": ["versioned-reader"]
+		}`))
+
+		cases := []struct {
+			name string
+			url  string
+			// put is where the entity read can be sent back unchanged
+			put string
+		}{
+			{name: "Policy", url: "/policy/versioned-policy", put: "/policy/versioned-policy"},
+			{name: "Resource", url: "/resource/versioned", put: "/resource"},
+			{name: "ResourceExpanded", url: "/resource/versioned?expand"},
+			{name: "Role", url: "/role/versioned-reader", put: "/role/versioned-reader"},
+		}
+		for _, c := range cases {
+			c := c
+			t.Run(c.name, func(t *testing.T) {
 				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/client/%s/policy/%s", clientID, policyName)
-				req := newRequest("DELETE", url, nil)
-				req.Header.Add("X-AuthZ-Provider", authzProvider)
+				req := newRequest("GET", c.url, nil)
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNoContent {
-					httpError(t, w, "couldn't revoke policy")
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read "+c.url)
 				}
-				// look up client again and check that policy is gone
+				result := struct {
+					SchemaVersion int `json:"schema_version"`
+				}{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from "+c.url)
+				}
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, arborist.OutputSchemaVersion, result.SchemaVersion, msg)
+
+				if c.put == "" {
+					return
+				}
+				body := w.Body.Bytes()
 				w = httptest.NewRecorder()
-				url = fmt.Sprintf("/client/%s", clientID)
-				req = newRequest("GET", url, nil)
+				req = newRequest("PUT", c.put, bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
+				if w.Code >= 300 {
+					httpError(t, w, "couldn't send back what was read from "+c.url)
+				}
+			})
+		}
+
+		tearDown(t)
+	})
+
+	t.Run("PolicyTest", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		createResourceBytes(t, []byte(`{"path": "/tested", "subresources": [{"name": "child"}]}`))
+		createResourceBytes(t, []byte(`{"path": "/untested"}`))
+		createRoleBytes(t, []byte(`{
+			"id": "tested-reader",
+			"permissions": [
+				{"id": "read", "action": {"service": "tested-service", "method": "read"}}
+			]
+		}`))
+		createPolicyBytes(t, []byte(`{
+			"id": "tested-allow",
+			"resource_paths": ["/tested"],
+			"role_ids": ["tested-reader"]
+		}`))
+		createPolicyBytes(t, []byte(`{
+			"id": "tested-deny",
+			"effect": "deny",
+			"resource_paths": ["/tested"],
+			"role_ids": ["tested-reader"]
+		}`))
+
+		testPolicy := func(t *testing.T, policy string, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req := newRequest("POST", "/policy/"+policy+"/test", bytes.NewBufferString(body))
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		var childTag string
+		err := db.Get(&childTag, "SELECT tag FROM resource WHERE path = 'tested.child'")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cases := []struct {
+			name     string
+			policy   string
+			resource string
+			method   string
+			auth     bool
+		}{
+			{"Matching", "tested-allow", "/tested", "read", true},
+			{"Subresource", "tested-allow", "/tested/child", "read", true},
+			{"Tag", "tested-allow", childTag, "read", true},
+			{"OtherMethod", "tested-allow", "/tested", "write", false},
+			{"OtherResource", "tested-allow", "/untested", "read", false},
+			{"Deny", "tested-deny", "/tested", "read", false},
+		}
+		for _, c := range cases {
+			c := c
+			t.Run(c.name, func(t *testing.T) {
+				body := fmt.Sprintf(
+					`{"resource": "%s", "service": "tested-service", "method": "%s"}`,
+					c.resource,
+					c.method,
+				)
+				w := testPolicy(t, c.policy, body)
 				if w.Code != http.StatusOK {
-					httpError(t, w, "couldn't read client")
+					httpError(t, w, "couldn't test policy")
 				}
 				result := struct {
-					ClientID string   `json:"clientID"`
-					Policies []string `json:"policies"`
+					Auth   bool   `json:"auth"`
+					RoleID string `json:"role_id"`
 				}{}
-				err = json.Unmarshal(w.Body.Bytes(), &result)
+				err := json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from client read")
+					httpError(t, w, "couldn't read response from policy test")
 				}
-				msg = fmt.Sprintf(msg, w.Body.String())
-				if expected {
-					assert.Contains(t, result.Policies, policyName, msg)
-				} else {
-					assert.NotContains(t, result.Policies, policyName, msg)
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, c.auth, result.Auth, msg)
+				if c.auth {
+					assert.Equal(t, "tested-reader", result.RoleID, msg)
 				}
-			}
-			test("yyy", true, "shouldn't revoke policy; got response body: %s")
-			test("xxx", false, "didn't revoke policy correctly; got response body: %s")
-		})
+			})
+		}
 
-		t.Run("GrantPolicy", func(t *testing.T) {
+		t.Run("NotGranted", func(t *testing.T) {
+			// the policy isn't granted to anyone, so no one is authorized by it
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/client/%s/policy", clientID)
-			req := newRequest(
-				"POST",
-				url,
-				bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
-			)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't grant policy to client")
-			}
-			// look up client again and check that policy is there
-			w = httptest.NewRecorder()
-			url = fmt.Sprintf("/client/%s", clientID)
-			req = newRequest("GET", url, nil)
+			body := []byte(`{
+				"request": {
+					"resource": "/tested",
+					"action": {"service": "tested-service", "method": "read"}
+				}
+			}`)
+			req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read client")
+				httpError(t, w, "auth request failed")
 			}
 			result := struct {
-				ClientID string   `json:"clientID"`
-				Policies []string `json:"policies"`
+				Auth bool `json:"auth"`
 			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
+			err := json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from client read")
+				httpError(t, w, "couldn't read response from auth request")
 			}
-			msg := fmt.Sprintf(
-				"didn't grant policy correctly; got response body: %s",
-				w.Body.String(),
-			)
-			assert.Equal(t, []string{policyName}, result.Policies, msg)
-
-			t.Run("PolicyNotExist", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/client/%s/policy", clientID)
-				req := newRequest(
-					"POST",
-					url,
-					bytes.NewBuffer([]byte(`{"policy": "nonexistent"}`)),
-				)
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNotFound {
-					httpError(t, w, "didn't get 404 for nonexistent policy")
-				}
-			})
+			assert.False(t, result.Auth)
+		})
 
-			t.Run("ClientNotExist", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				url := "/client/nonexistent/policy"
-				req := newRequest(
-					"POST",
-					url,
-					bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
-				)
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNotFound {
-					httpError(t, w, "didn't get 404 for nonexistent client")
-				}
-			})
+		t.Run("PolicyNotExist", func(t *testing.T) {
+			w := testPolicy(t, "does-not-exist", `{"resource": "/tested", "service": "tested-service", "method": "read"}`)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "expected 404 testing nonexistent policy")
+			}
+			assert.Equal(t, "policy_not_found", errorCode(t, w))
 		})
 
-		t.Run("Delete", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("DELETE", "/client/foo", nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't delete client")
+		t.Run("MissingField", func(t *testing.T) {
+			w := testPolicy(t, "tested-allow", `{"resource": "/tested", "service": "tested-service"}`)
+			if w.Code != http.StatusBadRequest {
+				httpError(t, w, "expected 400 testing policy without method")
 			}
 		})
 
-		t.Run("DeleteNotExist", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/client/%s", clientID)
-			req := newRequest("DELETE", url, nil)
+		t.Run("AdminPolicy", func(t *testing.T) {
+			adminUsername := "policy-tester"
+			createUserBytes(t, []byte(fmt.Sprintf(`{"name": "%s"}`, adminUsername)))
+			grantUserPolicy(t, adminUsername, "tested-allow", "null")
+			server.WithAdminPolicy("tested-allow")
+			defer server.WithAdminPolicy("")
+			body := `{"resource": "/tested", "service": "tested-service", "method": "read"}`
+
+			w := testPolicy(t, "tested-allow", body)
+			if w.Code != http.StatusUnauthorized {
+				httpError(t, w, "expected 401 testing policy without token")
+			}
+
+			w = httptest.NewRecorder()
+			req := newRequest("POST", "/policy/tested-allow/test", bytes.NewBufferString(body))
+			token := TestJWT{username: adminUsername}
+			req.Header.Add("Authorization", "Bearer "+token.Encode())
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "wrong response from deleting client that doesn't exist")
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't test policy as admin")
 			}
-		})
 
-		t.Run("CheckDeleted", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", "/client/foo", nil)
+			w = httptest.NewRecorder()
+			req = newRequest("POST", "/policy/tested-allow/test", bytes.NewBufferString(body))
+			token = TestJWT{username: "not-an-admin"}
+			req.Header.Add("Authorization", "Bearer "+token.Encode())
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNotFound {
-				httpError(t, w, "client was not actually deleted")
+			if w.Code != http.StatusForbidden {
+				httpError(t, w, "expected 403 testing policy without admin policy")
 			}
 		})
 
 		tearDown(t)
 	})
 
-	t.Run("Group", func(t *testing.T) {
+	t.Run("Policy", func(t *testing.T) {
 		tearDown := testSetup(t)
 
-		t.Run("NotFound", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", "/group/nonexistent", nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNotFound {
-				httpError(t, w, "didn't get 404 for nonexistent group")
-			}
-		})
-
-		testGroupName := "test-group"
-		testGroupUser1 := "test-group-user-1"
-		testGroupUser2 := "test-group-user-2"
-		testGroupUser3 := "test-group-user-3"
-		testGroupUsers := []string{
-			testGroupUser1,
-			testGroupUser2,
-			testGroupUser3,
-		}
+		roleName := "bazgo-create"
+		policyName := "bazgo-create-b"
+		policyNameA := "bazgoA-create-b"
 
 		t.Run("Create", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			body := []byte(fmt.Sprintf(`{"name": "%s"}`, testGroupName))
-			req := newRequest("POST", "/group", bytes.NewBuffer(body))
+			// set up some resources to work with
+			// TODO: make more of this setup into "fixtures", not hard-coded
+			body := []byte(`{"path": "/a"}`)
+			req := newRequest("POST", "/resource", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create group")
+				httpError(t, w, "couldn't create resource")
 			}
-			result := struct {
-				I interface{} `json:"created"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from group creation")
+			w = httptest.NewRecorder()
+			body = []byte(`{"path": "/a/b"}`)
+			req = newRequest("POST", "/resource", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create resource")
 			}
-
-			t.Run("MissingName", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				body := []byte(fmt.Sprintf(`{"users": ["%s"]}`, testGroupUser1))
-				req := newRequest("POST", "/group", bytes.NewBuffer(body))
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusBadRequest {
-					httpError(t, w, "expected 400 from creating group without name")
-				}
-			})
-
-			t.Run("AlreadyExists", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				body := []byte(fmt.Sprintf(`{"name": "%s"}`, testGroupName))
-				req := newRequest("POST", "/group", bytes.NewBuffer(body))
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusConflict {
-					httpError(t, w, "creating group that already exists didn't error as expected")
-				}
-			})
-		})
-
-		t.Run("List", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", "/group", nil)
+			w = httptest.NewRecorder()
+			body = []byte(`{"path": "/a/b/c"}`)
+			req = newRequest("POST", "/resource", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "can't list groups")
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create resource")
+			}
+			// set up roles
+			w = httptest.NewRecorder()
+			body = []byte(fmt.Sprintf(
+				`{
+					"id": "%s",
+					"permissions": [
+						{
+							"id": "foo",
+							"action": {"service": "bazgo", "method": "create"}
+						}
+					]
+				}`,
+				roleName,
+			))
+			req = newRequest("POST", "/role", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create role")
+			}
+			// create policies
+			w = httptest.NewRecorder()
+			body = []byte(fmt.Sprintf(
+				`{
+					"id": "%s",
+					"resource_paths": ["/a/b"],
+					"role_ids": ["%s"]
+				}`,
+				policyName,
+				roleName,
+			))
+			req = newRequest("POST", "/policy", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create policy")
 			}
+			assert.Equal(t, "/policy/"+policyName, w.Header().Get("Location"), "expected Location of the new policy")
 			result := struct {
-				Groups []struct {
-					Name string `json:"name"`
-				} `json:"groups"`
+				I interface{} `json:"created"`
 			}{}
 			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from groups list")
-			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			// check test group is in the results
-			groupNames := []string{}
-			for _, group := range result.Groups {
-				groupNames = append(groupNames, group.Name)
+				httpError(t, w, "couldn't read response from resource creation")
 			}
-			assert.Contains(t, groupNames, testGroupName, msg)
-		})
-
-		t.Run("Read", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", fmt.Sprintf("/group/%s", testGroupName), nil)
+			w = httptest.NewRecorder()
+			body = []byte(fmt.Sprintf(
+				`{
+					"id": "%s",
+					"resource_paths": ["/a/b"],
+					"role_ids": ["%s"]
+				}`,
+				policyNameA,
+				roleName,
+			))
+			req = newRequest("POST", "/policy", bytes.NewBuffer(body))
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read group")
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create policy")
 			}
-			result := struct {
-				Name     string   `json:"name"`
-				Users    []string `json:"users"`
-				Policies []string `json:"policies"`
-			}{}
 			err = json.Unmarshal(w.Body.Bytes(), &result)
 			if err != nil {
-				httpError(t, w, "couldn't read response from group read")
+				httpError(t, w, "couldn't read response from resource creation")
 			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, testGroupName, result.Name, msg)
-			assert.Equal(t, []string{}, result.Users, msg)
-			assert.Equal(t, []string{}, result.Policies, msg)
-		})
 
-		t.Run("AddUsers", func(t *testing.T) {
-			for _, testUsername := range testGroupUsers {
-				createUserBytes(t, []byte(fmt.Sprintf(`{"name": "%s"}`, testUsername)))
+			t.Run("AlreadyExists", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				groupUserURL := fmt.Sprintf("/group/%s/user", testGroupName)
-				body := []byte(fmt.Sprintf(`{"username": "%s"}`, testUsername))
-				req := newRequest("POST", groupUserURL, bytes.NewBuffer(body))
-				req.Header.Add("X-AuthZ-Provider", "xxx")
+				body := []byte(fmt.Sprintf(
+					`{
+						"id": "%s",
+						"resource_paths": ["/a/b"],
+						"role_ids": ["%s"]
+					}`,
+					policyName,
+					roleName,
+				))
+				req := newRequest("POST", "/policy", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNoContent {
-					httpError(t, w, "couldn't add user to group")
+				if w.Code != http.StatusConflict {
+					httpError(t, w, "expected error from creating policy that already exists")
 				}
-			}
+				assert.Equal(t, "policy_exists", errorCode(t, w))
+			})
 
-			t.Run("UserNotExist", func(t *testing.T) {
+			t.Run("MissingRoleIDs", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				groupUserURL := fmt.Sprintf("/group/%s/user", testGroupName)
-				body := []byte(`{"username": "does-not-exist"}`)
-				req := newRequest("POST", groupUserURL, bytes.NewBuffer(body))
+				body := []byte(`{"id": "testPolicyNoRoles", "resource_paths": ["/a/b"]}`)
+				req := newRequest("POST", "/policy", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusBadRequest {
-					httpError(t, w, "expected 400 from trying to add nonexistent user to group")
+					httpError(t, w, "expected error creating policy without role_ids")
 				}
+				assert.Contains(t, errorMessage(t, w), "missing the following required fields: `role_ids`")
 			})
 
-			t.Run("GroupNotExist", func(t *testing.T) {
+			t.Run("WrongType", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				groupUserURL := "/group/does-not-exist/user"
-				body := []byte(fmt.Sprintf(`{"username": "%s"}`, testGroupUser1))
-				req := newRequest("POST", groupUserURL, bytes.NewBuffer(body))
+				body := []byte(`{"id": "testPolicyWrongType", "resource_paths": ["/a/b", 1], "role_ids": []}`)
+				req := newRequest("POST", "/policy", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNotFound {
-					httpError(t, w, "expected 404 from trying to add user to nonexistent group")
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected error creating policy with non-string resource path")
 				}
+				assert.Contains(t, errorMessage(t, w), "field `resource_paths[1]` must be a string, not a number")
 			})
-		})
-
-		t.Run("CheckUsersAdded", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			req := newRequest("GET", fmt.Sprintf("/group/%s", testGroupName), nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read group")
-			}
-			result := struct {
-				Name     string   `json:"name"`
-				Users    []string `json:"users"`
-				Policies []string `json:"policies"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from group read")
-			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			resultUsers := make([]string, len(result.Users))
-			copy(resultUsers, result.Users)
-			sort.Strings(resultUsers)
-			expectUsers := make([]string, len(testGroupUsers))
-			copy(expectUsers, testGroupUsers)
-			sort.Strings(expectUsers)
-			assert.Equal(t, expectUsers, resultUsers, msg)
-		})
 
-		t.Run("CreateWithUsers", func(t *testing.T) {
-			groupName := "test-group-with-users"
+			t.Run("Webhook", func(t *testing.T) {
+				events := make(chan arborist.WebhookEvent, 1)
+				receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					event := arborist.WebhookEvent{}
+					err := json.NewDecoder(r.Body).Decode(&event)
+					if err != nil {
+						t.Error(err)
+					}
+					events <- event
+				}))
+				defer receiver.Close()
+				hooked, err := arborist.
+					NewServer().
+					WithLogger(logger).
+					WithJWTApp(jwtApp).
+					WithDB(db).
+					WithWebhook(receiver.URL).
+					Init()
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(
+					`{"id": "testPolicyWebhook", "resource_paths": ["/a/b"], "role_ids": ["%s"]}`,
+					roleName,
+				))
+				req := newRequest("POST", "/policy", bytes.NewBuffer(body))
+				hooked.MakeRouter(logDest).ServeHTTP(w, req)
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't create policy")
+				}
+				select {
+				case event := <-events:
+					assert.Equal(t, "policy", event.Type)
+					assert.Equal(t, "create", event.Action)
+					assert.Equal(t, "testPolicyWebhook", event.ID)
+					assert.False(t, event.Timestamp.IsZero())
+				case <-time.After(5 * time.Second):
+					t.Error("no webhook event for policy create")
+				}
+			})
 
-			// create a group with some users in it
-			w := httptest.NewRecorder()
-			body := []byte(fmt.Sprintf(
-				`{"name": "%s", "users": ["%s", "%s"]}`,
-				groupName,
-				testGroupUser1,
-				testGroupUser2,
-			))
-			req := newRequest("POST", "/group", bytes.NewBuffer(body))
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusCreated {
-				httpError(t, w, "couldn't create group")
-			}
-			result := struct {
-				Created struct {
-					Users []string `json:"users"`
-				} `json:"created"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from group creation")
-			}
-			sort.Strings(result.Created.Users)
-			expectUsers := []string{testGroupUser1, testGroupUser2}
-			sort.Strings(expectUsers)
-			msg := fmt.Sprintf("didn't get expected users; got response body: %s", w.Body.String())
-			assert.Equal(t, expectUsers, result.Created.Users, msg)
+			t.Run("YAML", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(
+					"id: testPolicyYAML\nresource_paths:\n  - /a/b\nrole_ids:\n  - %s\n",
+					roleName,
+				))
+				req := newRequest("POST", "/policy", bytes.NewBuffer(body))
+				req.Header.Set("Content-Type", "application/yaml")
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't create policy from YAML")
+				}
 
-			// check that users were added correctly using read request
-			w = httptest.NewRecorder()
-			req = newRequest("GET", fmt.Sprintf("/group/%s", groupName), nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read group")
-			}
-			resultRead := struct {
-				Users []string `json:"users"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &resultRead)
-			if err != nil {
-				httpError(t, w, "couldn't read response from group read")
-			}
-			sort.Strings(resultRead.Users)
-			msg = fmt.Sprintf("group doesn't have users; got response body: %s", w.Body.String())
-			assert.Equal(t, expectUsers, resultRead.Users, msg)
-		})
+				// should be stored the same as the policy created from JSON
+				getPolicy := func(t *testing.T, name string) arborist.Policy {
+					w := httptest.NewRecorder()
+					req := newRequest("GET", "/policy/"+name, nil)
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "couldn't read policy")
+					}
+					policy := arborist.Policy{}
+					err := json.Unmarshal(w.Body.Bytes(), &policy)
+					if err != nil {
+						httpError(t, w, "couldn't read response from policy read")
+					}
+					return policy
+				}
+				fromYAML := getPolicy(t, "testPolicyYAML")
+				fromJSON := getPolicy(t, policyName)
+				fromJSON.Name = fromYAML.Name
+				assert.Equal(t, fromJSON, fromYAML, "YAML and JSON policies should match")
 
-		userToRemove := testGroupUser1
+				t.Run("Read", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					req := newRequest("GET", "/policy/testPolicyYAML", nil)
+					req.Header.Set("Accept", "application/yaml")
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "couldn't read policy as YAML")
+					}
+					assert.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+					assert.Contains(t, w.Body.String(), "id: testPolicyYAML\n")
+					assert.Contains(t, w.Body.String(), "resource_paths:\n  - /a/b\n")
+				})
+
+				t.Run("Invalid", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte("id: [testPolicyYAML")
+					req := newRequest("POST", "/policy", bytes.NewBuffer(body))
+					req.Header.Set("Content-Type", "application/yaml")
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusBadRequest {
+						httpError(t, w, "expected 400 for invalid YAML")
+					}
+					assert.Contains(t, errorMessage(t, w), "could not parse valid YAML")
+				})
+			})
+
+			t.Run("IdempotencyKey", func(t *testing.T) {
+				body := []byte(fmt.Sprintf(
+					`{"id": "testPolicyIdempotent", "resource_paths": ["/a/b"], "role_ids": ["%s"]}`,
+					roleName,
+				))
+				create := func() *httptest.ResponseRecorder {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/policy", bytes.NewBuffer(body))
+					req.Header.Set("Idempotency-Key", "create-testPolicyIdempotent")
+					handler.ServeHTTP(w, req)
+					return w
+				}
+				first := create()
+				if first.Code != http.StatusCreated {
+					httpError(t, first, "couldn't create policy")
+				}
+				second := create()
+				assert.Equal(t, http.StatusCreated, second.Code, "retry should get the original response, not a 409")
+				assert.Equal(t, first.Body.String(), second.Body.String())
+				assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+				var count int
+				err := db.Get(&count, "SELECT COUNT(*) FROM policy WHERE name = 'testPolicyIdempotent'")
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.Equal(t, 1, count, "policy should only be created once")
+			})
+
+			t.Run("DryRun", func(t *testing.T) {
+				countPolicies := func(t *testing.T) int {
+					var count int
+					err := db.Get(&count, "SELECT COUNT(*) FROM policy")
+					if err != nil {
+						t.Fatal(err)
+					}
+					return count
+				}
+				before := countPolicies(t)
 
-		t.Run("RemoveUser", func(t *testing.T) {
-			test := func(authzProvider string, expected bool, msg string) {
 				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/group/%s/user/%s", testGroupName, userToRemove)
-				req := newRequest("DELETE", url, nil)
-				req.Header.Add("X-AuthZ-Provider", authzProvider)
+				body := []byte(fmt.Sprintf(
+					`{
+						"id": "testPolicyDryRun",
+						"resource_paths": ["/a/b"],
+						"role_ids": ["%s"]
+					}`,
+					roleName,
+				))
+				req := newRequest("POST", "/policy?dry_run=true", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNoContent {
-					httpError(t, w, "couldn't remove user from group")
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't dry-run policy creation")
 				}
-				// look up group again and check that user is gone
-				url = fmt.Sprintf("/group/%s", testGroupName)
+				assert.Equal(t, before, countPolicies(t), "dry run should not create a policy")
 				w = httptest.NewRecorder()
-				req = newRequest("GET", url, nil)
+				req = newRequest("GET", "/policy/testPolicyDryRun", nil)
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusOK {
-					httpError(t, w, "couldn't read group")
-				}
-				result := struct {
-					Name     string   `json:"name"`
-					Users    []string `json:"users"`
-					Policies []string `json:"policies"`
-				}{}
-				err = json.Unmarshal(w.Body.Bytes(), &result)
-				if err != nil {
-					httpError(t, w, "couldn't read response from group read")
-				}
-				msg = fmt.Sprintf(msg, w.Body.String())
-				if expected {
-					assert.Contains(t, result.Users, userToRemove, msg)
-				} else {
-					assert.NotContains(t, result.Users, userToRemove, msg)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "dry run created a policy")
 				}
-			}
-			test("yyy", true, "shouldn't remove user; got response body: %s")
-			test("xxx", false, "didn't remove user; got response body: %s")
-		})
 
-		// do some preliminary setup so we have a policy to work with
-		createResourceBytes(t, resourceBody)
-		createRoleBytes(t, roleBody)
-		createPolicyBytes(t, policyBody)
+				t.Run("Invalid", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(`{
+						"id": "testPolicyDryRun",
+						"resource_paths": ["/a/b"],
+						"role_ids": ["does_not_exist"]
+					}`)
+					req := newRequest("POST", "/policy?dry_run=true", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusBadRequest {
+						httpError(t, w, "expected error from dry run with nonexistent role")
+					}
+				})
 
-		t.Run("GrantPolicy", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/group/%s/policy", testGroupName)
-			req := newRequest(
-				"POST",
-				url,
-				bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
-			)
-			req.Header.Add("X-AuthZ-Provider", "xxx")
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't grant policy to group")
-			}
-			// look up group again and check that policy is there
-			w = httptest.NewRecorder()
-			url = fmt.Sprintf("/group/%s", testGroupName)
-			req = newRequest("GET", url, nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read group")
-			}
-			result := struct {
-				Name     string   `json:"name"`
-				Users    []string `json:"users"`
-				Policies []string `json:"policies"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from group read")
-			}
-			msg := fmt.Sprintf(
-				"didn't grant policy correctly; got response body: %s",
-				w.Body.String(),
-			)
-			assert.Equal(t, []string{policyName}, result.Policies, msg)
+				t.Run("Many", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(fmt.Sprintf(
+						`[
+							{"id": "dry-run-1", "resource_paths": ["/a/b"], "role_ids": ["%s"]},
+							{"id": "dry-run-2", "resource_paths": ["/a/b/c"], "role_ids": ["%s"]}
+						]`,
+						roleName,
+						roleName,
+					))
+					req := newRequest("POST", "/policy?dry_run=true", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "couldn't dry-run creating many policies")
+					}
+					assert.Equal(t, before, countPolicies(t), "dry run should not create policies")
+				})
 
-			t.Run("PolicyNotExist", func(t *testing.T) {
+				t.Run("BadFlag", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/policy?dry_run=maybe", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusBadRequest {
+						httpError(t, w, "expected error from invalid dry_run value")
+					}
+				})
+			})
+
+			t.Run("RoleNotExist", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/group/%s/policy", testGroupName)
-				req := newRequest(
-					"POST",
-					url,
-					bytes.NewBuffer([]byte(`{"policy": "nonexistent"}`)),
-				)
+				createResourceBytes(t, []byte(`{"path": "/test_resource"}`))
+				body := []byte(`{
+					"id": "testPolicyRoleNotExist",
+					"resource_paths": ["/test_resource"],
+					"role_ids": ["does_not_exist"]
+				}`)
+				req = newRequest("POST", "/policy", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusBadRequest {
-					httpError(t, w, "didn't get 400 for nonexistent policy")
+					httpError(t, w, "expected error creating policy with nonexistent role")
 				}
-			})
-
-			t.Run("GroupNotExist", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				url := "/group/nonexistent/policy"
-				req := newRequest(
-					"POST",
-					url,
-					bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
-				)
+				assert.Contains(t, errorMessage(t, w), "does_not_exist", "expected error to name the missing role")
+				// the policy row inserted before the role lookup failed must
+				// have been rolled back
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/policy/testPolicyRoleNotExist", nil)
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusNotFound {
-					httpError(t, w, "didn't get 404 for nonexistent group")
+					httpError(t, w, "policy with nonexistent role was partially created")
 				}
 			})
 
-			t.Run("InvalidJSON", func(t *testing.T) {
-			})
-		})
-		userToAttemptRevoke := testGroupUser2
-		t.Run("RevokePolicyThroughUser", func(t *testing.T) {
-			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/user/%s/policy/%s", userToAttemptRevoke, policyName)
-			req := newRequest("DELETE", url, nil)
-			req.Header.Add("X-AuthZ-Provider", "xxx")
-			handler.ServeHTTP(w, req)
-			assert.Equal(t, w.Code, http.StatusBadRequest, " Group policy must not be revoked directly through user")
-			w = httptest.NewRecorder()
-			url = fmt.Sprintf("/user/%s", userToAttemptRevoke)
-			req = newRequest("GET", url, nil)
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "couldn't read user policies")
-			}
-			result := struct {
-				Name     string `json:"name"`
-				Email    string `json:"email"`
-				Policies []struct {
-					Name string `json:"policy"`
-				} `json:"policies"`
-				Groups []string `json:"groups"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from user read")
-			}
-			found := false
-			for _, policy := range result.Policies {
-				if policy.Name == policyName {
-					found = true
-					break
+			t.Run("ResourceNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(
+					`{
+						"id": "testPolicyResourceNotExist",
+						"resource_paths": ["/does/not/exist"],
+						"role_ids": ["%s"]
+					}`,
+					roleName,
+				))
+				req = newRequest("POST", "/policy", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected error creating policy with nonexistent resource")
 				}
-			}
-			assert.True(t, found, fmt.Sprintf("shouldn't revoke group policy through user; got response body: %s", result))
-		})
+				assert.Contains(t, errorMessage(t, w), "/does/not/exist", "expected error to name the missing resource")
+			})
 
-		t.Run("RevokePolicy", func(t *testing.T) {
-			test := func(authzProvider string, expected bool, msg string) {
+			t.Run("Many", func(t *testing.T) {
 				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/group/%s/policy/%s", testGroupName, policyName)
-				req := newRequest("DELETE", url, nil)
-				req.Header.Add("X-AuthZ-Provider", authzProvider)
+				body := []byte(fmt.Sprintf(
+					`[
+						{
+							"id": "bulk-create-1",
+							"resource_paths": ["/a/b"],
+							"role_ids": ["%s"]
+						},
+						{
+							"id": "bulk-create-2",
+							"resource_paths": ["/a/b/c"],
+							"role_ids": ["%s"]
+						}
+					]`,
+					roleName, roleName,
+				))
+				req := newRequest("POST", "/policy", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusNoContent {
-					httpError(t, w, "couldn't revoke policy from group")
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't create policies")
 				}
-				w = httptest.NewRecorder()
-				url = fmt.Sprintf("/group/%s", testGroupName)
-				req = newRequest("GET", url, nil)
+				result := struct {
+					Created []arborist.Policy `json:"created"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from policies creation")
+				}
+				assert.Equal(t, 2, len(result.Created), w.Body.String())
+
+				for _, name := range []string{"bulk-create-1", "bulk-create-2"} {
+					w = httptest.NewRecorder()
+					req = newRequest("DELETE", "/policy/"+name, nil)
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusNoContent {
+						httpError(t, w, "couldn't delete policy")
+					}
+				}
+
+				t.Run("RollbackOnInvalid", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(fmt.Sprintf(
+						`[
+							{
+								"id": "bulk-create-ok",
+								"resource_paths": ["/a/b"],
+								"role_ids": ["%s"]
+							},
+							{
+								"id": "bulk-create-bad",
+								"resource_paths": ["/does/not/exist"],
+								"role_ids": ["%s"]
+							}
+						]`,
+						roleName, roleName,
+					))
+					req := newRequest("POST", "/policy", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusBadRequest {
+						httpError(t, w, "expected error creating policies with nonexistent resource")
+					}
+					assert.Contains(t, w.Body.String(), "index 1", "error should name the offending element")
+
+					w = httptest.NewRecorder()
+					req = newRequest("GET", "/policy/bulk-create-ok", nil)
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusNotFound {
+						httpError(t, w, "valid policy in failed batch should not have been created")
+					}
+				})
+			})
+
+			t.Run("BulkPolicyOverwrite", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(
+					`[
+						{
+							"id": "%s",
+							"resource_paths": ["/a/b"],
+							"role_ids": ["%s"]
+						},
+						{
+							"id": "%s",
+							"resource_paths": ["/a/b"],
+							"role_ids": ["%s"]
+						}
+					]`,
+					policyName, roleName, policyNameA, roleName,
+				))
+				req = newRequest("PUT", "/bulk/policy", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "couldn't put policies")
+				}
+				result := struct {
+					Policies struct {
+						Policy []string `json:"policy"`
+					}
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from resource creation")
+				}
+			})
+		})
+
+		t.Run("Read", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/policy/%s", policyName)
+			req := newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "policy not found")
+			}
+			result := struct {
+				Name      string   `json:"id"`
+				Resources []string `json:"resource_paths"`
+				Roles     []string `json:"role_ids"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from GET policy")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, policyName, result.Name, msg)
+			assert.Equal(t, []string{"/a/b"}, result.Resources, msg)
+			assert.Equal(t, []string{roleName}, result.Roles, msg)
+		})
+
+		t.Run("Overwrite", func(t *testing.T) {
+			createResourceBytes(t, []byte(`{"path": "/a/z"}`))
+			w := httptest.NewRecorder()
+			body := []byte(fmt.Sprintf(
+				`{
+					"id": "%s",
+					"resource_paths": ["/a/z"],
+					"role_ids": ["%s"]
+				}`,
+				policyName,
+				roleName,
+			))
+			url := fmt.Sprintf("/policy/%s", policyName)
+			req := newRequest("PUT", url, bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't put policy")
+			}
+			result := struct {
+				Policy struct {
+					Paths []string `json:"resource_paths"`
+				} `json:"updated"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from resource creation")
+			}
+			assert.Equal(t, []string{"/a/z"}, result.Policy.Paths)
+
+			// check the stored policy reflects the new resource list
+			w = httptest.NewRecorder()
+			req = newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read updated policy")
+			}
+			read := struct {
+				Paths []string `json:"resource_paths"`
+				Roles []string `json:"role_ids"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &read)
+			if err != nil {
+				httpError(t, w, "couldn't read response from GET policy")
+			}
+			assert.Equal(t, []string{"/a/z"}, read.Paths)
+			assert.Equal(t, []string{roleName}, read.Roles)
+
+			t.Run("NotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(
+					`{
+						"resource_paths": ["/a/z"],
+						"role_ids": ["%s"]
+					}`,
+					roleName,
+				))
+				req := newRequest("PUT", "/policy/does-not-exist", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 trying to update nonexistent policy")
+				}
+				assert.Equal(t, "policy_not_found", errorCode(t, w))
+			})
+		})
+
+		t.Run("List", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/policy", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "can't list policies")
+			}
+			result := struct {
+				Policies []arborist.Policy `json:"policies"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from policies list")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, 2, len(result.Policies), msg)
+			msg = fmt.Sprintf("non expanded policies should contain 'role_ids'. got response body: %s", w.Body.String())
+			assert.NotNil(t, result.Policies[0].RoleIDs, msg)
+			// TODO (rudyardrichter, 2019-04-15): more checks here on response
+		})
+
+		t.Run("ListPage", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/policy?limit=1&offset=1", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "can't list policies")
+			}
+			result := struct {
+				Policies []arborist.Policy `json:"policies"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from policies list")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, 1, len(result.Policies), msg)
+			assert.Equal(t, "2", w.Header().Get("X-Total-Count"), "wrong total count")
+
+			t.Run("FilterResource", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/policy?resource=/a/z", nil)
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
-					httpError(t, w, "couldn't read group")
+					httpError(t, w, "can't list policies")
 				}
 				result := struct {
-					Name     string   `json:"name"`
-					Users    []string `json:"users"`
-					Policies []string `json:"policies"`
+					Policies []arborist.Policy `json:"policies"`
 				}{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from group read")
+					httpError(t, w, "couldn't read response from policies list")
 				}
-				msg = fmt.Sprintf(msg, w.Body.String())
-				if expected {
-					assert.Contains(t, result.Policies, policyName, msg)
-				} else {
-					assert.NotContains(t, result.Policies, policyName, msg)
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				if assert.Equal(t, 1, len(result.Policies), msg) {
+					assert.Equal(t, policyName, result.Policies[0].Name, msg)
+				}
+				assert.Equal(t, "1", w.Header().Get("X-Total-Count"), "wrong total count")
+			})
+
+			t.Run("BadLimit", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/policy?limit=-1", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 for negative limit")
 				}
+			})
+		})
+
+		t.Run("ListExpanded", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/policy?expand", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "can't list policies")
 			}
-			test("yyy", true, "shouldn't revoke policy; got response body: %s")
-			test("xxx", false, "didn't revoke policy correctly; got response body: %s")
+			result := struct {
+				Policies []arborist.ExpandedPolicy `json:"policies"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from policies list")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, 2, len(result.Policies), msg)
+			msg = fmt.Sprintf("expanded policies should contain 'roles'. got response body: %s", w.Body.String())
+			assert.NotNil(t, result.Policies[0].Roles, msg)
 		})
 
 		t.Run("Delete", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/group/%s", testGroupName)
-			req := newRequest("DELETE", url, nil)
+			req := newRequest("DELETE", "/policy/"+policyNameA, nil)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusNoContent {
-				httpError(t, w, "couldn't delete group")
+				httpError(t, w, "couldn't delete policy")
 			}
+
+			t.Run("NotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("DELETE", "/policy/does-not-exist", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 trying delete nonexistent policy")
+				}
+			})
 		})
 
 		t.Run("CheckDeleted", func(t *testing.T) {
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/group/%s", testGroupName)
-			req := newRequest("GET", url, nil)
+			req := newRequest("GET", "/policy/"+policyNameA, nil)
 			handler.ServeHTTP(w, req)
 			if w.Code != http.StatusNotFound {
-				httpError(t, w, "group was not actually deleted")
+				httpError(t, w, "policy was not actually deleted")
 			}
 		})
 
-		t.Run("DeleteNotExist", func(t *testing.T) {
+		t.Run("Resources", func(t *testing.T) {
+			for _, path := range []string{"/inherited", "/inherited/a", "/inherited/a/b", "/inherited/c"} {
+				createResourceBytes(t, []byte(fmt.Sprintf(`{"path": "%s"}`, path)))
+			}
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "inherited", "resource_paths": ["/inherited/a"], "role_ids": ["%s"]}`,
+				roleName,
+			)))
 			w := httptest.NewRecorder()
-			url := fmt.Sprintf("/group/%s", testGroupName)
-			req := newRequest("DELETE", url, nil)
+			req := newRequest("GET", "/policy/inherited/resources", nil)
 			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusNoContent {
-				httpError(t, w, "wrong response from deleting group that doesn't exist")
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't list policy's resources")
+			}
+			result := struct {
+				Resources []arborist.ResourceOut `json:"resources"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from policy resources")
+			}
+			paths := []string{}
+			for _, resource := range result.Resources {
+				paths = append(paths, resource.Path)
 			}
+			// the subresource is included, but not the parent or sibling
+			assert.Equal(t, []string{"/inherited/a", "/inherited/a/b"}, paths, w.Body.String())
+
+			t.Run("NotFound", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/policy/nonexistent/resources", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 listing resources of missing policy")
+				}
+			})
 		})
 
-		t.Run("BuiltIn", func(t *testing.T) {
-			groups := [][]string{
-				[]string{arborist.AnonymousGroup, "Anonymous"},
-				[]string{arborist.LoggedInGroup, "LoggedIn"},
-			}
-			for _, groupInfo := range groups {
-				groupName := groupInfo[0]
-				testName := groupInfo[1]
-				t.Run(testName, func(t *testing.T) {
-					t.Run("Exists", func(t *testing.T) {
-						w := httptest.NewRecorder()
-						req := newRequest("GET", fmt.Sprintf("/group/%s", groupName), nil)
-						handler.ServeHTTP(w, req)
-						if w.Code != http.StatusOK {
-							httpError(t, w, "couldn't read group")
-						}
-						result := struct {
-							Name  string   `json:"name"`
-							Users []string `json:"users"`
-							P     []string `json:"policies"`
-						}{}
-						err = json.Unmarshal(w.Body.Bytes(), &result)
-						if err != nil {
-							httpError(t, w, "couldn't read response from group read")
-						}
-						msg := fmt.Sprintf("got response body: %s", w.Body.String())
-						assert.Equal(t, groupName, result.Name, msg)
-						assert.Equal(t, []string{}, result.Users, msg)
-					})
+		t.Run("Diff", func(t *testing.T) {
+			createRoleBytes(t, []byte(`{
+				"id": "diff-role",
+				"permissions": [
+					{"id": "diff-read", "action": {"service": "diff", "method": "read"}}
+				]
+			}`))
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "diff-from", "resource_paths": ["/a", "/a/b"], "role_ids": ["%s"]}`,
+				roleName,
+			)))
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "diff-to", "resource_paths": ["/a/b", "/a/b/c"], "role_ids": ["%s", "diff-role"]}`,
+				roleName,
+			)))
+			diff := func(t *testing.T, from string, to string) arborist.PolicyDiff {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/policy/"+from+"/diff/"+to, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't diff policies")
+				}
+				result := arborist.PolicyDiff{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from policy diff")
+				}
+				return result
+			}
+
+			result := diff(t, "diff-from", "diff-to")
+			assert.Equal(t, "diff-from", result.From)
+			assert.Equal(t, "diff-to", result.To)
+			assert.Equal(t, []string{"/a/b/c"}, result.ResourcePaths.Added)
+			assert.Equal(t, []string{"/a"}, result.ResourcePaths.Removed)
+			assert.Equal(t, []string{"diff-role"}, result.RoleIDs.Added)
+			assert.Equal(t, []string{}, result.RoleIDs.Removed)
+
+			t.Run("Reversed", func(t *testing.T) {
+				result := diff(t, "diff-to", "diff-from")
+				assert.Equal(t, []string{"/a"}, result.ResourcePaths.Added)
+				assert.Equal(t, []string{"/a/b/c"}, result.ResourcePaths.Removed)
+				assert.Equal(t, []string{}, result.RoleIDs.Added)
+				assert.Equal(t, []string{"diff-role"}, result.RoleIDs.Removed)
+			})
 
-					t.Run("CannotDelete", func(t *testing.T) {
-						w := httptest.NewRecorder()
-						req := newRequest("DELETE", fmt.Sprintf("/group/%s", groupName), nil)
-						handler.ServeHTTP(w, req)
-						if w.Code != http.StatusBadRequest {
-							msg := fmt.Sprintf(
-								"expected error from trying to delete built-in group %s",
-								groupName,
-							)
-							httpError(t, w, msg)
-						}
-					})
+			t.Run("Same", func(t *testing.T) {
+				result := diff(t, "diff-from", "diff-from")
+				assert.Equal(t, []string{}, result.ResourcePaths.Added)
+				assert.Equal(t, []string{}, result.ResourcePaths.Removed)
+				assert.Equal(t, []string{}, result.RoleIDs.Added)
+				assert.Equal(t, []string{}, result.RoleIDs.Removed)
+			})
 
-					t.Run("CannotAddUser", func(t *testing.T) {
-						w := httptest.NewRecorder()
-						username := "user-not-getting-added"
-						body := []byte(fmt.Sprintf(`{"name": "%s"}`, username))
-						req := newRequest("POST", "/user", bytes.NewBuffer(body))
-						handler.ServeHTTP(w, req)
+			t.Run("NotFound", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/policy/diff-from/diff/nonexistent", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 diffing against missing policy")
+				}
+				assert.Equal(t, "policy_not_found", errorCode(t, w))
+				assert.Contains(t, errorMessage(t, w), "nonexistent")
+			})
+		})
 
-						w = httptest.NewRecorder()
-						url := fmt.Sprintf("/group/%s/user", groupName)
-						body = []byte(fmt.Sprintf(`{"username": "%s"}`, username))
-						req = newRequest("POST", url, bytes.NewBuffer(body))
-						handler.ServeHTTP(w, req)
-						if w.Code != http.StatusBadRequest {
-							httpError(t, w, "expected error adding user to built in group")
-						}
-					})
-				})
+		t.Run("BulkGrant", func(t *testing.T) {
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "cohort", "resource_paths": ["/a"], "role_ids": ["%s"]}`,
+				roleName,
+			)))
+			createUserBytes(t, []byte(`{"name": "cohort-1"}`))
+			createUserBytes(t, []byte(`{"name": "cohort-2"}`))
+			bulk := func(t *testing.T, action string, body string) (int, arborist.BulkGrantResults) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/policy/cohort/"+action, bytes.NewBufferString(body))
+				handler.ServeHTTP(w, req)
+				result := arborist.BulkGrantResults{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from bulk "+action)
+				}
+				return w.Code, result
 			}
-		})
+			hasPolicy := func(t *testing.T, username string) bool {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/user/"+username, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read user")
+				}
+				user := arborist.User{}
+				err := json.Unmarshal(w.Body.Bytes(), &user)
+				if err != nil {
+					httpError(t, w, "couldn't read response from user read")
+				}
+				for _, binding := range user.Policies {
+					if binding.Policy == "cohort" {
+						return true
+					}
+				}
+				return false
+			}
+
+			code, result := bulk(t, "grant", `{"usernames": ["cohort-1", "nobody", "cohort-2"]}`)
+			assert.Equal(t, http.StatusMultiStatus, code)
+			assert.Equal(t, 2, result.Succeeded)
+			assert.Equal(t, 1, result.Failed)
+			if assert.Len(t, result.Results, 3) {
+				assert.Equal(t, "cohort-1", result.Results[0].Username)
+				assert.True(t, result.Results[0].OK)
+				assert.Equal(t, "nobody", result.Results[1].Username)
+				assert.False(t, result.Results[1].OK)
+				if assert.NotNil(t, result.Results[1].Error) {
+					assert.Equal(t, arborist.ErrorCodeUserNotFound, result.Results[1].Error.ErrorCode)
+				}
+				assert.True(t, result.Results[2].OK)
+			}
+			assert.True(t, hasPolicy(t, "cohort-1"))
+			assert.True(t, hasPolicy(t, "cohort-2"))
 
-		tearDown(t)
-	})
+			t.Run("AllGranted", func(t *testing.T) {
+				code, result := bulk(t, "grant", `{"usernames": ["cohort-1", "cohort-2"]}`)
+				assert.Equal(t, http.StatusOK, code)
+				assert.Equal(t, 2, result.Succeeded)
+			})
 
-	t.Run("Auth", func(t *testing.T) {
-		tearDown := testSetup(t)
+			t.Run("Revoke", func(t *testing.T) {
+				code, result := bulk(t, "revoke", `{"usernames": ["cohort-1", "nobody"]}`)
+				assert.Equal(t, http.StatusMultiStatus, code)
+				assert.Equal(t, 1, result.Succeeded)
+				assert.False(t, hasPolicy(t, "cohort-1"))
+				assert.True(t, hasPolicy(t, "cohort-2"))
+
+				// revoking again fails, since it's not granted any more
+				code, result = bulk(t, "revoke", `{"usernames": ["cohort-1"]}`)
+				assert.Equal(t, http.StatusMultiStatus, code)
+				assert.Equal(t, 1, result.Failed)
+			})
 
-		t.Run("Mapping", func(t *testing.T) {
-			setupTestPolicy(t)
-			_, _, anonymousAuthMapping := setupAnonymousPolicies(t)
-			_, _, loggedInAuthMapping := setupLoggedInPolicies(t)
-			createUserBytes(t, userBody)
-			grantUserPolicy(t, username, policyName, "null")
+			t.Run("PolicyNotFound", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := bytes.NewBufferString(`{"usernames": ["cohort-1"]}`)
+				req := newRequest("POST", "/policy/nonexistent/grant", body)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 granting missing policy")
+				}
+			})
 
-			// testUserAuthMappingResponse checks whether the AuthMapping in the HTTP
-			// response 'w' contains the correct resources and actions that belong to the user.
-			// This includes the resources and actions that belong to the anonymous and loggedIn groups.
-			testUserAuthMappingResponse := func(t *testing.T, w *httptest.ResponseRecorder) {
-				msg := fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, 200, w.Code, msg)
-				result := make(map[string][]arborist.Action)
+			t.Run("NoUsernames", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/policy/cohort/grant", bytes.NewBufferString(`{}`))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 without usernames")
+				}
+			})
+		})
+
+		t.Run("SoftDelete", func(t *testing.T) {
+			softName := "soft-deleted"
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "%s", "resource_paths": ["/a/b"], "role_ids": ["%s"]}`,
+				softName,
+				roleName,
+			)))
+			createUserBytes(t, []byte(`{"name": "soft-user"}`))
+			grantUserPolicy(t, "soft-user", softName, "null")
+			listed := func(t *testing.T) bool {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/policy", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't list policies")
+				}
+				result := struct {
+					Policies []arborist.Policy `json:"policies"`
+				}{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from auth mapping")
+					httpError(t, w, "couldn't read response from policies list")
 				}
-				msg = fmt.Sprintf("result does not contain expected resource %s", resourcePath)
-				assert.Contains(t, result, resourcePath, msg)
-				action := arborist.Action{Service: serviceName, Method: methodName}
-				msg = fmt.Sprintf("result does not contain expected action %s", action)
-				assert.Contains(t, result[resourcePath], action, msg)
-
-				// Expect response to also contain anonymous and loggedIn groups.
-				msg = fmt.Sprintf("Expected to see these auth mappings from anonymous group in response: %v, but got: %v", anonymousAuthMapping, result)
-				for resource, actions := range anonymousAuthMapping {
-					assert.Contains(t, result, resource, msg)
-					assert.ElementsMatch(t, result[resource], actions, msg)
+				for _, policy := range result.Policies {
+					if policy.Name == softName {
+						return true
+					}
 				}
-				msg = fmt.Sprintf("Expected to see these auth mappings from loggedIn group in response: %v, but got: %v", loggedInAuthMapping, result)
-				for resource, actions := range loggedInAuthMapping {
-					assert.Contains(t, result, resource, msg)
-					assert.ElementsMatch(t, result[resource], actions, msg)
+				return false
+			}
+
+			t.Run("InvalidParam", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("DELETE", "/policy/"+softName+"?soft=maybe", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 for invalid `soft`")
 				}
+			})
+
+			w := httptest.NewRecorder()
+			req := newRequest("DELETE", "/policy/"+softName+"?soft=true", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't soft-delete policy")
+			}
+			assert.False(t, listed(t), "expected soft-deleted policy not to be listed")
+			w = httptest.NewRecorder()
+			req = newRequest("GET", "/policy/"+softName, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "expected 404 reading soft-deleted policy")
 			}
 
-			// testAnonymousAuthMappingResponse checks whether the AuthMapping in the HTTP response 'w'
-			// ONLY contains the correct resources and actions that belong to the anonymous group.
-			testAnonymousAuthMappingResponse := func(t *testing.T, w *httptest.ResponseRecorder) {
-				assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
+			w = httptest.NewRecorder()
+			req = newRequest("POST", "/policy/"+softName+"/restore", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't restore policy")
+			}
+			result := struct {
+				Restored arborist.Policy `json:"restored"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from policy restore")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, softName, result.Restored.Name, msg)
+			assert.Equal(t, []string{"/a/b"}, result.Restored.ResourcePaths, msg)
+			assert.Equal(t, []string{roleName}, result.Restored.RoleIDs, msg)
+			assert.True(t, listed(t), "expected restored policy to be listed")
 
-				// expect result to contain only authMappings of anonymous policies
-				result := make(arborist.AuthMapping)
-				err = json.Unmarshal(w.Body.Bytes(), &result)
-				if err != nil {
-					httpError(t, w, "couldn't read response from auth mapping")
+			// the grant comes back too
+			w = httptest.NewRecorder()
+			req = newRequest("GET", "/user/soft-user", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read user")
+			}
+			user := arborist.User{}
+			err = json.Unmarshal(w.Body.Bytes(), &user)
+			if err != nil {
+				httpError(t, w, "couldn't read response from user read")
+			}
+			if assert.Len(t, user.Policies, 1, w.Body.String()) {
+				assert.Equal(t, softName, user.Policies[0].Policy)
+			}
+
+			t.Run("NotArchived", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/policy/"+softName+"/restore", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 restoring policy which isn't archived")
 				}
-				msg := fmt.Sprintf("Expected these auth mappings from anonymous group: %v \t Got: %v", anonymousAuthMapping, result)
-				for resource, actions := range result {
-					assert.Contains(t, anonymousAuthMapping, resource, msg)
-					assert.ElementsMatch(t, anonymousAuthMapping[resource], actions, msg)
+				assert.Equal(t, "policy_not_found", errorCode(t, w))
+			})
+
+			t.Run("HardDelete", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("DELETE", "/policy/"+softName, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "couldn't delete policy")
+				}
+				w = httptest.NewRecorder()
+				req = newRequest("POST", "/policy/"+softName+"/restore", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected policy deleted without `soft` not to be restorable")
 				}
+			})
+		})
+
+		tearDown(t)
+	})
+
+	t.Run("User", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		username := "foo"
+		userEmail := "foo@planx.net"
+
+		t.Run("ListEmpty", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/user", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "can't list users")
+			}
+			result := struct {
+				Users interface{} `json:"users"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from users list")
 			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, []interface{}{}, result.Users, msg)
+		})
 
-			// testClientAuthMappingResponse checks whether the AuthMapping in the HTTP
-			// response 'w' contains the correct resources and actions that belong to the client.
-			// This does NOT include the resources and actions that belong to the anonymous and loggedIn groups.
-			testClientAuthMappingResponse := func(t *testing.T, w *httptest.ResponseRecorder) {
-				msg := fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, 200, w.Code, msg)
-				result := make(map[string][]arborist.Action)
-				err = json.Unmarshal(w.Body.Bytes(), &result)
-				if err != nil {
-					httpError(t, w, "couldn't read response from auth mapping")
-				}
-				msg = fmt.Sprintf("result does not contain expected resource %s", resourcePath)
-				assert.Contains(t, result, resourcePath, msg)
-				action := arborist.Action{Service: serviceName, Method: methodName}
-				msg = fmt.Sprintf("result does not contain expected action %s", action)
-				assert.Contains(t, result[resourcePath], action, msg)
+		t.Run("NotFound", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/user/nonexistent", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "didn't get 404 for nonexistent user")
+			}
+			assert.Equal(t, "user_not_found", errorCode(t, w))
+		})
+
+		t.Run("Create", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			body := []byte(fmt.Sprintf(
+				`{
+					"name": "%s",
+					"email": "%s"
+				}`,
+				username,
+				userEmail,
+			))
+			req := newRequest("POST", "/user", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create user")
+			}
+			result := struct {
+				I interface{} `json:"created"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from user creation")
+			}
+
+			t.Run("AlreadyExists", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(
+					`{
+						"name": "%s",
+						"email": "%s"
+					}`,
+					username,
+					userEmail,
+				))
+				req := newRequest("POST", "/user", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusConflict {
+					httpError(t, w, "expected 409 from trying to create same user again")
+				}
+			})
+
+			t.Run("MissingName", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(`{"email": "asdf"}`)
+				req := newRequest("POST", "/user", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 from trying to create user without name")
+				}
+			})
+		})
+
+		anonymousPolicies, anonymousResourcePaths, _ := setupAnonymousPolicies(t)
+		loggedInPolicies, loggedInResourcePaths, _ := setupLoggedInPolicies(t)
+		t.Run("Read", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/user/%s", username)
+			req := newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read user")
+			}
+			result := struct {
+				Name     string `json:"name"`
+				Email    string `json:"email"`
+				Policies []struct {
+					Policy    string  `json:"policy"`
+					ExpiresAt *string `json:"expires_at"`
+				} `json:"policies"`
+				Groups []string `json:"groups"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from user read")
+			}
+			assert.Equalf(t, username, result.Name, "Wanted username: %v \t Got: %v", username, result.Name)
+			assert.Equalf(t, userEmail, result.Email, "Wanted email: %v \t Got: %v", userEmail, result.Email)
+			// expect to receive policies from user's groups (in this case, 0 policies
+			// are assigned to user) as well as policies from Anonymous and LoggedIn groups.
+			var expectedPolicyNames []string
+			for _, policy := range anonymousPolicies {
+				expectedPolicyNames = append(expectedPolicyNames, policy.Name)
+			}
+			for _, policy := range loggedInPolicies {
+				expectedPolicyNames = append(expectedPolicyNames, policy.Name)
+			}
+			var actualPolicyNames []string
+			for _, policy := range result.Policies {
+				actualPolicyNames = append(actualPolicyNames, policy.Policy)
+			}
+			assert.ElementsMatchf(t, expectedPolicyNames, actualPolicyNames, "Wanted policies: %v \t Got: %v", expectedPolicyNames, actualPolicyNames)
+			// expect to receive user's groups (in this case, 0 groups) as well
+			// as Anonymous and LoggedIn groups.
+			expectedGroups := []string{arborist.LoggedInGroup, arborist.AnonymousGroup}
+			assert.ElementsMatchf(t, expectedGroups, result.Groups, "Wanted groups: %v \t Got: %v", expectedGroups, result.Groups)
+		})
+
+		t.Run("Update", func(t *testing.T) {
+			originalUsername := "johnsmith"
+			originalUserEmail := "johnsmith@domain.tld"
+			createUserBytes(t, []byte(fmt.Sprintf(`{"name": "%s", "email": "%s"}`, originalUsername, originalUserEmail)))
+
+			t.Run("OnlyName", func(t *testing.T) {
+				newUsername := "jsmith"
+				updateUserBytes(
+					t,
+					originalUsername,
+					[]byte(fmt.Sprintf(`{"name": "%s"}`, newUsername)),
+					http.StatusNoContent,
+				)
+				assertUsernameAndEmail(t, newUsername, originalUserEmail)
+			})
+
+			originalUsername = "jsmith"
+			t.Run("OnlyEmail", func(t *testing.T) {
+				newUserEmail := "jsmith@domain.tld"
+				updateUserBytes(
+					t,
+					originalUsername,
+					[]byte(fmt.Sprintf(`{"email": "%s"}`, newUserEmail)),
+					http.StatusNoContent,
+				)
+				assertUsernameAndEmail(t, originalUsername, newUserEmail)
+			})
+
+			t.Run("BothNameAndEmail", func(t *testing.T) {
+				newUsername := "janesmith"
+				newUserEmail := "janesmith@domain.tld"
+				updateUserBytes(
+					t,
+					originalUsername,
+					[]byte(fmt.Sprintf(`{"name": "%s", "email": "%s"}`, newUsername, newUserEmail)),
+					http.StatusNoContent,
+				)
+				assertUsernameAndEmail(t, newUsername, newUserEmail)
+			})
+
+			originalUsername = "janesmith"
+			t.Run("NeitherNameNorEmail", func(t *testing.T) {
+				updateUserBytes(
+					t,
+					originalUsername,
+					[]byte("{}"),
+					http.StatusBadRequest,
+				)
+			})
+
+			t.Run("InvalidName", func(t *testing.T) {
+				updateUserBytes(
+					t,
+					originalUsername,
+					[]byte(`{"name": 42}`),
+					http.StatusBadRequest,
+				)
+			})
+
+			t.Run("NonExistentUsername", func(t *testing.T) {
+				updateUserBytes(
+					t,
+					"nonexistentuser",
+					[]byte(`{"name": "existentuser"}`),
+					http.StatusNotFound,
+				)
+			})
+
+			t.Run("ConflictingName", func(t *testing.T) {
+				otherUsername := "joesmith"
+				createUserBytes(t, []byte(fmt.Sprintf(`{"name": "%s"}`, otherUsername)))
+				updateUserBytes(
+					t,
+					originalUsername,
+					[]byte(fmt.Sprintf(`{"name": "%s"}`, otherUsername)),
+					http.StatusConflict,
+				)
+			})
+		})
+
+		// do some preliminary setup so we have a policy to work with
+		createResourceBytes(t, resourceBody)
+		createRoleBytes(t, roleBody)
+		createPolicyBytes(t, policyBody)
+
+		t.Run("GrantPolicy", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/user/%s/policy", username)
+			req := newRequest(
+				"POST",
+				url,
+				bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
+			)
+			req.Header.Add("X-AuthZ-Provider", "xxx")
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't grant policy to user")
+			}
+			// look up user again and check that policy is there
+			w = httptest.NewRecorder()
+			url = fmt.Sprintf("/user/%s", username)
+			req = newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read user")
+			}
+			result := struct {
+				Name     string `json:"name"`
+				Email    string `json:"email"`
+				Policies []struct {
+					Policy    string  `json:"policy"`
+					ExpiresAt *string `json:"expires_at"`
+				} `json:"policies"`
+				Groups []string `json:"groups"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from user read")
+			}
+			msg := fmt.Sprintf(
+				"didn't grant policy correctly; got response body: %s",
+				w.Body.String(),
+			)
+			// expect that policy with policyName is in response
+			var actualPolicy struct {
+				Policy    string  `json:"policy"`
+				ExpiresAt *string `json:"expires_at"`
+			}
+			for _, policy := range result.Policies {
+				if policy.Policy == policyName {
+					actualPolicy = policy
+				}
+			}
+			assert.NotNil(t, actualPolicy, msg)
+			// expect the expiresAt field to be nil, because expiration was not set.
+			assert.Nil(t, actualPolicy.ExpiresAt, msg)
+
+			t.Run("BulkGrantPolicy", func(t *testing.T) {
+				// create test policy
+				policyNameA := "pqrs"
+				createPolicyBytes(
+					t,
+					[]byte(fmt.Sprintf(
+						`{
+							"id": "%s",
+							"resource_paths": ["%s"],
+							"role_ids": ["%s"]
+						}`,
+						policyNameA,
+						resourcePath,
+						roleName,
+					)),
+				)
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/user/%s/bulk/policy", username)
+				body := []byte(fmt.Sprintf(
+					`
+					[
+						{"policy": "%s"},
+						{"policy": "%s"}
+					]`,
+					policyName, policyNameA,
+				))
+				req := newRequest(
+					"POST",
+					url,
+					bytes.NewBuffer(body))
+				req.Header.Set("X-AuthZ-Provider", "xxx")
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "couldn't grant policies to user")
+				}
+				w = httptest.NewRecorder()
+				url = fmt.Sprintf("/user/%s", username)
+				req = newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read user")
+				}
+			})
+
+			t.Run("PolicyNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/user/%s/policy", username)
+				req := newRequest(
+					"POST",
+					url,
+					bytes.NewBuffer([]byte(`{"policy": "nonexistent"}`)),
+				)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "didn't get 404 for nonexistent policy")
+				}
+			})
+
+			t.Run("UserNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := "/user/nonexistent/policy"
+				req := newRequest(
+					"POST",
+					url,
+					bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
+				)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "didn't get 404 for nonexistent user")
+				}
+			})
+		})
+
+		t.Run("ListResources", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/user/%s/resources", username)
+			req := newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't list user's authed resources")
+			}
+			result := struct {
+				Resources []string `json:"resources"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from user resources")
+			}
+			// expect to see resources from user's policies, as well as
+			// resources from Anonymous and LoggedIn policies.
+			expectedResources := append(anonymousResourcePaths, loggedInResourcePaths...)
+			expectedResources = append(expectedResources, resourcePath)
+			msg := fmt.Sprintf(
+				"didn't get expected resources; got response body: %s \t Wanted resources: %v",
+				w.Body.String(),
+				expectedResources,
+			)
+			assert.ElementsMatch(t, expectedResources, result.Resources, msg)
+
+			t.Run("UserNotFound", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/user/nonexistent/resources", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 trying to list resources for fake user")
+				}
+			})
+
+			// TODO (rudyardrichter, 2019-05-09): also test response with tag
+		})
+
+		t.Run("RevokePolicy", func(t *testing.T) {
+			test := func(authzProvider string, httpStatusCode int, expected bool, msg string) {
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/user/%s/policy/%s", username, policyName)
+				req := newRequest("DELETE", url, nil)
+				if authzProvider != "" {
+					req.Header.Add("X-AuthZ-Provider", authzProvider)
+				}
+				handler.ServeHTTP(w, req)
+				if w.Code != httpStatusCode {
+					httpError(t, w, fmt.Sprintf("revoke policy: expected status code `%d`, got status code `%d`", httpStatusCode, w.Code))
+				}
+				// look up user again and check if policy is still there
+				w = httptest.NewRecorder()
+				url = fmt.Sprintf("/user/%s", username)
+				req = newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read user")
+				}
+				result := struct {
+					Name     string `json:"name"`
+					Email    string `json:"email"`
+					Policies []struct {
+						Name      string `json:"policy"`
+						ExpiresAt string `json:"expires_at"`
+					} `json:"policies"`
+					Groups []string `json:"groups"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from user read")
+				}
+				found := false
+				for _, policy := range result.Policies {
+					if policy.Name == policyName {
+						found = true
+						break
+					}
+				}
+				if found != expected {
+					assert.Fail(t, fmt.Sprintf(msg, w.Body.String()))
+				}
+			}
+			test("yyy", http.StatusUnauthorized, true, "shouldn't revoke policy; got response body: %s")
+			test("xxx", http.StatusNoContent, false, "didn't revoke policy correctly; got response body: %s")
+
+			// If no authz header is provided, the policy should still be revoked.
+			grantUserPolicy(t, username, policyName, "") // Granting policy again to revoke
+			test("", http.StatusNoContent, false, "didn't revoke policy correctly; got response body: %s")
+
+			t.Run("NotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/user/%s/policy/nonexistent", username)
+				req := newRequest("DELETE", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "didn't get 404 revoking nonexistent policy")
+				}
+				w = httptest.NewRecorder()
+				url = fmt.Sprintf("/user/nonexistent/policy/%s", policyName)
+				req = newRequest("DELETE", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "didn't get 404 revoking policy from nonexistent user")
+				}
+			})
+
+			t.Run("Authorization", func(t *testing.T) {
+				authorized := func(t *testing.T) bool {
+					w := httptest.NewRecorder()
+					body := []byte(fmt.Sprintf(
+						`{
+							"user": {"user_id": "%s"},
+							"request": {
+								"resource": "%s",
+								"action": {"service": "%s", "method": "%s"}
+							}
+						}`,
+						username,
+						resourcePath,
+						serviceName,
+						methodName,
+					))
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth request failed")
+					}
+					result := struct {
+						Auth bool `json:"auth"`
+					}{}
+					err = json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth request")
+					}
+					return result.Auth
+				}
+
+				grantUserPolicy(t, username, policyName, "null")
+				assert.True(t, authorized(t), "user should be authorized after policy grant")
+				revokeUserPolicy(t, username, policyName)
+				assert.False(t, authorized(t), "user should not be authorized after policy revoke")
+			})
+		})
+
+		timestamp := time.Now().Add(time.Hour).Format(time.RFC3339)
+
+		t.Run("GrantPolicyWithExpiration", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/user/%s/policy", username)
+			req := newRequest(
+				"POST",
+				url,
+				bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s", "expires_at": "%s"}`, policyName, timestamp))),
+			)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't grant policy to user with expiration")
+			}
+		})
+
+		t.Run("CheckPolicyHasExpiration", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/user/%s", username)
+			req := newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			result := struct {
+				Policies []struct {
+					Policy    string  `json:"policy"`
+					ExpiresAt *string `json:"expires_at"`
+				} `json:"policies"`
+			}{}
+			err := json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from user info")
+			}
+			// Assert that the policy we added in GrantPolicyWithExpiration has expiration.
+			var addedPolicy struct {
+				Policy    string  `json:"policy"`
+				ExpiresAt *string `json:"expires_at"`
+			}
+			for _, policy := range result.Policies {
+				if policy.Policy == policyName {
+					addedPolicy = policy
+				}
+			}
+			assert.NotNilf(t, addedPolicy, "Expected to find policy %v in response: %v", addedPolicy, result.Policies)
+			assert.NotNil(t, addedPolicy.ExpiresAt, "missing `expires_at` in response")
+			expect, _ := time.Parse(time.RFC3339, timestamp)
+			got, _ := time.Parse(time.RFC3339, *addedPolicy.ExpiresAt)
+			assert.True(t, expect.Equal(got), "wrong value for `expires_at`")
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("DELETE", "/user/foo", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't delete user")
+			}
+
+			t.Run("NotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("DELETE", "/user/foo", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "expected 204 from trying to delete nonexistent user")
+				}
+			})
+		})
+
+		t.Run("DeleteNotExist", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/user/%s", username)
+			req := newRequest("DELETE", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "wrong response from deleting user that doesn't exist")
+			}
+		})
+
+		t.Run("CheckDeleted", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/user/foo", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "user was not actually deleted")
+			}
+		})
+
+		tearDown(t)
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		clientID := "foo"
+
+		t.Run("ListEmpty", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/client", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "can't list clients")
+			}
+			result := struct {
+				Clients interface{} `json:"clients"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from clients list")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, []interface{}{}, result.Clients, msg)
+		})
+
+		t.Run("NotFound", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/client/nonexistent", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "didn't get 404 for nonexistent client")
+			}
+		})
+
+		// do some preliminary setup so we have a policy to work with
+		createResourceBytes(t, resourceBody)
+		createRoleBytes(t, roleBody)
+		createPolicyBytes(t, policyBody)
+
+		t.Run("Create", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			body := []byte(fmt.Sprintf(
+				`{
+					"clientID": "%s",
+					"policies": ["%s"]
+				}`,
+				clientID, policyName,
+			))
+			req := newRequest("POST", "/client", bytes.NewBuffer(body))
+			req.Header.Add("X-AuthZ-Provider", "xxx")
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create client")
+			}
+			result := struct {
+				I interface{} `json:"created"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from client creation")
+			}
+		})
+
+		t.Run("Read", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/client/%s", clientID)
+			req := newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read client")
+			}
+			result := struct {
+				ClientID string   `json:"clientID"`
+				Policies []string `json:"policies"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from client read")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, clientID, result.ClientID, msg)
+			assert.Equal(t, []string{policyName}, result.Policies, msg)
+		})
+
+		t.Run("RevokePolicy", func(t *testing.T) {
+			test := func(authzProvider string, expected bool, msg string) {
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/client/%s/policy/%s", clientID, policyName)
+				req := newRequest("DELETE", url, nil)
+				req.Header.Add("X-AuthZ-Provider", authzProvider)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "couldn't revoke policy")
+				}
+				// look up client again and check that policy is gone
+				w = httptest.NewRecorder()
+				url = fmt.Sprintf("/client/%s", clientID)
+				req = newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read client")
+				}
+				result := struct {
+					ClientID string   `json:"clientID"`
+					Policies []string `json:"policies"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from client read")
+				}
+				msg = fmt.Sprintf(msg, w.Body.String())
+				if expected {
+					assert.Contains(t, result.Policies, policyName, msg)
+				} else {
+					assert.NotContains(t, result.Policies, policyName, msg)
+				}
+			}
+			test("yyy", true, "shouldn't revoke policy; got response body: %s")
+			test("xxx", false, "didn't revoke policy correctly; got response body: %s")
+		})
+
+		t.Run("GrantPolicy", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/client/%s/policy", clientID)
+			req := newRequest(
+				"POST",
+				url,
+				bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
+			)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't grant policy to client")
+			}
+			// look up client again and check that policy is there
+			w = httptest.NewRecorder()
+			url = fmt.Sprintf("/client/%s", clientID)
+			req = newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read client")
+			}
+			result := struct {
+				ClientID string   `json:"clientID"`
+				Policies []string `json:"policies"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from client read")
+			}
+			msg := fmt.Sprintf(
+				"didn't grant policy correctly; got response body: %s",
+				w.Body.String(),
+			)
+			assert.Equal(t, []string{policyName}, result.Policies, msg)
+
+			t.Run("PolicyNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/client/%s/policy", clientID)
+				req := newRequest(
+					"POST",
+					url,
+					bytes.NewBuffer([]byte(`{"policy": "nonexistent"}`)),
+				)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "didn't get 404 for nonexistent policy")
+				}
+			})
+
+			t.Run("ClientNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := "/client/nonexistent/policy"
+				req := newRequest(
+					"POST",
+					url,
+					bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
+				)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "didn't get 404 for nonexistent client")
+				}
+			})
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("DELETE", "/client/foo", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't delete client")
+			}
+		})
+
+		t.Run("DeleteNotExist", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/client/%s", clientID)
+			req := newRequest("DELETE", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "wrong response from deleting client that doesn't exist")
+			}
+		})
+
+		t.Run("CheckDeleted", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/client/foo", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "client was not actually deleted")
+			}
+		})
+
+		tearDown(t)
+	})
+
+	t.Run("Group", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		t.Run("NotFound", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/group/nonexistent", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "didn't get 404 for nonexistent group")
+			}
+		})
+
+		testGroupName := "test-group"
+		testGroupUser1 := "test-group-user-1"
+		testGroupUser2 := "test-group-user-2"
+		testGroupUser3 := "test-group-user-3"
+		testGroupUsers := []string{
+			testGroupUser1,
+			testGroupUser2,
+			testGroupUser3,
+		}
+
+		t.Run("Create", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			body := []byte(fmt.Sprintf(`{"name": "%s"}`, testGroupName))
+			req := newRequest("POST", "/group", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create group")
+			}
+			result := struct {
+				I interface{} `json:"created"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from group creation")
+			}
+
+			t.Run("MissingName", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(`{"users": ["%s"]}`, testGroupUser1))
+				req := newRequest("POST", "/group", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 from creating group without name")
+				}
+			})
+
+			t.Run("AlreadyExists", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(`{"name": "%s"}`, testGroupName))
+				req := newRequest("POST", "/group", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusConflict {
+					httpError(t, w, "creating group that already exists didn't error as expected")
+				}
+			})
+		})
+
+		t.Run("List", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", "/group", nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "can't list groups")
+			}
+			result := struct {
+				Groups []struct {
+					Name string `json:"name"`
+				} `json:"groups"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from groups list")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			// check test group is in the results
+			groupNames := []string{}
+			for _, group := range result.Groups {
+				groupNames = append(groupNames, group.Name)
+			}
+			assert.Contains(t, groupNames, testGroupName, msg)
+		})
+
+		t.Run("Read", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", fmt.Sprintf("/group/%s", testGroupName), nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read group")
+			}
+			result := struct {
+				Name     string   `json:"name"`
+				Users    []string `json:"users"`
+				Policies []string `json:"policies"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from group read")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, testGroupName, result.Name, msg)
+			assert.Equal(t, []string{}, result.Users, msg)
+			assert.Equal(t, []string{}, result.Policies, msg)
+		})
+
+		t.Run("AddUsers", func(t *testing.T) {
+			for _, testUsername := range testGroupUsers {
+				createUserBytes(t, []byte(fmt.Sprintf(`{"name": "%s"}`, testUsername)))
+				w := httptest.NewRecorder()
+				groupUserURL := fmt.Sprintf("/group/%s/user", testGroupName)
+				body := []byte(fmt.Sprintf(`{"username": "%s"}`, testUsername))
+				req := newRequest("POST", groupUserURL, bytes.NewBuffer(body))
+				req.Header.Add("X-AuthZ-Provider", "xxx")
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "couldn't add user to group")
+				}
+			}
+
+			t.Run("UserNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				groupUserURL := fmt.Sprintf("/group/%s/user", testGroupName)
+				body := []byte(`{"username": "does-not-exist"}`)
+				req := newRequest("POST", groupUserURL, bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 from trying to add nonexistent user to group")
+				}
+			})
+
+			t.Run("GroupNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				groupUserURL := "/group/does-not-exist/user"
+				body := []byte(fmt.Sprintf(`{"username": "%s"}`, testGroupUser1))
+				req := newRequest("POST", groupUserURL, bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "expected 404 from trying to add user to nonexistent group")
+				}
+			})
+		})
+
+		t.Run("CheckUsersAdded", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := newRequest("GET", fmt.Sprintf("/group/%s", testGroupName), nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read group")
+			}
+			result := struct {
+				Name     string   `json:"name"`
+				Users    []string `json:"users"`
+				Policies []string `json:"policies"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from group read")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			resultUsers := make([]string, len(result.Users))
+			copy(resultUsers, result.Users)
+			sort.Strings(resultUsers)
+			expectUsers := make([]string, len(testGroupUsers))
+			copy(expectUsers, testGroupUsers)
+			sort.Strings(expectUsers)
+			assert.Equal(t, expectUsers, resultUsers, msg)
+		})
+
+		t.Run("CreateWithUsers", func(t *testing.T) {
+			groupName := "test-group-with-users"
+
+			// create a group with some users in it
+			w := httptest.NewRecorder()
+			body := []byte(fmt.Sprintf(
+				`{"name": "%s", "users": ["%s", "%s"]}`,
+				groupName,
+				testGroupUser1,
+				testGroupUser2,
+			))
+			req := newRequest("POST", "/group", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't create group")
+			}
+			result := struct {
+				Created struct {
+					Users []string `json:"users"`
+				} `json:"created"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from group creation")
+			}
+			sort.Strings(result.Created.Users)
+			expectUsers := []string{testGroupUser1, testGroupUser2}
+			sort.Strings(expectUsers)
+			msg := fmt.Sprintf("didn't get expected users; got response body: %s", w.Body.String())
+			assert.Equal(t, expectUsers, result.Created.Users, msg)
+
+			// check that users were added correctly using read request
+			w = httptest.NewRecorder()
+			req = newRequest("GET", fmt.Sprintf("/group/%s", groupName), nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read group")
+			}
+			resultRead := struct {
+				Users []string `json:"users"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &resultRead)
+			if err != nil {
+				httpError(t, w, "couldn't read response from group read")
+			}
+			sort.Strings(resultRead.Users)
+			msg = fmt.Sprintf("group doesn't have users; got response body: %s", w.Body.String())
+			assert.Equal(t, expectUsers, resultRead.Users, msg)
+		})
+
+		userToRemove := testGroupUser1
+
+		t.Run("RemoveUser", func(t *testing.T) {
+			test := func(authzProvider string, expected bool, msg string) {
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/group/%s/user/%s", testGroupName, userToRemove)
+				req := newRequest("DELETE", url, nil)
+				req.Header.Add("X-AuthZ-Provider", authzProvider)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "couldn't remove user from group")
+				}
+				// look up group again and check that user is gone
+				url = fmt.Sprintf("/group/%s", testGroupName)
+				w = httptest.NewRecorder()
+				req = newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read group")
+				}
+				result := struct {
+					Name     string   `json:"name"`
+					Users    []string `json:"users"`
+					Policies []string `json:"policies"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from group read")
+				}
+				msg = fmt.Sprintf(msg, w.Body.String())
+				if expected {
+					assert.Contains(t, result.Users, userToRemove, msg)
+				} else {
+					assert.NotContains(t, result.Users, userToRemove, msg)
+				}
+			}
+			test("yyy", true, "shouldn't remove user; got response body: %s")
+			test("xxx", false, "didn't remove user; got response body: %s")
+		})
+
+		// do some preliminary setup so we have a policy to work with
+		createResourceBytes(t, resourceBody)
+		createRoleBytes(t, roleBody)
+		createPolicyBytes(t, policyBody)
+
+		t.Run("GrantPolicy", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/group/%s/policy", testGroupName)
+			req := newRequest(
+				"POST",
+				url,
+				bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
+			)
+			req.Header.Add("X-AuthZ-Provider", "xxx")
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't grant policy to group")
+			}
+			// look up group again and check that policy is there
+			w = httptest.NewRecorder()
+			url = fmt.Sprintf("/group/%s", testGroupName)
+			req = newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read group")
+			}
+			result := struct {
+				Name     string   `json:"name"`
+				Users    []string `json:"users"`
+				Policies []string `json:"policies"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from group read")
+			}
+			msg := fmt.Sprintf(
+				"didn't grant policy correctly; got response body: %s",
+				w.Body.String(),
+			)
+			assert.Equal(t, []string{policyName}, result.Policies, msg)
+
+			t.Run("PolicyNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/group/%s/policy", testGroupName)
+				req := newRequest(
+					"POST",
+					url,
+					bytes.NewBuffer([]byte(`{"policy": "nonexistent"}`)),
+				)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "didn't get 400 for nonexistent policy")
+				}
+			})
+
+			t.Run("GroupNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := "/group/nonexistent/policy"
+				req := newRequest(
+					"POST",
+					url,
+					bytes.NewBuffer([]byte(fmt.Sprintf(`{"policy": "%s"}`, policyName))),
+				)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNotFound {
+					httpError(t, w, "didn't get 404 for nonexistent group")
+				}
+			})
+
+			t.Run("InvalidJSON", func(t *testing.T) {
+			})
+		})
+		userToAttemptRevoke := testGroupUser2
+		t.Run("RevokePolicyThroughUser", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/user/%s/policy/%s", userToAttemptRevoke, policyName)
+			req := newRequest("DELETE", url, nil)
+			req.Header.Add("X-AuthZ-Provider", "xxx")
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, w.Code, http.StatusBadRequest, " Group policy must not be revoked directly through user")
+			w = httptest.NewRecorder()
+			url = fmt.Sprintf("/user/%s", userToAttemptRevoke)
+			req = newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't read user policies")
+			}
+			result := struct {
+				Name     string `json:"name"`
+				Email    string `json:"email"`
+				Policies []struct {
+					Name string `json:"policy"`
+				} `json:"policies"`
+				Groups []string `json:"groups"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from user read")
+			}
+			found := false
+			for _, policy := range result.Policies {
+				if policy.Name == policyName {
+					found = true
+					break
+				}
+			}
+			assert.True(t, found, fmt.Sprintf("shouldn't revoke group policy through user; got response body: %s", result))
+		})
+
+		t.Run("RevokePolicy", func(t *testing.T) {
+			test := func(authzProvider string, expected bool, msg string) {
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/group/%s/policy/%s", testGroupName, policyName)
+				req := newRequest("DELETE", url, nil)
+				req.Header.Add("X-AuthZ-Provider", authzProvider)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "couldn't revoke policy from group")
+				}
+				w = httptest.NewRecorder()
+				url = fmt.Sprintf("/group/%s", testGroupName)
+				req = newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read group")
+				}
+				result := struct {
+					Name     string   `json:"name"`
+					Users    []string `json:"users"`
+					Policies []string `json:"policies"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from group read")
+				}
+				msg = fmt.Sprintf(msg, w.Body.String())
+				if expected {
+					assert.Contains(t, result.Policies, policyName, msg)
+				} else {
+					assert.NotContains(t, result.Policies, policyName, msg)
+				}
+			}
+			test("yyy", true, "shouldn't revoke policy; got response body: %s")
+			test("xxx", false, "didn't revoke policy correctly; got response body: %s")
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/group/%s", testGroupName)
+			req := newRequest("DELETE", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't delete group")
+			}
+		})
+
+		t.Run("CheckDeleted", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/group/%s", testGroupName)
+			req := newRequest("GET", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound {
+				httpError(t, w, "group was not actually deleted")
+			}
+		})
+
+		t.Run("DeleteNotExist", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			url := fmt.Sprintf("/group/%s", testGroupName)
+			req := newRequest("DELETE", url, nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "wrong response from deleting group that doesn't exist")
+			}
+		})
+
+		t.Run("BuiltIn", func(t *testing.T) {
+			groups := [][]string{
+				[]string{arborist.AnonymousGroup, "Anonymous"},
+				[]string{arborist.LoggedInGroup, "LoggedIn"},
+			}
+			for _, groupInfo := range groups {
+				groupName := groupInfo[0]
+				testName := groupInfo[1]
+				t.Run(testName, func(t *testing.T) {
+					t.Run("Exists", func(t *testing.T) {
+						w := httptest.NewRecorder()
+						req := newRequest("GET", fmt.Sprintf("/group/%s", groupName), nil)
+						handler.ServeHTTP(w, req)
+						if w.Code != http.StatusOK {
+							httpError(t, w, "couldn't read group")
+						}
+						result := struct {
+							Name  string   `json:"name"`
+							Users []string `json:"users"`
+							P     []string `json:"policies"`
+						}{}
+						err = json.Unmarshal(w.Body.Bytes(), &result)
+						if err != nil {
+							httpError(t, w, "couldn't read response from group read")
+						}
+						msg := fmt.Sprintf("got response body: %s", w.Body.String())
+						assert.Equal(t, groupName, result.Name, msg)
+						assert.Equal(t, []string{}, result.Users, msg)
+					})
+
+					t.Run("CannotDelete", func(t *testing.T) {
+						w := httptest.NewRecorder()
+						req := newRequest("DELETE", fmt.Sprintf("/group/%s", groupName), nil)
+						handler.ServeHTTP(w, req)
+						if w.Code != http.StatusBadRequest {
+							msg := fmt.Sprintf(
+								"expected error from trying to delete built-in group %s",
+								groupName,
+							)
+							httpError(t, w, msg)
+						}
+					})
+
+					t.Run("CannotAddUser", func(t *testing.T) {
+						w := httptest.NewRecorder()
+						username := "user-not-getting-added"
+						body := []byte(fmt.Sprintf(`{"name": "%s"}`, username))
+						req := newRequest("POST", "/user", bytes.NewBuffer(body))
+						handler.ServeHTTP(w, req)
+
+						w = httptest.NewRecorder()
+						url := fmt.Sprintf("/group/%s/user", groupName)
+						body = []byte(fmt.Sprintf(`{"username": "%s"}`, username))
+						req = newRequest("POST", url, bytes.NewBuffer(body))
+						handler.ServeHTTP(w, req)
+						if w.Code != http.StatusBadRequest {
+							httpError(t, w, "expected error adding user to built in group")
+						}
+					})
+				})
+			}
+		})
+
+		tearDown(t)
+	})
+
+	t.Run("Auth", func(t *testing.T) {
+		tearDown := testSetup(t)
+
+		t.Run("Mapping", func(t *testing.T) {
+			setupTestPolicy(t)
+			_, _, anonymousAuthMapping := setupAnonymousPolicies(t)
+			_, _, loggedInAuthMapping := setupLoggedInPolicies(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+
+			// testUserAuthMappingResponse checks whether the AuthMapping in the HTTP
+			// response 'w' contains the correct resources and actions that belong to the user.
+			// This includes the resources and actions that belong to the anonymous and loggedIn groups.
+			testUserAuthMappingResponse := func(t *testing.T, w *httptest.ResponseRecorder) {
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, 200, w.Code, msg)
+				result := make(map[string][]arborist.Action)
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth mapping")
+				}
+				msg = fmt.Sprintf("result does not contain expected resource %s", resourcePath)
+				assert.Contains(t, result, resourcePath, msg)
+				action := arborist.Action{Service: serviceName, Method: methodName}
+				msg = fmt.Sprintf("result does not contain expected action %s", action)
+				assert.Contains(t, result[resourcePath], action, msg)
+
+				// Expect response to also contain anonymous and loggedIn groups.
+				msg = fmt.Sprintf("Expected to see these auth mappings from anonymous group in response: %v, but got: %v", anonymousAuthMapping, result)
+				for resource, actions := range anonymousAuthMapping {
+					assert.Contains(t, result, resource, msg)
+					assert.ElementsMatch(t, result[resource], actions, msg)
+				}
+				msg = fmt.Sprintf("Expected to see these auth mappings from loggedIn group in response: %v, but got: %v", loggedInAuthMapping, result)
+				for resource, actions := range loggedInAuthMapping {
+					assert.Contains(t, result, resource, msg)
+					assert.ElementsMatch(t, result[resource], actions, msg)
+				}
+			}
+
+			// testAnonymousAuthMappingResponse checks whether the AuthMapping in the HTTP response 'w'
+			// ONLY contains the correct resources and actions that belong to the anonymous group.
+			testAnonymousAuthMappingResponse := func(t *testing.T, w *httptest.ResponseRecorder) {
+				assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
+
+				// expect result to contain only authMappings of anonymous policies
+				result := make(arborist.AuthMapping)
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth mapping")
+				}
+				msg := fmt.Sprintf("Expected these auth mappings from anonymous group: %v \t Got: %v", anonymousAuthMapping, result)
+				for resource, actions := range result {
+					assert.Contains(t, anonymousAuthMapping, resource, msg)
+					assert.ElementsMatch(t, anonymousAuthMapping[resource], actions, msg)
+				}
+			}
+
+			// testClientAuthMappingResponse checks whether the AuthMapping in the HTTP
+			// response 'w' contains the correct resources and actions that belong to the client.
+			// This does NOT include the resources and actions that belong to the anonymous and loggedIn groups.
+			testClientAuthMappingResponse := func(t *testing.T, w *httptest.ResponseRecorder) {
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, 200, w.Code, msg)
+				result := make(map[string][]arborist.Action)
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth mapping")
+				}
+				msg = fmt.Sprintf("result does not contain expected resource %s", resourcePath)
+				assert.Contains(t, result, resourcePath, msg)
+				action := arborist.Action{Service: serviceName, Method: methodName}
+				msg = fmt.Sprintf("result does not contain expected action %s", action)
+				assert.Contains(t, result[resourcePath], action, msg)
+			}
+
+			t.Run("GET_usernameQueryParam", func(t *testing.T) {
+				// this endpoint should not handle the "username" query parameter anymore
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/auth/mapping?username=%s", username)
+				req := newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+
+				// expect a 200 OK response
+				assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
+
+				// expect result to only contain anonymous and loggedIn auth mappings, not the user's mappings.
+				result := make(arborist.AuthMapping)
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth mapping")
+				}
+				expectedMappings := make(arborist.AuthMapping)
+				for k, v := range anonymousAuthMapping {
+					expectedMappings[k] = v
+				}
+				for k, v := range loggedInAuthMapping {
+					expectedMappings[k] = v
+				}
+				msg := fmt.Sprintf("Expected to see these auth mappings from anonymous and logged-in groups in response: %v, but got: %v", expectedMappings, result)
+				for resource, actions := range result {
+					assert.Contains(t, expectedMappings, resource, msg)
+					assert.ElementsMatch(t, expectedMappings[resource], actions, msg)
+				}
+			})
+
+			t.Run("GET", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := "/auth/mapping"
+				req := newRequest("GET", url, nil)
+				token := TestJWT{username: username}
+				req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+				handler.ServeHTTP(w, req)
+				// expect to receive user's auth mappings, as well as auth mappings of anonymous and logged-in policies
+				testUserAuthMappingResponse(t, w)
+			})
+
+			t.Run("GET_userDoesNotExist", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := "/auth/mapping"
+				req := newRequest("GET", url, nil)
+				badUsername := "hulkhogan12"
+				token := TestJWT{username: badUsername}
+				req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+				handler.ServeHTTP(w, req)
+
+				// expect a 200 OK response
+				assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
+
+				// expect result to only contain anonymous and loggedIn auth mappings.
+				result := make(arborist.AuthMapping)
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth mapping")
+				}
+				expectedMappings := make(arborist.AuthMapping)
+				for k, v := range anonymousAuthMapping {
+					expectedMappings[k] = v
+				}
+				for k, v := range loggedInAuthMapping {
+					expectedMappings[k] = v
+				}
+				msg := fmt.Sprintf("Expected response to be these auth mappings from anonymous and logged-in groups: %v", expectedMappings)
+				for resource, actions := range result {
+					assert.Contains(t, expectedMappings, resource, msg)
+					assert.ElementsMatch(t, expectedMappings[resource], actions, msg)
+				}
+			})
+
+			t.Run("GET_noUsernameProvided", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				url := "/auth/mapping"
+				req := newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+				testAnonymousAuthMappingResponse(t, w)
+			})
+
+			t.Run("GET_expiredPolicy", func(t *testing.T) {
+				expiredTimestamp := time.Now().Add(time.Duration(-1) * time.Minute).Format(time.RFC3339)
+				grantUserPolicy(t, username, policyName, expiredTimestamp)
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/auth/mapping?username=%s", username)
+				req := newRequest("GET", url, nil)
+				handler.ServeHTTP(w, req)
+
+				result := make(map[string][]arborist.Action)
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth mapping")
+				}
+				msg := fmt.Sprintf("result contains resource %s corresponding to expired policy %s", resourcePath, policyName)
+				assert.NotContains(t, result, resourcePath, msg)
+				grantUserPolicy(t, username, policyName, "null")
+			})
+
+			t.Run("POST_body", func(t *testing.T) {
+				t.Run("usernameProvided", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(fmt.Sprintf(`{"username": "%s"}`, username))
+					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					// expect to also receive auth mappings of anonymous and logged-in policies
+					testUserAuthMappingResponse(t, w)
+				})
+
+				t.Run("userDoesNotExist", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					badUsername := "hulkhogan12"
+					body := []byte(fmt.Sprintf(`{"username": "%s"}`, badUsername))
+					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
+
+					// expect result to only contain anonymous and loggedIn auth mappings.
+					result := make(arborist.AuthMapping)
+					err = json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth mapping")
+					}
+					expectedMappings := make(arborist.AuthMapping)
+					for k, v := range anonymousAuthMapping {
+						expectedMappings[k] = v
+					}
+					for k, v := range loggedInAuthMapping {
+						expectedMappings[k] = v
+					}
+					msg := fmt.Sprintf("Expected response to be these auth mappings from anonymous and logged-in groups: %v", expectedMappings)
+					for resource, actions := range result {
+						assert.Contains(t, expectedMappings, resource, msg)
+						assert.ElementsMatch(t, expectedMappings[resource], actions, msg)
+					}
+				})
+
+				createClientBytes(t, clientBody)
+				grantClientPolicy(t, clientID, policyName)
+
+				t.Run("noUsernameOrClientIdProvided", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte("")
+					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					testAnonymousAuthMappingResponse(t, w)
+				})
+
+				t.Run("bothUsernameAndClientIdProvided", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(fmt.Sprintf(`{"username": "%s", "clientID": "%s"}`, username, clientID))
+					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					assert.Equal(t, w.Code, http.StatusBadRequest, "expected a 400 response")
+				})
+
+				t.Run("clientIdProvided", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(fmt.Sprintf(`{"clientID": "%s"}`, clientID))
+					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					testClientAuthMappingResponse(t, w)
+				})
+
+				t.Run("clientIdDoesNotExist", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(`{"clientID": "badClientId"}`)
+					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
+
+					result := make(map[string][]arborist.Action)
+					err = json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth mapping")
+					}
+					assert.Equal(t, map[string][]arborist.Action{}, result, "expected an empty result")
+				})
+			})
+
+			t.Run("POST_token", func(t *testing.T) {
+				t.Run("usernameProvided", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/auth/mapping", nil)
+					token := TestJWT{username: username}
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					handler.ServeHTTP(w, req)
+					// expect to also receive auth mappings of anonymous and logged-in policies
+					testUserAuthMappingResponse(t, w)
+				})
+
+				t.Run("userDoesNotExist", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					badUsername := "hulkhogan12"
+					req := newRequest("POST", "/auth/mapping", nil)
+					token := TestJWT{username: badUsername}
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					handler.ServeHTTP(w, req)
+					assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
+
+					// expect result to only contain anonymous and loggedIn auth mappings.
+					result := make(arborist.AuthMapping)
+					err = json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth mapping")
+					}
+					expectedMappings := make(arborist.AuthMapping)
+					for k, v := range anonymousAuthMapping {
+						expectedMappings[k] = v
+					}
+					for k, v := range loggedInAuthMapping {
+						expectedMappings[k] = v
+					}
+					msg := fmt.Sprintf("Expected response to be these auth mappings from anonymous and logged-in groups: %v", expectedMappings)
+					for resource, actions := range result {
+						assert.Contains(t, expectedMappings, resource, msg)
+						assert.ElementsMatch(t, expectedMappings[resource], actions, msg)
+					}
+				})
+
+				t.Run("noUsernameOrClientIdProvided", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/auth/mapping", nil)
+					token := TestJWT{}
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					handler.ServeHTTP(w, req)
+					assert.Equal(t, w.Code, http.StatusUnauthorized, "expected a 401 response")
+				})
+
+				t.Run("bothUsernameAndClientIdProvided", func(t *testing.T) {
+					// when both are present, the returned access should be the user's
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/auth/mapping", nil)
+					token := TestJWT{username: username, clientID: clientID}
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					handler.ServeHTTP(w, req)
+					testUserAuthMappingResponse(t, w)
+				})
+
+				t.Run("clientIdProvided", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/auth/mapping", nil)
+					token := TestJWT{clientID: clientID}
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					handler.ServeHTTP(w, req)
+					testClientAuthMappingResponse(t, w)
+				})
+
+				t.Run("clientIdDoesNotExist", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/auth/mapping", nil)
+					token := TestJWT{clientID: "badClientId"}
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					handler.ServeHTTP(w, req)
+					assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
+
+					result := make(map[string][]arborist.Action)
+					err = json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth mapping")
+					}
+					assert.Equal(t, map[string][]arborist.Action{}, result, "expected an empty result")
+				})
+			})
+
+			t.Run("POST_noBodyOrTokenProvided", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/auth/mapping", nil)
+				handler.ServeHTTP(w, req)
+				testAnonymousAuthMappingResponse(t, w)
+			})
+
+			t.Run("GET_unionAcrossPolicies", func(t *testing.T) {
+				// a second policy on the same resource, with a role that overlaps
+				// the first one, should add its methods without duplicating any
+				otherRoleName := "mapping-union-role"
+				otherMethodName := "uiop"
+				otherPolicyName := "mapping-union-policy"
+				createRoleBytes(t, []byte(fmt.Sprintf(
+					`{
+						"id": "%s",
+						"permissions": [
+							{"id": "%s", "action": {"service": "%s", "method": "%s"}},
+							{"id": "%s", "action": {"service": "%s", "method": "%s"}}
+						]
+					}`,
+					otherRoleName,
+					permissionName,
+					serviceName,
+					methodName,
+					otherMethodName,
+					serviceName,
+					otherMethodName,
+				)))
+				createPolicyBytes(t, []byte(fmt.Sprintf(
+					`{
+						"id": "%s",
+						"resource_paths": ["%s"],
+						"role_ids": ["%s"]
+					}`,
+					otherPolicyName,
+					resourcePath,
+					otherRoleName,
+				)))
+				grantUserPolicy(t, username, otherPolicyName, "null")
+
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/auth/mapping", nil)
+				token := TestJWT{username: username}
+				req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth mapping request failed")
+				}
+				result := make(arborist.AuthMapping)
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth mapping")
+				}
+				expected := []arborist.Action{
+					{Service: serviceName, Method: methodName},
+					{Service: serviceName, Method: otherMethodName},
+				}
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.ElementsMatch(t, expected, result[resourcePath], msg)
+
+				revokeUserPolicy(t, username, otherPolicyName)
+			})
+		})
+
+		deleteEverything()
+
+		t.Run("Request", func(t *testing.T) {
+			setupTestPolicy(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+			w := httptest.NewRecorder()
+			token := TestJWT{username: username}
+			body := []byte(fmt.Sprintf(
+				`{
+					"user": {"token": "%s"},
+					"request": {
+						"resource": "%s",
+						"action": {
+							"service": "%s",
+							"method": "%s"
+						}
+					}
+				}`,
+				token.Encode(),
+				resourcePath,
+				serviceName,
+				methodName,
+			))
+			req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "auth request failed")
+			}
+			// request should succeed, user has authorization
+			result := struct {
+				Auth bool `json:"auth"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from auth request")
+			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, true, result.Auth, msg)
+
+			t.Run("Tag", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				tag, err := getTagForResource(resourcePath)
+				if err != nil {
+					httpError(t, w, "couldn't get tag for resource")
+				}
+				body := []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {"service": "%s", "method": "%s"}
+						}
+					}`,
+					token.Encode(),
+					tag,
+					serviceName,
+					methodName,
+				))
+				req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				// request should succeed, user has authorization
+				result := struct {
+					Auth bool `json:"auth"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, true, result.Auth, msg)
+			})
+
+			t.Run("GrantingPolicy", func(t *testing.T) {
+				decision := func(t *testing.T, resource string) map[string]interface{} {
+					w := httptest.NewRecorder()
+					body := []byte(fmt.Sprintf(
+						`{
+							"user": {"token": "%s"},
+							"request": {
+								"resource": "%s",
+								"action": {"service": "%s", "method": "%s"}
+							}
+						}`,
+						token.Encode(),
+						resource,
+						serviceName,
+						methodName,
+					))
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth request failed")
+					}
+					result := map[string]interface{}{}
+					err := json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth request")
+					}
+					return result
+				}
+
+				result := decision(t, resourcePath)
+				assert.Equal(t, true, result["auth"], "got response: %v", result)
+				assert.Equal(t, policyName, result["policy_id"], "got response: %v", result)
+				assert.Equal(t, roleName, result["role_id"], "got response: %v", result)
+
+				result = decision(t, "/wrongresource")
+				assert.Equal(t, false, result["auth"], "got response: %v", result)
+				assert.NotContains(t, result, "policy_id")
+				assert.NotContains(t, result, "role_id")
+			})
+
+			t.Run("Unauthorized", func(t *testing.T) {
+				w = httptest.NewRecorder()
+				token = TestJWT{username: username}
+				body = []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					token.Encode(),
+					"/wrongresource", // TODO: get errors if these contain slashes
+					serviceName,
+					methodName,
+				))
+				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				// request should fail
+				result = struct {
+					Auth bool `json:"auth"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				msg = fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, false, result.Auth, msg)
+			})
+
+			t.Run("ExpiredPolicy", func(t *testing.T) {
+				expiredTimestamp := time.Now().Add(time.Duration(-1) * time.Minute).Format(time.RFC3339)
+				grantUserPolicy(t, username, policyName, expiredTimestamp)
+				w = httptest.NewRecorder()
+				token = TestJWT{username: username}
+				body = []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				// request should fail
+				result = struct {
+					Auth bool `json:"auth"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				msg = fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, false, result.Auth, msg)
+				grantUserPolicy(t, username, policyName, "null")
+			})
+
+			t.Run("UnexpiredPolicy", func(t *testing.T) {
+				futureTimestamp := time.Now().Add(time.Hour).Format(time.RFC3339)
+				grantUserPolicy(t, username, policyName, futureTimestamp)
+				w := httptest.NewRecorder()
+				token := TestJWT{username: username}
+				body := []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				// request should succeed until the grant expires
+				result := struct {
+					Auth bool `json:"auth"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, true, result.Auth, msg)
+
+				// the user read endpoint reports how long the grant has left
+				w = httptest.NewRecorder()
+				req = newRequest("GET", fmt.Sprintf("/user/%s", username), nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read user")
+				}
+				user := arborist.User{}
+				err = json.Unmarshal(w.Body.Bytes(), &user)
+				if err != nil {
+					httpError(t, w, "couldn't read response from user read")
+				}
+				msg = fmt.Sprintf("got response body: %s", w.Body.String())
+				found := false
+				for _, binding := range user.Policies {
+					if binding.Policy == policyName && binding.ExpiresIn != nil {
+						found = true
+						assert.True(t, *binding.ExpiresIn > 0 && *binding.ExpiresIn <= 3600, msg)
+					}
+				}
+				assert.True(t, found, msg)
+				grantUserPolicy(t, username, policyName, "null")
+			})
+
+			t.Run("BadRequest", func(t *testing.T) {
+
+				t.Run("NotJSON", func(t *testing.T) {
+					w = httptest.NewRecorder()
+					token = TestJWT{username: username}
+					body = []byte("not real JSON")
+					req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusBadRequest {
+						httpError(t, w, "expected error")
+					}
+				})
+
+				t.Run("MissingFields", func(t *testing.T) {
+					w = httptest.NewRecorder()
+					token = TestJWT{username: username}
+					body = []byte(fmt.Sprintf(
+						`{
+							"user": {"token": "%s"}
+						}`,
+						token.Encode(),
+					))
+					req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusBadRequest {
+						httpError(t, w, "expected error from request missing fields")
+					}
+				})
+			})
+
+			createClientBytes(t, clientBody)
+
+			t.Run("ClientForbidden", func(t *testing.T) {
+				w = httptest.NewRecorder()
+				token = TestJWT{username: username, clientID: clientID}
+				body = []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				// request should fail
+				result = struct {
+					Auth bool `json:"auth"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				msg = fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, false, result.Auth, msg)
+			})
+
+			t.Run("ClientOnlyForbidden", func(t *testing.T) {
+				// same as `ClientForbidden` but with a client token
+				w = httptest.NewRecorder()
+				token = TestJWT{clientID: clientID}
+				body = []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				result = struct {
+					Auth bool `json:"auth"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				if result.Auth != false {
+					httpError(t, w, "auth request succeeded when it should not have")
+				}
+			})
+
+			grantClientPolicy(t, clientID, policyName)
+
+			t.Run("ClientBothOK", func(t *testing.T) {
+				w = httptest.NewRecorder()
+				token = TestJWT{username: username, clientID: clientID}
+				body = []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				result = struct {
+					Auth bool `json:"auth"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				msg = fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, true, result.Auth, msg)
+			})
+
+			t.Run("ClientOnlyOK", func(t *testing.T) {
+				// same as `ClientBothOK` but with a client token
+				w = httptest.NewRecorder()
+				token = TestJWT{clientID: clientID}
+				body = []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				result = struct {
+					Auth bool `json:"auth"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				if result.Auth != true {
+					httpError(t, w, "auth request failed")
+				}
+			})
+
+			t.Run("QueryUsingUserID", func(t *testing.T) {
+				w = httptest.NewRecorder()
+				body = []byte(fmt.Sprintf(
+					`{
+						"user": {"user_id": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					username,
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				// request should fail
+				result = struct {
+					Auth bool `json:"auth"`
+				}{}
+				err = json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				msg = fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, true, result.Auth, msg)
+			})
+
+			t.Run("AdminPolicy", func(t *testing.T) {
+				// the test user holds `policyName`, so treat it as the admin
+				// policy and check the test user from another user's token
+				server.WithAdminPolicy(policyName)
+				defer server.WithAdminPolicy("")
+				otherUsername := "test-not-admin"
+				createUserBytes(t, []byte(fmt.Sprintf(`{"name": "%s"}`, otherUsername)))
+				body := []byte(fmt.Sprintf(
+					`{
+						"user": {"user_id": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					username,
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+
+				t.Run("Admin", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+					token := TestJWT{username: username}
+					req.Header.Add("Authorization", "Bearer "+token.Encode())
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth request from admin failed")
+					}
+					result := struct {
+						Auth bool `json:"auth"`
+					}{}
+					err := json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth request")
+					}
+					assert.True(t, result.Auth, "got response body: %s", w.Body.String())
+				})
+
+				t.Run("NotAdmin", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+					token := TestJWT{username: otherUsername}
+					req.Header.Add("Authorization", "Bearer "+token.Encode())
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusForbidden {
+						httpError(t, w, "expected 403 for caller without admin policy")
+					}
+					assert.Equal(t, "forbidden", errorCode(t, w))
+				})
+
+				t.Run("NoToken", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusUnauthorized {
+						httpError(t, w, "expected 401 for caller without token")
+					}
+					assert.Equal(t, "missing_token", errorCode(t, w))
+				})
+
+				t.Run("Batch", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					batch := []byte(fmt.Sprintf("[%s, %s]", body, body))
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(batch))
+					token := TestJWT{username: otherUsername}
+					req.Header.Add("Authorization", "Bearer "+token.Encode())
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusForbidden {
+						httpError(t, w, "expected 403 for batch from caller without admin policy")
+					}
+				})
+			})
+
+			t.Run("Group", func(t *testing.T) {
+				// a user with no direct grants should inherit the policies of
+				// every group they belong to, and lose them when removed
+				memberName := "test-group-member"
+				memberGroupName := "test-request-group"
+				createUserBytes(t, []byte(fmt.Sprintf(`{"name": "%s"}`, memberName)))
+				createGroupBytes(t, []byte(fmt.Sprintf(
+					`{"name": "%s", "policies": [], "users": []}`,
+					memberGroupName,
+				)))
+				grantGroupPolicy(t, memberGroupName, policyName)
+				token := TestJWT{username: memberName}
+				body := []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				authorized := func(t *testing.T) bool {
+					w := httptest.NewRecorder()
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth request failed")
+					}
+					result := struct {
+						Auth bool `json:"auth"`
+					}{}
+					err := json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth request")
+					}
+					return result.Auth
+				}
+
+				assert.False(t, authorized(t), "user not in group should not be authorized")
+				addUserToGroup(t, memberName, memberGroupName)
+				assert.True(t, authorized(t), "group member should inherit group policy")
+
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/group/%s/user/%s", memberGroupName, memberName)
+				req := newRequest("DELETE", url, nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusNoContent {
+					httpError(t, w, "couldn't remove user from group")
+				}
+				assert.False(t, authorized(t), "user removed from group should not be authorized")
+			})
+		})
+
+		deleteEverything()
+
+		t.Run("RequestMultiple", func(t *testing.T) {
+			setupTestPolicy(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+			w := httptest.NewRecorder()
+			token := TestJWT{username: username}
+			// TODO (rudyardrichter, 2019-04-22): this works just for testing
+			// the `requests` thing but it would be better if it actually was
+			// using distinct policies
+			body := []byte(fmt.Sprintf(
+				`{
+					"user": {"token": "%s"},
+					"requests": [
+						{
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						},
+						{
+							"resource": "%s",
+							"action": {
+								"service": "%s",
+								"method": "%s"
+							}
+						}
+					]
+				}`,
+				token.Encode(),
+				resourcePath,
+				serviceName,
+				methodName,
+				resourcePath,
+				serviceName,
+				methodName,
+			))
+			req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "auth request failed")
+			}
+			// request should succeed, user has authorization
+			result := struct {
+				Auth bool `json:"auth"`
+			}{}
+			err = json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from auth request")
 			}
+			msg := fmt.Sprintf("got response body: %s", w.Body.String())
+			assert.Equal(t, true, result.Auth, msg)
 
-			t.Run("GET_usernameQueryParam", func(t *testing.T) {
-				// this endpoint should not handle the "username" query parameter anymore
+			t.Run("UsingStar", func(t *testing.T) {
+				createRoleBytes(
+					t,
+					[]byte(`{
+						"id": "roleUsingStar",
+						"permissions": [
+							{"id": "serviceStar", "action": {"service": "*", "method": "read"}}
+						]
+					}`),
+				)
+				createPolicyBytes(
+					t,
+					[]byte(fmt.Sprintf(
+						`{
+							"id": "policyUsingStar",
+							"resource_paths": ["%s"],
+							"role_ids": ["roleUsingStar"]
+						}`,
+						resourcePath,
+					)),
+				)
+				grantUserPolicy(t, username, "policyUsingStar", "null")
 				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/auth/mapping?username=%s", username)
-				req := newRequest("GET", url, nil)
+				token := TestJWT{username: username}
+				body := []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {
+								"service": "shouldNotMatter",
+								"method": "read"
+							}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+				))
+				req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-
-				// expect a 200 OK response
-				assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
-
-				// expect result to only contain anonymous and loggedIn auth mappings, not the user's mappings.
-				result := make(arborist.AuthMapping)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				// request should succeed, user has authorization
+				result := struct {
+					Auth bool `json:"auth"`
+				}{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from auth mapping")
-				}
-				expectedMappings := make(arborist.AuthMapping)
-				for k, v := range anonymousAuthMapping {
-					expectedMappings[k] = v
-				}
-				for k, v := range loggedInAuthMapping {
-					expectedMappings[k] = v
-				}
-				msg := fmt.Sprintf("Expected to see these auth mappings from anonymous and logged-in groups in response: %v, but got: %v", expectedMappings, result)
-				for resource, actions := range result {
-					assert.Contains(t, expectedMappings, resource, msg)
-					assert.ElementsMatch(t, expectedMappings[resource], actions, msg)
+					httpError(t, w, "couldn't read response from auth request")
 				}
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, true, result.Auth, msg)
 			})
 
-			t.Run("GET", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				url := "/auth/mapping"
-				req := newRequest("GET", url, nil)
-				token := TestJWT{username: username}
-				req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
-				handler.ServeHTTP(w, req)
-				// expect to receive user's auth mappings, as well as auth mappings of anonymous and logged-in policies
-				testUserAuthMappingResponse(t, w)
-			})
-
-			t.Run("GET_userDoesNotExist", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				url := "/auth/mapping"
-				req := newRequest("GET", url, nil)
-				badUsername := "hulkhogan12"
-				token := TestJWT{username: badUsername}
-				req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+			t.Run("Unauthorized", func(t *testing.T) {
+				w = httptest.NewRecorder()
+				token = TestJWT{username: username}
+				body = []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"requests": [
+							{
+								"resource": "%s",
+								"action": {
+									"service": "%s",
+									"method": "%s"
+								}
+							},
+							{
+								"resource": "%s",
+								"action": {
+									"service": "%s",
+									"method": "%s"
+								}
+							}
+						]
+					}`,
+					token.Encode(),
+					"/wrongresource", // TODO: get errors if these contain dashes
+					serviceName,
+					methodName,
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-
-				// expect a 200 OK response
-				assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
-
-				// expect result to only contain anonymous and loggedIn auth mappings.
-				result := make(arborist.AuthMapping)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				// request should fail
+				result = struct {
+					Auth bool `json:"auth"`
+				}{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from auth mapping")
-				}
-				expectedMappings := make(arborist.AuthMapping)
-				for k, v := range anonymousAuthMapping {
-					expectedMappings[k] = v
-				}
-				for k, v := range loggedInAuthMapping {
-					expectedMappings[k] = v
-				}
-				msg := fmt.Sprintf("Expected response to be these auth mappings from anonymous and logged-in groups: %v", expectedMappings)
-				for resource, actions := range result {
-					assert.Contains(t, expectedMappings, resource, msg)
-					assert.ElementsMatch(t, expectedMappings[resource], actions, msg)
+					httpError(t, w, "couldn't read response from auth request")
 				}
+				msg = fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, false, result.Auth, msg)
 			})
 
-			t.Run("GET_noUsernameProvided", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				url := "/auth/mapping"
-				req := newRequest("GET", url, nil)
-				handler.ServeHTTP(w, req)
-				testAnonymousAuthMappingResponse(t, w)
-			})
-
-			t.Run("GET_expiredPolicy", func(t *testing.T) {
-				expiredTimestamp := time.Now().Add(time.Duration(-1) * time.Minute).Format(time.RFC3339)
-				grantUserPolicy(t, username, policyName, expiredTimestamp)
+			t.Run("Batch", func(t *testing.T) {
+				token := TestJWT{username: username}
+				entry := `{
+					"user": {"token": "%s"},
+					"request": {
+						"resource": "%s",
+						"action": {"service": "%s", "method": "%s"}
+					}
+				}`
+				body := []byte(fmt.Sprintf(
+					"[%s, %s, %s]",
+					fmt.Sprintf(entry, token.Encode(), resourcePath, serviceName, methodName),
+					fmt.Sprintf(entry, token.Encode(), "/wrongresource", serviceName, methodName),
+					fmt.Sprintf(entry, token.Encode(), resourcePath, serviceName, "wrongmethod"),
+				))
+				decodesBefore := jwtApp.decodes
 				w := httptest.NewRecorder()
-				url := fmt.Sprintf("/auth/mapping?username=%s", username)
-				req := newRequest("GET", url, nil)
+				req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-
-				result := make(map[string][]arborist.Action)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				result := []struct {
+					Auth bool `json:"auth"`
+				}{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from auth mapping")
+					httpError(t, w, "couldn't read response from auth request")
 				}
-				msg := fmt.Sprintf("result contains resource %s corresponding to expired policy %s", resourcePath, policyName)
-				assert.NotContains(t, result, resourcePath, msg)
-				grantUserPolicy(t, username, policyName, "null")
-			})
-
-			t.Run("POST_body", func(t *testing.T) {
-				t.Run("usernameProvided", func(t *testing.T) {
-					w := httptest.NewRecorder()
-					body := []byte(fmt.Sprintf(`{"username": "%s"}`, username))
-					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
-					handler.ServeHTTP(w, req)
-					// expect to also receive auth mappings of anonymous and logged-in policies
-					testUserAuthMappingResponse(t, w)
-				})
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				if assert.Len(t, result, 3, msg) {
+					assert.True(t, result[0].Auth, msg)
+					assert.False(t, result[1].Auth, msg)
+					assert.False(t, result[2].Auth, msg)
+				}
+				assert.Equal(t, 1, jwtApp.decodes-decodesBefore, "expected the shared token to be decoded once")
 
-				t.Run("userDoesNotExist", func(t *testing.T) {
+				t.Run("Invalid", func(t *testing.T) {
 					w := httptest.NewRecorder()
-					badUsername := "hulkhogan12"
-					body := []byte(fmt.Sprintf(`{"username": "%s"}`, badUsername))
-					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
+					body := []byte(fmt.Sprintf(
+						`[%s, {"user": {"token": "%s"}}]`,
+						fmt.Sprintf(entry, token.Encode(), resourcePath, serviceName, methodName),
+						token.Encode(),
+					))
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 					handler.ServeHTTP(w, req)
-					assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
-
-					// expect result to only contain anonymous and loggedIn auth mappings.
-					result := make(arborist.AuthMapping)
-					err = json.Unmarshal(w.Body.Bytes(), &result)
-					if err != nil {
-						httpError(t, w, "couldn't read response from auth mapping")
-					}
-					expectedMappings := make(arborist.AuthMapping)
-					for k, v := range anonymousAuthMapping {
-						expectedMappings[k] = v
-					}
-					for k, v := range loggedInAuthMapping {
-						expectedMappings[k] = v
-					}
-					msg := fmt.Sprintf("Expected response to be these auth mappings from anonymous and logged-in groups: %v", expectedMappings)
-					for resource, actions := range result {
-						assert.Contains(t, expectedMappings, resource, msg)
-						assert.ElementsMatch(t, expectedMappings[resource], actions, msg)
+					if w.Code != http.StatusBadRequest {
+						httpError(t, w, "expected 400 for invalid entry in batch")
 					}
+					assert.Contains(t, w.Body.String(), "index 1", "expected error to name the invalid entry")
 				})
+			})
+		})
 
-				createClientBytes(t, clientBody)
-				grantClientPolicy(t, clientID, policyName)
+		deleteEverything()
 
-				t.Run("noUsernameOrClientIdProvided", func(t *testing.T) {
-					w := httptest.NewRecorder()
-					body := []byte("")
-					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
-					handler.ServeHTTP(w, req)
-					testAnonymousAuthMappingResponse(t, w)
-				})
+		t.Run("RequestWildcard", func(t *testing.T) {
+			createRoleBytes(t, roleBody)
+			createResourceBytes(t, []byte(`{
+				"path": "/wildcard",
+				"subresources": [
+					{"name": "*", "subresources": [{"name": "projects"}]}
+				]
+			}`))
+			createResourceBytes(t, []byte(`{
+				"path": "/trailing",
+				"subresources": [{"name": "*"}]
+			}`))
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{
+					"id": "wildcard-policy",
+					"resource_paths": ["/wildcard/*/projects", "/trailing/*"],
+					"role_ids": ["%s"]
+				}`,
+				roleName,
+			)))
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, "wildcard-policy", "null")
+			token := TestJWT{username: username}
 
-				t.Run("bothUsernameAndClientIdProvided", func(t *testing.T) {
+			tests := []struct {
+				resource string
+				expected bool
+			}{
+				{"/wildcard/foo/projects", true},
+				{"/wildcard/foo/projects/bar", true},
+				{"/wildcard/*/projects", true},
+				{"/wildcard/foo/studies", false},
+				{"/wildcard/foo", false},
+				{"/wildcard/foo/bar/projects", false},
+				{"/trailing/foo", true},
+				{"/trailing/foo/bar/baz", true},
+				{"/trailing", false},
+				{"/trailingsibling/foo", false},
+			}
+			for _, test := range tests {
+				t.Run(test.resource, func(t *testing.T) {
 					w := httptest.NewRecorder()
-					body := []byte(fmt.Sprintf(`{"username": "%s", "clientID": "%s"}`, username, clientID))
-					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
+					body := []byte(fmt.Sprintf(
+						`{
+							"user": {"token": "%s"},
+							"request": {
+								"resource": "%s",
+								"action": {"service": "%s", "method": "%s"}
+							}
+						}`,
+						token.Encode(),
+						test.resource,
+						serviceName,
+						methodName,
+					))
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 					handler.ServeHTTP(w, req)
-					assert.Equal(t, w.Code, http.StatusBadRequest, "expected a 400 response")
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth request failed")
+					}
+					result := struct {
+						Auth bool `json:"auth"`
+					}{}
+					err = json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth request")
+					}
+					msg := fmt.Sprintf("got response body: %s", w.Body.String())
+					assert.Equal(t, test.expected, result.Auth, msg)
 				})
+			}
+		})
 
-				t.Run("clientIdProvided", func(t *testing.T) {
-					w := httptest.NewRecorder()
-					body := []byte(fmt.Sprintf(`{"clientID": "%s"}`, clientID))
-					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
-					handler.ServeHTTP(w, req)
-					testClientAuthMappingResponse(t, w)
-				})
+		deleteEverything()
 
-				t.Run("clientIdDoesNotExist", func(t *testing.T) {
+		t.Run("RequestHierarchy", func(t *testing.T) {
+			// one policy on a parent with `roleName`, and one directly on a
+			// child with a role allowing only `childMethod`
+			childMethod := "childmethod"
+			createRoleBytes(t, roleBody)
+			createRoleBytes(t, []byte(fmt.Sprintf(
+				`{
+					"id": "child-role",
+					"permissions": [
+						{"id": "child-permission", "action": {"service": "%s", "method": "%s"}}
+					]
+				}`,
+				serviceName,
+				childMethod,
+			)))
+			createResourceBytes(t, []byte(`{
+				"path": "/parent",
+				"subresources": [{"name": "child", "subresources": [{"name": "grandchild"}]}]
+			}`))
+			createResourceBytes(t, []byte(`{
+				"path": "/other",
+				"subresources": [{"name": "child"}, {"name": "sibling"}]
+			}`))
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "parent-policy", "resource_paths": ["/parent"], "role_ids": ["%s"]}`,
+				roleName,
+			)))
+			createPolicyBytes(t, []byte(
+				`{"id": "child-policy", "resource_paths": ["/other/child"], "role_ids": ["child-role"]}`,
+			))
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, "parent-policy", "null")
+			grantUserPolicy(t, username, "child-policy", "null")
+			token := TestJWT{username: username}
+
+			tests := []struct {
+				name     string
+				resource string
+				method   string
+				expected bool
+			}{
+				{"ParentGrant", "/parent", methodName, true},
+				{"InheritedFromParent", "/parent/child", methodName, true},
+				{"InheritedFromGrandparent", "/parent/child/grandchild", methodName, true},
+				{"ParentWrongMethod", "/parent/child", childMethod, false},
+				{"ChildGrant", "/other/child", childMethod, true},
+				{"ChildWrongMethod", "/other/child", methodName, false},
+				{"ChildDoesNotGrantParent", "/other", childMethod, false},
+				{"ChildDoesNotGrantSibling", "/other/sibling", childMethod, false},
+			}
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
 					w := httptest.NewRecorder()
-					body := []byte(`{"clientID": "badClientId"}`)
-					req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
+					body := []byte(fmt.Sprintf(
+						`{
+							"user": {"token": "%s"},
+							"request": {
+								"resource": "%s",
+								"action": {"service": "%s", "method": "%s"}
+							}
+						}`,
+						token.Encode(),
+						test.resource,
+						serviceName,
+						test.method,
+					))
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 					handler.ServeHTTP(w, req)
-					assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
-
-					result := make(map[string][]arborist.Action)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth request failed")
+					}
+					result := struct {
+						Auth bool `json:"auth"`
+					}{}
 					err = json.Unmarshal(w.Body.Bytes(), &result)
 					if err != nil {
-						httpError(t, w, "couldn't read response from auth mapping")
+						httpError(t, w, "couldn't read response from auth request")
 					}
-					assert.Equal(t, map[string][]arborist.Action{}, result, "expected an empty result")
+					msg := fmt.Sprintf("got response body: %s", w.Body.String())
+					assert.Equal(t, test.expected, result.Auth, msg)
 				})
-			})
+			}
+		})
 
-			t.Run("POST_token", func(t *testing.T) {
-				t.Run("usernameProvided", func(t *testing.T) {
-					w := httptest.NewRecorder()
-					req := newRequest("POST", "/auth/mapping", nil)
-					token := TestJWT{username: username}
-					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
-					handler.ServeHTTP(w, req)
-					// expect to also receive auth mappings of anonymous and logged-in policies
-					testUserAuthMappingResponse(t, w)
-				})
+		deleteEverything()
 
-				t.Run("userDoesNotExist", func(t *testing.T) {
+		t.Run("RequestConstraints", func(t *testing.T) {
+			createResourceBytes(t, resourceBody)
+			createRoleBytes(t, []byte(fmt.Sprintf(
+				`{
+					"id": "constrained-role",
+					"permissions": [
+						{
+							"id": "constrained-permission",
+							"action": {"service": "%s", "method": "%s"},
+							"constraints": {"env": "prod"}
+						}
+					]
+				}`,
+				serviceName,
+				methodName,
+			)))
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "constrained-policy", "resource_paths": ["%s"], "role_ids": ["constrained-role"]}`,
+				resourcePath,
+			)))
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, "constrained-policy", "null")
+			token := TestJWT{username: username}
+
+			// the requests only differ by their constraints or context
+			tests := []struct {
+				name        string
+				field       string
+				constraints string
+				expected    bool
+			}{
+				{"Match", "constraints", `{"env": "prod"}`, true},
+				{"ExtraKeys", "constraints", `{"env": "prod", "region": "us"}`, true},
+				{"DifferentValue", "constraints", `{"env": "dev"}`, false},
+				{"Missing", "constraints", `{}`, false},
+				{"MissingField", "constraints", ``, false},
+				{"ContextMatch", "context", `{"env": "prod"}`, true},
+				{"ContextDifferentValue", "context", `{"env": "dev"}`, false},
+				{"ContextSetMember", "context", `{"env": ["dev", "prod"]}`, true},
+				{"ContextSetNotMember", "context", `{"env": ["dev", "test"]}`, false},
+				{"ContextEmptySet", "context", `{"env": []}`, false},
+			}
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					constraints := ""
+					if test.constraints != "" {
+						constraints = fmt.Sprintf(`, "%s": %s`, test.field, test.constraints)
+					}
 					w := httptest.NewRecorder()
-					badUsername := "hulkhogan12"
-					req := newRequest("POST", "/auth/mapping", nil)
-					token := TestJWT{username: badUsername}
-					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					body := []byte(fmt.Sprintf(
+						`{
+							"user": {"token": "%s"},
+							"request": {
+								"resource": "%s",
+								"action": {"service": "%s", "method": "%s"}%s
+							}
+						}`,
+						token.Encode(),
+						resourcePath,
+						serviceName,
+						methodName,
+						constraints,
+					))
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 					handler.ServeHTTP(w, req)
-					assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
-
-					// expect result to only contain anonymous and loggedIn auth mappings.
-					result := make(arborist.AuthMapping)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth request failed")
+					}
+					result := struct {
+						Auth bool `json:"auth"`
+					}{}
 					err = json.Unmarshal(w.Body.Bytes(), &result)
 					if err != nil {
-						httpError(t, w, "couldn't read response from auth mapping")
-					}
-					expectedMappings := make(arborist.AuthMapping)
-					for k, v := range anonymousAuthMapping {
-						expectedMappings[k] = v
-					}
-					for k, v := range loggedInAuthMapping {
-						expectedMappings[k] = v
-					}
-					msg := fmt.Sprintf("Expected response to be these auth mappings from anonymous and logged-in groups: %v", expectedMappings)
-					for resource, actions := range result {
-						assert.Contains(t, expectedMappings, resource, msg)
-						assert.ElementsMatch(t, expectedMappings[resource], actions, msg)
+						httpError(t, w, "couldn't read response from auth request")
 					}
+					msg := fmt.Sprintf("got response body: %s", w.Body.String())
+					assert.Equal(t, test.expected, result.Auth, msg)
 				})
+			}
+		})
 
-				t.Run("noUsernameOrClientIdProvided", func(t *testing.T) {
-					w := httptest.NewRecorder()
-					req := newRequest("POST", "/auth/mapping", nil)
-					token := TestJWT{}
-					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
-					handler.ServeHTTP(w, req)
-					assert.Equal(t, w.Code, http.StatusUnauthorized, "expected a 401 response")
-				})
+		t.Run("RequestContextInvalid", func(t *testing.T) {
+			token := TestJWT{username: username}
+			w := httptest.NewRecorder()
+			body := []byte(fmt.Sprintf(
+				`{
+					"user": {"token": "%s"},
+					"request": {
+						"resource": "%s",
+						"action": {"service": "%s", "method": "%s"},
+						"context": {"env": 1}
+					}
+				}`,
+				token.Encode(),
+				resourcePath,
+				serviceName,
+				methodName,
+			))
+			req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				httpError(t, w, "expected 400 for a context value which isn't a string")
+			}
+		})
 
-				t.Run("bothUsernameAndClientIdProvided", func(t *testing.T) {
-					// when both are present, the returned access should be the user's
+		// uses the constrained policy from RequestConstraints
+		t.Run("ProxyConstraints", func(t *testing.T) {
+			token := TestJWT{username: username}
+			tests := []struct {
+				name     string
+				query    string
+				expected int
+			}{
+				{"Match", "&constraint.env=prod", http.StatusOK},
+				{"ExtraKeys", "&constraint.env=prod&constraint.region=us", http.StatusOK},
+				{"DifferentValue", "&constraint.env=dev", http.StatusForbidden},
+				{"Missing", "", http.StatusForbidden},
+				{"NoName", "&constraint.=prod", http.StatusBadRequest},
+				{"Repeated", "&constraint.env=prod&constraint.env=dev", http.StatusBadRequest},
+			}
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
 					w := httptest.NewRecorder()
-					req := newRequest("POST", "/auth/mapping", nil)
-					token := TestJWT{username: username, clientID: clientID}
+					authUrl := fmt.Sprintf(
+						"/auth/proxy?resource=%s&service=%s&method=%s%s",
+						url.QueryEscape(resourcePath),
+						url.QueryEscape(serviceName),
+						url.QueryEscape(methodName),
+						test.query,
+					)
+					req := newRequest("GET", authUrl, nil)
 					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
 					handler.ServeHTTP(w, req)
-					testUserAuthMappingResponse(t, w)
+					if w.Code != test.expected {
+						httpError(t, w, fmt.Sprintf("expected %d", test.expected))
+					}
 				})
+			}
+		})
 
-				t.Run("clientIdProvided", func(t *testing.T) {
-					w := httptest.NewRecorder()
-					req := newRequest("POST", "/auth/mapping", nil)
-					token := TestJWT{clientID: clientID}
-					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
-					handler.ServeHTTP(w, req)
-					testClientAuthMappingResponse(t, w)
-				})
+		deleteEverything()
 
-				t.Run("clientIdDoesNotExist", func(t *testing.T) {
+		t.Run("RequestActionWildcard", func(t *testing.T) {
+			createResourceBytes(t, []byte(`{"path": "/any-method"}`))
+			createResourceBytes(t, []byte(`{"path": "/any-service"}`))
+			createResourceBytes(t, []byte(`{"path": "/specific"}`))
+			createRoleBytes(t, []byte(fmt.Sprintf(
+				`{
+					"id": "any-method-role",
+					"permissions": [
+						{"id": "any-method", "action": {"service": "%s", "method": "*"}}
+					]
+				}`,
+				serviceName,
+			)))
+			createRoleBytes(t, []byte(`{
+				"id": "any-service-role",
+				"permissions": [
+					{"id": "any-service", "action": {"service": "*", "method": "read"}}
+				]
+			}`))
+			createRoleBytes(t, roleBody)
+			createPolicyBytes(t, []byte(
+				`{"id": "any-method-policy", "resource_paths": ["/any-method"], "role_ids": ["any-method-role"]}`,
+			))
+			createPolicyBytes(t, []byte(
+				`{"id": "any-service-policy", "resource_paths": ["/any-service"], "role_ids": ["any-service-role"]}`,
+			))
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "specific-policy", "resource_paths": ["/specific"], "role_ids": ["%s"]}`,
+				roleName,
+			)))
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, "any-method-policy", "null")
+			grantUserPolicy(t, username, "any-service-policy", "null")
+			grantUserPolicy(t, username, "specific-policy", "null")
+			token := TestJWT{username: username}
+
+			tests := []struct {
+				resource string
+				service  string
+				method   string
+				expected bool
+			}{
+				{"/any-method", serviceName, "read", true},
+				{"/any-method", serviceName, "write", true},
+				{"/any-method", serviceName, "delete", true},
+				{"/any-method", "otherservice", "read", false},
+				{"/any-service", serviceName, "read", true},
+				{"/any-service", "otherservice", "read", true},
+				{"/any-service", serviceName, "write", false},
+				{"/specific", serviceName, methodName, true},
+				{"/specific", serviceName, "write", false},
+				{"/specific", "otherservice", methodName, false},
+			}
+			for _, test := range tests {
+				name := fmt.Sprintf("%s/%s/%s", test.resource, test.service, test.method)
+				t.Run(name, func(t *testing.T) {
 					w := httptest.NewRecorder()
-					req := newRequest("POST", "/auth/mapping", nil)
-					token := TestJWT{clientID: "badClientId"}
-					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					body := []byte(fmt.Sprintf(
+						`{
+							"user": {"token": "%s"},
+							"request": {
+								"resource": "%s",
+								"action": {"service": "%s", "method": "%s"}
+							}
+						}`,
+						token.Encode(),
+						test.resource,
+						test.service,
+						test.method,
+					))
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 					handler.ServeHTTP(w, req)
-					assert.Equal(t, w.Code, http.StatusOK, "expected a 200 OK")
-
-					result := make(map[string][]arborist.Action)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth request failed")
+					}
+					result := struct {
+						Auth bool `json:"auth"`
+					}{}
 					err = json.Unmarshal(w.Body.Bytes(), &result)
 					if err != nil {
-						httpError(t, w, "couldn't read response from auth mapping")
+						httpError(t, w, "couldn't read response from auth request")
 					}
-					assert.Equal(t, map[string][]arborist.Action{}, result, "expected an empty result")
+					msg := fmt.Sprintf("got response body: %s", w.Body.String())
+					assert.Equal(t, test.expected, result.Auth, msg)
 				})
-			})
-
-			t.Run("POST_noBodyOrTokenProvided", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				req := newRequest("POST", "/auth/mapping", nil)
-				handler.ServeHTTP(w, req)
-				testAnonymousAuthMappingResponse(t, w)
-			})
+			}
 		})
 
 		deleteEverything()
 
-		t.Run("Request", func(t *testing.T) {
-			setupTestPolicy(t)
+		t.Run("RequestDeny", func(t *testing.T) {
+			createRoleBytes(t, roleBody)
+			createResourceBytes(t, []byte(`{
+				"path": "/programs",
+				"subresources": [
+					{"name": "open"},
+					{"name": "restricted", "subresources": [{"name": "sub"}]}
+				]
+			}`))
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "programs-allow", "resource_paths": ["/programs"], "role_ids": ["%s"]}`,
+				roleName,
+			)))
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{
+					"id": "restricted-deny",
+					"resource_paths": ["/programs/restricted"],
+					"role_ids": ["%s"],
+					"effect": "deny"
+				}`,
+				roleName,
+			)))
 			createUserBytes(t, userBody)
-			grantUserPolicy(t, username, policyName, "null")
-			w := httptest.NewRecorder()
+			grantUserPolicy(t, username, "programs-allow", "null")
+			grantUserPolicy(t, username, "restricted-deny", "null")
 			token := TestJWT{username: username}
-			body := []byte(fmt.Sprintf(
-				`{
-					"user": {"token": "%s"},
-					"request": {
-						"resource": "%s",
-						"action": {
-							"service": "%s",
-							"method": "%s"
-						}
+
+			tests := []struct {
+				resource string
+				expected bool
+			}{
+				{"/programs", true},
+				{"/programs/open", true},
+				{"/programs/restricted", false},
+				{"/programs/restricted/sub", false},
+			}
+			for _, test := range tests {
+				t.Run(test.resource, func(t *testing.T) {
+					w := httptest.NewRecorder()
+					body := []byte(fmt.Sprintf(
+						`{
+							"user": {"token": "%s"},
+							"request": {
+								"resource": "%s",
+								"action": {"service": "%s", "method": "%s"}
+							}
+						}`,
+						token.Encode(),
+						test.resource,
+						serviceName,
+						methodName,
+					))
+					req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth request failed")
 					}
-				}`,
-				token.Encode(),
-				resourcePath,
-				serviceName,
-				methodName,
-			))
-			req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
-			handler.ServeHTTP(w, req)
-			if w.Code != http.StatusOK {
-				httpError(t, w, "auth request failed")
-			}
-			// request should succeed, user has authorization
-			result := struct {
-				Auth bool `json:"auth"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from auth request")
+					result := struct {
+						Auth bool `json:"auth"`
+					}{}
+					err = json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil {
+						httpError(t, w, "couldn't read response from auth request")
+					}
+					msg := fmt.Sprintf("got response body: %s", w.Body.String())
+					assert.Equal(t, test.expected, result.Auth, msg)
+				})
 			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, true, result.Auth, msg)
 
-			t.Run("Tag", func(t *testing.T) {
-				w := httptest.NewRecorder()
-				tag, err := getTagForResource(resourcePath)
-				if err != nil {
-					httpError(t, w, "couldn't get tag for resource")
+			t.Run("PoliciesWithoutDeny", func(t *testing.T) {
+				// listing only the allow policy, in the request or in the
+				// token, must not drop the deny policy the user has
+				tokenWithPolicies := TestJWT{username: username, policies: []string{"programs-allow"}}
+				users := map[string]string{
+					"Request": fmt.Sprintf(`{"token": "%s", "policies": ["programs-allow"]}`, token.Encode()),
+					"Token":   fmt.Sprintf(`{"token": "%s"}`, tokenWithPolicies.Encode()),
 				}
-				body := []byte(fmt.Sprintf(
-					`{
-						"user": {"token": "%s"},
-						"request": {
-							"resource": "%s",
-							"action": {"service": "%s", "method": "%s"}
+				for name, user := range users {
+					t.Run(name, func(t *testing.T) {
+						tests := []struct {
+							resource string
+							expected bool
+						}{
+							{"/programs/open", true},
+							{"/programs/restricted", false},
 						}
-					}`,
-					token.Encode(),
-					tag,
-					serviceName,
-					methodName,
-				))
-				req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusOK {
-					httpError(t, w, "auth request failed")
-				}
-				// request should succeed, user has authorization
-				result := struct {
-					Auth bool `json:"auth"`
-				}{}
-				err = json.Unmarshal(w.Body.Bytes(), &result)
-				if err != nil {
-					httpError(t, w, "couldn't read response from auth request")
+						for _, test := range tests {
+							w := httptest.NewRecorder()
+							body := []byte(fmt.Sprintf(
+								`{
+									"user": %s,
+									"request": {
+										"resource": "%s",
+										"action": {"service": "%s", "method": "%s"}
+									}
+								}`,
+								user,
+								test.resource,
+								serviceName,
+								methodName,
+							))
+							req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+							handler.ServeHTTP(w, req)
+							if w.Code != http.StatusOK {
+								httpError(t, w, "auth request failed")
+							}
+							result := struct {
+								Auth bool `json:"auth"`
+							}{}
+							err = json.Unmarshal(w.Body.Bytes(), &result)
+							if err != nil {
+								httpError(t, w, "couldn't read response from auth request")
+							}
+							msg := fmt.Sprintf("%s: got response body: %s", test.resource, w.Body.String())
+							assert.Equal(t, test.expected, result.Auth, msg)
+						}
+					})
 				}
-				msg := fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, true, result.Auth, msg)
 			})
 
-			t.Run("Unauthorized", func(t *testing.T) {
-				w = httptest.NewRecorder()
-				token = TestJWT{username: username}
-				body = []byte(fmt.Sprintf(
-					`{
-						"user": {"token": "%s"},
-						"request": {
-							"resource": "%s",
-							"action": {
-								"service": "%s",
-								"method": "%s"
-							}
-						}
-					}`,
-					token.Encode(),
-					"/wrongresource", // TODO: get errors if these contain slashes
-					serviceName,
-					methodName,
-				))
-				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+			t.Run("Resources", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(`{"user": {"token": "%s"}}`, token.Encode()))
+				req := newRequest("POST", "/auth/resources", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
-					httpError(t, w, "auth request failed")
+					httpError(t, w, "auth resources request failed")
 				}
-				// request should fail
-				result = struct {
-					Auth bool `json:"auth"`
+				result := struct {
+					Resources []string `json:"resources"`
 				}{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from auth request")
+					httpError(t, w, "couldn't read response from auth resources")
 				}
-				msg = fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, false, result.Auth, msg)
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Contains(t, result.Resources, "/programs", msg)
+				assert.Contains(t, result.Resources, "/programs/open", msg)
+				assert.NotContains(t, result.Resources, "/programs/restricted", msg)
+				assert.NotContains(t, result.Resources, "/programs/restricted/sub", msg)
 			})
 
-			t.Run("ExpiredPolicy", func(t *testing.T) {
-				expiredTimestamp := time.Now().Add(time.Duration(-1) * time.Minute).Format(time.RFC3339)
-				grantUserPolicy(t, username, policyName, expiredTimestamp)
-				w = httptest.NewRecorder()
-				token = TestJWT{username: username}
-				body = []byte(fmt.Sprintf(
+			t.Run("Mapping", func(t *testing.T) {
+				// the deny policy only covers `methodName`, so other actions
+				// granted on `/programs` are still listed under it
+				createRoleBytes(t, []byte(fmt.Sprintf(
 					`{
-						"user": {"token": "%s"},
-						"request": {
-							"resource": "%s",
-							"action": {
-								"service": "%s",
-								"method": "%s"
-							}
-						}
+						"id": "programs-writer",
+						"permissions": [
+							{"id": "programs-write", "action": {"service": "%s", "method": "write"}}
+						]
 					}`,
-					token.Encode(),
-					resourcePath,
 					serviceName,
-					methodName,
+				)))
+				createPolicyBytes(t, []byte(
+					`{"id": "programs-write", "resource_paths": ["/programs"], "role_ids": ["programs-writer"]}`,
 				))
-				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				grantUserPolicy(t, username, "programs-write", "null")
+
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(`{"username": "%s"}`, username))
+				req := newRequest("POST", "/auth/mapping", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
-					httpError(t, w, "auth request failed")
+					httpError(t, w, "auth mapping request failed")
 				}
-				// request should fail
-				result = struct {
-					Auth bool `json:"auth"`
-				}{}
+				result := make(arborist.AuthMapping)
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from auth request")
+					httpError(t, w, "couldn't read response from auth mapping")
 				}
-				msg = fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, false, result.Auth, msg)
-				grantUserPolicy(t, username, policyName, "null")
-			})
-
-			t.Run("BadRequest", func(t *testing.T) {
-
-				t.Run("NotJSON", func(t *testing.T) {
-					w = httptest.NewRecorder()
-					token = TestJWT{username: username}
-					body = []byte("not real JSON")
-					req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
-					handler.ServeHTTP(w, req)
-					if w.Code != http.StatusBadRequest {
-						httpError(t, w, "expected error")
-					}
-				})
-
-				t.Run("MissingFields", func(t *testing.T) {
-					w = httptest.NewRecorder()
-					token = TestJWT{username: username}
-					body = []byte(fmt.Sprintf(
-						`{
-							"user": {"token": "%s"}
-						}`,
-						token.Encode(),
-					))
-					req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
-					handler.ServeHTTP(w, req)
-					if w.Code != http.StatusBadRequest {
-						httpError(t, w, "expected error from request missing fields")
-					}
-				})
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				read := arborist.Action{Service: serviceName, Method: methodName}
+				write := arborist.Action{Service: serviceName, Method: "write"}
+				assert.ElementsMatch(t, []arborist.Action{read, write}, result["/programs"], msg)
+				assert.ElementsMatch(t, []arborist.Action{read, write}, result["/programs/open"], msg)
+				assert.ElementsMatch(t, []arborist.Action{write}, result["/programs/restricted"], msg)
+				assert.ElementsMatch(t, []arborist.Action{write}, result["/programs/restricted/sub"], msg)
 			})
 
-			createClientBytes(t, clientBody)
-
-			t.Run("ClientForbidden", func(t *testing.T) {
-				w = httptest.NewRecorder()
-				token = TestJWT{username: username, clientID: clientID}
-				body = []byte(fmt.Sprintf(
-					`{
-						"user": {"token": "%s"},
-						"request": {
-							"resource": "%s",
-							"action": {
-								"service": "%s",
-								"method": "%s"
-							}
-						}
-					}`,
-					token.Encode(),
-					resourcePath,
-					serviceName,
-					methodName,
-				))
-				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+			t.Run("ReadEffect", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/policy/restricted-deny", nil)
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
-					httpError(t, w, "auth request failed")
+					httpError(t, w, "couldn't read policy")
 				}
-				// request should fail
-				result = struct {
-					Auth bool `json:"auth"`
-				}{}
+				result := arborist.Policy{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from auth request")
+					httpError(t, w, "couldn't read response from policy read")
 				}
-				msg = fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, false, result.Auth, msg)
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, arborist.PolicyEffectDeny, result.Effect, msg)
 			})
 
-			t.Run("ClientOnlyForbidden", func(t *testing.T) {
-				// same as `ClientForbidden` but with a client token
-				w = httptest.NewRecorder()
-				token = TestJWT{clientID: clientID}
-				body = []byte(fmt.Sprintf(
+			t.Run("InvalidEffect", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(
 					`{
-						"user": {"token": "%s"},
-						"request": {
-							"resource": "%s",
-							"action": {
-								"service": "%s",
-								"method": "%s"
-							}
-						}
+						"id": "bad-effect",
+						"resource_paths": ["/programs"],
+						"role_ids": ["%s"],
+						"effect": "maybe"
 					}`,
-					token.Encode(),
-					resourcePath,
-					serviceName,
-					methodName,
+					roleName,
 				))
-				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				req := newRequest("POST", "/policy", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusOK {
-					httpError(t, w, "auth request failed")
-				}
-				result = struct {
-					Auth bool `json:"auth"`
-				}{}
-				err = json.Unmarshal(w.Body.Bytes(), &result)
-				if err != nil {
-					httpError(t, w, "couldn't read response from auth request")
-				}
-				if result.Auth != false {
-					httpError(t, w, "auth request succeeded when it should not have")
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 for invalid policy effect")
 				}
 			})
+		})
 
-			grantClientPolicy(t, clientID, policyName)
+		deleteEverything()
 
-			t.Run("ClientBothOK", func(t *testing.T) {
-				w = httptest.NewRecorder()
-				token = TestJWT{username: username, clientID: clientID}
-				body = []byte(fmt.Sprintf(
-					`{
-						"user": {"token": "%s"},
-						"request": {
-							"resource": "%s",
-							"action": {
-								"service": "%s",
-								"method": "%s"
-							}
-						}
-					}`,
-					token.Encode(),
-					resourcePath,
-					serviceName,
-					methodName,
-				))
-				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+		t.Run("Metrics", func(t *testing.T) {
+			setupTestPolicy(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+			token := TestJWT{username: username}
+
+			// decisionCount reads the auth decision counter from `/metrics`
+			decisionCount := func(decision string) string {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/metrics", nil)
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
-					httpError(t, w, "auth request failed")
+					httpError(t, w, "couldn't get metrics")
 				}
-				result = struct {
-					Auth bool `json:"auth"`
-				}{}
-				err = json.Unmarshal(w.Body.Bytes(), &result)
-				if err != nil {
-					httpError(t, w, "couldn't read response from auth request")
+				prefix := fmt.Sprintf(`arborist_auth_decisions_total{decision="%s"} `, decision)
+				for _, line := range strings.Split(w.Body.String(), "\n") {
+					if strings.HasPrefix(line, prefix) {
+						return strings.TrimPrefix(line, prefix)
+					}
 				}
-				msg = fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, true, result.Auth, msg)
-			})
-
-			t.Run("ClientOnlyOK", func(t *testing.T) {
-				// same as `ClientBothOK` but with a client token
-				w = httptest.NewRecorder()
-				token = TestJWT{clientID: clientID}
-				body = []byte(fmt.Sprintf(
+				t.Fatalf("no %s decisions in metrics: %s", decision, w.Body.String())
+				return ""
+			}
+			authRequest := func(resource string) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(
 					`{
 						"user": {"token": "%s"},
 						"request": {
 							"resource": "%s",
-							"action": {
-								"service": "%s",
-								"method": "%s"
-							}
+							"action": {"service": "%s", "method": "%s"}
 						}
 					}`,
 					token.Encode(),
-					resourcePath,
+					resource,
 					serviceName,
 					methodName,
 				))
-				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
 					httpError(t, w, "auth request failed")
 				}
-				result = struct {
-					Auth bool `json:"auth"`
-				}{}
+			}
+
+			allowed := decisionCount("allow")
+			denied := decisionCount("deny")
+			authRequest(resourcePath)
+			assert.NotEqual(t, allowed, decisionCount("allow"), "allow counter didn't increment")
+			assert.Equal(t, denied, decisionCount("deny"))
+			allowed = decisionCount("allow")
+			authRequest("/wrongresource")
+			assert.NotEqual(t, denied, decisionCount("deny"), "deny counter didn't increment")
+			assert.Equal(t, allowed, decisionCount("allow"))
+		})
+
+		deleteEverything()
+
+		t.Run("DecisionCache", func(t *testing.T) {
+			setupTestPolicy(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+			cached, err := arborist.
+				NewServer().
+				WithLogger(logger).
+				WithJWTApp(jwtApp).
+				WithDB(db).
+				WithDecisionCacheTTL(time.Hour).
+				Init()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cachedHandler := cached.MakeRouter(logDest)
+			token := TestJWT{username: username}
+			authProxy := func() int {
+				w := httptest.NewRecorder()
+				authUrl := fmt.Sprintf(
+					"/auth/proxy?resource=%s&service=%s&method=%s",
+					url.QueryEscape(resourcePath),
+					serviceName,
+					methodName,
+				)
+				req := newRequest("GET", authUrl, nil)
+				req.Header.Add("Authorization", "Bearer "+token.Encode())
+				cachedHandler.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			assert.Equal(t, http.StatusOK, authProxy())
+			// revoking the grant through another server doesn't clear the
+			// cache, so the allow is still cached
+			w := httptest.NewRecorder()
+			req := newRequest("DELETE", fmt.Sprintf("/user/%s/policy/%s", username, policyName), nil)
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't revoke policy")
+			}
+			assert.Equal(t, http.StatusOK, authProxy(), "expected allow to be cached")
+
+			// but a change through the same server does
+			grantUserPolicy(t, username, policyName, "null")
+			w = httptest.NewRecorder()
+			req = newRequest("DELETE", fmt.Sprintf("/user/%s/policy/%s", username, policyName), nil)
+			cachedHandler.ServeHTTP(w, req)
+			if w.Code != http.StatusNoContent {
+				httpError(t, w, "couldn't revoke policy")
+			}
+			assert.Equal(t, http.StatusForbidden, authProxy(), "expected revoking the policy to clear cached allow")
+
+			t.Run("Reload", func(t *testing.T) {
+				// a role added straight into the database, in place of the
+				// policy's own, and granted through another server, isn't
+				// seen until a reload
+				_ = db.MustExec("DELETE FROM policy_role")
+				_ = db.MustExec("INSERT INTO role(name) VALUES ('reloaded')")
+				_ = db.MustExec(
+					`INSERT INTO permission(role_id, name, service, method)
+					SELECT id, 'reloaded', $1, $2 FROM role WHERE name = 'reloaded'`,
+					serviceName,
+					methodName,
+				)
+				_ = db.MustExec(
+					`INSERT INTO policy_role(policy_id, role_id)
+					SELECT policy.id, role.id FROM policy, role
+					WHERE policy.name = $1 AND role.name = 'reloaded'`,
+					policyName,
+				)
+				grantUserPolicy(t, username, policyName, "null")
+				assert.Equal(t, http.StatusForbidden, authProxy(), "expected deny to be cached")
+
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/admin/reload", nil)
+				cachedHandler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't reload")
+				}
+				result := arborist.ReloadResult{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
-					httpError(t, w, "couldn't read response from auth request")
+					httpError(t, w, "couldn't read response from reload")
 				}
-				if result.Auth != true {
-					httpError(t, w, "auth request failed")
+				msg := fmt.Sprintf("got response body: %s", w.Body.String())
+				assert.Equal(t, 2, result.Roles, msg)
+				assert.Equal(t, 2, result.Permissions, msg)
+				assert.Equal(t, 1, result.Services, msg)
+				assert.Equal(t, 1, result.Policies, msg)
+				assert.Equal(t, 1, result.DroppedDecisions, msg)
+				assert.Equal(t, http.StatusOK, authProxy(), "expected reload to clear cached deny")
+
+				w = httptest.NewRecorder()
+				req = newRequest("GET", "/role/reloaded", nil)
+				cachedHandler.ServeHTTP(w, req)
+				assert.Equal(t, http.StatusOK, w.Code, "expected role added in the database to be readable")
+			})
+		})
+
+		deleteEverything()
+
+		t.Run("ClockExpiresGrant", func(t *testing.T) {
+			// well after the database's own time, so only the server's
+			// clock can expire the grant
+			now := time.Date(2040, time.January, 1, 0, 0, 0, 0, time.UTC)
+			clocked, err := arborist.
+				NewServer().
+				WithLogger(logger).
+				WithJWTApp(jwtApp).
+				WithDB(db).
+				WithClock(func() time.Time { return now }).
+				Init()
+			if err != nil {
+				t.Fatal(err)
+			}
+			clockedHandler := clocked.MakeRouter(logDest)
+			setupTestPolicy(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, now.Add(time.Hour).Format(time.RFC3339))
+			token := TestJWT{username: username, exp: now.Add(24 * time.Hour).Unix()}
+			authProxy := func() int {
+				w := httptest.NewRecorder()
+				authUrl := fmt.Sprintf(
+					"/auth/proxy?resource=%s&service=%s&method=%s",
+					url.QueryEscape(resourcePath),
+					serviceName,
+					methodName,
+				)
+				req := newRequest("GET", authUrl, nil)
+				req.Header.Add("Authorization", "Bearer "+token.Encode())
+				clockedHandler.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			assert.Equal(t, http.StatusOK, authProxy(), "expected grant to allow before it expires")
+			now = now.Add(2 * time.Hour)
+			assert.Equal(t, http.StatusForbidden, authProxy(), "expected grant to expire with the server's clock")
+		})
+
+		deleteEverything()
+
+		t.Run("AuthHeader", func(t *testing.T) {
+			setupTestPolicy(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+			token := TestJWT{username: username}
+			encoded := token.Encode()
+			authProxy := func(header string, value string) int {
+				w := httptest.NewRecorder()
+				authUrl := fmt.Sprintf(
+					"/auth/proxy?resource=%s&service=%s&method=%s",
+					url.QueryEscape(resourcePath),
+					serviceName,
+					methodName,
+				)
+				req := newRequest("GET", authUrl, nil)
+				req.Header.Add(header, value)
+				handler.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			t.Run("Prefix", func(t *testing.T) {
+				assert.Equal(t, http.StatusOK, authProxy("Authorization", "Bearer "+encoded))
+				assert.Equal(t, http.StatusOK, authProxy("Authorization", "BEARER \t "+encoded))
+				assert.Equal(t, http.StatusOK, authProxy("Authorization", encoded))
+			})
+
+			t.Run("Custom", func(t *testing.T) {
+				server.WithAuthHeader("X-Access-Token")
+				defer server.WithAuthHeader("")
+				assert.Equal(t, http.StatusOK, authProxy("X-Access-Token", encoded))
+				assert.Equal(t, http.StatusOK, authProxy("X-Access-Token", "Bearer "+encoded))
+				assert.Equal(
+					t,
+					http.StatusUnauthorized,
+					authProxy("Authorization", "Bearer "+encoded),
+					"expected the `Authorization` header to be ignored",
+				)
+			})
+		})
+
+		deleteEverything()
+
+		t.Run("ClientCert", func(t *testing.T) {
+			setupTestPolicy(t)
+			createClientBytes(t, clientBody)
+			grantClientPolicy(t, clientID, policyName)
+			server.WithClientCertAuth(true)
+			defer server.WithClientCertAuth(false)
+			// a fake peer certificate, as if verified during the TLS handshake
+			peer := func(commonName string) *tls.ConnectionState {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+				return &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{cert},
+					VerifiedChains:   [][]*x509.Certificate{{cert}},
 				}
+			}
+			authProxy := func(state *tls.ConnectionState) int {
+				w := httptest.NewRecorder()
+				authUrl := fmt.Sprintf(
+					"/auth/proxy?resource=%s&service=%s&method=%s",
+					url.QueryEscape(resourcePath),
+					serviceName,
+					methodName,
+				)
+				req := newRequest("GET", authUrl, nil)
+				req.TLS = state
+				handler.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			t.Run("Proxy", func(t *testing.T) {
+				assert.Equal(t, http.StatusOK, authProxy(peer(clientID)))
+				assert.Equal(t, http.StatusForbidden, authProxy(peer("someone-else")))
+				assert.Equal(t, http.StatusUnauthorized, authProxy(nil), "expected a token to be needed without a certificate")
+				unverified := peer(clientID)
+				unverified.VerifiedChains = nil
+				assert.Equal(t, http.StatusUnauthorized, authProxy(unverified), "expected an unverified certificate to be ignored")
 			})
 
-			t.Run("QueryUsingUserID", func(t *testing.T) {
-				w = httptest.NewRecorder()
-				body = []byte(fmt.Sprintf(
+			t.Run("Request", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(
 					`{
-						"user": {"user_id": "%s"},
-						"request": {
-							"resource": "%s",
-							"action": {
-								"service": "%s",
-								"method": "%s"
-							}
-						}
+						"requests": [
+							{"resource": "%s", "action": {"service": "%s", "method": "%s"}}
+						]
 					}`,
-					username,
 					resourcePath,
 					serviceName,
 					methodName,
 				))
-				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				req.TLS = peer(clientID)
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
 					httpError(t, w, "auth request failed")
 				}
-				// request should fail
-				result = struct {
+				result := struct {
 					Auth bool `json:"auth"`
 				}{}
 				err = json.Unmarshal(w.Body.Bytes(), &result)
 				if err != nil {
 					httpError(t, w, "couldn't read response from auth request")
 				}
-				msg = fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, true, result.Auth, msg)
+				assert.True(t, result.Auth, "expected the certificate's client to be authorized")
+			})
+
+			t.Run("Off", func(t *testing.T) {
+				server.WithClientCertAuth(false)
+				defer server.WithClientCertAuth(true)
+				assert.Equal(t, http.StatusUnauthorized, authProxy(peer(clientID)))
 			})
 		})
 
 		deleteEverything()
 
-		t.Run("RequestMultiple", func(t *testing.T) {
+		t.Run("Audit", func(t *testing.T) {
 			setupTestPolicy(t)
 			createUserBytes(t, userBody)
 			grantUserPolicy(t, username, policyName, "null")
-			w := httptest.NewRecorder()
 			token := TestJWT{username: username}
-			// TODO (rudyardrichter, 2019-04-22): this works just for testing
-			// the `requests` thing but it would be better if it actually was
-			// using distinct policies
+			auditLog.Reset()
+
+			w := httptest.NewRecorder()
 			body := []byte(fmt.Sprintf(
 				`{
 					"user": {"token": "%s"},
 					"requests": [
-						{
-							"resource": "%s",
-							"action": {
-								"service": "%s",
-								"method": "%s"
-							}
-						},
-						{
-							"resource": "%s",
-							"action": {
-								"service": "%s",
-								"method": "%s"
-							}
-						}
+						{"resource": "%s", "action": {"service": "%s", "method": "%s"}},
+						{"resource": "/wrongresource", "action": {"service": "%s", "method": "%s"}}
 					]
 				}`,
 				token.Encode(),
 				resourcePath,
 				serviceName,
 				methodName,
-				resourcePath,
 				serviceName,
 				methodName,
 			))
@@ -3658,118 +7670,120 @@ func TestServer(t *testing.T) {
 			if w.Code != http.StatusOK {
 				httpError(t, w, "auth request failed")
 			}
-			// request should succeed, user has authorization
-			result := struct {
-				Auth bool `json:"auth"`
-			}{}
-			err = json.Unmarshal(w.Body.Bytes(), &result)
-			if err != nil {
-				httpError(t, w, "couldn't read response from auth request")
+			w = httptest.NewRecorder()
+			authUrl := fmt.Sprintf(
+				"/auth/proxy?resource=%s&service=%s&method=%s",
+				url.QueryEscape("/wrongresource"),
+				serviceName,
+				methodName,
+			)
+			req = newRequest("GET", authUrl, nil)
+			req.Header.Add("Authorization", "Bearer "+token.Encode())
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusForbidden {
+				httpError(t, w, "expected proxy request to be denied")
 			}
-			msg := fmt.Sprintf("got response body: %s", w.Body.String())
-			assert.Equal(t, true, result.Auth, msg)
 
-			t.Run("UsingStar", func(t *testing.T) {
-				createRoleBytes(
-					t,
-					[]byte(`{
-						"id": "roleUsingStar",
-						"permissions": [
-							{"id": "serviceStar", "action": {"service": "*", "method": "read"}}
-						]
-					}`),
-				)
-				createPolicyBytes(
-					t,
-					[]byte(fmt.Sprintf(
-						`{
-							"id": "policyUsingStar",
-							"resource_paths": ["%s"],
-							"role_ids": ["roleUsingStar"]
-						}`,
-						resourcePath,
-					)),
-				)
-				grantUserPolicy(t, username, "policyUsingStar", "null")
+			records := []map[string]interface{}{}
+			for _, line := range strings.Split(strings.TrimSpace(auditLog.String()), "\n") {
+				record := map[string]interface{}{}
+				err := json.Unmarshal([]byte(line), &record)
+				if err != nil {
+					t.Fatalf("audit log line is not JSON: %s", line)
+				}
+				assert.NotEmpty(t, record["timestamp"])
+				delete(record, "timestamp")
+				records = append(records, record)
+			}
+			expected := []map[string]interface{}{
+				{
+					"endpoint": "/auth/request",
+					"username": username,
+					"resource": resourcePath,
+					"service":  serviceName,
+					"method":   methodName,
+					"decision": "allow",
+				},
+				{
+					"endpoint": "/auth/request",
+					"username": username,
+					"resource": "/wrongresource",
+					"service":  serviceName,
+					"method":   methodName,
+					"decision": "deny",
+				},
+				{
+					"endpoint": "/auth/proxy",
+					"username": username,
+					"resource": "/wrongresource",
+					"service":  serviceName,
+					"method":   methodName,
+					"decision": "deny",
+				},
+			}
+			assert.Equal(t, expected, records, auditLog.String())
+		})
+
+		deleteEverything()
+
+		t.Run("Tracing", func(t *testing.T) {
+			setupTestPolicy(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+			token := TestJWT{username: username}
+			spans.Reset()
+
+			w := httptest.NewRecorder()
+			body := []byte(fmt.Sprintf(
+				`{
+					"user": {"token": "%s"},
+					"request": {
+						"resource": "%s",
+						"action": {"service": "%s", "method": "%s"}
+					}
+				}`,
+				token.Encode(),
+				resourcePath,
+				serviceName,
+				methodName,
+			))
+			req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+			traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+			req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				httpError(t, w, "auth request failed")
+			}
+
+			names := []string{}
+			for _, span := range spans.GetSpans() {
+				names = append(names, span.Name)
+				assert.Equal(t, traceID, span.SpanContext.TraceID().String())
+			}
+			assert.ElementsMatch(t, []string{"POST /auth/request", "authorizeUser"}, names)
+
+			t.Run("Database", func(t *testing.T) {
+				spans.Reset()
 				w := httptest.NewRecorder()
-				token := TestJWT{username: username}
-				body := []byte(fmt.Sprintf(
-					`{
-						"user": {"token": "%s"},
-						"request": {
-							"resource": "%s",
-							"action": {
-								"service": "shouldNotMatter",
-								"method": "read"
-							}
-						}
-					}`,
-					token.Encode(),
-					resourcePath,
-				))
-				req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				req := newRequest("GET", "/policy", nil)
 				handler.ServeHTTP(w, req)
 				if w.Code != http.StatusOK {
-					httpError(t, w, "auth request failed")
+					httpError(t, w, "couldn't list policies")
 				}
-				// request should succeed, user has authorization
-				result := struct {
-					Auth bool `json:"auth"`
-				}{}
-				err = json.Unmarshal(w.Body.Bytes(), &result)
-				if err != nil {
-					httpError(t, w, "couldn't read response from auth request")
+				byName := map[string]tracetest.SpanStub{}
+				for _, span := range spans.GetSpans() {
+					byName[span.Name] = span
 				}
-				msg := fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, true, result.Auth, msg)
-			})
-
-			t.Run("Unauthorized", func(t *testing.T) {
-				w = httptest.NewRecorder()
-				token = TestJWT{username: username}
-				body = []byte(fmt.Sprintf(
-					`{
-						"user": {"token": "%s"},
-						"requests": [
-							{
-								"resource": "%s",
-								"action": {
-									"service": "%s",
-									"method": "%s"
-								}
-							},
-							{
-								"resource": "%s",
-								"action": {
-									"service": "%s",
-									"method": "%s"
-								}
-							}
-						]
-					}`,
-					token.Encode(),
-					"/wrongresource", // TODO: get errors if these contain dashes
-					serviceName,
-					methodName,
-					resourcePath,
-					serviceName,
-					methodName,
-				))
-				req = newRequest("POST", "/auth/request", bytes.NewBuffer(body))
-				handler.ServeHTTP(w, req)
-				if w.Code != http.StatusOK {
-					httpError(t, w, "auth request failed")
+				root, ok := byName["GET /policy"]
+				if !assert.True(t, ok, "missing request span") {
+					return
 				}
-				// request should fail
-				result = struct {
-					Auth bool `json:"auth"`
-				}{}
-				err = json.Unmarshal(w.Body.Bytes(), &result)
-				if err != nil {
-					httpError(t, w, "couldn't read response from auth request")
+				for _, name := range []string{"listPoliciesFromDb", "countPoliciesFromDb"} {
+					span, ok := byName[name]
+					if assert.True(t, ok, "missing span for %s", name) {
+						assert.Equal(t, root.SpanContext.SpanID(), span.Parent.SpanID(), name)
+					}
 				}
-				msg = fmt.Sprintf("got response body: %s", w.Body.String())
-				assert.Equal(t, false, result.Auth, msg)
 			})
 		})
 
@@ -3971,6 +7985,338 @@ func TestServer(t *testing.T) {
 
 		deleteEverything()
 
+		t.Run("Policies", func(t *testing.T) {
+			setupTestPolicy(t)
+			createPolicyBytes(t, []byte(fmt.Sprintf(
+				`{"id": "extra-policy", "resource_paths": ["%s"], "role_ids": ["%s"]}`,
+				resourcePath,
+				roleName,
+			)))
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+			grantUserPolicy(t, username, "extra-policy", "null")
+			getPolicies := func(t *testing.T, token TestJWT) arborist.EffectivePolicies {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/auth/policies", nil)
+				req.Header.Add("Authorization", "Bearer "+token.Encode())
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't list token's policies")
+				}
+				result := arborist.EffectivePolicies{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from token's policies")
+				}
+				return result
+			}
+
+			t.Run("FromGrants", func(t *testing.T) {
+				result := getPolicies(t, TestJWT{username: username})
+				assert.Equal(t, username, result.Username)
+				assert.Empty(t, result.TokenPolicies)
+				expected := []arborist.EffectivePolicy{
+					{ID: "extra-policy", Via: pq.StringArray{"user"}},
+					{ID: policyName, Via: pq.StringArray{"user"}},
+				}
+				assert.Equal(t, expected, result.Policies)
+			})
+
+			t.Run("FromClaims", func(t *testing.T) {
+				// the token narrows the user's policies down to the ones it lists
+				result := getPolicies(t, TestJWT{username: username, policies: []string{policyName, "not-granted"}})
+				assert.Equal(t, username, result.Username)
+				assert.Equal(t, []string{policyName, "not-granted"}, result.TokenPolicies)
+				expected := []arborist.EffectivePolicy{
+					{ID: policyName, Via: pq.StringArray{"user"}},
+				}
+				assert.Equal(t, expected, result.Policies)
+			})
+
+			t.Run("POST", func(t *testing.T) {
+				token := TestJWT{username: username}
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(`{"user": {"token": "%s"}}`, token.Encode()))
+				req := newRequest("POST", "/auth/policies", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't list token's policies")
+				}
+				result := arborist.EffectivePolicies{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from token's policies")
+				}
+				assert.Len(t, result.Policies, 2, w.Body.String())
+			})
+
+			t.Run("MissingToken", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/auth/policies", bytes.NewBufferString(`{"user": {}}`))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 without a token")
+				}
+			})
+		})
+
+		deleteEverything()
+
+		t.Run("RevokeToken", func(t *testing.T) {
+			setupTestPolicy(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+			token := TestJWT{username: username, jti: "leaked-token"}
+			encoded := token.Encode()
+			listResources := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/auth/resources", nil)
+				req.Header.Add("Authorization", "Bearer "+encoded)
+				handler.ServeHTTP(w, req)
+				return w
+			}
+			revoke := func(token string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				body := []byte(fmt.Sprintf(`{"token": "%s"}`, token))
+				req := newRequest("POST", "/token/revoke", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				return w
+			}
+
+			w := listResources()
+			if w.Code != http.StatusOK {
+				httpError(t, w, "couldn't list resources before revoking token")
+			}
+
+			w = revoke(encoded)
+			if w.Code != http.StatusCreated {
+				httpError(t, w, "couldn't revoke token")
+			}
+			result := struct {
+				Revoked arborist.RevokedToken `json:"revoked"`
+			}{}
+			err := json.Unmarshal(w.Body.Bytes(), &result)
+			if err != nil {
+				httpError(t, w, "couldn't read response from revoking token")
+			}
+			assert.Equal(t, "leaked-token", result.Revoked.JTI)
+
+			w = listResources()
+			if w.Code != http.StatusUnauthorized {
+				httpError(t, w, "expected 401 using a revoked token")
+			}
+			assert.Equal(t, arborist.ErrorCodeInvalidToken, errorCode(t, w))
+
+			t.Run("Again", func(t *testing.T) {
+				w := revoke(encoded)
+				if w.Code != http.StatusCreated {
+					httpError(t, w, "expected revoking a token twice to succeed")
+				}
+			})
+
+			t.Run("OtherToken", func(t *testing.T) {
+				other := TestJWT{username: username, jti: "other-token"}
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/auth/resources", nil)
+				req.Header.Add("Authorization", "Bearer "+other.Encode())
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "revoking one token rejected another")
+				}
+			})
+
+			t.Run("NoJTI", func(t *testing.T) {
+				noJTI := TestJWT{username: username}
+				w := revoke(noJTI.Encode())
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 revoking a token without a jti")
+				}
+			})
+
+			t.Run("MissingToken", func(t *testing.T) {
+				w := revoke("")
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 revoking without a token")
+				}
+			})
+
+			t.Run("Prune", func(t *testing.T) {
+				_ = db.MustExec("UPDATE revoked_token SET expires_at = NOW() - INTERVAL '1 day'")
+				stop := server.PruneRevokedTokensEvery(10 * time.Millisecond)
+				defer stop()
+				var remaining int
+				assert.Eventually(t, func() bool {
+					_ = db.Get(&remaining, "SELECT COUNT(*) FROM revoked_token")
+					return remaining == 0
+				}, time.Second, 10*time.Millisecond, "expected expired revoked tokens to be pruned")
+			})
+		})
+
+		deleteEverything()
+
+		t.Run("Explain", func(t *testing.T) {
+			setupTestPolicy(t)
+			createUserBytes(t, userBody)
+			grantUserPolicy(t, username, policyName, "null")
+			token := TestJWT{username: username}
+			body := []byte(fmt.Sprintf(
+				`{
+					"user": {"token": "%s"},
+					"request": {
+						"resource": "%s",
+						"action": {"service": "%s", "method": "not-granted"}
+					}
+				}`,
+				token.Encode(),
+				resourcePath,
+				serviceName,
+			))
+			authRequest := func(t *testing.T, query string) arborist.AuthResponse {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/auth/request"+query, bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				result := arborist.AuthResponse{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				return result
+			}
+
+			result := authRequest(t, "")
+			assert.False(t, result.Auth)
+			assert.Nil(t, result.Explain, "expected no explanation unless asked")
+
+			result = authRequest(t, "?explain=true")
+			assert.False(t, result.Auth)
+			if assert.NotNil(t, result.Explain) {
+				assert.Equal(t, arborist.AuthCheckUser, result.Explain.DeniedBy)
+				assert.Equal(t, "not-granted", result.Explain.Request.Action.Method)
+				expected := []arborist.ExplainedPermission{
+					{
+						Policy:           policyName,
+						Effect:           "allow",
+						ResourcePath:     resourcePath,
+						Role:             roleName,
+						Permission:       permissionName,
+						Action:           arborist.Action{Service: serviceName, Method: methodName},
+						Constraints:      arborist.Constraints{},
+						ResourceMatches:  true,
+						ActionMatches:    false,
+						ConstraintsMatch: true,
+					},
+				}
+				assert.Equal(t, expected, result.Explain.Permissions)
+			}
+
+			t.Run("Allowed", func(t *testing.T) {
+				body := []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {"service": "%s", "method": "%s"}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/auth/request?explain=true", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				result := arborist.AuthResponse{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				assert.True(t, result.Auth)
+				assert.Nil(t, result.Explain, "expected no explanation for an allowed request")
+			})
+
+			t.Run("BadFlag", func(t *testing.T) {
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/auth/request?explain=maybe", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusBadRequest {
+					httpError(t, w, "expected 400 for invalid explain flag")
+				}
+			})
+		})
+
+		deleteEverything()
+
+		t.Run("UsernameCase", func(t *testing.T) {
+			setupTestPolicy(t)
+			authorized := func(t *testing.T, name string) bool {
+				token := TestJWT{username: name}
+				body := []byte(fmt.Sprintf(
+					`{
+						"user": {"token": "%s"},
+						"request": {
+							"resource": "%s",
+							"action": {"service": "%s", "method": "%s"}
+						}
+					}`,
+					token.Encode(),
+					resourcePath,
+					serviceName,
+					methodName,
+				))
+				w := httptest.NewRecorder()
+				req := newRequest("POST", "/auth/request", bytes.NewBuffer(body))
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth request failed")
+				}
+				result := arborist.AuthResponse{}
+				err := json.Unmarshal(w.Body.Bytes(), &result)
+				if err != nil {
+					httpError(t, w, "couldn't read response from auth request")
+				}
+				return result.Auth
+			}
+
+			t.Run("CaseSensitive", func(t *testing.T) {
+				createUserBytes(t, []byte(`{"name": "Mixed.Case"}`))
+				grantUserPolicy(t, "Mixed.Case", policyName, "null")
+				assert.True(t, authorized(t, "Mixed.Case"))
+				assert.False(t, authorized(t, "mixed.case"), "expected usernames to be case-sensitive by default")
+			})
+
+			deleteEverything()
+			setupTestPolicy(t)
+			server.WithCaseInsensitiveUsernames(true)
+			defer server.WithCaseInsensitiveUsernames(false)
+
+			t.Run("CaseInsensitive", func(t *testing.T) {
+				createUserBytes(t, []byte(`{"name": "Mixed.Case"}`))
+				// granted under a different casing from the one it was created with
+				grantUserPolicy(t, "MIXED.CASE", policyName, "null")
+				assert.True(t, authorized(t, "Mixed.Case"))
+				assert.True(t, authorized(t, "mixed.CASE"))
+
+				w := httptest.NewRecorder()
+				req := newRequest("GET", "/user/MiXeD.cAsE", nil)
+				handler.ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "couldn't read user by a different casing")
+				}
+				user := arborist.User{}
+				err := json.Unmarshal(w.Body.Bytes(), &user)
+				if err != nil {
+					httpError(t, w, "couldn't read response from user read")
+				}
+				assert.Equal(t, "mixed.case", user.Name)
+			})
+		})
+
+		deleteEverything()
+
 		t.Run("Resources", func(t *testing.T) {
 			createUserBytes(t, userBody)
 
@@ -4512,6 +8858,121 @@ func TestServer(t *testing.T) {
 				if w.Code != http.StatusOK {
 					httpError(t, w, "auth proxy request failed")
 				}
+				assert.Equal(t, username, w.Header().Get("REMOTE_USER"))
+				assert.Equal(t, resourcePath, w.Header().Get("X-Authorized-Resources"))
+				assert.Empty(t, w.Header().Get("X-Authorized-Policy"), "expected only the default headers")
+			})
+
+			t.Run("Headers", func(t *testing.T) {
+				_, err := arborist.
+					NewServer().
+					WithLogger(logger).
+					WithJWTApp(jwtApp).
+					WithDB(db).
+					WithProxyHeaders([]string{"X-Bogus"}).
+					Init()
+				assert.Error(t, err, "expected unknown proxy header to be rejected")
+
+				headered, err := arborist.
+					NewServer().
+					WithLogger(logger).
+					WithJWTApp(jwtApp).
+					WithDB(db).
+					WithProxyHeaders([]string{
+						arborist.ProxyHeaderResources,
+						arborist.ProxyHeaderPolicy,
+						arborist.ProxyHeaderRole,
+					}).
+					Init()
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := httptest.NewRecorder()
+				authUrl := fmt.Sprintf(
+					"/auth/proxy?resource=%s&service=%s&method=%s",
+					url.QueryEscape(resourcePath),
+					url.QueryEscape(serviceName),
+					url.QueryEscape(methodName),
+				)
+				req := newRequest("GET", authUrl, nil)
+				req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+				headered.MakeRouter(logDest).ServeHTTP(w, req)
+				if w.Code != http.StatusOK {
+					httpError(t, w, "auth proxy request failed")
+				}
+				assert.Empty(t, w.Header().Get("REMOTE_USER"), "expected REMOTE_USER to be left out")
+				assert.Equal(t, resourcePath, w.Header().Get("X-Authorized-Resources"))
+				assert.Equal(t, policyName, w.Header().Get("X-Authorized-Policy"))
+				assert.Equal(t, roleName, w.Header().Get("X-Authorized-Role"))
+			})
+
+			t.Run("HeaderFallback", func(t *testing.T) {
+				t.Run("ForwardedMethod", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					authUrl := fmt.Sprintf(
+						"/auth/proxy?resource=%s&service=%s",
+						url.QueryEscape(resourcePath),
+						url.QueryEscape(serviceName),
+					)
+					req := newRequest("GET", authUrl, nil)
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					req.Header.Add("X-Forwarded-Method", methodName)
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth proxy request with X-Forwarded-Method failed")
+					}
+				})
+
+				t.Run("ForwardedMethodForbidden", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					authUrl := fmt.Sprintf(
+						"/auth/proxy?resource=%s&service=%s",
+						url.QueryEscape(resourcePath),
+						url.QueryEscape(serviceName),
+					)
+					req := newRequest("GET", authUrl, nil)
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					req.Header.Add("X-Forwarded-Method", "bogus")
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusForbidden {
+						httpError(t, w, "auth proxy request did not error as expected")
+					}
+				})
+
+				t.Run("RequestURI", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					authUrl := fmt.Sprintf(
+						"/auth/proxy?service=%s&method=%s",
+						url.QueryEscape(serviceName),
+						url.QueryEscape(methodName),
+					)
+					req := newRequest("GET", authUrl, nil)
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					requestURI := (&url.URL{Path: resourcePath, RawQuery: "x=1"}).RequestURI()
+					req.Header.Add("X-Request-URI", requestURI)
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth proxy request with X-Request-URI failed")
+					}
+				})
+
+				t.Run("QueryStringWins", func(t *testing.T) {
+					w := httptest.NewRecorder()
+					authUrl := fmt.Sprintf(
+						"/auth/proxy?resource=%s&service=%s&method=%s",
+						url.QueryEscape(resourcePath),
+						url.QueryEscape(serviceName),
+						url.QueryEscape(methodName),
+					)
+					req := newRequest("GET", authUrl, nil)
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
+					req.Header.Add("X-Forwarded-Method", "bogus")
+					req.Header.Add("X-Request-URI", "/wrongresource")
+					handler.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						httpError(t, w, "auth proxy request should use the query string over headers")
+					}
+				})
 			})
 
 			t.Run("BadRequest", func(t *testing.T) {
@@ -4594,6 +9055,7 @@ func TestServer(t *testing.T) {
 					if w.Code != http.StatusForbidden {
 						httpError(t, w, "auth proxy request succeeded when it should not have")
 					}
+					assert.Empty(t, w.Header().Get("X-Authorized-Resources"), "expected no authorized resources on a denied request")
 				})
 
 				t.Run("WrongService", func(t *testing.T) {
@@ -4760,3 +9222,403 @@ func TestServer(t *testing.T) {
 
 	deleteEverything()
 }
+
+func TestHealthResponseJSON(t *testing.T) {
+	health := arborist.HealthResponse{
+		Version: "1.2.3",
+		Commit:  "abc123",
+		Uptime:  "1m0s",
+	}
+	bytes, err := json.Marshal(health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]interface{}{}
+	err = json.Unmarshal(bytes, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(
+		t,
+		map[string]interface{}{"version": "1.2.3", "commit": "abc123", "uptime": "1m0s"},
+		fields,
+	)
+}
+
+// headerCountingRecorder records how many times WriteHeader is called, so we
+// can catch handlers which write more than one response.
+type headerCountingRecorder struct {
+	*httptest.ResponseRecorder
+	headerWrites int
+}
+
+func (recorder *headerCountingRecorder) WriteHeader(code int) {
+	recorder.headerWrites++
+	recorder.ResponseRecorder.WriteHeader(code)
+}
+
+func TestHealthDatabaseUnavailable(t *testing.T) {
+	// open and immediately close the database so that pinging it fails,
+	// without needing an actual database to be running
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	logger := log.New(bytes.NewBuffer([]byte{}), "", log.Ldate|log.Ltime)
+	server, err := arborist.
+		NewServer().
+		WithLogger(logger).
+		WithJWTApp(&mockJWTApp{}).
+		WithDB(db).
+		Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.MakeRouter(bytes.NewBuffer([]byte{}))
+
+	w := &headerCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req, err := http.NewRequest("GET", "/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code, "expected 500 from health check")
+	assert.Equal(t, 1, w.headerWrites, "health check should write exactly one response")
+
+	// liveness doesn't depend on the database
+	w = &headerCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+	req, err = http.NewRequest("GET", "/_status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "expected 200 from status check")
+}
+
+func TestDBConfig(t *testing.T) {
+	logger := log.New(bytes.NewBuffer([]byte{}), "", log.Ldate|log.Ltime)
+	newServer := func(maxOpen, maxIdle int, lifetime time.Duration) (*sqlx.DB, error) {
+		// opening doesn't connect, so no database is needed here
+		db, err := sqlx.Open("postgres", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = arborist.
+			NewServer().
+			WithLogger(logger).
+			WithJWTApp(&mockJWTApp{}).
+			WithDB(db).
+			WithDBConfig(maxOpen, maxIdle, lifetime).
+			Init()
+		return db, err
+	}
+
+	t.Run("Applied", func(t *testing.T) {
+		db, err := newServer(7, 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		assert.Equal(t, 7, db.Stats().MaxOpenConnections, "max open connections not applied")
+	})
+
+	t.Run("Negative", func(t *testing.T) {
+		for _, settings := range [][3]int{{-1, 0, 0}, {0, -1, 0}, {0, 0, -1}} {
+			db, err := newServer(settings[0], settings[1], time.Duration(settings[2]))
+			db.Close()
+			assert.Error(t, err, "expected negative pool settings %v to be rejected", settings)
+		}
+	})
+}
+
+func TestExpectedAudiences(t *testing.T) {
+	logger := log.New(bytes.NewBuffer([]byte{}), "", log.Ldate|log.Ltime)
+	// the token is rejected before the database is used, so none is needed
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server, err := arborist.
+		NewServer().
+		WithLogger(logger).
+		WithJWTApp(&mockJWTApp{}).
+		WithDB(db).
+		WithExpectedAudiences([]string{"arborist"}).
+		Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.MakeRouter(bytes.NewBuffer([]byte{}))
+	// test tokens only have the `openid` scope
+	token := TestJWT{username: "wasd"}
+
+	t.Run("Proxy", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/auth/proxy?resource=/a&service=b&method=c", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Authorization", "Bearer "+token.Encode())
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+		assert.Equal(t, "invalid_token", errorCode(t, w))
+
+		w = httptest.NewRecorder()
+		req.Header.Del("Authorization")
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+		assert.Equal(t, "missing_token", errorCode(t, w))
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		body := []byte(fmt.Sprintf(
+			`{
+				"user": {"token": "%s"},
+				"request": {"resource": "/a", "action": {"service": "b", "method": "c"}}
+			}`,
+			token.Encode(),
+		))
+		req, err := http.NewRequest("POST", "/auth/request", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		for _, audiences := range [][]string{nil, {}, {""}} {
+			_, err := arborist.
+				NewServer().
+				WithLogger(logger).
+				WithJWTApp(&mockJWTApp{}).
+				WithDB(db).
+				WithExpectedAudiences(audiences).
+				Init()
+			assert.Error(t, err, "expected audiences %v to be rejected", audiences)
+		}
+	})
+}
+
+func TestCORS(t *testing.T) {
+	logger := log.New(bytes.NewBuffer([]byte{}), "", log.Ldate|log.Ltime)
+	// preflight requests are answered before the database is used
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	newHandler := func(t *testing.T, origins []string) http.Handler {
+		server := arborist.
+			NewServer().
+			WithLogger(logger).
+			WithJWTApp(&mockJWTApp{}).
+			WithDB(db)
+		if origins != nil {
+			server = server.WithCORS(origins)
+		}
+		server, err := server.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server.MakeRouter(bytes.NewBuffer([]byte{}))
+	}
+	origin := "https://portal.example.org"
+	preflight := func(t *testing.T, origin string) *http.Request {
+		req, err := http.NewRequest("OPTIONS", "/policy", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		req.Header.Set("Access-Control-Request-Headers", "Authorization, Content-Type")
+		return req
+	}
+
+	t.Run("Preflight", func(t *testing.T) {
+		handler := newHandler(t, []string{origin})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, preflight(t, origin))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "PUT", w.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "Authorization,Content-Type", w.Header().Get("Access-Control-Allow-Headers"))
+	})
+
+	t.Run("PreflightPATCH", func(t *testing.T) {
+		handler := newHandler(t, []string{origin})
+		w := httptest.NewRecorder()
+		req := preflight(t, origin)
+		req.Header.Set("Access-Control-Request-Method", "PATCH")
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "PATCH", w.Header().Get("Access-Control-Allow-Methods"))
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		handler := newHandler(t, []string{origin})
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("OtherOrigin", func(t *testing.T) {
+		handler := newHandler(t, []string{origin})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, preflight(t, "https://elsewhere.example.org"))
+		assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("AnyOrigin", func(t *testing.T) {
+		handler := newHandler(t, []string{"*"})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, preflight(t, origin))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("Off", func(t *testing.T) {
+		handler := newHandler(t, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, preflight(t, origin))
+		assert.Equal(t, "", w.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("NoOrigins", func(t *testing.T) {
+		_, err := arborist.
+			NewServer().
+			WithLogger(logger).
+			WithJWTApp(&mockJWTApp{}).
+			WithDB(db).
+			WithCORS([]string{}).
+			Init()
+		assert.Error(t, err)
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	logs := bytes.NewBuffer([]byte{})
+	logger := log.New(logs, "", log.Ldate|log.Ltime)
+	// the request fails before the database is used, so none is needed
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server, err := arborist.
+		NewServer().
+		WithLogger(logger).
+		WithJWTApp(&mockJWTApp{}).
+		WithDB(db).
+		Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.MakeRouter(bytes.NewBuffer([]byte{}))
+	request := func(t *testing.T, id string) *httptest.ResponseRecorder {
+		// no token, so this is a 401
+		req, err := http.NewRequest("GET", "/auth/proxy?resource=/a&service=b&method=c", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+		return w
+	}
+	bodyRequestID := func(t *testing.T, w *httptest.ResponseRecorder) string {
+		result := struct {
+			Error struct {
+				RequestID string `json:"request_id"`
+			} `json:"error"`
+		}{}
+		err := json.Unmarshal(w.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatalf("couldn't read error response: %s", w.Body.String())
+		}
+		return result.Error.RequestID
+	}
+
+	t.Run("Supplied", func(t *testing.T) {
+		logs.Reset()
+		w := request(t, "abc-123")
+		assert.Equal(t, "abc-123", w.Header().Get("X-Request-ID"))
+		assert.Equal(t, "abc-123", bodyRequestID(t, w))
+		assert.Contains(t, logs.String(), "[abc-123]")
+	})
+
+	t.Run("Generated", func(t *testing.T) {
+		w := request(t, "")
+		id := w.Header().Get("X-Request-ID")
+		assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", id)
+		assert.Equal(t, id, bodyRequestID(t, w))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		w := request(t, "has spaces\nand newlines")
+		id := w.Header().Get("X-Request-ID")
+		assert.NotEqual(t, "has spaces\nand newlines", id)
+		assert.Equal(t, id, bodyRequestID(t, w))
+	})
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	// every request here fails before the database is used, so none is needed
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server, err := arborist.
+		NewServer().
+		WithLogger(log.New(bytes.NewBuffer([]byte{}), "", log.Ldate|log.Ltime)).
+		WithJWTApp(&mockJWTApp{}).
+		WithDB(db).
+		WithMaxBodyBytes(64).
+		Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.MakeRouter(bytes.NewBuffer([]byte{}))
+	request := func(t *testing.T, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/policy", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		w := request(t, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		assert.Contains(t, errorMessage(t, w), "expected JSON body")
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		w := request(t, `{"id": "`+strings.Repeat("x", 100)+`"}`)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+		assert.Equal(t, "body_too_large", errorCode(t, w))
+	})
+
+	t.Run("UnderLimit", func(t *testing.T) {
+		// invalid, but small enough to be read and parsed
+		w := request(t, `{"id": "x"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		assert.Contains(t, errorMessage(t, w), "could not parse policy")
+	})
+}
@@ -0,0 +1,57 @@
+package arborist
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// Services aren't stored on their own; a service is just the `service` named
+// in the action of some permission. These list what the permissions refer to.
+
+// Service lists the permissions, across all roles, for one service.
+type Service struct {
+	Name        string              `json:"name"`
+	Permissions []ServicePermission `json:"permissions"`
+}
+
+// ServicePermission is a permission for a service, with the role it is in.
+type ServicePermission struct {
+	Role   string `json:"role" db:"role"`
+	ID     string `json:"id" db:"name"`
+	Method string `json:"method" db:"method"`
+}
+
+// listServiceNames returns the names of every service used by a permission.
+func listServiceNames(db *sqlx.DB) ([]string, error) {
+	stmt := "SELECT DISTINCT service FROM permission ORDER BY service"
+	names := []string{}
+	err := db.Select(&names, stmt)
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// serviceWithName returns the permissions for the service `name`, or nil if
+// no permission uses it.
+func serviceWithName(db *sqlx.DB, name string) (*Service, error) {
+	stmt := `
+		SELECT role.name AS role, permission.name, permission.method
+		FROM permission
+		JOIN role ON role.id = permission.role_id
+		WHERE permission.service = $1
+		ORDER BY role.name, permission.name
+	`
+	permissions := []ServicePermission{}
+	err := db.Select(&permissions, stmt, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(permissions) == 0 {
+		return nil, nil
+	}
+	service := Service{
+		Name:        name,
+		Permissions: permissions,
+	}
+	return &service, nil
+}
@@ -0,0 +1,84 @@
+package arborist
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Run serves the API on `addr` (like `:8080`) until `Shutdown` is called. It
+// returns as soon as the server stops accepting connections, without waiting
+// for requests still in progress; `Shutdown` waits for those.
+func (server *Server) Run(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if server.grpcAddr != "" {
+		grpcListener, err := net.Listen("tcp", server.grpcAddr)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		grpcServer := server.newGRPCServer()
+		server.httpServerMu.Lock()
+		server.grpcServer = grpcServer
+		server.httpServerMu.Unlock()
+		go server.serveGRPC(grpcServer, grpcListener)
+	}
+	return server.serve(listener)
+}
+
+func (server *Server) serve(listener net.Listener) error {
+	httpServer := &http.Server{
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		ErrorLog:     server.logger.logger,
+		Handler:      server.MakeRouter(os.Stdout),
+	}
+	server.httpServerMu.Lock()
+	server.httpServer = httpServer
+	server.httpServerMu.Unlock()
+	server.logger.Info("arborist serving at %s", listener.Addr())
+	var err error
+	if server.tlsConfig != nil {
+		httpServer.TLSConfig = server.tlsConfig
+		// the certificates are in the config, so no files are needed
+		err = httpServer.ServeTLS(listener, "", "")
+	} else {
+		err = httpServer.Serve(listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops the server started with `Run` from accepting connections,
+// over HTTP and gRPC, waits for the requests in progress to finish and for
+// queued webhook events to be delivered (or for `ctx` to be done), and then
+// closes the database connections.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.httpServerMu.Lock()
+	httpServer := server.httpServer
+	server.httpServerMu.Unlock()
+	var err error
+	if httpServer != nil {
+		server.logger.Info("shutting down; waiting for requests in progress")
+		err = httpServer.Shutdown(ctx)
+	}
+	server.stopGRPC(ctx)
+	if server.webhook != nil {
+		webhookErr := server.webhook.close(ctx)
+		if err == nil {
+			err = webhookErr
+		}
+	}
+	dbErr := server.db.Close()
+	if err != nil {
+		return err
+	}
+	return dbErr
+}
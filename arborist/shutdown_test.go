@@ -0,0 +1,214 @@
+package arborist
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingCollector holds up a `/metrics` request until it's released, to
+// have a request in progress during shutdown.
+type blockingCollector struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *blockingCollector) Collect(ch chan<- prometheus.Metric) {
+	close(c.started)
+	<-c.release
+}
+
+func TestShutdown(t *testing.T) {
+	// nothing here uses the database, but shutting down should close it
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer().
+		WithLogger(log.New(bytes.NewBuffer([]byte{}), "", log.Ldate|log.Ltime)).
+		WithDB(db)
+	collector := &blockingCollector{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	server.metrics.registry.MustRegister(collector)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.serve(listener)
+	}()
+
+	responses := make(chan *http.Response, 1)
+	requestErrs := make(chan error, 1)
+	go func() {
+		response, err := http.Get("http://" + addr + "/metrics")
+		if err != nil {
+			requestErrs <- err
+			return
+		}
+		response.Body.Close()
+		responses <- response
+	}()
+	select {
+	case <-collector.started:
+	case err := <-requestErrs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never started")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+	// wait for the server to stop accepting connections
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if i > 500 {
+			t.Fatal("server still accepting connections after shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown finished before the request in progress")
+	default:
+	}
+
+	close(collector.release)
+	select {
+	case response := <-responses:
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+	case err := <-requestErrs:
+		t.Fatalf("request in progress failed during shutdown: %s", err.Error())
+	}
+	assert.NoError(t, <-shutdown)
+	assert.NoError(t, <-served)
+	assert.EqualError(t, db.Ping(), "sql: database is closed")
+}
+
+// newTestCert makes a certificate for `commonName`, signed by `parent` (or
+// self-signed if it's nil).
+func newTestCert(t *testing.T, commonName string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServeTLS(t *testing.T) {
+	db, err := sqlx.Open("postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestCert(t, "ca", nil)
+	otherCA := newTestCert(t, "other-ca", nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	server := NewServer().
+		WithLogger(log.New(bytes.NewBuffer([]byte{}), "", log.Ldate|log.Ltime)).
+		WithDB(db).
+		WithClientCertAuth(true).
+		WithTLS(&tls.Config{
+			Certificates: []tls.Certificate{newTestCert(t, "arborist", &ca)},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.serve(listener)
+	}()
+	defer func() {
+		assert.NoError(t, server.Shutdown(context.Background()))
+		assert.NoError(t, <-served)
+	}()
+
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(ca.Leaf)
+	get := func(clientCerts ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: serverCAs, Certificates: clientCerts},
+			},
+			Timeout: 5 * time.Second,
+		}
+		// with no `resource`, a caller which got past authentication gets a
+		// 400, and one which didn't gets a 401
+		response, err := client.Get("https://" + listener.Addr().String() + "/auth/proxy")
+		if err == nil {
+			response.Body.Close()
+		}
+		return response, err
+	}
+
+	response, err := get(newTestCert(t, "svc", &ca))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusBadRequest, response.StatusCode, "expected the client certificate to authenticate the caller")
+	}
+	response, err = get()
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	}
+	// the client doesn't offer a certificate the server's CAs didn't sign
+	response, err = get(newTestCert(t, "svc", &otherCA))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "expected a certificate from another CA not to count")
+	}
+}
@@ -1,11 +1,17 @@
 package arborist
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // multiInsertStmt generates a string for a SQL command to insert multiple rows
@@ -51,6 +57,14 @@ func selectInStmt(table string, col string, values []string) string {
 	return stmt
 }
 
+// isUniqueViolation reports whether `err` came from an insert which would have
+// duplicated a row under a unique constraint, like a policy name or resource
+// path which is already taken.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" // unique_violation
+}
+
 // transactify lets you pass a `sqlx.DB` to a function which uses a `sqlx.Tx`,
 // and handles opening and committing the transaction. The function passed to
 // transactify can chain multiple other functions together into one
@@ -76,3 +90,56 @@ func transactify(db *sqlx.DB, call func(tx *sqlx.Tx) *ErrorResponse) *ErrorRespo
 	}
 	return nil
 }
+
+// transactifyDryRun runs `call` in a transaction like `transactify`, but always
+// rolls it back, so callers can check that a change would go through without
+// making it. Deferred constraints are checked as each statement runs, since
+// there is no commit for them to wait for.
+func transactifyDryRun(db *sqlx.DB, call func(tx *sqlx.Tx) *ErrorResponse) *ErrorResponse {
+	tx, err := db.Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("couldn't open database transaction: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	_, err = tx.Exec("SET CONSTRAINTS ALL IMMEDIATE")
+	if err != nil {
+		msg := fmt.Sprintf("couldn't set up dry run: %s", err.Error())
+		return newErrorResponse(msg, 500, &err)
+	}
+	return call(tx)
+}
+
+// traceDB starts a span for one call to the database helper `name`, like
+// `listPoliciesFromDb` or `transactify`, as a child of the request's span in
+// `ctx`. The caller ends it with `endDBSpan` once the helper returns.
+func (server *Server) traceDB(ctx context.Context, name string) trace.Span {
+	_, span := server.tracer.Start(
+		ctx,
+		name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL),
+	)
+	return span
+}
+
+// endDBSpan ends a span from `traceDB`, recording `err` if the helper failed.
+func endDBSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// dbSpanError is the error for `endDBSpan` from a helper which returns an
+// error response instead of an error.
+func dbSpanError(errResponse *ErrorResponse) error {
+	if errResponse == nil {
+		return nil
+	}
+	if errResponse.err != nil {
+		return errResponse.err
+	}
+	return errors.New(errResponse.HTTPError.Message)
+}
@@ -1,8 +1,10 @@
 package arborist
 
 import (
+	"errors"
 	"testing"
 
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,3 +18,64 @@ func TestMultiInsertStmt(t *testing.T) {
 		assert.Equal(t, multiInsertStmt("test(a, b)", 2), expected)
 	})
 }
+
+func TestTransactify(t *testing.T) {
+	newTree := func() *ResourceIn {
+		return &ResourceIn{
+			Path:         "/parent",
+			Subresources: []ResourceIn{{Name: "child"}},
+		}
+	}
+
+	t.Run("Commits", func(t *testing.T) {
+		d := &flakyDriver{}
+		db := newFlakyDB(t, d)
+		defer db.Close()
+		errResponse := transactify(db, newTree().createInDb)
+		assert.Nil(t, errResponse)
+		assert.Equal(t, 2, d.execs)
+		assert.Equal(t, 1, d.commits)
+		assert.Equal(t, 0, d.rollbacks)
+	})
+
+	t.Run("RollsBackOnSecondStatement", func(t *testing.T) {
+		d := &flakyDriver{failExecAt: 2, failWith: &pq.Error{Code: "23505"}}
+		db := newFlakyDB(t, d)
+		defer db.Close()
+		errResponse := transactify(db, newTree().createInDb)
+		if assert.NotNil(t, errResponse) {
+			assert.Equal(t, 409, errResponse.HTTPError.Code)
+			assert.Equal(t, ErrorCodeResourceExists, errResponse.HTTPError.ErrorCode)
+		}
+		assert.Equal(t, 2, d.execs)
+		assert.Equal(t, 0, d.commits, "the first insert should not be committed")
+		assert.Equal(t, 1, d.rollbacks)
+	})
+
+	t.Run("OtherErrorIsNotConflict", func(t *testing.T) {
+		d := &flakyDriver{failExecAt: 1, failWith: errors.New("induced failure")}
+		db := newFlakyDB(t, d)
+		defer db.Close()
+		errResponse := transactify(db, newTree().createInDb)
+		if assert.NotNil(t, errResponse) {
+			assert.Equal(t, 500, errResponse.HTTPError.Code)
+		}
+		assert.Equal(t, 1, d.rollbacks)
+	})
+}
+
+func TestTransactifyDryRun(t *testing.T) {
+	d := &flakyDriver{}
+	db := newFlakyDB(t, d)
+	defer db.Close()
+	resource := &ResourceIn{
+		Path:         "/parent",
+		Subresources: []ResourceIn{{Name: "child"}},
+	}
+	errResponse := transactifyDryRun(db, resource.createInDb)
+	assert.Nil(t, errResponse)
+	// one statement to check constraints immediately, then the two inserts
+	assert.Equal(t, 3, d.execs)
+	assert.Equal(t, 0, d.commits)
+	assert.Equal(t, 1, d.rollbacks)
+}
@@ -3,16 +3,284 @@ package arborist
 import (
 	"errors"
 	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/uc-cdis/go-authutils/authutils"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
+// keyRefreshCooldown is the least time between two refreshes of the keys
+// triggered by tokens with unknown key IDs, so that tokens with made-up key
+// IDs can't make arborist fetch the JWKS on every request.
+var keyRefreshCooldown = 5 * time.Second
+
+// JWTApplication wraps the `authutils` JWT application, which arborist uses to
+// decode tokens, to add a check that its keys are actually usable and to
+// refresh the keys when the identity provider rotates them.
+//
+// The `authutils` key manager is not safe for concurrent use, so every access
+// to `Keys` here goes through `mu`.
+type JWTApplication struct {
+	*authutils.JWTApplication
+	mu        sync.RWMutex
+	refreshed time.Time
+}
+
+func NewJWTApplication(jwkURL string) *JWTApplication {
+	return &JWTApplication{JWTApplication: authutils.NewJWTApplication(jwkURL)}
+}
+
+// Decode checks the token's signature and returns its claims (without
+// validating them), like the `authutils` version. A token signed with a key
+// ID which isn't loaded yet makes the application fetch the keys again, since
+// the identity provider may have rotated them.
+func (jwtApp *JWTApplication) Decode(token string) (*map[string]interface{}, error) {
+	decoded, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded.Headers) != 1 {
+		return nil, errors.New("token has multiple headers; expected exactly 1")
+	}
+	kid := decoded.Headers[0].KeyID
+	key := jwtApp.lookupKey(kid)
+	if key == nil {
+		err = jwtApp.refreshKeys(kid)
+		if err != nil {
+			return nil, err
+		}
+		key = jwtApp.lookupKey(kid)
+		if key == nil {
+			return nil, fmt.Errorf("no key found with ID %s", kid)
+		}
+	}
+	claims := map[string]interface{}{}
+	err = decoded.Claims(key, &claims)
+	if err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func (jwtApp *JWTApplication) lookupKey(kid string) *jose.JSONWebKey {
+	jwtApp.mu.RLock()
+	defer jwtApp.mu.RUnlock()
+	return jwtApp.Keys.KeyMap[kid]
+}
+
+// refreshKeys fetches the keys from the JWKS endpoint because a token used
+// the key ID `kid`. If another request already loaded that key, or the keys
+// were fetched within `keyRefreshCooldown`, it does nothing.
+func (jwtApp *JWTApplication) refreshKeys(kid string) error {
+	jwtApp.mu.Lock()
+	defer jwtApp.mu.Unlock()
+	if _, exists := jwtApp.Keys.KeyMap[kid]; exists {
+		return nil
+	}
+	if time.Since(jwtApp.refreshed) < keyRefreshCooldown {
+		return nil
+	}
+	return jwtApp.refreshLocked()
+}
+
+// refreshLocked fetches the keys; the caller must hold `mu`. If the fetch
+// fails the keys loaded before are kept.
+func (jwtApp *JWTApplication) refreshLocked() error {
+	jwtApp.refreshed = time.Now()
+	keys := authutils.NewKeysManager(jwtApp.Keys.URL)
+	err := keys.Refresh()
+	if err != nil {
+		return err
+	}
+	*jwtApp.Keys = keys
+	return nil
+}
+
+// RefreshKeysEvery fetches the keys from the JWKS endpoint every `interval`
+// in the background, so rotated keys are picked up (and removed keys dropped)
+// even if no token asks for them. Failures are logged to `logger`, and the
+// keys loaded before are kept. Call the returned function to stop.
+func (jwtApp *JWTApplication) RefreshKeysEvery(interval time.Duration, logger *log.Logger) (stop func()) {
+	logHandler := &LogHandler{logger: logger}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				jwtApp.mu.Lock()
+				err := jwtApp.refreshLocked()
+				jwtApp.mu.Unlock()
+				if err != nil {
+					logHandler.Warning("couldn't refresh JWT keys: %s", err.Error())
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// CheckKeys returns an error if the application has no keys to validate
+// tokens with, fetching the keys from the JWKS endpoint first if none are
+// loaded yet. If no JWKS endpoint is configured there is nothing to check.
+func (jwtApp *JWTApplication) CheckKeys() error {
+	jwtApp.mu.Lock()
+	defer jwtApp.mu.Unlock()
+	if jwtApp.Keys.URL == "" {
+		return nil
+	}
+	if jwtApp.Keys.DefaultKey() != nil {
+		return nil
+	}
+	err := jwtApp.refreshLocked()
+	if err != nil {
+		return err
+	}
+	if jwtApp.Keys.DefaultKey() == nil {
+		return fmt.Errorf("no keys found at %s", jwtApp.Keys.URL)
+	}
+	return nil
+}
+
+// IssuersJWTApplication decodes tokens from several trusted issuers, each
+// with its own JWKS endpoint. The token's `iss` claim picks which keys
+// validate it, so a token can only be signed by its own issuer; tokens from
+// any other issuer are rejected.
+type IssuersJWTApplication struct {
+	issuers map[string]*JWTApplication
+}
+
+// NewIssuersJWTApplication takes a map from each trusted issuer (as it
+// appears in the `iss` claim) to the URL of its JWKS.
+func NewIssuersJWTApplication(jwkURLs map[string]string) *IssuersJWTApplication {
+	issuers := make(map[string]*JWTApplication, len(jwkURLs))
+	for issuer, jwkURL := range jwkURLs {
+		issuers[issuer] = NewJWTApplication(jwkURL)
+	}
+	return &IssuersJWTApplication{issuers: issuers}
+}
+
+func (jwtApp *IssuersJWTApplication) Decode(token string) (*map[string]interface{}, error) {
+	decoded, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	// only used to pick the keys: if the issuer is forged, the signature
+	// check against that issuer's keys fails
+	unverified := jwt.Claims{}
+	err = decoded.UnsafeClaimsWithoutVerification(&unverified)
+	if err != nil {
+		return nil, err
+	}
+	if unverified.Issuer == "" {
+		return nil, errors.New("token has no issuer (`iss`)")
+	}
+	issuerApp, trusted := jwtApp.issuers[unverified.Issuer]
+	if !trusted {
+		return nil, fmt.Errorf("token issuer is not trusted: %s", unverified.Issuer)
+	}
+	return issuerApp.Decode(token)
+}
+
+// CheckKeys returns an error if any of the issuers has no usable keys.
+func (jwtApp *IssuersJWTApplication) CheckKeys() error {
+	for issuer, issuerApp := range jwtApp.issuers {
+		err := issuerApp.CheckKeys()
+		if err != nil {
+			return fmt.Errorf("issuer %s: %s", issuer, err.Error())
+		}
+	}
+	return nil
+}
+
+// RefreshKeysEvery refreshes the keys of every issuer in the background (see
+// `JWTApplication.RefreshKeysEvery`).
+func (jwtApp *IssuersJWTApplication) RefreshKeysEvery(interval time.Duration, logger *log.Logger) (stop func()) {
+	stops := []func(){}
+	for _, issuerApp := range jwtApp.issuers {
+		stops = append(stops, issuerApp.RefreshKeysEvery(interval, logger))
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// bearerToken takes the token out of an auth header value, dropping the
+// `Bearer` scheme in any case and any whitespace around it. A value without
+// the scheme is taken to be the token itself.
+//
+//     bearerToken("Bearer  abc") == "abc"
+//     bearerToken("abc") == "abc"
+func bearerToken(value string) string {
+	value = strings.TrimSpace(value)
+	fields := strings.Fields(value)
+	if len(fields) > 1 && strings.EqualFold(fields[0], "bearer") {
+		return strings.TrimSpace(value[len(fields[0]):])
+	}
+	return value
+}
+
+// requestToken returns the caller's token from the auth header (see
+// `WithAuthHeader`), or "" if there is none.
+func (server *Server) requestToken(r *http.Request) string {
+	return bearerToken(r.Header.Get(server.authHeader))
+}
+
+// clientCertInfo returns the client named by the common name of the caller's
+// TLS certificate, as if from a token's `azp`, if `WithClientCertAuth` is on
+// and the certificate was verified against the client CAs in the config from
+// `WithTLS`. Otherwise it returns nil.
+func (server *Server) clientCertInfo(r *http.Request) *TokenInfo {
+	if !server.trustClientCerts || r.TLS == nil {
+		return nil
+	}
+	if len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return nil
+	}
+	return &TokenInfo{clientID: name}
+}
+
 type TokenInfo struct {
 	username string
 	clientID string
 	policies []string
 }
 
+// verifiedClaims returns the claims of `token` once its signature checks out.
+// The signature check is the expensive part, so tokens verified already are
+// taken from the token cache; the claims still need validating every time.
+func (server *Server) verifiedClaims(token string, now time.Time) (*map[string]interface{}, error) {
+	if claims := server.tokenCache.get(token, now); claims != nil {
+		return claims, nil
+	}
+	claims, err := server.jwtApp.Decode(token)
+	if err != nil {
+		return nil, err
+	}
+	// tokens without a numeric `exp` fail validation, so aren't worth caching
+	if exp, ok := (*claims)["exp"].(float64); ok {
+		expires := time.Unix(int64(exp), 0).Add(server.tokenLeeway)
+		server.tokenCache.add(token, claims, expires)
+	}
+	return claims, nil
+}
+
 func (server *Server) decodeToken(token string, scopes []string) (*TokenInfo, error) {
 	missingRequiredField := func(field string) error {
 		msg := fmt.Sprintf(
@@ -29,15 +297,37 @@ func (server *Server) decodeToken(token string, scopes []string) (*TokenInfo, er
 		return errors.New(msg)
 	}
 	server.logger.Debug("decoding token: %s", token)
-	claims, err := server.jwtApp.Decode(token)
+	now := server.clock()
+	claims, err := server.verifiedClaims(token, now)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding token: %s", err.Error())
 	}
-	expected := &authutils.Expected{Scopes: scopes}
+	// authutils compares `exp` against this time, so moving it back by the
+	// leeway accepts tokens which expired within the leeway
+	expiration := now.Add(-server.tokenLeeway).Unix()
+	expected := &authutils.Expected{Scopes: scopes, Expiration: &expiration}
 	err = expected.Validate(claims)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding token: %s", err.Error())
 	}
+	err = checkNotBefore(claims, now.Add(server.tokenLeeway))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token: %s", err.Error())
+	}
+	// this is checked every time, since a cached token can be revoked since
+	if jti, ok := (*claims)["jti"].(string); ok && jti != "" && server.db != nil {
+		var revoked bool
+		err = server.retryRead(func() (err error) {
+			revoked, err = tokenIsRevoked(server.db, jti)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error checking whether token is revoked: %s", err.Error())
+		}
+		if revoked {
+			return nil, errors.New("error decoding token: token has been revoked")
+		}
+	}
 	contextInterface, exists := (*claims)["context"]
 	if !exists {
 		return nil, missingRequiredField("context")
@@ -71,7 +361,7 @@ func (server *Server) decodeToken(token string, scopes []string) (*TokenInfo, er
 			if !casted {
 				return nil, fieldTypeError("policies")
 			}
-			policies := make([]string, len(policiesInterfaceSlice))
+			policies = make([]string, len(policiesInterfaceSlice))
 			for i, policyInterface := range policiesInterfaceSlice {
 				policyString, casted := policyInterface.(string)
 				if !casted {
@@ -90,9 +380,26 @@ func (server *Server) decodeToken(token string, scopes []string) (*TokenInfo, er
 		}
 	}
 	info := TokenInfo{
-		username: username,
+		username: server.normalizeUsername(username),
 		clientID: clientID,
 		policies: policies,
 	}
 	return &info, nil
 }
+
+// checkNotBefore returns an error if the token has an `nbf` claim after
+// `now`. The claim is optional.
+func checkNotBefore(claims *map[string]interface{}, now time.Time) error {
+	nbfInterface, exists := (*claims)["nbf"]
+	if !exists {
+		return nil
+	}
+	nbf, casted := nbfInterface.(float64)
+	if !casted {
+		return errors.New("field `nbf` has wrong type")
+	}
+	if now.Unix() < int64(nbf) {
+		return fmt.Errorf("token is not valid until %s", time.Unix(int64(nbf), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
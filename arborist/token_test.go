@@ -0,0 +1,302 @@
+package arborist
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// jwksServer serves a JWKS which the test can change, and counts requests.
+type jwksServer struct {
+	mu      sync.Mutex
+	keys    []jose.JSONWebKey
+	fetches int
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+	_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: s.keys})
+}
+
+func (s *jwksServer) setKeys(keys ...jose.JSONWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func newSigningKey(t testing.TB, kid string) (*rsa.PrivateKey, jose.JSONWebKey) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := jose.JSONWebKey{Key: &private.PublicKey, KeyID: kid, Algorithm: "RS256", Use: "sig"}
+	return private, public
+}
+
+func signToken(t testing.TB, private *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	options := (&jose.SignerOptions{}).WithHeader("kid", kid)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: private}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTApplicationKeyRotation(t *testing.T) {
+	cooldown := keyRefreshCooldown
+	keyRefreshCooldown = 0
+	defer func() { keyRefreshCooldown = cooldown }()
+
+	oldPrivate, oldPublic := newSigningKey(t, "old")
+	newPrivate, newPublic := newSigningKey(t, "new")
+	jwks := &jwksServer{}
+	jwks.setKeys(oldPublic)
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+	jwtApp := NewJWTApplication(server.URL)
+
+	claims := map[string]interface{}{"sub": "test-user"}
+	decoded, err := jwtApp.Decode(signToken(t, oldPrivate, "old", claims))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "test-user", (*decoded)["sub"])
+	}
+	assert.Equal(t, 1, jwks.fetches)
+
+	// known key IDs don't fetch the keys again
+	_, err = jwtApp.Decode(signToken(t, oldPrivate, "old", claims))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, jwks.fetches)
+
+	// the identity provider rotates its keys: a token with the new key ID
+	// makes the application fetch the keys and then validate it
+	jwks.setKeys(newPublic)
+	decoded, err = jwtApp.Decode(signToken(t, newPrivate, "new", claims))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "test-user", (*decoded)["sub"])
+	}
+	assert.Equal(t, 2, jwks.fetches)
+
+	// the old key was dropped with the refresh
+	_, err = jwtApp.Decode(signToken(t, oldPrivate, "old", claims))
+	assert.Error(t, err)
+
+	t.Run("WrongKey", func(t *testing.T) {
+		_, err := jwtApp.Decode(signToken(t, oldPrivate, "new", claims))
+		assert.Error(t, err, "expected signature check to fail")
+	})
+
+	t.Run("Cooldown", func(t *testing.T) {
+		keyRefreshCooldown = cooldown
+		fetches := jwks.fetches
+		for i := 0; i < 3; i++ {
+			_, err := jwtApp.Decode(signToken(t, oldPrivate, "made-up", claims))
+			assert.Error(t, err)
+		}
+		assert.LessOrEqual(t, jwks.fetches-fetches, 1, "unknown key IDs should not fetch the keys every time")
+	})
+
+	t.Run("Periodic", func(t *testing.T) {
+		jwks.setKeys(oldPublic)
+		stop := jwtApp.RefreshKeysEvery(10*time.Millisecond, log.New(ioutil.Discard, "", 0))
+		defer stop()
+		assert.Eventually(t, func() bool {
+			return jwtApp.lookupKey("old") != nil
+		}, time.Second, 10*time.Millisecond, "expected the keys to be refreshed in the background")
+	})
+}
+
+func TestDecodeTokenLeeway(t *testing.T) {
+	private, public := newSigningKey(t, "key")
+	jwks := &jwksServer{}
+	jwks.setKeys(public)
+	keys := httptest.NewServer(jwks)
+	defer keys.Close()
+	jwtApp := NewJWTApplication(keys.URL)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	newServer := func(leeway time.Duration) *Server {
+		return NewServer().
+			WithLogger(log.New(ioutil.Discard, "", 0)).
+			WithJWTApp(jwtApp).
+			WithClock(func() time.Time { return now }).
+			WithTokenLeeway(leeway)
+	}
+	token := func(exp, nbf time.Time) string {
+		return signToken(t, private, "key", map[string]interface{}{
+			"scope":   []string{"openid"},
+			"exp":     exp.Unix(),
+			"nbf":     nbf.Unix(),
+			"context": map[string]interface{}{"user": map[string]interface{}{"name": "test-user"}},
+		})
+	}
+	valid := token(now.Add(time.Hour), now.Add(-time.Hour))
+	expired := token(now.Add(-10*time.Second), now.Add(-time.Hour))
+	notYetValid := token(now.Add(time.Hour), now.Add(10*time.Second))
+
+	t.Run("NoLeeway", func(t *testing.T) {
+		server := newServer(0)
+		info, err := server.decodeToken(valid, []string{"openid"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "test-user", info.username)
+		}
+		_, err = server.decodeToken(expired, []string{"openid"})
+		assert.Error(t, err, "expected token expired 10s ago to be rejected")
+		_, err = server.decodeToken(notYetValid, []string{"openid"})
+		assert.Error(t, err, "expected token valid in 10s to be rejected")
+	})
+
+	t.Run("Leeway", func(t *testing.T) {
+		server := newServer(30 * time.Second)
+		_, err := server.decodeToken(expired, []string{"openid"})
+		assert.NoError(t, err, "expected token expired 10s ago to be accepted")
+		_, err = server.decodeToken(notYetValid, []string{"openid"})
+		assert.NoError(t, err, "expected token valid in 10s to be accepted")
+		longExpired := token(now.Add(-time.Minute), now.Add(-time.Hour))
+		_, err = server.decodeToken(longExpired, []string{"openid"})
+		assert.Error(t, err, "expected token expired past the leeway to be rejected")
+	})
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := map[string]string{
+		"Bearer abc":      "abc",
+		"bearer abc":      "abc",
+		"BEARER \t abc  ": "abc",
+		"abc":             "abc",
+		"  abc ":          "abc",
+		"Bearer":          "Bearer",
+		"":                "",
+	}
+	for value, expected := range tests {
+		assert.Equal(t, expected, bearerToken(value), "header value %q", value)
+	}
+}
+
+func TestClientCertInfo(t *testing.T) {
+	server := NewServer().WithClientCertAuth(true)
+	request := func(commonName string, verified bool) *http.Request {
+		r := httptest.NewRequest("GET", "/auth/proxy", nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if verified {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		return r
+	}
+
+	info := server.clientCertInfo(request("svc", true))
+	if assert.NotNil(t, info) {
+		assert.Equal(t, "svc", info.clientID)
+		assert.Equal(t, "", info.username)
+	}
+	assert.Nil(t, server.clientCertInfo(request("svc", false)), "expected unverified certificates to be ignored")
+	assert.Nil(t, server.clientCertInfo(request("", true)), "expected a certificate without a common name to be ignored")
+	assert.Nil(t, server.clientCertInfo(httptest.NewRequest("GET", "/auth/proxy", nil)))
+
+	server.WithClientCertAuth(false)
+	assert.Nil(t, server.clientCertInfo(request("svc", true)), "expected certificates to be ignored unless turned on")
+}
+
+func TestDecodeTokenUsernameCase(t *testing.T) {
+	private, public := newSigningKey(t, "key")
+	jwks := &jwksServer{}
+	jwks.setKeys(public)
+	keys := httptest.NewServer(jwks)
+	defer keys.Close()
+	jwtApp := NewJWTApplication(keys.URL)
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	token := signToken(t, private, "key", map[string]interface{}{
+		"scope":   []string{"openid"},
+		"exp":     now.Add(time.Hour).Unix(),
+		"context": map[string]interface{}{"user": map[string]interface{}{"name": "Test.User@Example.org"}},
+	})
+	newServer := func(caseInsensitive bool) *Server {
+		return NewServer().
+			WithLogger(log.New(ioutil.Discard, "", 0)).
+			WithJWTApp(jwtApp).
+			WithClock(func() time.Time { return now }).
+			WithCaseInsensitiveUsernames(caseInsensitive)
+	}
+
+	t.Run("CaseSensitive", func(t *testing.T) {
+		info, err := newServer(false).decodeToken(token, []string{"openid"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Test.User@Example.org", info.username)
+		}
+	})
+
+	t.Run("CaseInsensitive", func(t *testing.T) {
+		info, err := newServer(true).decodeToken(token, []string{"openid"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "test.user@example.org", info.username)
+		}
+	})
+}
+
+func TestTrustedIssuers(t *testing.T) {
+	// both issuers use the same key ID, so only the issuer tells them apart
+	privateA, publicA := newSigningKey(t, "key")
+	privateB, publicB := newSigningKey(t, "key")
+	jwksA := &jwksServer{}
+	jwksA.setKeys(publicA)
+	keysA := httptest.NewServer(jwksA)
+	defer keysA.Close()
+	jwksB := &jwksServer{}
+	jwksB.setKeys(publicB)
+	keysB := httptest.NewServer(jwksB)
+	defer keysB.Close()
+
+	server := NewServer().
+		WithLogger(log.New(ioutil.Discard, "", 0)).
+		WithTrustedIssuers(map[string]string{
+			"https://a.example.org/user": keysA.URL,
+			"https://b.example.org/user": keysB.URL,
+		})
+	token := func(private *rsa.PrivateKey, issuer string) string {
+		return signToken(t, private, "key", map[string]interface{}{
+			"iss":     issuer,
+			"scope":   []string{"openid"},
+			"exp":     time.Now().Add(time.Hour).Unix(),
+			"context": map[string]interface{}{"user": map[string]interface{}{"name": "test-user"}},
+		})
+	}
+	scopes := []string{"openid"}
+
+	_, err := server.decodeToken(token(privateA, "https://a.example.org/user"), scopes)
+	assert.NoError(t, err, "expected issuer A's token to validate with A's keys")
+	_, err = server.decodeToken(token(privateB, "https://b.example.org/user"), scopes)
+	assert.NoError(t, err, "expected issuer B's token to validate with B's keys")
+
+	_, err = server.decodeToken(token(privateA, "https://b.example.org/user"), scopes)
+	assert.Error(t, err, "expected token claiming issuer B but signed by A to be rejected")
+	_, err = server.decodeToken(token(privateB, "https://a.example.org/user"), scopes)
+	assert.Error(t, err, "expected token claiming issuer A but signed by B to be rejected")
+
+	fetches := jwksA.fetches + jwksB.fetches
+	_, err = server.decodeToken(token(privateA, "https://evil.example.org/user"), scopes)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "token issuer is not trusted: https://evil.example.org/user")
+	}
+	assert.Equal(t, fetches, jwksA.fetches+jwksB.fetches, "untrusted issuers should not fetch any keys")
+}
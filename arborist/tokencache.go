@@ -0,0 +1,87 @@
+package arborist
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// tokenCache is a least-recently-used cache of the claims from tokens whose
+// signatures have already been verified, so that a token used again before it
+// expires skips the signature check. Entries are keyed by a hash of the
+// token, and dropped once the token expires or the cache is full.
+type tokenCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[[sha256.Size]byte]*list.Element
+	// order has the most recently used entries at the front
+	order *list.List
+}
+
+type tokenCacheEntry struct {
+	key     [sha256.Size]byte
+	claims  *map[string]interface{}
+	expires time.Time
+}
+
+func newTokenCache(size int) *tokenCache {
+	return &tokenCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached claims for `token`, or nil if it isn't cached or
+// has expired by `now`. The claims must not be modified.
+func (cache *tokenCache) get(token string, now time.Time) *map[string]interface{} {
+	if cache == nil {
+		return nil
+	}
+	key := sha256.Sum256([]byte(token))
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, exists := cache.entries[key]
+	if !exists {
+		return nil
+	}
+	entry := element.Value.(*tokenCacheEntry)
+	if !now.Before(entry.expires) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil
+	}
+	cache.order.MoveToFront(element)
+	return entry.claims
+}
+
+// add caches the claims for `token` until `expires`, evicting the least
+// recently used entry if the cache is full.
+func (cache *tokenCache) add(token string, claims *map[string]interface{}, expires time.Time) {
+	if cache == nil {
+		return
+	}
+	key := sha256.Sum256([]byte(token))
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, exists := cache.entries[key]; exists {
+		cache.order.MoveToFront(element)
+		return
+	}
+	for cache.order.Len() >= cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*tokenCacheEntry).key)
+	}
+	entry := &tokenCacheEntry{key: key, claims: claims, expires: expires}
+	cache.entries[key] = cache.order.PushFront(entry)
+}
+
+// len returns the number of cached tokens, including any that have expired
+// but not been looked up since.
+func (cache *tokenCache) len() int {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.order.Len()
+}
@@ -0,0 +1,117 @@
+package arborist
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingDecoder is a spy on the token verifier, counting the tokens it is
+// asked to verify.
+type countingDecoder struct {
+	JWTDecoder
+	decodes int
+}
+
+func (decoder *countingDecoder) Decode(token string) (*map[string]interface{}, error) {
+	decoder.decodes++
+	return decoder.JWTDecoder.Decode(token)
+}
+
+func TestTokenCache(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	claims := func(name string) *map[string]interface{} {
+		return &map[string]interface{}{"sub": name}
+	}
+
+	t.Run("Expiry", func(t *testing.T) {
+		cache := newTokenCache(10)
+		cache.add("a", claims("a"), now.Add(time.Minute))
+		assert.Equal(t, claims("a"), cache.get("a", now))
+		assert.Nil(t, cache.get("a", now.Add(time.Minute)), "expected entry to expire at exp")
+		assert.Equal(t, 0, cache.len(), "expected expired entry to be dropped")
+	})
+
+	t.Run("LeastRecentlyUsed", func(t *testing.T) {
+		cache := newTokenCache(2)
+		cache.add("a", claims("a"), now.Add(time.Hour))
+		cache.add("b", claims("b"), now.Add(time.Hour))
+		// using "a" makes "b" the least recently used
+		assert.NotNil(t, cache.get("a", now))
+		cache.add("c", claims("c"), now.Add(time.Hour))
+		assert.Equal(t, 2, cache.len())
+		assert.NotNil(t, cache.get("a", now))
+		assert.Nil(t, cache.get("b", now), "expected least recently used entry to be evicted")
+		assert.NotNil(t, cache.get("c", now))
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		var cache *tokenCache
+		cache.add("a", claims("a"), now.Add(time.Hour))
+		assert.Nil(t, cache.get("a", now))
+	})
+}
+
+// newCachingServer sets up a server whose tokens are validated with a real
+// JWKS, returning a valid token and a spy on the verifier.
+func newCachingServer(t testing.TB, cacheSize int) (*Server, *countingDecoder, string, func()) {
+	private, public := newSigningKey(t, "key")
+	jwks := &jwksServer{}
+	jwks.setKeys(public)
+	keys := httptest.NewServer(jwks)
+	decoder := &countingDecoder{JWTDecoder: NewJWTApplication(keys.URL)}
+	server := NewServer().
+		WithLogger(log.New(ioutil.Discard, "", 0)).
+		WithJWTApp(decoder).
+		WithTokenCache(cacheSize)
+	token := signToken(t, private, "key", map[string]interface{}{
+		"scope":   []string{"openid"},
+		"exp":     time.Now().Add(time.Hour).Unix(),
+		"context": map[string]interface{}{"user": map[string]interface{}{"name": "test-user"}},
+	})
+	return server, decoder, token, keys.Close
+}
+
+func TestDecodeTokenCached(t *testing.T) {
+	server, decoder, token, done := newCachingServer(t, 10)
+	defer done()
+
+	for i := 0; i < 3; i++ {
+		info, err := server.decodeToken(token, []string{"openid"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, "test-user", info.username)
+		}
+	}
+	assert.Equal(t, 1, decoder.decodes, "expected later calls to skip verification")
+
+	// the claims are still validated on a cache hit
+	_, err := server.decodeToken(token, []string{"openid", "admin"})
+	assert.Error(t, err, "expected missing scope to be rejected even when cached")
+
+	// once the token expires, it's neither cached nor valid
+	server.WithClock(func() time.Time { return time.Now().Add(2 * time.Hour) })
+	_, err = server.decodeToken(token, []string{"openid"})
+	assert.Error(t, err)
+	assert.Equal(t, 2, decoder.decodes)
+}
+
+func benchmarkDecodeToken(b *testing.B, cacheSize int) {
+	server, _, token, done := newCachingServer(b, cacheSize)
+	defer done()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := server.decodeToken(token, []string{"openid"})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeToken(b *testing.B) {
+	b.Run("Uncached", func(b *testing.B) { benchmarkDecodeToken(b, 0) })
+	b.Run("Cached", func(b *testing.B) { benchmarkDecodeToken(b, 1000) })
+}
@@ -0,0 +1,78 @@
+package arborist
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/uc-cdis/arborist"
+
+// traceContext reads and writes the W3C `traceparent` header, so spans join
+// the trace of whichever service called arborist.
+var traceContext = propagation.TraceContext{}
+
+// traceMiddleware wraps every route in a span named for its method and route
+// template, continuing the trace from an incoming `traceparent` header.
+func (server *Server) traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := server.tracer.Start(
+			ctx,
+			r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(r.Method),
+				semconv.HTTPRouteKey.String(route),
+			),
+		)
+		defer span.End()
+		captured := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(captured.Code))
+		if captured.Code >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(captured.Code))
+		}
+	})
+}
+
+// traceAuthorize runs one of the authorize functions (`authorizeUser`,
+// `authorizeClient`, `authorizeAnonymous`) in a span, recording what was
+// asked for and the decision. The span covers the database queries too.
+func (server *Server) traceAuthorize(
+	ctx context.Context,
+	name string,
+	authorize func(*AuthRequest) (*AuthResponse, error),
+	request *AuthRequest,
+) (*AuthResponse, error) {
+	_, span := server.tracer.Start(
+		ctx,
+		name,
+		trace.WithAttributes(
+			attribute.String("arborist.resource", request.Resource),
+			attribute.String("arborist.service", request.Service),
+			attribute.String("arborist.method", request.Method),
+		),
+	)
+	defer span.End()
+	rv, err := authorize(request)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return rv, err
+	}
+	span.SetAttributes(attribute.Bool("arborist.auth", rv.Auth))
+	return rv, nil
+}
@@ -0,0 +1,92 @@
+package arborist
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	server := NewServer().WithTracerProvider(provider)
+
+	allow := func(*AuthRequest) (*AuthResponse, error) {
+		return &AuthResponse{Auth: true}, nil
+	}
+	fail := func(*AuthRequest) (*AuthResponse, error) {
+		return nil, errors.New("database is down")
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/auth/request", func(w http.ResponseWriter, r *http.Request) {
+		request := &AuthRequest{Resource: "/programs/a", Service: "peregrine", Method: "read"}
+		_, _ = server.traceAuthorize(r.Context(), "authorizeUser", allow, request)
+		_, _ = server.traceAuthorize(r.Context(), "authorizeClient", fail, request)
+		span := server.traceDB(r.Context(), "listPoliciesFromDb")
+		endDBSpan(span, nil)
+		span = server.traceDB(r.Context(), "transactify")
+		endDBSpan(span, dbSpanError(newErrorResponse("policy already exists", 409, nil)))
+		w.WriteHeader(http.StatusOK)
+	})
+	router.Use(server.traceMiddleware)
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("POST", "/auth/request", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	if !assert.Len(t, spans, 5) {
+		return
+	}
+	root := spans["POST /auth/request"]
+	assert.Equal(t, trace.SpanKindServer, root.SpanKind)
+	assert.Equal(t, traceID, root.SpanContext.TraceID().String(), "expected the incoming trace to continue")
+	assert.Contains(t, root.Attributes, attribute.Int("http.status_code", 200))
+
+	user := spans["authorizeUser"]
+	assert.Equal(t, root.SpanContext.SpanID(), user.Parent.SpanID())
+	assert.Contains(t, user.Attributes, attribute.String("arborist.resource", "/programs/a"))
+	assert.Contains(t, user.Attributes, attribute.String("arborist.service", "peregrine"))
+	assert.Contains(t, user.Attributes, attribute.Bool("arborist.auth", true))
+
+	client := spans["authorizeClient"]
+	assert.Equal(t, codes.Error, client.Status.Code)
+
+	query := spans["listPoliciesFromDb"]
+	assert.Equal(t, root.SpanContext.SpanID(), query.Parent.SpanID(), "expected the database span under the request span")
+	assert.Equal(t, trace.SpanKindClient, query.SpanKind)
+	assert.Contains(t, query.Attributes, attribute.String("db.system", "postgresql"))
+	assert.Equal(t, codes.Unset, query.Status.Code)
+
+	write := spans["transactify"]
+	assert.Equal(t, root.SpanContext.SpanID(), write.Parent.SpanID())
+	assert.Equal(t, codes.Error, write.Status.Code)
+	assert.Equal(t, "policy already exists", write.Status.Description)
+
+	t.Run("NoProvider", func(t *testing.T) {
+		// the default tracer does nothing, but the handler still runs
+		server := NewServer()
+		called := false
+		router := mux.NewRouter()
+		router.HandleFunc("/auth/request", func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			assert.False(t, trace.SpanFromContext(r.Context()).IsRecording())
+		})
+		router.Use(server.traceMiddleware)
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/auth/request", nil))
+		assert.True(t, called)
+	})
+}
@@ -13,6 +13,9 @@ import (
 type PolicyBinding struct {
 	Policy    string  `json:"policy"`
 	ExpiresAt *string `json:"expires_at"`
+	// ExpiresIn is the number of seconds left before the grant expires, or
+	// zero if it already has; it is absent for grants which never expire.
+	ExpiresIn *int64 `json:"expires_in,omitempty"`
 }
 
 type User struct {
@@ -63,7 +66,9 @@ type UserFromQuery struct {
 	Policies []byte         `db:"policies"`
 }
 
-func (userFromQuery *UserFromQuery) standardize() User {
+// standardize converts the query result into a User, filling in how long
+// each policy grant has left as of `now`.
+func (userFromQuery *UserFromQuery) standardize(now time.Time) User {
 	if len(userFromQuery.Policies) == 0 {
 		userFromQuery.Policies = []byte("[]")
 	}
@@ -73,6 +78,20 @@ func (userFromQuery *UserFromQuery) standardize() User {
 		// debug
 		fmt.Printf("ERROR: UserFromQuery loader is broken: %s\n", err.Error())
 	}
+	for i := range policies {
+		if policies[i].ExpiresAt == nil {
+			continue
+		}
+		expiresAt, err := time.Parse(time.RFC3339Nano, *policies[i].ExpiresAt)
+		if err != nil {
+			continue
+		}
+		expiresIn := int64(expiresAt.Sub(now) / time.Second)
+		if expiresIn < 0 {
+			expiresIn = 0
+		}
+		policies[i].ExpiresIn = &expiresIn
+	}
 	user := User{
 		Name:     userFromQuery.Name,
 		Groups:   userFromQuery.Groups,
@@ -188,7 +207,38 @@ func fetchUserPolicyInfo(db *sqlx.DB, user_name string, policy_name string) (*Us
 	return &policyInfo, nil
 }
 
-func listUsersFromDb(db *sqlx.DB) ([]UserFromQuery, error) {
+// userHasPolicy reports whether the user currently holds the policy, granted
+// either directly or through one of their groups. Policies which every user
+// gets from the `anonymous` and `logged-in` groups don't count, and neither
+// do grants which have expired by `now`.
+func userHasPolicy(db *sqlx.DB, username string, policyName string, now time.Time) (bool, error) {
+	stmt := `
+		SELECT EXISTS (
+			SELECT 1 FROM usr
+			INNER JOIN usr_policy ON usr_policy.usr_id = usr.id
+			INNER JOIN policy ON policy.id = usr_policy.policy_id
+			WHERE usr.name = $1 AND policy.name = $2
+			AND (usr_policy.expires_at IS NULL OR $3 < usr_policy.expires_at)
+			UNION
+			SELECT 1 FROM usr
+			INNER JOIN usr_grp ON usr_grp.usr_id = usr.id
+			INNER JOIN grp_policy ON grp_policy.grp_id = usr_grp.grp_id
+			INNER JOIN policy ON policy.id = grp_policy.policy_id
+			WHERE usr.name = $1 AND policy.name = $2
+			AND (usr_grp.expires_at IS NULL OR $3 < usr_grp.expires_at)
+		)
+	`
+	var exists bool
+	err := db.Get(&exists, stmt, username, policyName, now)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// queryUsers selects every user, with their groups and policies, returning
+// the rows for the caller to scan into `UserFromQuery` one at a time.
+func queryUsers(db *sqlx.DB) (*sqlx.Rows, error) {
 	stmt := `
 		SELECT
 			usr.id,
@@ -206,12 +256,7 @@ func listUsersFromDb(db *sqlx.DB) ([]UserFromQuery, error) {
 		LEFT JOIN grp ON grp.id = usr_grp.grp_id
 		GROUP BY usr.id
 	`
-	users := []UserFromQuery{}
-	err := db.Select(&users, stmt)
-	if err != nil {
-		return nil, err
-	}
-	return users, nil
+	return db.Queryx(stmt)
 }
 
 func (user *User) createInDb(db *sqlx.DB) *ErrorResponse {
@@ -240,7 +285,7 @@ func (user *User) createInDb(db *sqlx.DB) *ErrorResponse {
 		// this should only fail because the user was not unique. return error
 		// accordingly
 		msg := fmt.Sprintf("failed to insert user: user with this ID already exists: %s", user.Name)
-		return newErrorResponse(msg, 409, &err)
+		return newErrorResponse(msg, 409, &err).withCode(ErrorCodeUserExists)
 	}
 
 	err = tx.Commit()
@@ -266,7 +311,7 @@ func (user *User) updateInDb(db *sqlx.DB, name *string, email *string) *ErrorRes
 	if err != nil {
 		// this should only fail because the target name was not unique
 		msg := fmt.Sprintf(`failed to update name to "%s": user with this name already exists`, *name)
-		return newErrorResponse(msg, 409, &err)
+		return newErrorResponse(msg, 409, &err).withCode(ErrorCodeUserExists)
 	}
 
 	rowsAffected, _ := result.RowsAffected()
@@ -275,7 +320,7 @@ func (user *User) updateInDb(db *sqlx.DB, name *string, email *string) *ErrorRes
 			"failed to update user: user does not exist: %s",
 			user.Name,
 		)
-		return newErrorResponse(msg, 404, nil)
+		return newErrorResponse(msg, 404, nil).withCode(ErrorCodeUserNotFound)
 	}
 	return nil
 }
@@ -305,7 +350,7 @@ func grantUserPolicy(db *sqlx.DB, username string, policyName string, expiresAt
 				"failed to grant policy to user: user does not exist: %s",
 				username,
 			)
-			return newErrorResponse(msg, 404, nil)
+			return newErrorResponse(msg, 404, nil).withCode(ErrorCodeUserNotFound)
 		}
 		if err != nil {
 			msg := "user query failed"
@@ -317,7 +362,7 @@ func grantUserPolicy(db *sqlx.DB, username string, policyName string, expiresAt
 				"failed to grant policy to user: policy does not exist: %s",
 				policyName,
 			)
-			return newErrorResponse(msg, 400, nil)
+			return newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
 		}
 		if err != nil {
 			msg := "policy query failed"
@@ -328,6 +373,30 @@ func grantUserPolicy(db *sqlx.DB, username string, policyName string, expiresAt
 	return nil
 }
 
+// userAndPolicyExist returns a 404 error response if either the user or the
+// policy does not exist.
+func userAndPolicyExist(db *sqlx.DB, username string, policyName string) *ErrorResponse {
+	user, err := userWithName(db, username)
+	if err != nil {
+		msg := "user query failed"
+		return newErrorResponse(msg, 500, &err)
+	}
+	if user == nil {
+		msg := fmt.Sprintf("user does not exist: %s", username)
+		return newErrorResponse(msg, 404, nil).withCode(ErrorCodeUserNotFound)
+	}
+	policy, err := policyWithName(db, policyName)
+	if err != nil {
+		msg := "policy query failed"
+		return newErrorResponse(msg, 500, &err)
+	}
+	if policy == nil {
+		msg := fmt.Sprintf("policy does not exist: %s", policyName)
+		return newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
+	}
+	return nil
+}
+
 func revokeUserPolicy(db *sqlx.DB, username string, policyName string, authzProvider sql.NullString) *ErrorResponse {
 	stmt := `
 		DELETE FROM usr_policy
@@ -367,6 +436,129 @@ func revokeUserPolicyAll(db *sqlx.DB, username string, authzProvider sql.NullStr
 	return nil
 }
 
+// BulkGrantResult is what happened for one user in a bulk grant or revoke
+// of a policy: either it worked, or `Error` says why not.
+type BulkGrantResult struct {
+	Username string     `json:"username"`
+	OK       bool       `json:"ok"`
+	Error    *HTTPError `json:"error,omitempty"`
+}
+
+// BulkGrantResults is the response to granting or revoking a policy for a
+// list of users, with a result for each user in the order they were given.
+type BulkGrantResults struct {
+	Policy    string            `json:"policy"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []BulkGrantResult `json:"results"`
+}
+
+func (results *BulkGrantResults) add(username string, errResponse *ErrorResponse) {
+	result := BulkGrantResult{Username: username, OK: errResponse == nil}
+	if errResponse != nil {
+		result.Error = &errResponse.HTTPError
+		results.Failed++
+	} else {
+		results.Succeeded++
+	}
+	results.Results = append(results.Results, result)
+}
+
+// bulkGrantUsers looks up the policy and which of `usernames` exist, for
+// `grantPolicyToUsers` and `revokePolicyFromUsers`. A missing policy fails
+// the whole request with a 404.
+func bulkGrantUsers(tx *sqlx.Tx, policyName string, usernames []string) (map[string]bool, *ErrorResponse) {
+	var policyExists bool
+	err := tx.Get(&policyExists, "SELECT EXISTS (SELECT 1 FROM policy WHERE name = $1)", policyName)
+	if err != nil {
+		msg := "policy query failed"
+		return nil, newErrorResponse(msg, 500, &err)
+	}
+	if !policyExists {
+		msg := fmt.Sprintf("policy does not exist: %s", policyName)
+		return nil, newErrorResponse(msg, 404, nil).withCode(ErrorCodePolicyNotFound)
+	}
+	found := []string{}
+	err = tx.Select(&found, "SELECT name FROM usr WHERE name = ANY($1)", pq.Array(usernames))
+	if err != nil {
+		msg := "user query failed"
+		return nil, newErrorResponse(msg, 500, &err)
+	}
+	exists := make(map[string]bool, len(found))
+	for _, username := range found {
+		exists[username] = true
+	}
+	return exists, nil
+}
+
+// grantPolicyToUsers grants the policy to each of `usernames` which exists,
+// and reports the ones which don't as failures rather than failing the rest.
+func grantPolicyToUsers(tx *sqlx.Tx, policyName string, usernames []string, expiresAt *time.Time, authzProvider sql.NullString) (*BulkGrantResults, *ErrorResponse) {
+	exists, errResponse := bulkGrantUsers(tx, policyName, usernames)
+	if errResponse != nil {
+		return nil, errResponse
+	}
+	results := &BulkGrantResults{Policy: policyName, Results: []BulkGrantResult{}}
+	stmt := `
+		INSERT INTO usr_policy(usr_id, policy_id, expires_at, authz_provider)
+		VALUES ((SELECT id FROM usr WHERE name = $1), (SELECT id FROM policy WHERE name = $2), $3, $4)
+		ON CONFLICT (usr_id, policy_id) DO UPDATE SET expires_at = EXCLUDED.expires_at
+	`
+	for _, username := range usernames {
+		if !exists[username] {
+			msg := fmt.Sprintf("user does not exist: %s", username)
+			results.add(username, newErrorResponse(msg, 404, nil).withCode(ErrorCodeUserNotFound))
+			continue
+		}
+		_, err := tx.Exec(stmt, username, policyName, expiresAt, authzProvider)
+		if err != nil {
+			msg := fmt.Sprintf("failed to grant policy to user %s: %s", username, err.Error())
+			return nil, newErrorResponse(msg, 500, &err)
+		}
+		results.add(username, nil)
+	}
+	return results, nil
+}
+
+// revokePolicyFromUsers revokes the policy from each of `usernames` which
+// exists and has it granted directly (from `authzProvider`, if it's set), and
+// reports the others as failures rather than failing the rest.
+func revokePolicyFromUsers(tx *sqlx.Tx, policyName string, usernames []string, authzProvider sql.NullString) (*BulkGrantResults, *ErrorResponse) {
+	exists, errResponse := bulkGrantUsers(tx, policyName, usernames)
+	if errResponse != nil {
+		return nil, errResponse
+	}
+	results := &BulkGrantResults{Policy: policyName, Results: []BulkGrantResult{}}
+	stmt := `
+		DELETE FROM usr_policy
+		WHERE usr_id = (SELECT id FROM usr WHERE name = $1)
+		AND policy_id = (SELECT id FROM policy WHERE name = $2)
+		AND ($3::text IS NULL OR authz_provider = $3)
+	`
+	for _, username := range usernames {
+		if !exists[username] {
+			msg := fmt.Sprintf("user does not exist: %s", username)
+			results.add(username, newErrorResponse(msg, 404, nil).withCode(ErrorCodeUserNotFound))
+			continue
+		}
+		result, err := tx.Exec(stmt, username, policyName, authzProvider)
+		if err != nil {
+			msg := fmt.Sprintf("failed to revoke policy from user %s: %s", username, err.Error())
+			return nil, newErrorResponse(msg, 500, &err)
+		}
+		if revoked, err := result.RowsAffected(); err == nil && revoked == 0 {
+			msg := fmt.Sprintf("policy `%s` is not granted directly to user %s", policyName, username)
+			if authzProvider.Valid {
+				msg = fmt.Sprintf("%s by authz provider `%s`", msg, authzProvider.String)
+			}
+			results.add(username, newErrorResponse(msg, 400, nil))
+			continue
+		}
+		results.add(username, nil)
+	}
+	return results, nil
+}
+
 func addUserToGroup(db *sqlx.DB, username string, groupName string, expiresAt *time.Time, authzProvider sql.NullString) *ErrorResponse {
 	if groupName == AnonymousGroup || groupName == LoggedInGroup {
 		return newErrorResponse("can't add users to built-in groups", 400, nil)
@@ -399,7 +591,7 @@ func addUserToGroup(db *sqlx.DB, username string, groupName string, expiresAt *t
 				"failed to add user to group: group does not exist: %s",
 				groupName,
 			)
-			return newErrorResponse(msg, 404, nil)
+			return newErrorResponse(msg, 404, nil).withCode(ErrorCodeGroupNotFound)
 		}
 		if err != nil {
 			msg := "group query failed"
@@ -0,0 +1,33 @@
+package arborist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserStandardizeExpiresIn(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	userFromQuery := UserFromQuery{
+		Name: "test-user",
+		Policies: []byte(`[
+			{"policy": "future", "expires_at": "2020-01-01T13:00:00.5+00:00"},
+			{"policy": "past", "expires_at": "2020-01-01T11:00:00+00:00"},
+			{"policy": "forever", "expires_at": null}
+		]`),
+	}
+	user := userFromQuery.standardize(now)
+	expiresIn := map[string]*int64{}
+	for _, binding := range user.Policies {
+		expiresIn[binding.Policy] = binding.ExpiresIn
+	}
+
+	if assert.NotNil(t, expiresIn["future"]) {
+		assert.Equal(t, int64(3600), *expiresIn["future"])
+	}
+	if assert.NotNil(t, expiresIn["past"]) {
+		assert.Equal(t, int64(0), *expiresIn["past"])
+	}
+	assert.Nil(t, expiresIn["forever"])
+}
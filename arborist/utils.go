@@ -1,6 +1,7 @@
 package arborist
 
 import (
+	"encoding"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -96,9 +97,160 @@ func validateJSON(
 		return containsUnexpectedFields(structName, unexpectedFields)
 	}
 
+	// Finally, check that each field has the right type, so the error can
+	// name the field (`json.Unmarshal` names the struct field instead).
+	fieldTypes := structJSONFieldTypes(reflect.TypeOf(x))
+	for field, value := range content {
+		fieldType, exists := fieldTypes[field]
+		if !exists {
+			continue
+		}
+		if err := checkJSONType(structName, field, fieldType, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// structJSONFieldTypes maps the JSON tag names (without options like
+// `omitempty`) of the fields in a struct type to the types of the fields.
+func structJSONFieldTypes(structType reflect.Type) map[string]reflect.Type {
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	result := make(map[string]reflect.Type)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		result[name] = field.Type
+	}
+	return result
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// checkJSONType checks that `value`, as decoded from JSON into an
+// `interface{}`, can be unmarshalled into type `t`, looking inside arrays and
+// objects. The error names the offending field with its path from the top,
+// like `permissions[0].action`. Types which unmarshal themselves, and null
+// values, are left for `json.Unmarshal` to handle.
+func checkJSONType(structName string, field string, t reflect.Type, value interface{}) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if value == nil || t.Kind() == reflect.Interface {
+		return nil
+	}
+	ptr := reflect.PtrTo(t)
+	if ptr.Implements(jsonUnmarshalerType) || ptr.Implements(textUnmarshalerType) {
+		return nil
+	}
+	matches := false
+	switch value := value.(type) {
+	case string:
+		matches = t.Kind() == reflect.String
+	case bool:
+		matches = t.Kind() == reflect.Bool
+	case float64:
+		matches = isNumberKind(t.Kind())
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			break
+		}
+		for i, item := range value {
+			itemField := fmt.Sprintf("%s[%d]", field, i)
+			if err := checkJSONType(structName, itemField, t.Elem(), item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		if t.Kind() == reflect.Map {
+			for key, item := range value {
+				if err := checkJSONType(structName, field+"."+key, t.Elem(), item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if t.Kind() != reflect.Struct {
+			break
+		}
+		fieldTypes := structJSONFieldTypes(t)
+		for key, item := range value {
+			fieldType, exists := fieldTypes[key]
+			if !exists {
+				continue
+			}
+			if err := checkJSONType(structName, field+"."+key, fieldType, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		matches = true
+	}
+	if !matches {
+		return wrongFieldType(structName, field, jsonTypeName(t), jsonValueName(value))
+	}
 	return nil
 }
 
+func isNumberKind(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// jsonTypeName describes a Go type by the JSON type it is unmarshalled from,
+// for error messages.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t.Kind() == reflect.String:
+		return "a string"
+	case t.Kind() == reflect.Bool:
+		return "a boolean"
+	case isNumberKind(t.Kind()):
+		return "a number"
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return "an array"
+	case t.Kind() == reflect.Map || t.Kind() == reflect.Struct:
+		return "an object"
+	}
+	return "a value"
+}
+
+// jsonValueName describes a value decoded from JSON, for error messages.
+func jsonValueName(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case float64:
+		return "a number"
+	case []interface{}:
+		return "an array"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return "a value"
+}
+
 func unmarshal(body []byte, x interface{}) *ErrorResponse {
 	var structValue reflect.Value = reflect.ValueOf(x)
 	if structValue.Kind() == reflect.Ptr {
@@ -108,8 +260,9 @@ func unmarshal(body []byte, x interface{}) *ErrorResponse {
 	err := json.Unmarshal(body, x)
 	if err != nil {
 		msg := fmt.Sprintf(
-			"could not parse %s from JSON; make sure input has correct types",
+			"could not parse %s from JSON: %s",
 			structType,
+			err.Error(),
 		)
 		response := newErrorResponse(msg, 400, &err)
 		response.log.Info(
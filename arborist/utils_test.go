@@ -0,0 +1,75 @@
+package arborist
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateJSONTypes(t *testing.T) {
+	cases := []struct {
+		name  string
+		input interface{}
+		body  string
+		err   string
+	}{
+		{
+			name:  "PolicyMissingRoleIDs",
+			input: &Policy{},
+			body:  `{"id": "p", "resource_paths": ["/a"]}`,
+			err:   "input policy is missing the following required fields: `role_ids`",
+		},
+		{
+			name:  "PolicyRoleIDsNotArray",
+			input: &Policy{},
+			body:  `{"id": "p", "resource_paths": ["/a"], "role_ids": "r"}`,
+			err:   "input policy field `role_ids` must be an array, not a string",
+		},
+		{
+			name:  "PolicyResourcePathNotString",
+			input: &Policy{},
+			body:  `{"id": "p", "resource_paths": ["/a", 1], "role_ids": []}`,
+			err:   "input policy field `resource_paths[1]` must be a string, not a number",
+		},
+		{
+			name:  "PolicyNullDescription",
+			input: &Policy{},
+			body:  `{"id": "p", "resource_paths": ["/a"], "role_ids": [], "description": null}`,
+		},
+		{
+			name:  "ResourcePathNotString",
+			input: &ResourceIn{},
+			body:  `{"path": 123}`,
+			err:   "input resource field `path` must be a string, not a number",
+		},
+		{
+			name:  "SubresourceNameNotString",
+			input: &ResourceIn{},
+			body:  `{"path": "/a", "subresources": [{"name": true}]}`,
+			err:   "input resource field `name` must be a string, not a boolean",
+		},
+		{
+			name:  "RoleActionServiceNotString",
+			input: &Role{},
+			body:  `{"id": "r", "permissions": [{"id": "p", "action": {"service": 1, "method": "m"}}]}`,
+			err:   "input permission field `action.service` must be a string, not a number",
+		},
+		{
+			name:  "RoleConstraintNotString",
+			input: &Role{},
+			body:  `{"id": "r", "permissions": [{"id": "p", "action": {"service": "s", "method": "m"}, "constraints": {"k": {}}}]}`,
+			err:   "input permission field `constraints.k` must be a string, not an object",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := json.Unmarshal([]byte(c.body), c.input)
+			if c.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package arborist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebhookEvent is POSTed as JSON to the URL set with `WithWebhook` after a
+// policy, resource or role is created, updated or deleted. The ID is the
+// policy or role ID, or the resource path.
+type WebhookEvent struct {
+	Type      string    `json:"type"`
+	Action    string    `json:"action"`
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookQueueSize is how many events can wait to be delivered; events past
+// that are dropped, so a slow receiver can't hold up requests.
+const webhookQueueSize = 1000
+
+// webhookAttempts is how many times delivering an event is tried in total
+// before giving up on it.
+const webhookAttempts = 5
+
+// webhookRetryDelay is the wait before the first retry of a delivery; it
+// doubles after each further attempt.
+var webhookRetryDelay = 500 * time.Millisecond
+
+// webhook delivers events to a URL one at a time, in the order they happened,
+// from a goroutine of its own.
+type webhook struct {
+	url    string
+	client *http.Client
+	logger Logger
+
+	mu     sync.Mutex
+	closed bool
+	events chan WebhookEvent
+	done   chan struct{}
+}
+
+func newWebhook(url string, logger Logger) *webhook {
+	hook := &webhook{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+		events: make(chan WebhookEvent, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go hook.run()
+	return hook
+}
+
+func (hook *webhook) run() {
+	defer close(hook.done)
+	for event := range hook.events {
+		hook.deliver(event)
+	}
+}
+
+// send queues an event without waiting for it to be delivered.
+func (hook *webhook) send(event WebhookEvent) {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if hook.closed {
+		return
+	}
+	select {
+	case hook.events <- event:
+	default:
+		hook.logger.Warning("webhook queue is full; dropping %s %s event for %s", event.Type, event.Action, event.ID)
+	}
+}
+
+func (hook *webhook) deliver(event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		hook.logger.Error("couldn't encode webhook event: %s", err.Error())
+		return
+	}
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = hook.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= webhookAttempts {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	hook.logger.Warning(
+		"giving up on webhook %s %s event for %s after %d attempts: %s",
+		event.Type,
+		event.Action,
+		event.ID,
+		webhookAttempts,
+		err.Error(),
+	)
+}
+
+func (hook *webhook) post(body []byte) error {
+	response, err := hook.client.Post(hook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// close stops taking events, and waits until those already queued have been
+// delivered or `ctx` is done.
+func (hook *webhook) close(ctx context.Context) error {
+	hook.mu.Lock()
+	if !hook.closed {
+		hook.closed = true
+		close(hook.events)
+	}
+	hook.mu.Unlock()
+	select {
+	case <-hook.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notify sends an event for a change to a policy, resource or role to the
+// webhook, if the server has one (see `WithWebhook`).
+func (server *Server) notify(eventType string, action string, id string) {
+	if server.webhook == nil {
+		return
+	}
+	server.webhook.send(WebhookEvent{
+		Type:      eventType,
+		Action:    action,
+		ID:        id,
+		Timestamp: server.clock().UTC(),
+	})
+}
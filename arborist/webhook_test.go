@@ -0,0 +1,101 @@
+package arborist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook(t *testing.T) {
+	logger := NewServer().WithLogger(log.New(bytes.NewBuffer([]byte{}), "", log.Ldate|log.Ltime)).logger
+	defer func(delay time.Duration) { webhookRetryDelay = delay }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	// receiver fails the first `failures` deliveries, and passes on the
+	// events from the rest
+	receiver := func(failures int) (*httptest.Server, chan WebhookEvent, *int) {
+		events := make(chan WebhookEvent, 10)
+		var mu sync.Mutex
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			attempts++
+			attempt := attempts
+			mu.Unlock()
+			if attempt <= failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			event := WebhookEvent{}
+			err := json.NewDecoder(r.Body).Decode(&event)
+			if err != nil {
+				t.Error(err)
+			}
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			events <- event
+		}))
+		return server, events, &attempts
+	}
+	event := WebhookEvent{
+		Type:      "policy",
+		Action:    "create",
+		ID:        "test-policy",
+		Timestamp: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	t.Run("Delivers", func(t *testing.T) {
+		server, events, _ := receiver(0)
+		defer server.Close()
+		hook := newWebhook(server.URL, logger)
+		hook.send(event)
+		select {
+		case received := <-events:
+			assert.Equal(t, event, received)
+		case <-time.After(5 * time.Second):
+			t.Fatal("event never delivered")
+		}
+		assert.NoError(t, hook.close(context.Background()))
+	})
+
+	t.Run("Retries", func(t *testing.T) {
+		server, events, attempts := receiver(2)
+		defer server.Close()
+		hook := newWebhook(server.URL, logger)
+		hook.send(event)
+		assert.NoError(t, hook.close(context.Background()))
+		select {
+		case received := <-events:
+			assert.Equal(t, event, received)
+		default:
+			t.Fatal("event not delivered after retries")
+		}
+		assert.Equal(t, 3, *attempts)
+	})
+
+	t.Run("GivesUp", func(t *testing.T) {
+		server, events, attempts := receiver(webhookAttempts)
+		defer server.Close()
+		hook := newWebhook(server.URL, logger)
+		hook.send(event)
+		assert.NoError(t, hook.close(context.Background()))
+		assert.Len(t, events, 0)
+		assert.Equal(t, webhookAttempts, *attempts)
+	})
+
+	t.Run("SendAfterClose", func(t *testing.T) {
+		server, events, _ := receiver(0)
+		defer server.Close()
+		hook := newWebhook(server.URL, logger)
+		assert.NoError(t, hook.close(context.Background()))
+		hook.send(event)
+		assert.Len(t, events, 0)
+	})
+}
@@ -0,0 +1,97 @@
+package arborist
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Request and response bodies can be YAML instead of JSON, for tooling which
+// keeps its config in YAML. YAML is converted to and from JSON at the edges,
+// so the same structs, field names and validation apply either way.
+
+var yamlMediaTypes = map[string]struct{}{
+	"application/yaml":   {},
+	"application/x-yaml": {},
+	"text/yaml":          {},
+	"text/x-yaml":        {},
+}
+
+func isYAMLMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	_, isYAML := yamlMediaTypes[mediaType]
+	return isYAML
+}
+
+// sendsYAML reports whether the request body is YAML, going by its
+// `Content-Type`.
+func sendsYAML(r *http.Request) bool {
+	return isYAMLMediaType(r.Header.Get("Content-Type"))
+}
+
+// wantYAML reports whether the response should be YAML: the `Accept` header
+// has to list a YAML type before JSON or `*/*`. Quality values are ignored.
+func wantYAML(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		accepted = strings.TrimSpace(accepted)
+		if isYAMLMediaType(accepted) {
+			return true
+		}
+		mediaType, _, err := mime.ParseMediaType(accepted)
+		if err == nil && (mediaType == "application/json" || mediaType == "*/*" || mediaType == "application/*") {
+			return false
+		}
+	}
+	return false
+}
+
+// yamlToJSON converts a YAML document to JSON. An empty document gives an
+// empty result, so it's treated the same as an empty JSON body.
+func yamlToJSON(body []byte) ([]byte, error) {
+	var content interface{}
+	err := yaml.Unmarshal(body, &content)
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return []byte{}, nil
+	}
+	return json.Marshal(content)
+}
+
+// jsonToYAML converts JSON to YAML, keeping the order of the fields.
+func jsonToYAML(body []byte) ([]byte, error) {
+	// JSON is also YAML, so parse it as such and drop the JSON styling
+	var node yaml.Node
+	err := yaml.Unmarshal(body, &node)
+	if err != nil {
+		return nil, err
+	}
+	clearYAMLStyle(&node)
+	out := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&node)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
@@ -0,0 +1,58 @@
+package arborist
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWantYAML(t *testing.T) {
+	cases := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"application/yaml", true},
+		{"application/x-yaml; charset=utf-8", true},
+		{"text/yaml, application/json", true},
+		{"application/json, application/yaml", false},
+		{"*/*, application/yaml", false},
+		{"text/html, application/yaml", true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/policy", nil)
+		r.Header.Set("Accept", c.accept)
+		assert.Equal(t, c.want, wantYAML(r), "Accept: %s", c.accept)
+	}
+}
+
+func TestYAMLToJSON(t *testing.T) {
+	body, err := yamlToJSON([]byte("id: p\nrole_ids: [r]\nresource_paths:\n  - /a\n"))
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"id": "p", "role_ids": ["r"], "resource_paths": ["/a"]}`, string(body))
+	}
+
+	body, err = yamlToJSON([]byte(""))
+	if assert.NoError(t, err) {
+		assert.Empty(t, body, "empty YAML should give an empty body")
+	}
+
+	_, err = yamlToJSON([]byte("id: [p"))
+	assert.Error(t, err)
+}
+
+func TestJSONToYAML(t *testing.T) {
+	body, err := jsonToYAML([]byte(`{"id": "p", "enabled": "true", "count": 2, "role_ids": ["r"], "paths": [], "extra": null}`))
+	if assert.NoError(t, err) {
+		expected := "id: p\nenabled: \"true\"\ncount: 2\nrole_ids:\n  - r\npaths: []\nextra: null\n"
+		assert.Equal(t, expected, string(body), "fields should keep their order and strings their type")
+	}
+
+	// converting back should give the same JSON
+	roundTrip, err := yamlToJSON(body)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"id": "p", "enabled": "true", "count": 2, "role_ids": ["r"], "paths": [], "extra": null}`, string(roundTrip))
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/uc-cdis/arborist/arborist"
-	"github.com/uc-cdis/go-authutils/authutils"
 )
 
 func main() {
@@ -25,6 +30,141 @@ func main() {
 		jwkEndpointEnv,
 		"endpoint from which the application can fetch a JWKS",
 	)
+	var trustedIssuers *string = flag.String(
+		"issuers",
+		"",
+		"comma-separated issuer=JWKS-URL pairs, to accept tokens from several\n"+
+			"issuers (each validated with its own keys) instead of --jwks",
+	)
+	var jwkRefresh *time.Duration = flag.Duration(
+		"jwks-refresh",
+		time.Hour,
+		"how often to fetch the JWKS again to pick up rotated keys (0 to only\n"+
+			"fetch when a token uses an unknown key ID)",
+	)
+	var audiences *string = flag.String(
+		"audiences",
+		"openid",
+		"comma-separated audiences (scopes) which tokens must all have",
+	)
+	var tokenLeeway *time.Duration = flag.Duration(
+		"token-leeway",
+		0,
+		"accept tokens this long after they expire (or before they are valid),\n"+
+			"to allow for clock drift with the token issuer",
+	)
+	var tokenCacheSize *int = flag.Int(
+		"token-cache",
+		10000,
+		"number of verified tokens to remember until they expire, to skip\n"+
+			"checking their signatures again (0 to turn off)",
+	)
+	var decisionCacheTTL *time.Duration = flag.Duration(
+		"decision-cache-ttl",
+		0,
+		"how long to remember authorization decisions (0 to turn off); changes\n"+
+			"made through other replicas can take this long to take effect",
+	)
+	var rateLimit *float64 = flag.Float64(
+		"rate-limit",
+		0,
+		"requests a second allowed for each user or client, going by their\n"+
+			"token (0 for no limit)",
+	)
+	var rateLimitBurst *int = flag.Int(
+		"rate-limit-burst",
+		10,
+		"requests each user or client can make at once before --rate-limit\n"+
+			"applies",
+	)
+	var webhookURL *string = flag.String(
+		"webhook",
+		"",
+		"URL to POST an event to after every policy, resource or role change",
+	)
+	var maxBodyBytes *int64 = flag.Int64(
+		"max-body-bytes",
+		arborist.DefaultMaxBodyBytes,
+		"largest request body accepted, in bytes (0 for no limit)",
+	)
+	var maxResourceDepth *int = flag.Int(
+		"max-resource-depth",
+		arborist.DefaultMaxResourceDepth,
+		"most levels of subresources returned by, or nested in, one request",
+	)
+	var idempotencyTTL *time.Duration = flag.Duration(
+		"idempotency-ttl",
+		arborist.DefaultIdempotencyTTL,
+		"how long to keep the responses to creates with an Idempotency-Key\n"+
+			"header, to replay to retries (0 to ignore the header)",
+	)
+	var adminPolicy *string = flag.String(
+		"admin-policy",
+		"",
+		"policy a caller's token must grant to check the authorization of\n"+
+			"another user by user_id in /auth/request, to test a policy with\n"+
+			"/policy/{policyID}/test, or to revoke a token with /token/revoke\n"+
+			"(empty to allow anyone)",
+	)
+	var revokedTokenPrune *time.Duration = flag.Duration(
+		"revoked-token-prune",
+		time.Hour,
+		"how often to drop revoked tokens which have expired (0 to never)",
+	)
+	var policySoftDelete *bool = flag.Bool(
+		"policy-soft-delete",
+		false,
+		"archive deleted policies, with their grants, so they can be restored\n"+
+			"with POST /policy/{policyID}/restore (a DELETE with ?soft=false\n"+
+			"still deletes for good)",
+	)
+	var caseInsensitiveUsernames *bool = flag.Bool(
+		"case-insensitive-usernames",
+		false,
+		"lowercase usernames from tokens and requests, so users match their\n"+
+			"grants however their name is cased (existing users need lowercase\n"+
+			"names)",
+	)
+	var proxyHeaders *string = flag.String(
+		"proxy-headers",
+		strings.Join(arborist.DefaultProxyHeaders, ","),
+		"comma-separated headers for /auth/proxy to set for the service behind\n"+
+			"it, out of REMOTE_USER, X-Authorized-Resources, X-Authorized-Policy\n"+
+			"and X-Authorized-Role (empty for none)",
+	)
+	var authHeader *string = flag.String(
+		"auth-header",
+		arborist.DefaultAuthHeader,
+		"request header to read callers' tokens from, with or without a\n"+
+			"Bearer prefix",
+	)
+	var constraintKeys *string = flag.String(
+		"constraint-keys",
+		"",
+		"comma-separated service=key|key... entries registering the constraint\n"+
+			"keys each service's permissions may use; roles using other keys for\n"+
+			"those services are rejected (other services are not checked)",
+	)
+	var tlsCert *string = flag.String(
+		"tls-cert",
+		"",
+		"certificate file to serve over TLS with, along with --tls-key (plain\n"+
+			"HTTP if unset)",
+	)
+	var tlsKey *string = flag.String("tls-key", "", "private key file for --tls-cert")
+	var tlsClientCA *string = flag.String(
+		"tls-client-ca",
+		"",
+		"file of PEM CA certificates to verify client certificates against;\n"+
+			"the common name of a verified certificate is taken as the caller's\n"+
+			"client ID by /auth/proxy and /auth/request (needs --tls-cert)",
+	)
+	var grpcAddr *string = flag.String(
+		"grpc-addr",
+		"",
+		"address to also serve the Authorize gRPC method on, like :8090\n"+
+			"(see arborist/arboristpb/arborist.proto; no gRPC if unset)",
+	)
 	var dbUrl *string = flag.String(
 		"db",
 		"",
@@ -33,40 +173,189 @@ func main() {
 			"environment variables. If using the commandline argument, add\n"+
 			"?sslmode=disable",
 	)
+	var dbMaxOpen *int = flag.Int("db-max-open", 20, "maximum open database connections (0 for no limit)")
+	var dbMaxIdle *int = flag.Int("db-max-idle", 10, "maximum idle database connections (0 keeps none idle, opening a new one per query)")
+	var dbConnLifetime *time.Duration = flag.Duration(
+		"db-conn-lifetime",
+		5*time.Minute,
+		"maximum time a database connection is reused (0 for no limit)",
+	)
+	var migrate *bool = flag.Bool(
+		"migrate",
+		true,
+		"apply any pending database migrations at startup",
+	)
+	var auditLogPath *string = flag.String(
+		"audit-log",
+		"",
+		"file to append a JSON line to for every authorization decision\n"+
+			"(\"-\" for stdout; no audit log if empty)",
+	)
+	var corsOrigins *string = flag.String(
+		"cors-origins",
+		"",
+		"comma-separated origins browsers may call arborist from (\"*\" for any;\n"+
+			"no cross-origin requests if empty)",
+	)
+	var corsMethods *string = flag.String(
+		"cors-methods",
+		strings.Join(arborist.DefaultCORSMethods, ","),
+		"comma-separated methods allowed in cross-origin requests",
+	)
+	var corsHeaders *string = flag.String(
+		"cors-headers",
+		strings.Join(arborist.DefaultCORSHeaders, ","),
+		"comma-separated request headers allowed in cross-origin requests",
+	)
+	var shutdownTimeout *time.Duration = flag.Duration(
+		"shutdown-timeout",
+		15*time.Second,
+		"on SIGTERM, how long to wait for requests in progress to finish",
+	)
 	flag.Parse()
 
-	if *jwkEndpoint == "" {
+	if *jwkEndpoint == "" && *trustedIssuers == "" {
 		print("WARNING: no $JWKS_ENDPOINT or --jwks specified; endpoints requiring JWT validation will error\n")
 	}
 	// if database URL is not provided it can use environment variables
 
+	// the server closes the database when it shuts down
 	db, err := sqlx.Open("postgres", *dbUrl)
 	if err != nil {
 		panic(err)
 	}
-	defer db.Close()
 	logFlags := log.Ldate | log.Ltime
 	logger := log.New(os.Stdout, "", logFlags)
-	jwtApp := authutils.NewJWTApplication(*jwkEndpoint)
-	arboristServer, err := arborist.NewServer().
+	var jwtApp interface {
+		arborist.JWTDecoder
+		RefreshKeysEvery(time.Duration, *log.Logger) func()
+	}
+	if *trustedIssuers != "" {
+		jwkURLs := map[string]string{}
+		for _, pair := range strings.Split(*trustedIssuers, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				panic(fmt.Sprintf("malformed --issuers entry (expected issuer=JWKS-URL): %s", pair))
+			}
+			jwkURLs[parts[0]] = parts[1]
+		}
+		jwtApp = arborist.NewIssuersJWTApplication(jwkURLs)
+	} else {
+		jwtApp = arborist.NewJWTApplication(*jwkEndpoint)
+	}
+	if (*jwkEndpoint != "" || *trustedIssuers != "") && *jwkRefresh > 0 {
+		stopRefresh := jwtApp.RefreshKeysEvery(*jwkRefresh, logger)
+		defer stopRefresh()
+	}
+	proxyHeaderList := []string{}
+	if *proxyHeaders != "" {
+		proxyHeaderList = strings.Split(*proxyHeaders, ",")
+	}
+	arboristServer := arborist.NewServer().
 		WithLogger(logger).
 		WithJWTApp(jwtApp).
 		WithDB(db).
-		Init()
+		WithDBConfig(*dbMaxOpen, *dbMaxIdle, *dbConnLifetime).
+		WithExpectedAudiences(strings.Split(*audiences, ",")).
+		WithTokenLeeway(*tokenLeeway).
+		WithTokenCache(*tokenCacheSize).
+		WithDecisionCacheTTL(*decisionCacheTTL).
+		WithRateLimit(*rateLimit, *rateLimitBurst).
+		WithAdminPolicy(*adminPolicy).
+		WithProxyHeaders(proxyHeaderList).
+		WithAuthHeader(*authHeader).
+		WithPolicySoftDelete(*policySoftDelete).
+		WithCaseInsensitiveUsernames(*caseInsensitiveUsernames).
+		WithMaxBodyBytes(*maxBodyBytes).
+		WithIdempotencyTTL(*idempotencyTTL).
+		WithMaxResourceDepth(*maxResourceDepth).
+		WithWebhook(*webhookURL).
+		WithGRPC(*grpcAddr)
+	if *migrate {
+		arboristServer = arboristServer.WithMigrations()
+	}
+	if *constraintKeys != "" {
+		for _, entry := range strings.Split(*constraintKeys, ",") {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				panic(fmt.Sprintf("malformed --constraint-keys entry (expected service=key|key...): %s", entry))
+			}
+			keys := []string{}
+			if parts[1] != "" {
+				keys = strings.Split(parts[1], "|")
+			}
+			arboristServer = arboristServer.WithConstraintKeys(parts[0], keys)
+		}
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			panic(err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if *tlsClientCA != "" {
+			caPEM, err := ioutil.ReadFile(*tlsClientCA)
+			if err != nil {
+				panic(err)
+			}
+			clientCAs := x509.NewCertPool()
+			if !clientCAs.AppendCertsFromPEM(caPEM) {
+				panic(fmt.Sprintf("no certificates found in --tls-client-ca file %s", *tlsClientCA))
+			}
+			tlsConfig.ClientCAs = clientCAs
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			arboristServer = arboristServer.WithClientCertAuth(true)
+		}
+		arboristServer = arboristServer.WithTLS(tlsConfig)
+	} else if *tlsClientCA != "" {
+		panic("--tls-client-ca needs --tls-cert")
+	}
+	if *auditLogPath == "-" {
+		arboristServer = arboristServer.WithAuditLog(os.Stdout)
+	} else if *auditLogPath != "" {
+		auditLog, err := os.OpenFile(*auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			panic(err)
+		}
+		defer auditLog.Close()
+		arboristServer = arboristServer.WithAuditLog(auditLog)
+	}
+	if *corsOrigins != "" {
+		arboristServer = arboristServer.WithCORSConfig(arborist.CORSConfig{
+			AllowedOrigins: strings.Split(*corsOrigins, ","),
+			AllowedMethods: strings.Split(*corsMethods, ","),
+			AllowedHeaders: strings.Split(*corsHeaders, ","),
+		})
+	}
+	arboristServer, err = arboristServer.Init()
 	if err != nil {
 		panic(err)
 	}
+	if *revokedTokenPrune > 0 {
+		stopPrune := arboristServer.PruneRevokedTokensEvery(*revokedTokenPrune)
+		defer stopPrune()
+	}
 
 	addr := fmt.Sprintf(":%d", *port)
-	router := arboristServer.MakeRouter(os.Stdout)
-	httpLogger := log.New(os.Stdout, "", log.LstdFlags)
-	httpServer := &http.Server{
-		Addr:         addr,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		ErrorLog:     httpLogger,
-		Handler:      router,
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- arboristServer.Run(addr)
+	}()
+
+	// on SIGTERM, stop taking new connections but let requests in progress
+	// finish before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serveErr:
+		logger.Fatal(err)
+	case sig := <-signals:
+		logger.Printf("received %s", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	err = arboristServer.Shutdown(ctx)
+	if err != nil {
+		logger.Printf("error shutting down: %s", err.Error())
 	}
-	httpLogger.Println("arborist serving at", httpServer.Addr)
-	httpLogger.Fatal(httpServer.ListenAndServe())
 }
@@ -0,0 +1,3 @@
+UPDATE db_version SET (id, version) = (3, '2019-09-03T155025Z_authz_provider');
+
+ALTER TABLE policy DROP COLUMN effect;
@@ -0,0 +1,3 @@
+UPDATE db_version SET (id, version) = (4, '2026-10-16T000000Z_policy_effect');
+
+ALTER TABLE policy ADD COLUMN effect VARCHAR NOT NULL DEFAULT 'allow' CHECK (effect IN ('allow', 'deny'));
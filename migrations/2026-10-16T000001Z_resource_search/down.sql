@@ -0,0 +1,3 @@
+UPDATE db_version SET (id, version) = (4, '2026-10-16T000000Z_policy_effect');
+
+DROP INDEX IF EXISTS resource_path_trgm_idx;
@@ -0,0 +1,6 @@
+UPDATE db_version SET (id, version) = (5, '2026-10-16T000001Z_resource_search');
+
+-- Trigram index for searching resources by part of their path with ILIKE,
+-- which the GiST ltree index can't help with.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX resource_path_trgm_idx ON resource USING gin(ltree2text(path) gin_trgm_ops);
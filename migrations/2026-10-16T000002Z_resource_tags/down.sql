@@ -0,0 +1,3 @@
+UPDATE db_version SET (id, version) = (5, '2026-10-16T000001Z_resource_search');
+
+ALTER TABLE resource DROP COLUMN tags;
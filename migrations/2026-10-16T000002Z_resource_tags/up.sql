@@ -0,0 +1,6 @@
+UPDATE db_version SET (id, version) = (6, '2026-10-16T000002Z_resource_tags');
+
+-- Key/value tags for cataloging resources, which GET /resource can filter on
+-- with a containment query served by the GIN index.
+ALTER TABLE resource ADD COLUMN tags jsonb NOT NULL DEFAULT '{}'::jsonb;
+CREATE INDEX resource_tags_idx ON resource USING gin(tags);
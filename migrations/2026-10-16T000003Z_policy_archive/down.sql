@@ -0,0 +1,3 @@
+UPDATE db_version SET (id, version) = (6, '2026-10-16T000002Z_resource_tags');
+
+DROP TABLE policy_archive;
@@ -0,0 +1,17 @@
+UPDATE db_version SET (id, version) = (7, '2026-10-16T000003Z_policy_archive');
+
+-- Policies removed with a soft delete, with who they were granted to, so
+-- they can be restored. Only the last soft-deleted policy with each name is
+-- kept. The grants are JSON lists of objects with the `name` of the user,
+-- group or client (for users also `expires_at`) and the `authz_provider`.
+CREATE TABLE policy_archive (
+    name text PRIMARY KEY,
+    description text,
+    effect varchar NOT NULL,
+    resource_paths ltree[] NOT NULL,
+    role_ids text[] NOT NULL,
+    usr_grants jsonb NOT NULL DEFAULT '[]'::jsonb,
+    grp_grants jsonb NOT NULL DEFAULT '[]'::jsonb,
+    client_grants jsonb NOT NULL DEFAULT '[]'::jsonb,
+    deleted_at timestamp with time zone NOT NULL
+);
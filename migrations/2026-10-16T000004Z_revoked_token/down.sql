@@ -0,0 +1,3 @@
+UPDATE db_version SET (id, version) = (7, '2026-10-16T000003Z_policy_archive');
+
+DROP TABLE revoked_token;
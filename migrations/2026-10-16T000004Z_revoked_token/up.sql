@@ -0,0 +1,10 @@
+UPDATE db_version SET (id, version) = (8, '2026-10-16T000004Z_revoked_token');
+
+-- The `jti` of tokens revoked before they expire, which are rejected until
+-- `expires_at` (the token's `exp`); rows past it are pruned.
+CREATE TABLE revoked_token (
+    jti text PRIMARY KEY,
+    expires_at timestamp with time zone NOT NULL,
+    revoked_at timestamp with time zone NOT NULL DEFAULT now()
+);
+CREATE INDEX revoked_token_expires_at_idx ON revoked_token (expires_at);
@@ -0,0 +1,182 @@
+// Package migrations applies the SQL migrations in this directory to the
+// arborist database. It does the same thing as the `latest` script, so that
+// the server can bring the schema up to date by itself at startup.
+//
+// Each migration is a directory named `<timestamp>_<description>` containing
+// an `up.sql` (and `down.sql`, used only by the scripts). Every `up.sql` is
+// responsible for recording its own version in the `db_version` table.
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed */up.sql
+var migrationFiles embed.FS
+
+// NoVersion is the version reported for a database which has not had any
+// migrations applied (matching the `current-version` script).
+const NoVersion = "0000-00-00T000000Z"
+
+// lockID is an arbitrary key for the postgres advisory lock which keeps
+// several servers starting at once from migrating concurrently.
+const lockID = 7343205
+
+var versionPattern = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{6}Z_[a-z0-9_]+$`)
+
+type migration struct {
+	Version string
+	Up      string
+}
+
+// loadMigrations reads the migrations from `fsys`, in order of version, and
+// returns an error if any directory is not a well-formed migration.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	migrations := []migration{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		version := entry.Name()
+		if !versionPattern.MatchString(version) {
+			return nil, fmt.Errorf("malformed migration name: %s", version)
+		}
+		up, err := fs.ReadFile(fsys, version+"/up.sql")
+		if err != nil {
+			return nil, fmt.Errorf("migration %s missing up.sql: %s", version, err.Error())
+		}
+		if len(up) == 0 {
+			return nil, fmt.Errorf("migration %s has an empty up.sql", version)
+		}
+		migrations = append(migrations, migration{Version: version, Up: string(up)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// CurrentVersion returns the version recorded in the `db_version` table, or
+// NoVersion if the table does not exist yet.
+func CurrentVersion(db sqlx.Queryer) (string, error) {
+	var exists bool
+	err := sqlx.Get(db, &exists, "SELECT to_regclass('db_version') IS NOT NULL")
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return NoVersion, nil
+	}
+	var version string
+	err = sqlx.Get(db, &version, "SELECT version FROM db_version")
+	if err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// LatestVersion returns the version of the most recent migration.
+func LatestVersion() (string, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return "", err
+	}
+	if len(migrations) == 0 {
+		return NoVersion, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// Pending returns the versions of the migrations which are newer than the
+// database's current version, in order; there are none if the database is
+// up to date. A database migrated by a newer arborist has none pending.
+func Pending(db sqlx.Queryer) ([]string, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	current, err := CurrentVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	return pendingVersions(migrations, current), nil
+}
+
+func pendingVersions(migrations []migration, current string) []string {
+	pending := []string{}
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m.Version)
+		}
+	}
+	return pending
+}
+
+// RunMigrations applies every migration newer than the database's current
+// version, each in its own transaction. It is safe to call when the database
+// is already up to date, and from several processes at once.
+func RunMigrations(db *sqlx.DB) error {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		err = apply(db, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func apply(db *sqlx.DB, m migration) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	// released at the end of the transaction
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", lockID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	// check the version after taking the lock, in case another process
+	// applied this migration in the meantime
+	current, err := CurrentVersion(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if m.Version <= current {
+		return tx.Rollback()
+	}
+	_, err = tx.Exec(m.Up)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migration %s failed: %s", m.Version, err.Error())
+	}
+	recorded, err := CurrentVersion(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if recorded != m.Version {
+		_ = tx.Rollback()
+		return fmt.Errorf(
+			"migration %s is malformed: it left db_version at %s instead of recording its own version",
+			m.Version,
+			recorded,
+		)
+	}
+	return tx.Commit()
+}
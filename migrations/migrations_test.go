@@ -0,0 +1,158 @@
+package migrations
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("Embedded", func(t *testing.T) {
+		migrations, err := loadMigrations(migrationFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.NotEmpty(t, migrations) {
+			assert.Equal(t, "2019-02-18T214320Z_init", migrations[0].Version)
+		}
+		for i := 1; i < len(migrations); i++ {
+			assert.True(t, migrations[i-1].Version < migrations[i].Version, "migrations out of order")
+		}
+	})
+
+	t.Run("Sorted", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"2020-01-02T000000Z_second/up.sql": {Data: []byte("SELECT 2;")},
+			"2020-01-01T000000Z_first/up.sql":  {Data: []byte("SELECT 1;")},
+		}
+		migrations, err := loadMigrations(fsys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, migrations, 2) {
+			assert.Equal(t, "2020-01-01T000000Z_first", migrations[0].Version)
+			assert.Equal(t, "2020-01-02T000000Z_second", migrations[1].Version)
+		}
+	})
+
+	t.Run("MalformedName", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"not-a-version/up.sql": {Data: []byte("SELECT 1;")},
+		}
+		_, err := loadMigrations(fsys)
+		assert.Error(t, err)
+	})
+
+	t.Run("MissingUp", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"2020-01-01T000000Z_first/down.sql": {Data: []byte("SELECT 1;")},
+		}
+		_, err := loadMigrations(fsys)
+		assert.Error(t, err)
+	})
+
+	t.Run("EmptyUp", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"2020-01-01T000000Z_first/up.sql": {Data: []byte{}},
+		}
+		_, err := loadMigrations(fsys)
+		assert.Error(t, err)
+	})
+}
+
+func TestPendingVersions(t *testing.T) {
+	migrations := []migration{
+		{Version: "2020-01-01T000000Z_first"},
+		{Version: "2020-01-02T000000Z_second"},
+		{Version: "2020-01-03T000000Z_third"},
+	}
+	assert.Equal(
+		t,
+		[]string{"2020-01-01T000000Z_first", "2020-01-02T000000Z_second", "2020-01-03T000000Z_third"},
+		pendingVersions(migrations, NoVersion),
+	)
+	assert.Equal(t, []string{"2020-01-03T000000Z_third"}, pendingVersions(migrations, "2020-01-02T000000Z_second"))
+	assert.Empty(t, pendingVersions(migrations, "2020-01-03T000000Z_third"))
+	// migrated by a newer version of arborist
+	assert.Empty(t, pendingVersions(migrations, "2020-01-04T000000Z_fourth"))
+}
+
+// withDatabase points a postgres connection string (either a URL or empty,
+// meaning the postgres environment variables) at a different database.
+func withDatabase(dbUrl string, name string) string {
+	if dbUrl == "" {
+		return fmt.Sprintf("dbname=%s", name)
+	}
+	parsed, err := url.Parse(dbUrl)
+	if err != nil || parsed.Scheme == "" {
+		return fmt.Sprintf("%s dbname=%s", dbUrl, name)
+	}
+	parsed.Path = "/" + name
+	return parsed.String()
+}
+
+func TestRunMigrations(t *testing.T) {
+	dbUrl := os.Getenv("ARBORIST_TEST_DB")
+	admin, err := sqlx.Open("postgres", dbUrl)
+	if err == nil {
+		err = admin.Ping()
+	}
+	if err != nil {
+		fmt.Println("couldn't reach db; make sure arborist has correct database configuration!")
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	// run against a throwaway database so the real test database is untouched
+	name := fmt.Sprintf("arborist_migrations_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec(fmt.Sprintf("CREATE DATABASE %s", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_, _ = admin.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", name))
+	}()
+	db, err := sqlx.Open("postgres", withDatabase(dbUrl, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// closed before the database is dropped
+	defer db.Close()
+
+	version, err := CurrentVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, NoVersion, version)
+
+	latest, err := LatestVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = RunMigrations(db)
+		if err != nil {
+			t.Fatalf("run %d failed: %s", i+1, err.Error())
+		}
+		version, err = CurrentVersion(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, latest, version)
+	}
+
+	var tables []string
+	err = db.Select(&tables, "SELECT tablename FROM pg_tables WHERE schemaname = 'public'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, tables, "policy", strings.Join(tables, ", "))
+}